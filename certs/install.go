@@ -2,51 +2,60 @@ package main
 
 import (
 	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
 	"flag"
 	"fmt"
+	"net/url"
 	"os"
-	"time"
-
-	"golang.org/x/oauth2"
+	"strings"
 
 	"github.com/krinklesaurus/jwt-proxy/config"
 	"github.com/krinklesaurus/jwt-proxy/core"
 	"github.com/krinklesaurus/jwt-proxy/log"
+	"github.com/krinklesaurus/jwt-proxy/provider"
 	"github.com/krinklesaurus/jwt-proxy/user"
 	uuid "github.com/satori/go.uuid"
 	"github.com/spf13/viper"
 )
 
 func installCerts(config *config.Config) {
+	if strings.HasPrefix(config.SigningMethod, "HS") {
+		fmt.Println(fmt.Sprintf("signing method %s uses the shared secret from jwt.hmacSecret, no certs needed", config.SigningMethod))
+		return
+	}
+
 	f1, err := os.Create(config.PrivateRSAKeyPath)
 	if err != nil {
 		fmt.Println(fmt.Sprintf("file %s could not be opened", config.PrivateRSAKeyPath))
 		panic(err)
 	}
-	f2, err := os.Create(config.PublicRSAKeyPath)
+	defer f1.Close()
+
+	privateKeyBlock, publicKey, err := generateKey(config.SigningMethod)
 	if err != nil {
 		panic(err)
 	}
+	pem.Encode(f1, privateKeyBlock)
 
-	privateKey, err := rsa.GenerateKey(rand.Reader, 4096)
+	// jwt-proxy derives the public key from the private key, the file is
+	// only written for verifiers that want a copy
+	if config.PublicRSAKeyPath == "" {
+		return
+	}
+	f2, err := os.Create(config.PublicRSAKeyPath)
 	if err != nil {
 		panic(err)
 	}
+	defer f2.Close()
 
-	privateKeyDer := x509.MarshalPKCS1PrivateKey(privateKey)
-	privateKeyBlock := pem.Block{
-		Type:    "RSA PRIVATE KEY",
-		Headers: nil,
-		Bytes:   privateKeyDer,
-	}
-	pem.Encode(f1, &privateKeyBlock)
-
-	publicKey := privateKey.PublicKey
-	publicKeyDer, err := x509.MarshalPKIXPublicKey(&publicKey)
+	publicKeyDer, err := x509.MarshalPKIXPublicKey(publicKey)
 	if err != nil {
 		panic(err)
 	}
@@ -57,27 +66,95 @@ func installCerts(config *config.Config) {
 		Bytes:   publicKeyDer,
 	}
 	pem.Encode(f2, &publicKeyBlock)
+}
 
-	f1.Close()
-	f2.Close()
+// generateKey creates a private key matching the signing method, i.e. a SEC1
+// encoded EC key for ES256, ES384 and ES512, a PKCS#8 encoded Ed25519 key for
+// EdDSA and a PKCS#1 encoded RSA key otherwise.
+func generateKey(signingMethod string) (*pem.Block, crypto.PublicKey, error) {
+	curves := map[string]elliptic.Curve{
+		"ES256": elliptic.P256(),
+		"ES384": elliptic.P384(),
+		"ES512": elliptic.P521(),
+	}
+
+	if curve, ok := curves[signingMethod]; ok {
+		privateKey, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		privateKeyDer, err := x509.MarshalECPrivateKey(privateKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &pem.Block{Type: "EC PRIVATE KEY", Bytes: privateKeyDer}, privateKey.Public(), nil
+	}
+
+	if signingMethod == "EdDSA" {
+		publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		privateKeyDer, err := x509.MarshalPKCS8PrivateKey(privateKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &pem.Block{Type: "PRIVATE KEY", Bytes: privateKeyDer}, publicKey, nil
+	}
+
+	privateKey, err := rsa.GenerateKey(rand.Reader, 4096)
+	if err != nil {
+		return nil, nil, err
+	}
+	privateKeyDer := x509.MarshalPKCS1PrivateKey(privateKey)
+	return &pem.Block{Type: "RSA PRIVATE KEY", Bytes: privateKeyDer}, privateKey.Public(), nil
 }
 
-func createTestToken(config *config.Config) {
-	userService := &user.HashUserService{}
-	tokenizer := core.NewRSATokenizer(core.SigningMethods[config.SigningMethod], config.PrivateRSAKey)
+// createTestToken logs in a random user with the dev provider and logs the
+// claims and the token jwt-proxy would issue for the config file, signed by
+// its keyring like the tokens of the running server.
+func createTestToken(configFile string) error {
+	config, err := config.Initialize(configFile)
+	if err != nil {
+		return fmt.Errorf("error initializing config: %w", err)
+	}
+	keyring, err := core.NewKeyringFromConfig(config)
+	if err != nil {
+		return fmt.Errorf("error initializing keyring: %w", err)
+	}
+
+	dev := provider.NewDev(config.RootURI)
+	callback, err := dev.Authorize("", fmt.Sprintf("user-%s", uuid.NewV4().String()), "", "")
+	if err != nil {
+		return err
+	}
+	callbackURL, err := url.Parse(callback)
+	if err != nil {
+		return err
+	}
+	oauthToken, err := dev.Exchange(context.Background(), callbackURL.Query().Get("code"))
+	if err != nil {
+		return err
+	}
+	profile, err := dev.User(context.Background(), oauthToken)
+	if err != nil {
+		return err
+	}
 
-	provider := pseudoProvider{}
-	oauthToken, _ := provider.Exchange(context.Background(), uuid.NewV4().String())
-	user, _ := provider.User()
-	c := core.New(config, tokenizer, userService)
-	token := &core.TokenInfo{
+	c := core.New(config, core.NewKeyringTokenizer(keyring), &user.HashUserService{})
+	claims, err := c.Claims(&core.TokenInfo{
 		Token:    *oauthToken,
-		User:     user,
-		Provider: provider,
+		User:     profile.ID,
+		Provider: dev,
+		Profile:  profile,
+	})
+	if err != nil {
+		return err
+	}
+	b, err := c.JwtToken(claims)
+	if err != nil {
+		return err
 	}
-	claims, _ := c.Claims(token)
-
-	b, _ := c.JwtToken(claims)
 
 	jwtAsString := string(b)
 
@@ -88,38 +165,7 @@ func createTestToken(config *config.Config) {
 	log.Infof("--------- CREATED TEST TOKEN BEGIN ---------")
 	log.Infof("%s", jwtAsString)
 	log.Infof("--------- CREATED TEST TOKEN END ---------")
-}
-
-type pseudoProvider struct {
-}
-
-func (p pseudoProvider) AuthCodeURL(state string) string {
-	return ""
-}
-
-func (p pseudoProvider) User() (string, error) {
-	return fmt.Sprintf("user-%s", uuid.NewV4().String()), nil
-}
-
-func (p pseudoProvider) Exchange(ctx context.Context, code string) (*oauth2.Token, error) {
-	return &oauth2.Token{
-		AccessToken:  uuid.NewV4().String(),
-		TokenType:    "Bearer",
-		RefreshToken: uuid.NewV4().String(),
-		Expiry:       time.Now().Add(time.Duration(24*30) * time.Hour),
-	}, nil
-}
-
-func (p pseudoProvider) String() string {
-	return p.Name()
-}
-
-func (p pseudoProvider) Name() string {
-	return "pseudo_provider"
-}
-
-func (p pseudoProvider) ClientID() string {
-	return "pseudo_client_id"
+	return nil
 }
 
 func main() {
@@ -149,6 +195,9 @@ func main() {
 	}
 
 	if *token {
-		createTestToken(config)
+		if err := createTestToken(*configPtr); err != nil {
+			fmt.Println("could not create test token:", err)
+			os.Exit(1)
+		}
 	}
 }
@@ -1,15 +1,20 @@
 package config
 
 import (
+	"bytes"
+	"crypto"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
 	"fmt"
 	"io/ioutil"
+	"net"
+	"sort"
 	"strings"
 
 	"github.com/krinklesaurus/jwt-proxy/log"
 	"github.com/krinklesaurus/jwt-proxy/provider"
+	"github.com/krinklesaurus/jwt-proxy/user"
 	"github.com/spf13/viper"
 )
 
@@ -19,15 +24,254 @@ type Config struct {
 	WWWRootDir        string
 	Providers         map[string]provider.Provider
 	SigningMethod     string
+	PrivateKey        interface{} // crypto.Signer or []byte secret for HMAC
 	PrivateRSAKey     *rsa.PrivateKey
-	PublicRSAKey      interface{}
+	PublicRSAKey      interface{} // public key of PrivateKey, nil for HMAC
 	PrivateRSAKeyPath string
-	PublicRSAKeyPath  string
+	PublicRSAKeyPath  string // optional, must match PrivateKey
 	Audience          string
 	Issuer            string
 	Subject           string
 	Password          string
 	ExpirySeconds     int
+	// RefreshExpirySeconds is the lifetime of refresh tokens. Refresh tokens
+	// are only issued if it is greater than 0.
+	RefreshExpirySeconds int
+	// SigningKeys are additional keys next to PrivateKey, which is always the
+	// active one at startup.
+	SigningKeys             []SigningKey
+	RotationIntervalSeconds int
+	AdminSecret             string
+	// TrustedProxies are the reverse proxies whose X-Forwarded-For header
+	// names the address of the client, e.g. for throttling logins.
+	TrustedProxies []*net.IPNet
+	// EncryptionKeys are the recipients issued tokens are encrypted to. If
+	// empty, tokens are only signed.
+	EncryptionKeys []EncryptionKey
+	Claims         ClaimsConfig
+	// Clients are the applications jwt-proxy acts as OpenID Connect provider
+	// for.
+	Clients []Client
+	// ProtectedResources are the services allowed to introspect tokens.
+	ProtectedResources []ProtectedResource
+	// PKCE is true for the providers whose logins are protected with a PKCE
+	// code challenge, which is every provider unless disabled.
+	PKCE map[string]bool
+	// TokenExchange is true for the providers whose access tokens may be
+	// exchanged for tokens of jwt-proxy, which must be enabled per provider.
+	TokenExchange map[string]bool
+	// ProviderInfos are the provider instances in configured order.
+	ProviderInfos []ProviderInfo
+	// DeviceExpirySeconds is the lifetime of the device codes of the device
+	// authorization grant, which is only offered if it is greater than 0.
+	DeviceExpirySeconds int
+	// DeviceIntervalSeconds is the time devices have to wait between polls.
+	DeviceIntervalSeconds int
+	// DevLogin enables the dev provider, with which anyone can log in as
+	// any user. It is only meant for local development and CI.
+	DevLogin bool
+	// ServiceAccounts are the machine clients that get tokens with the
+	// client_credentials grant.
+	ServiceAccounts []ServiceAccount
+}
+
+// ProviderInfo is a configured provider instance as shown on the login page.
+type ProviderInfo struct {
+	ID          string
+	Type        string
+	DisplayName string
+}
+
+// ProtectedResource is a service that accepts tokens issued by jwt-proxy and
+// authenticates with its id and secret to introspect them.
+type ProtectedResource struct {
+	ID     string
+	Secret string
+}
+
+// Client is an application registered to log in users via jwt-proxy. Clients
+// without secret are public clients, which must use PKCE.
+type Client struct {
+	ID           string
+	Secret       string
+	RedirectURIs []string
+}
+
+// Public returns true if the client cannot keep a secret.
+func (c Client) Public() bool {
+	return c.Secret == ""
+}
+
+// RedirectURIAllowed returns true if redirectURI is one of the client's
+// registered redirect URIs.
+func (c Client) RedirectURIAllowed(redirectURI string) bool {
+	for _, allowed := range c.RedirectURIs {
+		if allowed == redirectURI {
+			return true
+		}
+	}
+	return false
+}
+
+// Client returns the registered client with the given id or nil.
+func (c *Config) Client(id string) *Client {
+	for i := range c.Clients {
+		if c.Clients[i].ID == id {
+			return &c.Clients[i]
+		}
+	}
+	return nil
+}
+
+// defaultServiceAccountExpirySeconds is the lifetime of service account
+// tokens if the account configures none.
+const defaultServiceAccountExpirySeconds = 300
+
+// ServiceAccount is a machine client that authenticates with its id and
+// secret, whose bcrypt hash is configured, to get tokens without a user.
+type ServiceAccount struct {
+	ID         string
+	SecretHash string
+	// Audiences are the audiences the account may request tokens for. If
+	// empty, tokens are issued for the audience of the claims config.
+	Audiences []string
+	// Claims are added to every token of the account.
+	Claims        map[string]interface{}
+	ExpirySeconds int
+}
+
+// AudienceAllowed returns true if the account may request tokens for the
+// audience.
+func (s ServiceAccount) AudienceAllowed(audience string) bool {
+	return contains(s.Audiences, audience)
+}
+
+// ServiceAccount returns the service account with the given id or nil.
+func (c *Config) ServiceAccount(id string) *ServiceAccount {
+	for i := range c.ServiceAccounts {
+		if c.ServiceAccounts[i].ID == id {
+			return &c.ServiceAccounts[i]
+		}
+	}
+	return nil
+}
+
+// TokenExchangeEnabled returns true if any provider's access tokens may be
+// exchanged.
+func (c *Config) TokenExchangeEnabled() bool {
+	for _, enabled := range c.TokenExchange {
+		if enabled {
+			return true
+		}
+	}
+	return false
+}
+
+// ClaimMapping maps the profile field of a provider's user to a claim.
+type ClaimMapping struct {
+	Claim string
+	Field string
+}
+
+// ClaimsConfig configures the claims of issued tokens, either for all
+// providers or, within Providers, for a single provider.
+type ClaimsConfig struct {
+	Provider              string
+	Audience              string
+	IncludeProviderTokens *bool
+	Mapping               []ClaimMapping
+	Providers             []ClaimsConfig
+}
+
+// ForProvider returns the claims config for the provider, i.e. the global
+// config with the provider's overrides applied. Mappings of the provider
+// replace global mappings of the same claim.
+func (c ClaimsConfig) ForProvider(provider string) ClaimsConfig {
+	merged := ClaimsConfig{
+		Provider:              provider,
+		Audience:              c.Audience,
+		IncludeProviderTokens: c.IncludeProviderTokens,
+		Mapping:               append([]ClaimMapping{}, c.Mapping...),
+	}
+	for _, override := range c.Providers {
+		if override.Provider != provider {
+			continue
+		}
+		if override.Audience != "" {
+			merged.Audience = override.Audience
+		}
+		if override.IncludeProviderTokens != nil {
+			merged.IncludeProviderTokens = override.IncludeProviderTokens
+		}
+		for _, mapping := range override.Mapping {
+			mappings := []ClaimMapping{}
+			for _, existing := range merged.Mapping {
+				if existing.Claim != mapping.Claim {
+					mappings = append(mappings, existing)
+				}
+			}
+			merged.Mapping = append(mappings, mapping)
+		}
+	}
+	return merged
+}
+
+// ProviderTokens returns true if the provider's tokens should be included in
+// the claims, which is the default.
+func (c ClaimsConfig) ProviderTokens() bool {
+	return c.IncludeProviderTokens == nil || *c.IncludeProviderTokens
+}
+
+// reservedClaims are set by jwt-proxy itself and cannot be mapped. Mapping
+// sub, aud, user or provider would let a user pick the identity or audience
+// of their token by editing their profile at the provider.
+var reservedClaims = map[string]bool{"iss": true, "exp": true, "iat": true, "nbf": true, "jti": true,
+	"sub": true, "aud": true, "user": true, "provider": true}
+
+// serviceAccountClaims are set on the tokens of service accounts in addition
+// to the reserved claims and cannot be overridden by their fixed claims.
+var serviceAccountClaims = map[string]bool{"client_id": true}
+
+func (c ClaimsConfig) validate() error {
+	for _, mapping := range c.Mapping {
+		if mapping.Claim == "" || mapping.Field == "" {
+			return fmt.Errorf("claim mappings need both claim and field")
+		}
+		if reservedClaims[mapping.Claim] {
+			return fmt.Errorf("claim %s is reserved and cannot be mapped", mapping.Claim)
+		}
+		if err := provider.ValidatePath(mapping.Field); err != nil {
+			return fmt.Errorf("field of claim %s: %w", mapping.Claim, err)
+		}
+	}
+	for _, provider := range c.Providers {
+		if provider.Provider == "" {
+			return fmt.Errorf("claims config of a provider needs the provider")
+		}
+		if err := provider.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EncryptionKey is the key of a recipient of encrypted tokens. If PrivateKey is
+// set, jwt-proxy can decrypt tokens itself.
+type EncryptionKey struct {
+	Algorithm  string
+	Path       string
+	PublicKey  crypto.PublicKey
+	PrivateKey crypto.Signer
+}
+
+// SigningKey is an additional signing key with its keyring status, which is
+// either "next" for a key that is published ahead of being used for signing
+// or "retired" for a key that is only published for verification.
+type SigningKey struct {
+	ID         string
+	Status     string
+	Path       string
+	PrivateKey interface{}
 }
 
 func readString(key string, def string) (string, error) {
@@ -91,10 +335,7 @@ func Initialize(configFile string) (*Config, error) {
 	}
 
 	publicRSAKey := viper.GetString("jwt.publicRSAKey")
-	publicRSAKeyPath, err := readString("jwt.publicRSAKeyPath", "certs/public.pem")
-	if err != nil {
-		return nil, err
-	}
+	publicRSAKeyPath := viper.GetString("jwt.publicRSAKeyPath")
 	privateRSAKey := viper.GetString("jwt.privateRSAKey")
 	privateRSAKeyPath, err := readString("jwt.privateRSAKeyPath", "certs/private.pem")
 	if err != nil {
@@ -118,123 +359,482 @@ func Initialize(configFile string) (*Config, error) {
 	if err != nil {
 		return nil, err
 	}
+	refreshExpirySeconds := viper.GetInt("jwt.refreshExpirySeconds")
+	rotationIntervalSeconds := viper.GetInt("jwt.rotation.intervalSeconds")
+	deviceExpirySeconds := viper.GetInt("device.expirySeconds")
+	deviceIntervalSeconds, err := readInt("device.intervalSeconds", 5)
+	if err != nil {
+		return nil, err
+	}
+	adminSecret := viper.GetString("adminSecret")
+	trustedProxies, err := readTrustedProxies()
+	if err != nil {
+		return nil, err
+	}
 
-	providers := map[string]provider.Provider{}
+	hmac := strings.HasPrefix(signingMethod, "HS")
 
-	googleClientID := viper.GetString("providers.google.clientId")
-	if googleClientID != "" {
-		log.Debugf("found provider google")
-		googleSecret := viper.GetString("providers.google.clientSecret")
-		if googleSecret == "" {
-			return nil, fmt.Errorf("google secret must not be empty")
+	var keyConfigs []struct {
+		ID         string
+		Status     string
+		PrivateKey string
+		Secret     string
+		Path       string
+	}
+	if err := viper.UnmarshalKey("jwt.keys", &keyConfigs); err != nil {
+		return nil, err
+	}
+	signingKeys := []SigningKey{}
+	for _, keyConfig := range keyConfigs {
+		if keyConfig.Status != "next" && keyConfig.Status != "retired" {
+			return nil, fmt.Errorf("status of signing key %s must be next or retired", keyConfig.Path)
 		}
-		googleScopes := viper.GetStringSlice("providers.google.scopes")
-		if len(googleScopes) == 0 {
-			return nil, fmt.Errorf("google scopes must not be empty")
+		var privateKey interface{}
+		if hmac {
+			privateKey, err = readSecret(keyConfig.Secret, keyConfig.Path)
+		} else {
+			privateKey, err = readPrivateKey(keyConfig.PrivateKey, keyConfig.Path)
 		}
-		providers["google"] = provider.NewGoogle(
-			rootURI,
-			googleClientID,
-			googleSecret,
-			googleScopes,
-		)
+		if err != nil {
+			return nil, err
+		}
+		signingKeys = append(signingKeys, SigningKey{
+			ID:         keyConfig.ID,
+			Status:     keyConfig.Status,
+			Path:       keyConfig.Path,
+			PrivateKey: privateKey,
+		})
 	}
 
-	githubClientID := viper.GetString("providers.github.clientId")
-	if githubClientID != "" {
-		log.Debugf("found provider github")
-		githubSecret := viper.GetString("providers.github.clientSecret")
-		if githubSecret == "" {
-			return nil, fmt.Errorf("github secret must not be empty")
+	providers := map[string]provider.Provider{}
+	providerInfos := []ProviderInfo{}
+	pkce := map[string]bool{}
+	tokenExchange := map[string]bool{}
+	entries, err := providerOptions()
+	if err != nil {
+		return nil, err
+	}
+	for _, options := range entries {
+		id := options.String("id")
+		providerType := options.String("type")
+		if id == "" {
+			return nil, fmt.Errorf("provider of type %s must have an id", providerType)
 		}
-		githubScopes := viper.GetStringSlice("providers.github.scopes")
-		if len(githubScopes) == 0 {
-			return nil, fmt.Errorf("github scopes must not be empty")
+		if _, ok := providers[id]; ok {
+			return nil, fmt.Errorf("provider id %s is used twice", id)
 		}
-		providers["github"] = provider.NewGithub(
-			rootURI,
-			githubClientID,
-			githubSecret,
-			githubScopes,
-		)
-	}
-
-	facebookClientID := viper.GetString("providers.facebook.clientId")
-	if facebookClientID != "" {
-		log.Debugf("found provider facebook")
-		facebookSecret := viper.GetString("providers.facebook.clientSecret")
-		if facebookSecret == "" {
-			return nil, fmt.Errorf("facebook secret must not be empty")
+		log.Debugf("found %s provider %s", providerType, id)
+		providers[id], err = provider.New(providerType, rootURI, id, options)
+		if err != nil {
+			return nil, err
 		}
-		facebookScopes := viper.GetStringSlice("providers.facebook.scopes")
-		if len(facebookScopes) == 0 {
-			return nil, fmt.Errorf("facebook scopes must not be empty")
+		pkce[id] = !options.Has("pkce") || options.Bool("pkce")
+		tokenExchange[id] = options.Bool("tokenExchange")
+		if _, ok := providers[id].(provider.TokenVerifier); tokenExchange[id] && !ok {
+			return nil, fmt.Errorf("provider %s of type %s cannot verify access tokens, which token exchange requires", id, providerType)
 		}
-		providers["facebook"] = provider.NewFacebook(
-			rootURI,
-			facebookClientID,
-			viper.GetString("providers.facebook.clientSecret"),
-			viper.GetStringSlice("providers.facebook.scopes"),
-		)
+		providerInfos = append(providerInfos, ProviderInfo{
+			ID:          id,
+			Type:        providerType,
+			DisplayName: provider.DisplayName(providerType, id, options),
+		})
 	}
 
+	credentials, err := localCredentials()
 	if err != nil {
 		return nil, err
 	}
+	if len(credentials) > 0 {
+		if _, ok := providers[provider.LocalID]; ok {
+			return nil, fmt.Errorf("provider id %s is reserved for local accounts", provider.LocalID)
+		}
+		providers[provider.LocalID] = provider.NewLocal(rootURI, credentials)
+	}
 
-	var publicKeyData []byte
-	if publicRSAKey == "" {
-		if publicRSAKeyPath == "" {
-			publicRSAKeyPath = "certs/public.pem"
+	devLogin := viper.GetBool("dev.enabled")
+	if devLogin {
+		if _, ok := providers[provider.DevID]; ok {
+			return nil, fmt.Errorf("provider id %s is reserved for the dev login", provider.DevID)
+		}
+		// the dev provider ignores code challenges, so no PKCE
+		providers[provider.DevID] = provider.NewDev(rootURI)
+		providerInfos = append(providerInfos, ProviderInfo{
+			ID:          provider.DevID,
+			Type:        provider.DevID,
+			DisplayName: "Development login",
+		})
+	}
+
+	var encryptionKeyConfigs []struct {
+		Algorithm      string
+		PublicKey      string
+		PublicKeyPath  string
+		PrivateKey     string
+		PrivateKeyPath string
+	}
+	if err := viper.UnmarshalKey("jwt.encryption.recipients", &encryptionKeyConfigs); err != nil {
+		return nil, err
+	}
+	encryptionKeys := []EncryptionKey{}
+	for _, keyConfig := range encryptionKeyConfigs {
+		encryptionKey := EncryptionKey{Algorithm: keyConfig.Algorithm}
+		if keyConfig.PrivateKey != "" || keyConfig.PrivateKeyPath != "" {
+			encryptionKey.Path = keyConfig.PrivateKeyPath
+			encryptionKey.PrivateKey, err = readPrivateKey(keyConfig.PrivateKey, keyConfig.PrivateKeyPath)
+		} else {
+			encryptionKey.Path = keyConfig.PublicKeyPath
+			encryptionKey.PublicKey, err = readPublicKey(keyConfig.PublicKey, keyConfig.PublicKeyPath)
 		}
-		publicKeyData, err = ioutil.ReadFile(publicRSAKeyPath)
 		if err != nil {
 			return nil, err
 		}
-	} else {
-		publicKeyData = []byte(publicRSAKey)
+		encryptionKeys = append(encryptionKeys, encryptionKey)
 	}
-	block, _ := pem.Decode(publicKeyData)
-	if block == nil {
-		return nil, fmt.Errorf("could not decode publicKeyData %v", string(publicKeyData))
+
+	claims := ClaimsConfig{}
+	if err := viper.UnmarshalKey("claims", &claims); err != nil {
+		return nil, err
+	}
+	if claims.Audience == "" {
+		claims.Audience = audience
+	}
+	if err := claims.validate(); err != nil {
+		return nil, err
+	}
+
+	clients := []Client{}
+	if err := viper.UnmarshalKey("clients", &clients); err != nil {
+		return nil, err
+	}
+	clientIDs := map[string]bool{}
+	for _, client := range clients {
+		if client.ID == "" || len(client.RedirectURIs) == 0 {
+			return nil, fmt.Errorf("clients need an id and at least one redirect uri")
+		}
+		if clientIDs[client.ID] {
+			return nil, fmt.Errorf("duplicate client id %s", client.ID)
+		}
+		clientIDs[client.ID] = true
+	}
+	if hmac && len(clients) > 0 {
+		// clients could not verify ID tokens signed with jwt-proxy's secret
+		return nil, fmt.Errorf("clients need an asymmetric jwt.signingMethod instead of %s", signingMethod)
 	}
-	rsaPub, err := x509.ParsePKIXPublicKey(block.Bytes)
+
+	serviceAccounts, err := readServiceAccounts()
 	if err != nil {
 		return nil, err
 	}
 
-	var privateKeyData []byte
-	if privateRSAKey == "" {
+	protectedResources := []ProtectedResource{}
+	if err := viper.UnmarshalKey("protectedResources", &protectedResources); err != nil {
+		return nil, err
+	}
+	for _, resource := range protectedResources {
+		if resource.ID == "" || resource.Secret == "" {
+			return nil, fmt.Errorf("protected resources need an id and a secret")
+		}
+	}
+
+	var privateKey interface{}
+	var publicKey interface{}
+	if hmac {
+		privateKey, err = readSecret(viper.GetString("jwt.hmacSecret"), viper.GetString("jwt.hmacSecretPath"))
+		if err != nil {
+			return nil, err
+		}
+	} else {
 		if privateRSAKeyPath == "" {
 			privateRSAKeyPath = "certs/private.pem"
 		}
-		privateKeyData, err = ioutil.ReadFile(privateRSAKeyPath)
+		signer, err := readPrivateKey(privateRSAKey, privateRSAKeyPath)
 		if err != nil {
 			return nil, err
 		}
-	} else {
-		privateKeyData = []byte(privateRSAKey)
-	}
-	block2, _ := pem.Decode(privateKeyData)
-	rsaPriv, err := x509.ParsePKCS1PrivateKey(block2.Bytes)
+		privateKey = signer
+		publicKey = signer.Public()
 
-	if err != nil {
-		return nil, err
+		// the public key is derived from the private key, a configured one
+		// is only checked
+		if publicRSAKey != "" || publicRSAKeyPath != "" {
+			configured, err := readPublicKey(publicRSAKey, publicRSAKeyPath)
+			if err != nil {
+				return nil, err
+			}
+			if !samePublicKey(configured, publicKey) {
+				return nil, fmt.Errorf("jwt.publicRSAKey does not belong to the private key")
+			}
+		}
 	}
+	rsaPriv, _ := privateKey.(*rsa.PrivateKey)
 
 	return &Config{RootURI: rootURI,
 		RedirectURI:       redirectURI,
 		WWWRootDir:        wwwRootDir,
 		Providers:         providers,
 		SigningMethod:     signingMethod,
+		PrivateKey:        privateKey,
 		PrivateRSAKey:     rsaPriv,
 		PrivateRSAKeyPath: privateRSAKeyPath,
-		PublicRSAKey:      rsaPub,
+		PublicRSAKey:      publicKey,
 		PublicRSAKeyPath:  publicRSAKeyPath,
 		Audience:          audience,
 		Issuer:            issuer,
 		Subject:           subject,
-		ExpirySeconds:     expirySeconds}, nil
+		ExpirySeconds:     expirySeconds,
+		SigningKeys:       signingKeys,
+
+		RefreshExpirySeconds:    refreshExpirySeconds,
+		RotationIntervalSeconds: rotationIntervalSeconds,
+		AdminSecret:             adminSecret,
+		TrustedProxies:          trustedProxies,
+		EncryptionKeys:          encryptionKeys,
+		Claims:                  claims,
+		Clients:                 clients,
+		ProtectedResources:      protectedResources,
+		PKCE:                    pkce,
+		TokenExchange:           tokenExchange,
+		ProviderInfos:           providerInfos,
+		DeviceExpirySeconds:     deviceExpirySeconds,
+		DeviceIntervalSeconds:   deviceIntervalSeconds,
+		DevLogin:                devLogin,
+		ServiceAccounts:         serviceAccounts}, nil
+}
+
+// localCredentials returns the local accounts of the htpasswd file at
+// local.htpasswdPath and of the local.users list of usernames and bcrypt
+// password hashes.
+func localCredentials() (user.Credentials, error) {
+	credentials := user.Credentials{}
+	if path := viper.GetString("local.htpasswdPath"); path != "" {
+		var err error
+		if credentials, err = user.ReadHtpasswd(path); err != nil {
+			return nil, err
+		}
+	}
+
+	var users []struct {
+		Username     string
+		PasswordHash string
+	}
+	if err := viper.UnmarshalKey("local.users", &users); err != nil {
+		return nil, err
+	}
+	for _, account := range users {
+		if err := credentials.Add(account.Username, account.PasswordHash); err != nil {
+			return nil, fmt.Errorf("local.users: %w", err)
+		}
+	}
+	return credentials, nil
+}
+
+// readServiceAccounts returns the service accounts of the serviceAccounts list,
+// whose secrets must be bcrypt hashes as for local accounts.
+func readServiceAccounts() ([]ServiceAccount, error) {
+	serviceAccounts := []ServiceAccount{}
+	if err := viper.UnmarshalKey("serviceAccounts", &serviceAccounts); err != nil {
+		return nil, err
+	}
+	secrets := user.Credentials{}
+	for i, account := range serviceAccounts {
+		if err := secrets.Add(account.ID, account.SecretHash); err != nil {
+			return nil, fmt.Errorf("serviceAccounts: %w", err)
+		}
+		for claim := range account.Claims {
+			if reservedClaims[claim] || serviceAccountClaims[claim] {
+				return nil, fmt.Errorf("claim %s of service account %s is reserved", claim, account.ID)
+			}
+		}
+		if account.ExpirySeconds <= 0 {
+			serviceAccounts[i].ExpirySeconds = defaultServiceAccountExpirySeconds
+		}
+	}
+	return serviceAccounts, nil
+}
+
+// readTrustedProxies returns the networks of the trustedProxies list, whose
+// entries are CIDR ranges or single IP addresses.
+func readTrustedProxies() ([]*net.IPNet, error) {
+	proxies := []*net.IPNet{}
+	for _, entry := range viper.GetStringSlice("trustedProxies") {
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("trustedProxies: invalid address %s", entry)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("trustedProxies: %w", err)
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies, nil
+}
+
+// TrustedProxy returns true if the address is one of the trusted proxies.
+func (c *Config) TrustedProxy(address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	for _, proxy := range c.TrustedProxies {
+		if proxy.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// providerOptions returns the options of all configured provider instances.
+// providers is either a list of instances with id and type, or a map keyed by
+// id, in which the id is the type if no type is given, as for google, github
+// and facebook, whose settings can also be given by environment variables.
+func providerOptions() ([]provider.Options, error) {
+	if _, isList := viper.Get("providers").([]interface{}); isList {
+		var entries []map[string]interface{}
+		if err := viper.UnmarshalKey("providers", &entries); err != nil {
+			return nil, err
+		}
+		options := []provider.Options{}
+		for _, entry := range entries {
+			options = append(options, provider.Options(entry))
+		}
+		return options, nil
+	}
+
+	ids := []string{"facebook", "github", "google"}
+	for id := range viper.GetStringMap("providers") {
+		if !contains(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	options := []provider.Options{}
+	for _, id := range ids {
+		key := "providers." + id
+		entry := provider.Options{}
+		for name, value := range viper.GetStringMap(key) {
+			entry[name] = value
+		}
+		for _, name := range []string{"type", "clientId", "clientSecret", "scopes"} {
+			if viper.IsSet(key + "." + name) {
+				entry[strings.ToLower(name)] = viper.Get(key + "." + name)
+			}
+		}
+		if entry.String("type") == "" {
+			if !provider.Registered(id) || entry.String("clientId") == "" {
+				continue
+			}
+			entry["type"] = id
+		}
+		entry["id"] = id
+		options = append(options, entry)
+	}
+	return options, nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// readPrivateKey parses the inline PEM encoded private key or, if it is empty,
+// the one stored at path.
+func readPrivateKey(inline string, path string) (crypto.Signer, error) {
+	privateKeyData := []byte(inline)
+	if inline == "" {
+		var err error
+		privateKeyData, err = ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return parsePrivateKey(privateKeyData)
+}
+
+// readPublicKey parses the inline PEM encoded PKIX public key or, if it is
+// empty, the one stored at path.
+func readPublicKey(inline string, path string) (crypto.PublicKey, error) {
+	publicKeyData := []byte(inline)
+	if inline == "" {
+		var err error
+		publicKeyData, err = ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	block, _ := pem.Decode(publicKeyData)
+	if block == nil {
+		return nil, fmt.Errorf("could not decode public key")
+	}
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
+
+// samePublicKey returns true if both public keys are equal.
+func samePublicKey(a crypto.PublicKey, b crypto.PublicKey) bool {
+	aDer, err := x509.MarshalPKIXPublicKey(a)
+	if err != nil {
+		return false
+	}
+	bDer, err := x509.MarshalPKIXPublicKey(b)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(aDer, bDer)
+}
+
+// parsePrivateKey parses a PEM encoded PKCS#1 RSA, SEC1 EC or PKCS#8 RSA, EC
+// or Ed25519 private key.
+func parsePrivateKey(privateKeyData []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(privateKeyData)
+	if block == nil {
+		return nil, fmt.Errorf("could not decode private key")
+	}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("unsupported private key type %T", key)
+		}
+		return signer, nil
+	}
+	return nil, fmt.Errorf("unsupported private key block %s", block.Type)
+}
+
+// readSecret returns the inline HMAC secret or, if it is empty, the one stored
+// at path.
+func readSecret(inline string, path string) ([]byte, error) {
+	if inline != "" {
+		return []byte(inline), nil
+	}
+	if path == "" {
+		return nil, fmt.Errorf("config jwt.hmacSecret or jwt.hmacSecretPath must not be empty")
+	}
+	secret, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(strings.TrimSpace(string(secret))), nil
 }
 
 // String is a helping toString function for the config for debugging
@@ -243,6 +843,6 @@ func (c *Config) String() string {
 	for _, p := range c.Providers {
 		providersString = providersString + fmt.Sprintf("%s with clientId %s, ", p.Name(), p.ClientID())
 	}
-	return fmt.Sprintf("rootURI: %s, redirectURI: %s, WWWRootDir: %s, SigningMethod: %s, PublicRSAKeyPath: %s, PrivateKeyPath: %s, Audience: %s, Issuer: %s, Subject: %s, Expiry: %d, Providers: %s",
-		c.RootURI, c.RedirectURI, c.WWWRootDir, c.SigningMethod, c.PublicRSAKeyPath, c.PrivateRSAKeyPath, c.Audience, c.Issuer, c.Subject, c.ExpirySeconds, providersString)
+	return fmt.Sprintf("rootURI: %s, redirectURI: %s, WWWRootDir: %s, SigningMethod: %s, PublicRSAKeyPath: %s, PrivateKeyPath: %s, Audience: %s, Issuer: %s, Subject: %s, Expiry: %d, SigningKeys: %d, RotationInterval: %d, Providers: %s",
+		c.RootURI, c.RedirectURI, c.WWWRootDir, c.SigningMethod, c.PublicRSAKeyPath, c.PrivateRSAKeyPath, c.Audience, c.Issuer, c.Subject, c.ExpirySeconds, len(c.SigningKeys), c.RotationIntervalSeconds, providersString)
 }
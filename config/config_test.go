@@ -1,8 +1,20 @@
 package config
 
 import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"strings"
+	"testing"
+
+	"github.com/krinklesaurus/jwt-proxy/provider"
 )
 
 func ExampleInitialize() {
@@ -35,6 +47,40 @@ func ExampleInitialize() {
 	// {"client_id":"your-github-client-id","auth_url":"https://github.com/login/oauth/authorize","token_url":"https://github.com/login/oauth/access_token","redirect_url":"http://localhost:8080/jwt-proxy/callback/github","scopes":["user"]}
 }
 
+func ExampleInitialize_oauth2() {
+	cfg, err := Initialize("../test/config-test.yml")
+	if err != nil {
+		fmt.Printf("error initializing config %v", err)
+		return
+	}
+
+	fmt.Println(cfg.Providers["gitea"].String())
+	// Output:
+	// {"client_id":"your-gitea-client-id","auth_url":"https://gitea.example.com/login/oauth/authorize","token_url":"https://gitea.example.com/login/oauth/access_token","user_info_url":"https://gitea.example.com/api/v1/user","redirect_url":"http://localhost:8080/jwt-proxy/callback/gitea","scopes":["read:user"]}
+}
+
+func ExampleInitialize_providers() {
+	cfg, err := Initialize("../test/config-providers-test.yml")
+	if err != nil {
+		fmt.Printf("error initializing config %v", err)
+		return
+	}
+
+	for _, info := range cfg.ProviderInfos {
+		fmt.Println(info.ID, info.Type, info.DisplayName, cfg.PKCE[info.ID])
+		fmt.Println(cfg.Providers[info.ID].String())
+	}
+	// Output:
+	// github github GitHub true
+	// {"client_id":"your-github-client-id","auth_url":"https://github.com/login/oauth/authorize","token_url":"https://github.com/login/oauth/access_token","redirect_url":"http://localhost:8080/jwt-proxy/callback/github","scopes":["user"]}
+	// github-work github GitHub (work) false
+	// {"client_id":"your-work-github-client-id","auth_url":"https://github.com/login/oauth/authorize","token_url":"https://github.com/login/oauth/access_token","redirect_url":"http://localhost:8080/jwt-proxy/callback/github-work","scopes":["read:user"]}
+	// gitea oauth2 Gitea true
+	// {"client_id":"your-gitea-client-id","auth_url":"https://gitea.example.com/login/oauth/authorize","token_url":"https://gitea.example.com/login/oauth/access_token","user_info_url":"https://gitea.example.com/api/v1/user","redirect_url":"http://localhost:8080/jwt-proxy/callback/gitea","scopes":[]}
+	// dev dev Development login false
+	// {"login_url":"http://localhost:8080/jwt-proxy/dev","redirect_url":"http://localhost:8080/jwt-proxy/callback/dev"}
+}
+
 func ExampleInitialize_envvars() {
 	configPath := "../test/config-test.yml"
 
@@ -104,3 +150,255 @@ func ExampleInitialize_envvars() {
 	// {"client_id":"envvar-facebook-client-id","auth_url":"https://www.facebook.com/v3.2/dialog/oauth","token_url":"https://graph.facebook.com/v3.2/oauth/access_token","redirect_url":"http://envvar:8080/jwt-proxy/callback/facebook","scopes":["envvar-fb-scope-1","envvar-fb-scope-2"]}
 	// {"client_id":"envvar-github-client-id","auth_url":"https://github.com/login/oauth/authorize","token_url":"https://github.com/login/oauth/access_token","redirect_url":"http://envvar:8080/jwt-proxy/callback/github","scopes":["envvar-git-scope-1","envvar-git-scope-2"]}
 }
+
+func TestParsePrivateKey(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	sec1, _ := x509.MarshalECPrivateKey(ecKey)
+	pkcs8EC, _ := x509.MarshalPKCS8PrivateKey(ecKey)
+	pkcs8Ed, _ := x509.MarshalPKCS8PrivateKey(edKey)
+	pkcs8RSA, _ := x509.MarshalPKCS8PrivateKey(rsaKey)
+
+	blocks := []*pem.Block{
+		{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)},
+		{Type: "PRIVATE KEY", Bytes: pkcs8RSA},
+		{Type: "EC PRIVATE KEY", Bytes: sec1},
+		{Type: "PRIVATE KEY", Bytes: pkcs8EC},
+		{Type: "PRIVATE KEY", Bytes: pkcs8Ed},
+	}
+	for _, block := range blocks {
+		key, err := parsePrivateKey(pem.EncodeToMemory(block))
+		if err != nil {
+			t.Errorf("could not parse %s: %v", block.Type, err)
+			continue
+		}
+		if key.Public() == nil {
+			t.Errorf("no public key for %s", block.Type)
+		}
+	}
+
+	if _, err := parsePrivateKey([]byte("no pem")); err == nil {
+		t.Error("parsing garbage should fail")
+	}
+}
+
+func TestClaimsForProvider(t *testing.T) {
+	cfg, err := Initialize("../test/config-test.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	google := cfg.Claims.ForProvider("google")
+	if google.Audience != "your-audience" {
+		t.Errorf("audience should default to jwt.audience, got %s", google.Audience)
+	}
+	if google.ProviderTokens() {
+		t.Error("provider tokens should be dropped")
+	}
+	if len(google.Mapping) != 1 || google.Mapping[0] != (ClaimMapping{Claim: "email", Field: "email"}) {
+		t.Errorf("unexpected mapping %v", google.Mapping)
+	}
+
+	github := cfg.Claims.ForProvider("github")
+	if github.Audience != "github-audience" {
+		t.Errorf("audience should be overridden, got %s", github.Audience)
+	}
+	if !github.ProviderTokens() {
+		t.Error("provider tokens should be included for github")
+	}
+	expected := []ClaimMapping{{Claim: "email", Field: "login"}, {Claim: "picture", Field: "avatar"}}
+	if len(github.Mapping) != 2 || github.Mapping[0] != expected[0] || github.Mapping[1] != expected[1] {
+		t.Errorf("unexpected mapping %v", github.Mapping)
+	}
+
+	for _, claim := range []string{"exp", "sub", "aud", "user", "provider"} {
+		invalid := ClaimsConfig{Mapping: []ClaimMapping{{Claim: claim, Field: "email"}}}
+		if invalid.validate() == nil {
+			t.Errorf("mapping reserved claim %s should fail", claim)
+		}
+		invalid = ClaimsConfig{Providers: []ClaimsConfig{{Provider: "github", Mapping: []ClaimMapping{{Claim: claim, Field: "login"}}}}}
+		if invalid.validate() == nil {
+			t.Errorf("mapping reserved claim %s for a provider should fail", claim)
+		}
+	}
+
+	for _, field := range []string{"$.emails[*].value", "$..email", "emails[?(@.primary)].value"} {
+		invalid := ClaimsConfig{Mapping: []ClaimMapping{{Claim: "email", Field: field}}}
+		if invalid.validate() == nil {
+			t.Errorf("mapping unsupported path %s should fail", field)
+		}
+	}
+	valid := ClaimsConfig{Mapping: []ClaimMapping{{Claim: "email", Field: "$.emails[0].value"}}}
+	if err := valid.validate(); err != nil {
+		t.Errorf("mapping a bracket path should work, got %v", err)
+	}
+}
+
+func TestTrustedProxies(t *testing.T) {
+	cfg, err := Initialize("../test/config-test.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, address := range []string{"10.1.2.3", "192.168.1.1"} {
+		if !cfg.TrustedProxy(address) {
+			t.Errorf("%s should be a trusted proxy", address)
+		}
+	}
+	for _, address := range []string{"192.168.1.2", "127.0.0.1", "not-an-address"} {
+		if cfg.TrustedProxy(address) {
+			t.Errorf("%s should not be a trusted proxy", address)
+		}
+	}
+}
+
+func TestPKCE(t *testing.T) {
+	cfg, err := Initialize("../test/config-test.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !cfg.PKCE["github"] {
+		t.Error("pkce should be enabled by default")
+	}
+	if cfg.PKCE["gitea"] {
+		t.Error("pkce should be disabled for gitea")
+	}
+}
+
+func TestTokenExchange(t *testing.T) {
+	cfg, err := Initialize("../test/config-test.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !cfg.TokenExchange["github"] || !cfg.TokenExchangeEnabled() {
+		t.Error("token exchange should be enabled for github")
+	}
+	if cfg.TokenExchange["google"] {
+		t.Error("token exchange should be disabled by default")
+	}
+
+	if _, err := initializeReplaced(t, "      - public_profile\n", "      - public_profile\n    tokenExchange: true\n"); err == nil {
+		t.Error("token exchange should be rejected for providers that cannot verify access tokens")
+	}
+}
+
+// initializeReplaced initializes the test config with old replaced by new.
+func initializeReplaced(t *testing.T, old string, new string) (*Config, error) {
+	config, err := ioutil.ReadFile("../test/config-test.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(config), old) {
+		t.Fatalf("test config does not contain %q", old)
+	}
+	file, err := ioutil.TempFile("", "config-*.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.WriteString(strings.Replace(string(config), old, new, 1)); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	return Initialize(file.Name())
+}
+
+func TestClientsWithHMAC(t *testing.T) {
+	if _, err := initializeReplaced(t, "  signingMethod: RS256\n", "  signingMethod: HS256\n  hmacSecret: a-secret-of-at-least-thirty-two-bytes\n"); err == nil {
+		t.Error("clients should be rejected with HMAC signing")
+	}
+}
+
+func TestPublicKey(t *testing.T) {
+	cfg, err := initializeReplaced(t, "  publicRSAKeyPath: ../test/public.pem\n", "")
+	if err != nil {
+		t.Fatalf("the public key should be optional, got %v", err)
+	}
+	if !samePublicKey(cfg.PublicRSAKey, cfg.PrivateRSAKey.Public()) {
+		t.Error("the public key should be derived from the private key")
+	}
+
+	if _, err := initializeReplaced(t, "  publicRSAKeyPath: ../test/public.pem\n", "  publicRSAKeyPath: ../test/sample_key.pub\n"); err == nil {
+		t.Error("a public key of another private key should be rejected")
+	}
+}
+
+func TestLocalAccounts(t *testing.T) {
+	cfg, err := Initialize("../test/config-providers-test.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	local, ok := cfg.Providers["local"].(*provider.LocalProvider)
+	if !ok {
+		t.Fatal("local accounts should be configured")
+	}
+	if _, err := local.Login("tester", "tester"); err != nil {
+		t.Errorf("users of the htpasswd file should be able to log in, err is %v", err)
+	}
+	if _, err := local.Login("alice", "secret"); err != nil {
+		t.Errorf("users of the list should be able to log in, err is %v", err)
+	}
+	for _, info := range cfg.ProviderInfos {
+		if info.ID == "local" {
+			t.Error("local accounts have no provider button")
+		}
+	}
+
+	cfg, err = Initialize("../test/config-test.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cfg.Providers["local"]; ok {
+		t.Error("local accounts should not be configured")
+	}
+}
+
+func TestDevLogin(t *testing.T) {
+	cfg, err := Initialize("../test/config-providers-test.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.DevLogin {
+		t.Error("dev login should be enabled")
+	}
+	if _, ok := cfg.Providers["dev"].(*provider.DevProvider); !ok {
+		t.Error("dev provider should be configured")
+	}
+
+	cfg, err = Initialize("../test/config-test.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cfg.Providers["dev"]; ok || cfg.DevLogin {
+		t.Error("dev login must only be enabled explicitly")
+	}
+}
+
+func TestServiceAccounts(t *testing.T) {
+	cfg, err := Initialize("../test/config-test.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	account := cfg.ServiceAccount("ci")
+	if account == nil {
+		t.Fatal("service account ci should be configured")
+	}
+	if !account.AudienceAllowed("some-api") || account.AudienceAllowed("your-audience") {
+		t.Errorf("unexpected audiences %v", account.Audiences)
+	}
+	if account.Claims["role"] != "deployer" {
+		t.Errorf("unexpected claims %v", account.Claims)
+	}
+	if account.ExpirySeconds != 300 {
+		t.Errorf("expected default expiry of 300 seconds, got %d", account.ExpirySeconds)
+	}
+	if cfg.ServiceAccount("unknown") != nil {
+		t.Error("unknown service account should not be found")
+	}
+}
@@ -0,0 +1,352 @@
+package core
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/krinklesaurus/jwt-proxy/config"
+	"github.com/krinklesaurus/jwt-proxy/log"
+	"github.com/krinklesaurus/jwt-proxy/util"
+)
+
+// The errors of the authorization code flow. Their messages are the error
+// codes of RFC 6749 section 4.1.2.1 and 5.2.
+var (
+	ErrInvalidRequest          = errors.New("invalid_request")
+	ErrInvalidClient           = errors.New("invalid_client")
+	ErrInvalidGrant            = errors.New("invalid_grant")
+	ErrUnsupportedResponseType = errors.New("unsupported_response_type")
+	// ErrInvalidRedirectURI is returned for unknown clients and redirect URIs
+	// that are not registered. Such errors must never be redirected.
+	ErrInvalidRedirectURI = errors.New("invalid redirect uri")
+)
+
+const (
+	// authorizationRequestLifetime is the time a user has to log in with a
+	// provider after the client started the authorization request.
+	authorizationRequestLifetime = 10 * time.Minute
+	// authorizationCodeLifetime is the time a client has to redeem a code.
+	authorizationCodeLifetime = time.Minute
+	// idTokenLifetime is the lifetime of ID tokens, which clients only check
+	// right after the login, unless jwt.expirySeconds is shorter.
+	idTokenLifetime = 5 * time.Minute
+)
+
+// AuthorizationRequest is an OpenID Connect authentication request of a client
+// that is pending while the user logs in with a provider.
+type AuthorizationRequest struct {
+	ID                  string
+	ClientID            string
+	RedirectURI         string
+	ResponseType        string
+	Scope               string
+	State               string
+	Nonce               string
+	CodeChallenge       string
+	CodeChallengeMethod string
+	ExpiresAt           time.Time
+}
+
+// OpenID returns true if the request asks for an ID token.
+func (r *AuthorizationRequest) OpenID() bool {
+	for _, scope := range strings.Fields(r.Scope) {
+		if scope == "openid" {
+			return true
+		}
+	}
+	return false
+}
+
+// AuthorizationCode is the server side state of an authorization code handed
+// out to a client after the user logged in.
+type AuthorizationCode struct {
+	// ID is the hash of the code handed out to the client.
+	ID        string
+	Request   AuthorizationRequest
+	Token     TokenInfo
+	AuthTime  time.Time
+	Used      bool
+	ExpiresAt time.Time
+}
+
+// AuthorizationStore stores pending authorization requests and unredeemed
+// authorization codes.
+type AuthorizationStore interface {
+	SaveRequest(request *AuthorizationRequest) error
+	// UseRequest returns the request and removes it from the store.
+	UseRequest(id string) (*AuthorizationRequest, error)
+	SaveCode(code *AuthorizationCode) error
+	// UseCode marks the code as used and returns it. Codes can only be used
+	// once.
+	UseCode(id string) (*AuthorizationCode, error)
+}
+
+// NewMemoryAuthorizationStore creates an AuthorizationStore that keeps all
+// requests and codes in memory.
+func NewMemoryAuthorizationStore() *MemoryAuthorizationStore {
+	return &MemoryAuthorizationStore{
+		requests: map[string]*AuthorizationRequest{},
+		codes:    map[string]*AuthorizationCode{},
+	}
+}
+
+type MemoryAuthorizationStore struct {
+	mu       sync.Mutex
+	requests map[string]*AuthorizationRequest
+	codes    map[string]*AuthorizationCode
+}
+
+func (s *MemoryAuthorizationStore) SaveRequest(request *AuthorizationRequest) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prune(time.Now())
+	s.requests[request.ID] = request
+	return nil
+}
+
+func (s *MemoryAuthorizationStore) UseRequest(id string) (*AuthorizationRequest, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	request, ok := s.requests[id]
+	delete(s.requests, id)
+	if !ok || time.Now().After(request.ExpiresAt) {
+		return nil, fmt.Errorf("authorization request %s is unknown or expired", id)
+	}
+	return request, nil
+}
+
+func (s *MemoryAuthorizationStore) SaveCode(code *AuthorizationCode) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prune(time.Now())
+	s.codes[code.ID] = code
+	return nil
+}
+
+func (s *MemoryAuthorizationStore) UseCode(id string) (*AuthorizationCode, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	code, ok := s.codes[id]
+	if !ok || time.Now().After(code.ExpiresAt) {
+		return nil, fmt.Errorf("%w: authorization code is invalid or expired", ErrInvalidGrant)
+	}
+	if code.Used {
+		return nil, fmt.Errorf("%w: authorization code was already used", ErrInvalidGrant)
+	}
+	code.Used = true
+	copy := *code
+	return &copy, nil
+}
+
+func (s *MemoryAuthorizationStore) prune(now time.Time) {
+	for id, request := range s.requests {
+		if now.After(request.ExpiresAt) {
+			delete(s.requests, id)
+		}
+	}
+	for id, code := range s.codes {
+		if now.After(code.ExpiresAt) {
+			delete(s.codes, id)
+		}
+	}
+}
+
+// Authorize validates the authorization request of a client and stores it
+// until the user has logged in. It returns the id of the stored request.
+func (c *Core) Authorize(request *AuthorizationRequest) (string, error) {
+	client := c.Config.Client(request.ClientID)
+	if client == nil {
+		return "", fmt.Errorf("%w: unknown client %s", ErrInvalidRedirectURI, request.ClientID)
+	}
+	if !client.RedirectURIAllowed(request.RedirectURI) {
+		return "", fmt.Errorf("%w: %s is not registered for client %s", ErrInvalidRedirectURI, request.RedirectURI, client.ID)
+	}
+	if request.ResponseType != "code" {
+		return "", fmt.Errorf("%w: response type %s", ErrUnsupportedResponseType, request.ResponseType)
+	}
+	if request.CodeChallenge == "" {
+		if client.Public() {
+			return "", fmt.Errorf("%w: public clients must use PKCE", ErrInvalidRequest)
+		}
+	} else if request.CodeChallengeMethod != "S256" {
+		// a missing method means plain, which protects nothing if the
+		// authorization request is intercepted, see RFC 7636 section 7.2
+		return "", fmt.Errorf("%w: code challenge method must be S256", ErrInvalidRequest)
+	}
+
+	id, err := util.SecureRandomString(16)
+	if err != nil {
+		return "", err
+	}
+	request.ID = id
+	request.ExpiresAt = time.Now().Add(authorizationRequestLifetime)
+	if err := c.AuthorizationStore.SaveRequest(request); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// IssueAuthorizationCode completes the pending authorization request after the
+// user logged in and returns the request along with the code for its client.
+func (c *Core) IssueAuthorizationCode(requestID string, token *TokenInfo) (*AuthorizationRequest, string, error) {
+	request, err := c.AuthorizationStore.UseRequest(requestID)
+	if err != nil {
+		return nil, "", err
+	}
+
+	code, err := util.SecureRandomString(32)
+	if err != nil {
+		return nil, "", err
+	}
+	now := time.Now()
+	authorizationCode := &AuthorizationCode{
+		ID:        hashToken(code),
+		Request:   *request,
+		Token:     *token,
+		AuthTime:  now,
+		ExpiresAt: now.Add(authorizationCodeLifetime),
+	}
+	authorizationCode.Token.Client = request.ClientID
+	err = c.AuthorizationStore.SaveCode(authorizationCode)
+	if err != nil {
+		return nil, "", err
+	}
+	return request, code, nil
+}
+
+// AuthenticateClient checks the client's credentials. Public clients only need
+// to identify themselves.
+func (c *Core) AuthenticateClient(clientID string, secret string) (*config.Client, error) {
+	client := c.Config.Client(clientID)
+	if client == nil {
+		return nil, fmt.Errorf("%w: unknown client %s", ErrInvalidClient, clientID)
+	}
+	if !client.Public() && subtle.ConstantTimeCompare([]byte(secret), []byte(client.Secret)) != 1 {
+		return nil, fmt.Errorf("%w: wrong secret for client %s", ErrInvalidClient, clientID)
+	}
+	return client, nil
+}
+
+// ExchangeCode redeems the authorization code of the authenticated client. The
+// redirect URI and the PKCE code verifier must match the authorization request.
+func (c *Core) ExchangeCode(client *config.Client, code string, redirectURI string, codeVerifier string) (*AuthorizationCode, error) {
+	authorizationCode, err := c.AuthorizationStore.UseCode(hashToken(code))
+	if err != nil {
+		return nil, err
+	}
+	request := authorizationCode.Request
+	if request.ClientID != client.ID {
+		log.Warnf("client %s tried to redeem code of client %s", client.ID, request.ClientID)
+		return nil, fmt.Errorf("%w: code was issued to another client", ErrInvalidGrant)
+	}
+	if request.RedirectURI != redirectURI {
+		return nil, fmt.Errorf("%w: redirect uri does not match", ErrInvalidGrant)
+	}
+	if err := verifyCodeChallenge(request.CodeChallenge, request.CodeChallengeMethod, codeVerifier); err != nil {
+		return nil, err
+	}
+	return authorizationCode, nil
+}
+
+// verifyCodeChallenge checks the PKCE code verifier, see RFC 7636 section 4.6.
+func verifyCodeChallenge(challenge string, method string, verifier string) error {
+	if challenge == "" {
+		if verifier != "" {
+			return fmt.Errorf("%w: code verifier without code challenge", ErrInvalidGrant)
+		}
+		return nil
+	}
+	if verifier == "" {
+		return fmt.Errorf("%w: missing code verifier", ErrInvalidGrant)
+	}
+	if method != "S256" {
+		return fmt.Errorf("%w: unsupported code challenge method %s", ErrInvalidGrant, method)
+	}
+	hash := sha256.Sum256([]byte(verifier))
+	expected := base64.RawURLEncoding.EncodeToString(hash[:])
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(challenge)) != 1 {
+		return fmt.Errorf("%w: code verifier does not match code challenge", ErrInvalidGrant)
+	}
+	return nil
+}
+
+// IDToken returns the claims of the OpenID Connect ID token for the redeemed
+// authorization code, see
+// https://openid.net/specs/openid-connect-core-1_0.html#IDToken
+func (c *Core) IDToken(code *AuthorizationCode) (Claims, error) {
+	claimsConfig := c.Config.Claims.ForProvider(code.Token.Provider.Name())
+
+	claims := Claims{}
+	claims.SetIssuer(c.Config.RootURI)
+	claims.SetSubject(code.Token.User)
+	claims.SetAudience(code.Request.ClientID)
+
+	jti, err := util.SecureRandomString(16)
+	if err != nil {
+		return nil, err
+	}
+	claims.SetID(jti)
+
+	lifetime := idTokenLifetime
+	if lifetime > c.maxTokenLifetime() {
+		lifetime = c.maxTokenLifetime()
+	}
+	now := time.Now()
+	claims.SetExpiration(now.Add(lifetime))
+	claims.SetIssuedAt(now)
+	claims.Set("auth_time", code.AuthTime.Unix())
+	claims.Set("azp", code.Request.ClientID)
+	if code.Request.Nonce != "" {
+		claims.Set("nonce", code.Request.Nonce)
+	}
+	claims.Set("provider", code.Token.Provider.Name())
+
+	// mappings cannot override the claims OpenID Connect requires
+	for _, mapping := range claimsConfig.Mapping {
+		value := code.Token.profileField(mapping.Field)
+		if value == nil || value == "" || claims.Has(mapping.Claim) {
+			continue
+		}
+		claims.Set(mapping.Claim, value)
+	}
+
+	return claims, nil
+}
+
+// userInfoExcluded are the claims of an access token that are not returned by
+// the user info endpoint.
+var userInfoExcluded = map[string]bool{
+	"iss": true, "sub": true, "aud": true, "exp": true, "iat": true, "nbf": true, "jti": true,
+	"user": true, "access_token": true, "token_type": true, "refresh_token": true,
+	"scope": true, "client_id": true,
+}
+
+// UserInfo verifies the access token and returns the claims about its user,
+// see https://openid.net/specs/openid-connect-core-1_0.html#UserInfo
+func (c *Core) UserInfo(accessToken []byte) (Claims, error) {
+	claims, err := c.VerifyToken(accessToken)
+	if err != nil {
+		return nil, err
+	}
+	user, _ := claims.Get("user").(string)
+	if user == "" {
+		return nil, fmt.Errorf("%w: token has no user", ErrInvalidToken)
+	}
+
+	userInfo := Claims{}
+	userInfo.SetSubject(user)
+	for name, value := range claims {
+		if !userInfoExcluded[name] {
+			userInfo.Set(name, value)
+		}
+	}
+	return userInfo, nil
+}
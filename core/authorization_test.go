@@ -0,0 +1,184 @@
+package core
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/krinklesaurus/jwt-proxy/config"
+	"github.com/krinklesaurus/jwt-proxy/user"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthorize(t *testing.T) {
+	conf, _ := config.Initialize("../test/config-test.yml")
+	core := New(conf, rsaTokenizer(t, conf.PrivateRSAKey), user.PlainUserService{})
+
+	valid := func() *AuthorizationRequest {
+		return &AuthorizationRequest{
+			ClientID:     "internal-app",
+			RedirectURI:  "http://localhost:3000/callback",
+			ResponseType: "code",
+			Scope:        "openid",
+		}
+	}
+
+	id, err := core.Authorize(valid())
+	assert.Nil(t, err, "err should be nothing")
+	assert.NotEmpty(t, id)
+
+	request := valid()
+	request.ClientID = "unknown"
+	_, err = core.Authorize(request)
+	assert.True(t, errors.Is(err, ErrInvalidRedirectURI))
+
+	request = valid()
+	request.RedirectURI = "http://evil.example.com/callback"
+	_, err = core.Authorize(request)
+	assert.True(t, errors.Is(err, ErrInvalidRedirectURI))
+
+	request = valid()
+	request.ResponseType = "token"
+	_, err = core.Authorize(request)
+	assert.True(t, errors.Is(err, ErrUnsupportedResponseType))
+
+	request = &AuthorizationRequest{ClientID: "spa", RedirectURI: "http://localhost:3001/callback", ResponseType: "code"}
+	_, err = core.Authorize(request)
+	assert.True(t, errors.Is(err, ErrInvalidRequest), "public clients must use PKCE")
+
+	request.CodeChallenge = "challenge"
+	request.CodeChallengeMethod = "S512"
+	_, err = core.Authorize(request)
+	assert.True(t, errors.Is(err, ErrInvalidRequest))
+
+	for _, method := range []string{"plain", ""} {
+		request.CodeChallengeMethod = method
+		_, err = core.Authorize(request)
+		assert.True(t, errors.Is(err, ErrInvalidRequest), "only S256 code challenges are supported")
+	}
+}
+
+func TestAuthorizationCodeFlow(t *testing.T) {
+	conf, _ := config.Initialize("../test/config-test.yml")
+	conf.Providers["mock_provider"] = mockProvider{userId: "mock-id"}
+	core := New(conf, rsaTokenizer(t, conf.PrivateRSAKey), user.PlainUserService{})
+
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	hash := sha256.Sum256([]byte(verifier))
+	id, err := core.Authorize(&AuthorizationRequest{
+		ClientID:            "spa",
+		RedirectURI:         "http://localhost:3001/callback",
+		ResponseType:        "code",
+		Scope:               "openid email",
+		State:               "some-state",
+		Nonce:               "some-nonce",
+		CodeChallenge:       base64.RawURLEncoding.EncodeToString(hash[:]),
+		CodeChallengeMethod: "S256",
+	})
+	assert.Nil(t, err, "err should be nothing")
+
+	token, err := core.GenTokenInfo(context.Background(), "mock_provider", "code", "")
+	assert.Nil(t, err, "err should be nothing")
+	request, code, err := core.IssueAuthorizationCode(id, token)
+	assert.Nil(t, err, "err should be nothing")
+	assert.Equal(t, "some-state", request.State)
+
+	_, _, err = core.IssueAuthorizationCode(id, token)
+	assert.NotNil(t, err, "requests can only be completed once")
+
+	client, err := core.AuthenticateClient("spa", "")
+	assert.Nil(t, err, "err should be nothing")
+	_, err = core.ExchangeCode(client, code, "http://localhost:3001/callback", "wrong-verifier")
+	assert.True(t, errors.Is(err, ErrInvalidGrant))
+
+	_, code, _ = core.IssueAuthorizationCode(mustAuthorize(t, core, verifier, ""), token)
+	other, _ := core.AuthenticateClient("internal-app", "internal-app-secret")
+	_, err = core.ExchangeCode(other, code, "http://localhost:3001/callback", verifier)
+	assert.True(t, errors.Is(err, ErrInvalidGrant), "codes are bound to their client")
+
+	_, code, _ = core.IssueAuthorizationCode(mustAuthorize(t, core, verifier, "some-nonce"), token)
+	authorizationCode, err := core.ExchangeCode(client, code, "http://localhost:3001/callback", verifier)
+	assert.Nil(t, err, "err should be nothing")
+	_, err = core.ExchangeCode(client, code, "http://localhost:3001/callback", verifier)
+	assert.True(t, errors.Is(err, ErrInvalidGrant), "codes can only be used once")
+
+	claims, err := core.IDToken(authorizationCode)
+	assert.Nil(t, err, "err should be nothing")
+	assert.Equal(t, token.User, claims.Subject())
+	assert.Equal(t, "spa", claims.Get("aud"))
+	assert.Equal(t, "some-nonce", claims.Get("nonce"))
+	assert.Equal(t, authorizationCode.AuthTime.Unix(), claims.Get("auth_time"))
+	assert.Equal(t, "mock@example.com", claims.Get("email"))
+	assert.WithinDuration(t, time.Now().Add(idTokenLifetime), claims.Expiration(), time.Second, "id tokens should be short-lived")
+
+	accessClaims, _ := core.Claims(&authorizationCode.Token)
+	accessToken, _ := core.JwtToken(accessClaims)
+	userInfo, err := core.UserInfo(accessToken)
+	assert.Nil(t, err, "err should be nothing")
+	assert.Equal(t, token.User, userInfo.Subject())
+	assert.Equal(t, "mock@example.com", userInfo.Get("email"))
+	assert.False(t, userInfo.Has("jti"))
+}
+
+func TestClientTokensWithoutProviderTokens(t *testing.T) {
+	conf, _ := config.Initialize("../test/config-test.yml")
+	conf.Providers["mock_provider"] = codeProvider{}
+	conf.Claims.IncludeProviderTokens = nil
+	conf.RefreshExpirySeconds = 60
+	core := New(conf, rsaTokenizer(t, conf.PrivateRSAKey), user.PlainUserService{})
+
+	token, err := core.GenTokenInfo(context.Background(), "mock_provider", "someone", "")
+	assert.Nil(t, err, "err should be nothing")
+	claims, _ := core.Claims(token)
+	assert.Equal(t, "someone", claims.Get("access_token"))
+
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	_, code, err := core.IssueAuthorizationCode(mustAuthorize(t, core, verifier, ""), token)
+	assert.Nil(t, err, "err should be nothing")
+	client, _ := core.AuthenticateClient("spa", "")
+	authorizationCode, err := core.ExchangeCode(client, code, "http://localhost:3001/callback", verifier)
+	assert.Nil(t, err, "err should be nothing")
+
+	claims, err = core.Claims(&authorizationCode.Token)
+	assert.Nil(t, err, "err should be nothing")
+	assert.Equal(t, "spa", claims.Get("client_id"))
+	for _, name := range []string{"access_token", "token_type", "refresh_token"} {
+		assert.False(t, claims.Has(name), "clients must not get the provider's tokens")
+	}
+
+	refreshToken, err := core.IssueRefreshToken(&authorizationCode.Token)
+	assert.Nil(t, err, "err should be nothing")
+	session, err := core.RefreshStore.Use(hashToken(refreshToken))
+	assert.Nil(t, err, "err should be nothing")
+	assert.Equal(t, "spa", session.Client, "refreshed tokens should stay bound to the client")
+}
+
+func mustAuthorize(t *testing.T, core *Core, verifier string, nonce string) string {
+	hash := sha256.Sum256([]byte(verifier))
+	id, err := core.Authorize(&AuthorizationRequest{
+		ClientID:            "spa",
+		RedirectURI:         "http://localhost:3001/callback",
+		ResponseType:        "code",
+		Scope:               "openid",
+		Nonce:               nonce,
+		CodeChallenge:       base64.RawURLEncoding.EncodeToString(hash[:]),
+		CodeChallengeMethod: "S256",
+	})
+	assert.Nil(t, err, "err should be nothing")
+	return id
+}
+
+func TestAuthenticateClient(t *testing.T) {
+	conf, _ := config.Initialize("../test/config-test.yml")
+	core := New(conf, rsaTokenizer(t, conf.PrivateRSAKey), user.PlainUserService{})
+
+	_, err := core.AuthenticateClient("internal-app", "internal-app-secret")
+	assert.Nil(t, err, "err should be nothing")
+	_, err = core.AuthenticateClient("internal-app", "wrong")
+	assert.True(t, errors.Is(err, ErrInvalidClient))
+	_, err = core.AuthenticateClient("unknown", "")
+	assert.True(t, errors.Is(err, ErrInvalidClient))
+}
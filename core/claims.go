@@ -0,0 +1,106 @@
+package core
+
+import (
+	"time"
+)
+
+// Claims is the set of claims of a JWT issued by jwt-proxy. The registered
+// claims are set via the typed setters, all custom claims via Set.
+type Claims map[string]interface{}
+
+// Set sets the claim with the given name to val.
+func (c Claims) Set(name string, val interface{}) {
+	c[name] = val
+}
+
+// Get returns the claim with the given name or nil if it is not set.
+func (c Claims) Get(name string) interface{} {
+	return c[name]
+}
+
+// Del removes the claim with the given name.
+func (c Claims) Del(name string) {
+	delete(c, name)
+}
+
+// Has returns true if the claim with the given name is set.
+func (c Claims) Has(name string) bool {
+	_, ok := c[name]
+	return ok
+}
+
+// SetIssuer sets the "iss" claim.
+func (c Claims) SetIssuer(issuer string) {
+	c.Set("iss", issuer)
+}
+
+// SetSubject sets the "sub" claim.
+func (c Claims) SetSubject(subject string) {
+	c.Set("sub", subject)
+}
+
+// SetAudience sets the "aud" claim.
+func (c Claims) SetAudience(audience ...string) {
+	if len(audience) == 1 {
+		c.Set("aud", audience[0])
+		return
+	}
+	c.Set("aud", audience)
+}
+
+// SetID sets the "jti" claim.
+func (c Claims) SetID(id string) {
+	c.Set("jti", id)
+}
+
+// SetExpiration sets the "exp" claim.
+func (c Claims) SetExpiration(expiration time.Time) {
+	c.Set("exp", expiration.Unix())
+}
+
+// SetIssuedAt sets the "iat" claim.
+func (c Claims) SetIssuedAt(issuedAt time.Time) {
+	c.Set("iat", issuedAt.Unix())
+}
+
+// Issuer returns the "iss" claim.
+func (c Claims) Issuer() string {
+	return c.string("iss")
+}
+
+// Subject returns the "sub" claim.
+func (c Claims) Subject() string {
+	return c.string("sub")
+}
+
+// ID returns the "jti" claim.
+func (c Claims) ID() string {
+	return c.string("jti")
+}
+
+// Expiration returns the "exp" claim or the zero time if it is not set.
+func (c Claims) Expiration() time.Time {
+	return c.time("exp")
+}
+
+// IssuedAt returns the "iat" claim or the zero time if it is not set.
+func (c Claims) IssuedAt() time.Time {
+	return c.time("iat")
+}
+
+func (c Claims) string(name string) string {
+	s, _ := c[name].(string)
+	return s
+}
+
+func (c Claims) time(name string) time.Time {
+	switch v := c[name].(type) {
+	case int64:
+		return time.Unix(v, 0)
+	case int:
+		return time.Unix(int64(v), 0)
+	case float64:
+		return time.Unix(int64(v), 0)
+	}
+	return time.Time{}
+}
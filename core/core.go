@@ -1,30 +1,34 @@
 package core
 
 import (
+	"context"
+	"crypto/sha256"
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"time"
 
-	"github.com/SermoDigital/jose/crypto"
-	"github.com/SermoDigital/jose/jws"
+	jose "github.com/go-jose/go-jose/v3"
 	"github.com/krinklesaurus/jwt-proxy/config"
 	"github.com/krinklesaurus/jwt-proxy/log"
 	"github.com/krinklesaurus/jwt-proxy/provider"
 	"github.com/krinklesaurus/jwt-proxy/user"
+	"github.com/krinklesaurus/jwt-proxy/util"
 	"golang.org/x/oauth2"
 )
 
-var SigningMethods = map[string]crypto.SigningMethod{
-	"RS256": crypto.SigningMethodRS256,
-	"RS384": crypto.SigningMethodRS384,
-	"RS512": crypto.SigningMethodRS512,
-	"HS256": crypto.SigningMethodHS256,
-	"HS384": crypto.SigningMethodHS384,
-	"HS512": crypto.SigningMethodHS512,
-	"ES256": crypto.SigningMethodES256,
-	"ES384": crypto.SigningMethodES384,
-	"ES512": crypto.SigningMethodES512,
+var SigningMethods = map[string]jose.SignatureAlgorithm{
+	"RS256": jose.RS256,
+	"RS384": jose.RS384,
+	"RS512": jose.RS512,
+	"HS256": jose.HS256,
+	"HS384": jose.HS384,
+	"HS512": jose.HS512,
+	"ES256": jose.ES256,
+	"ES384": jose.ES384,
+	"ES512": jose.ES512,
+	"EdDSA": jose.EdDSA,
 }
 
 // CoreAuth is the central interface of jwt-proxy. It provides all function necessary
@@ -32,60 +36,140 @@ var SigningMethods = map[string]crypto.SigningMethod{
 // token with some custom parameters and return the JWT token to the callback URI.
 type CoreAuth interface {
 	PublicKeys() ([]string, error)
-	GenTokenInfo(provider string, code string) (*TokenInfo, error)
-	Claims(token *TokenInfo) (jws.Claims, error)
-	JwtToken(jws.Claims) ([]byte, error)
+	JWKS() (*jose.JSONWebKeySet, error)
+	GenTokenInfo(ctx context.Context, provider string, code string, codeVerifier string) (*TokenInfo, error)
+	ProfileTokenInfo(provider string, profile *provider.Profile) (*TokenInfo, error)
+	Claims(token *TokenInfo) (Claims, error)
+	JwtToken(Claims) ([]byte, error)
+	SignedToken(Claims) ([]byte, error)
+	VerifyToken(token []byte) (Claims, error)
+	RotateKeys() error
+	IssueRefreshToken(token *TokenInfo) (string, error)
+	Refresh(ctx context.Context, refreshToken string) (*TokenInfo, string, error)
+	RevokeToken(token []byte) error
+	RevokeID(jti string) error
+	RevokeUser(user string) error
+	RevokeProvider(provider string) error
 	RedirectURI() string
-	AuthURL(provider string, state string) (string, error)
-	Providers() []string
+	LocalEnabled() bool
+	LocalLogin(username string, password string, client string) (*TokenInfo, error)
+	CodeVerifier(provider string) (string, error)
+	AuthURL(provider string, state string, codeVerifier string, nonce string) (string, error)
+	Providers() []config.ProviderInfo
+	Authorize(request *AuthorizationRequest) (string, error)
+	IssueAuthorizationCode(requestID string, token *TokenInfo) (*AuthorizationRequest, string, error)
+	AuthenticateClient(clientID string, secret string) (*config.Client, error)
+	ExchangeCode(client *config.Client, code string, redirectURI string, codeVerifier string) (*AuthorizationCode, error)
+	IDToken(code *AuthorizationCode) (Claims, error)
+	UserInfo(accessToken []byte) (Claims, error)
+	AuthorizeDevice(clientID string, scope string) (*DeviceAuthorization, string, error)
+	DeviceByUserCode(userCode string, client string) (*DeviceAuthorization, error)
+	ApproveDevice(userCode string, token *TokenInfo) error
+	DenyDevice(userCode string) error
+	PollDevice(clientID string, deviceCode string) (*DeviceAuthorization, error)
+	AuthenticateServiceAccount(id string, secret string) (*config.ServiceAccount, error)
+	ServiceAccountClaims(account *config.ServiceAccount, audiences []string) (Claims, error)
+	ExchangeToken(ctx context.Context, provider string, accessToken string) (*TokenInfo, error)
+	AuthenticateResource(id string, secret string) error
+	Introspect(token []byte) Claims
 }
 
-// TokenInfo wraps oauth.Token and adds two additional fields:
+// TokenInfo wraps oauth.Token and adds four additional fields:
 // Provider is the OAuth provider, e.g. github or facebook
-// UserInfo is the map of user info claims from the provider
+// User is the unique user id
+// Profile is the user's profile at the provider
+// Client is the registered client the login is for, if any
 type TokenInfo struct {
 	oauth2.Token
 	Provider provider.Provider
 	User     string
+	Profile  *provider.Profile
+	Client   string
+}
+
+// Refreshable returns true if the login has a provider token, which refresh
+// tokens renew. Logins like those of SAML or local accounts have none.
+func (t *TokenInfo) Refreshable() bool {
+	return t.AccessToken != ""
+}
+
+// profileField returns the profile field with the given name, or nil if the
+// token has no profile.
+func (t *TokenInfo) profileField(name string) interface{} {
+	if t.Profile == nil {
+		return nil
+	}
+	return t.Profile.Field(name)
 }
 
 func New(config *config.Config, tokenizer Tokenizer, userService user.UserService) *Core {
-	tokenStore := map[string]*TokenInfo{}
-	return &Core{Config: config, userService: userService, tokenStore: tokenStore, Tokenizer: tokenizer}
+	return &Core{Config: config, userService: userService, Tokenizer: tokenizer,
+		RefreshStore: NewMemoryRefreshStore(), Denylist: NewMemoryDenylist(),
+		AuthorizationStore: NewMemoryAuthorizationStore(), DeviceStore: NewMemoryDeviceStore(),
+		UserCodeThrottle: NewThrottle(userCodeMaxFailures, userCodeLockout), LoginThrottle: NewThrottle(loginMaxFailures, loginLockout),
+		LoginAddressThrottle: NewThrottle(loginAddressMaxFailures, loginLockout)}
 }
 
 type Core struct {
-	Config      *config.Config
-	userService user.UserService
-	tokenStore  map[string]*TokenInfo
-	Tokenizer   Tokenizer
+	Config             *config.Config
+	userService        user.UserService
+	Tokenizer          Tokenizer
+	RefreshStore       RefreshStore
+	Denylist           Denylist
+	AuthorizationStore AuthorizationStore
+	DeviceStore        DeviceStore
+	UserCodeThrottle   *Throttle
+	// LoginThrottle and LoginAddressThrottle count the wrong passwords of
+	// local logins per username and per client address.
+	LoginThrottle        *Throttle
+	LoginAddressThrottle *Throttle
 }
 
 func (c *Core) PublicKeys() ([]string, error) {
-	publicKey := c.Config.PrivateRSAKey.PublicKey
-	publicKeyDer, err := x509.MarshalPKIXPublicKey(&publicKey)
+	jwks, err := c.Tokenizer.PublicKeys()
 	if err != nil {
 		return nil, err
 	}
 
-	publicKeyBlock := pem.Block{
-		Type:    "PUBLIC KEY",
-		Headers: nil,
-		Bytes:   publicKeyDer,
-	}
-	publicKeyPem := string(pem.EncodeToMemory(&publicKeyBlock))
+	keys := []string{}
+	for _, jwk := range jwks {
+		publicKeyDer, err := x509.MarshalPKIXPublicKey(jwk.Key)
+		if err != nil {
+			return nil, err
+		}
 
-	keys := []string{
-		publicKeyPem,
+		publicKeyBlock := pem.Block{
+			Type:    "PUBLIC KEY",
+			Headers: nil,
+			Bytes:   publicKeyDer,
+		}
+		keys = append(keys, string(pem.EncodeToMemory(&publicKeyBlock)))
 	}
 
 	return keys, nil
 }
 
-func (c *Core) GenTokenInfo(providerID string, code string) (*TokenInfo, error) {
+// JWKS returns the public keys of the tokenizer as RFC 7517 JSON Web Key Set.
+func (c *Core) JWKS() (*jose.JSONWebKeySet, error) {
+	keys, err := c.Tokenizer.PublicKeys()
+	if err != nil {
+		return nil, err
+	}
+	return &jose.JSONWebKeySet{Keys: keys}, nil
+}
+
+// GenTokenInfo exchanges the code with the provider and looks up the user it
+// belongs to. All state of the login is kept in the returned token info, so
+// concurrent callbacks of the same provider don't interfere. codeVerifier is
+// the PKCE verifier of the login, if any.
+func (c *Core) GenTokenInfo(ctx context.Context, providerID string, code string, codeVerifier string) (*TokenInfo, error) {
+	var opts []oauth2.AuthCodeOption
+	if codeVerifier != "" {
+		opts = append(opts, provider.VerifierOption(codeVerifier))
+	}
 	provider := c.Config.Providers[providerID]
 	log.Debugf("getting access token from %s with code %s", provider.Name(), code)
-	providerToken, err := provider.Exchange(oauth2.NoContext, code)
+	providerToken, err := provider.Exchange(ctx, code, opts...)
 
 	if err != nil {
 		return nil, err
@@ -93,46 +177,85 @@ func (c *Core) GenTokenInfo(providerID string, code string) (*TokenInfo, error)
 
 	log.Debugf("received provider token %+v", providerToken)
 
-	userID, err := provider.User()
+	profile, err := provider.User(ctx, providerToken)
 	if err != nil {
 		return nil, err
 	}
-	user, err := c.userService.UniqueUser(providerID, userID)
+	user, err := c.userService.UniqueUser(providerID, profile.ID)
 	if err != nil {
 		return nil, err
 	}
 
-	token := &TokenInfo{Token: *providerToken, User: user, Provider: provider}
+	token := &TokenInfo{Token: *providerToken, User: user, Provider: provider, Profile: profile}
 	return token, nil
 }
 
-func (c *Core) Claims(token *TokenInfo) (jws.Claims, error) {
+// ProfileTokenInfo looks up the user of a profile that the provider asserted
+// without an OAuth2 token, e.g. in a SAML response. The token info has no
+// provider token.
+func (c *Core) ProfileTokenInfo(providerID string, profile *provider.Profile) (*TokenInfo, error) {
+	provider := c.Config.Providers[providerID]
+	if provider == nil {
+		return nil, fmt.Errorf("provider %s not found", providerID)
+	}
+	user, err := c.userService.UniqueUser(providerID, profile.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &TokenInfo{User: user, Provider: provider, Profile: profile}, nil
+}
+
+func (c *Core) Claims(token *TokenInfo) (Claims, error) {
 	log.Debugf("received token %s from provider %s", token.AccessToken, token.Provider.Name())
 	// see https://openid.net/specs/openid-connect-core-1_0.html#IDToken
 
-	claims := jws.Claims{}
+	claimsConfig := c.Config.Claims.ForProvider(token.Provider.Name())
+
+	claims := Claims{}
 	claims.SetIssuer(c.Config.RootURI)
 	claims.SetSubject(c.Config.Subject)
-	claims.SetAudience(token.Provider.ClientID())
+	claims.SetAudience(claimsConfig.Audience)
 
+	jti, err := util.SecureRandomString(16)
+	if err != nil {
+		return nil, err
+	}
+	claims.SetID(jti)
+
+	// tokens never live longer than jwt.expirySeconds, so that denylist
+	// entries can expire after that time.
 	now := time.Now()
+	maxExpiry := now.Add(c.maxTokenLifetime())
 	expiry := token.Expiry
-	if aft := expiry.After(now); !aft {
-		expiry = now.Add(time.Duration(c.Config.ExpirySeconds) * time.Second)
+	if aft := expiry.After(now); !aft || expiry.After(maxExpiry) {
+		expiry = maxExpiry
 	}
 	claims.SetExpiration(expiry)
-	claims.SetIssuedAt(time.Now())
+	claims.SetIssuedAt(now)
 
 	claims.Set("provider", token.Provider.Name())
 	claims.Set("user", token.User)
-	claims.Set("access_token", token.AccessToken)
-	claims.Set("token_type", token.TokenType)
-	claims.Set("refresh_token", token.RefreshToken)
+	// the provider's tokens are the user's, registered clients never get them
+	if token.Client != "" {
+		claims.Set("client_id", token.Client)
+	} else if claimsConfig.ProviderTokens() && token.AccessToken != "" {
+		claims.Set("access_token", token.AccessToken)
+		claims.Set("token_type", token.TokenType)
+		claims.Set("refresh_token", token.RefreshToken)
+	}
+
+	for _, mapping := range claimsConfig.Mapping {
+		value := token.profileField(mapping.Field)
+		if value == nil || value == "" {
+			continue
+		}
+		claims.Set(mapping.Claim, value)
+	}
 
 	return claims, nil
 }
 
-func (c *Core) JwtToken(claims jws.Claims) ([]byte, error) {
+func (c *Core) JwtToken(claims Claims) ([]byte, error) {
 	b, err := c.Tokenizer.Serialize(claims)
 
 	if err != nil {
@@ -141,27 +264,246 @@ func (c *Core) JwtToken(claims jws.Claims) ([]byte, error) {
 	return b, nil
 }
 
+// SignedToken signs the claims without encrypting them, even if issued tokens
+// are encrypted. It is used for ID tokens, whose audience is the client and
+// not one of the recipients of encrypted tokens.
+func (c *Core) SignedToken(claims Claims) ([]byte, error) {
+	return SigningTokenizer(c.Tokenizer).Serialize(claims)
+}
+
+// VerifyToken checks that the token was issued by this jwt-proxy, i.e. that its
+// signature is valid and it is not expired, and returns its claims.
+func (c *Core) VerifyToken(token []byte) (Claims, error) {
+	claims, err := c.Tokenizer.Verify(token)
+	if err != nil {
+		return nil, err
+	}
+	revoked, err := c.Denylist.Revoked(claims)
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return nil, ErrTokenRevoked
+	}
+	return claims, nil
+}
+
+// RevokeToken revokes the given token, which must be valid, until it expires.
+func (c *Core) RevokeToken(token []byte) error {
+	claims, err := c.VerifyToken(token)
+	if err != nil {
+		return err
+	}
+	if claims.ID() == "" {
+		return fmt.Errorf("token has no jti")
+	}
+	return c.Denylist.RevokeID(claims.ID(), claims.Expiration())
+}
+
+// RevokeID revokes the token with the given jti.
+func (c *Core) RevokeID(jti string) error {
+	return c.Denylist.RevokeID(jti, time.Now().Add(c.maxTokenLifetime()))
+}
+
+// RevokeUser revokes all tokens and refresh tokens issued to the user so far.
+func (c *Core) RevokeUser(user string) error {
+	now := time.Now()
+	if err := c.RefreshStore.RevokeUser(user); err != nil {
+		return err
+	}
+	return c.Denylist.RevokeUser(user, now, now.Add(c.maxTokenLifetime()))
+}
+
+// RevokeProvider revokes all tokens and refresh tokens issued for logins with
+// the provider so far.
+func (c *Core) RevokeProvider(provider string) error {
+	now := time.Now()
+	if err := c.RefreshStore.RevokeProvider(provider); err != nil {
+		return err
+	}
+	return c.Denylist.RevokeProvider(provider, now, now.Add(c.maxTokenLifetime()))
+}
+
+func (c *Core) maxTokenLifetime() time.Duration {
+	return time.Duration(c.Config.ExpirySeconds) * time.Second
+}
+
+// RotateKeys rotates the signing key if the tokenizer supports rotation.
+func (c *Core) RotateKeys() error {
+	rotator, ok := c.Tokenizer.(Rotator)
+	if !ok {
+		return fmt.Errorf("tokenizer does not support key rotation")
+	}
+	return rotator.Rotate()
+}
+
+// IssueRefreshToken creates a one-time refresh token for the token info,
+// starting a new family of refresh tokens.
+func (c *Core) IssueRefreshToken(token *TokenInfo) (string, error) {
+	family, err := util.SecureRandomString(16)
+	if err != nil {
+		return "", err
+	}
+	return c.issueRefreshToken(token, family)
+}
+
+func (c *Core) issueRefreshToken(token *TokenInfo, family string) (string, error) {
+	refreshToken, err := util.SecureRandomString(32)
+	if err != nil {
+		return "", err
+	}
+	session := &RefreshSession{
+		ID:         hashToken(refreshToken),
+		Family:     family,
+		ProviderID: token.Provider.Name(),
+		User:       token.User,
+		Client:     token.Client,
+		Token:      token.Token,
+		ExpiresAt:  time.Now().Add(time.Duration(c.Config.RefreshExpirySeconds) * time.Second),
+	}
+	if err := c.RefreshStore.Save(session); err != nil {
+		return "", err
+	}
+	return refreshToken, nil
+}
+
+// Refresh redeems the refresh token. It refreshes the provider's token,
+// confirms with the provider that the user still exists and returns the new
+// token info along with the refresh token replacing the redeemed one.
+func (c *Core) Refresh(ctx context.Context, refreshToken string) (*TokenInfo, string, error) {
+	session, err := c.RefreshStore.Use(hashToken(refreshToken))
+	if err == ErrRefreshTokenReused {
+		log.Warnf("refresh token was reused, revoked all refresh tokens of its family")
+		return nil, "", err
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	provider := c.Config.Providers[session.ProviderID]
+	if provider == nil {
+		return nil, "", fmt.Errorf("provider %s not found", session.ProviderID)
+	}
+
+	// the refresh token stays valid if the provider fails, so that the
+	// client's retry is not mistaken for reuse
+	providerToken, err := provider.Refresh(ctx, &session.Token)
+	if err != nil {
+		return nil, "", c.releaseRefreshToken(session, err)
+	}
+	profile, err := provider.User(ctx, providerToken)
+	if err != nil {
+		session.Token = *providerToken
+		return nil, "", c.releaseRefreshToken(session, err)
+	}
+	user, err := c.userService.UniqueUser(session.ProviderID, profile.ID)
+	if err != nil {
+		return nil, "", err
+	}
+	if user != session.User {
+		c.RefreshStore.RevokeFamily(session.Family)
+		return nil, "", fmt.Errorf("provider %s returned user %s instead of %s", session.ProviderID, user, session.User)
+	}
+
+	token := &TokenInfo{Token: *providerToken, User: user, Provider: provider, Profile: profile, Client: session.Client}
+	newRefreshToken, err := c.issueRefreshToken(token, session.Family)
+	if err != nil {
+		return nil, "", err
+	}
+	return token, newRefreshToken, nil
+}
+
+// releaseRefreshToken undoes the use of the session after the refresh failed
+// with err, which is returned.
+func (c *Core) releaseRefreshToken(session *RefreshSession, err error) error {
+	if releaseErr := c.RefreshStore.Release(session); releaseErr != nil {
+		log.Warnf("could not release refresh token after failed refresh: %v", releaseErr)
+	}
+	return err
+}
+
+// hashToken returns the hash under which a refresh token or authorization code
+// is stored.
+func hashToken(token string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(token)))
+}
+
 func (c *Core) RedirectURI() string {
 	return c.Config.RedirectURI
 }
 
+// LocalEnabled returns true if local accounts are configured.
 func (c *Core) LocalEnabled() bool {
-	return false
+	_, ok := c.Config.Providers[provider.LocalID].(*provider.LocalProvider)
+	return ok
 }
 
-func (c *Core) Providers() []string {
-	keys := []string{}
-	for key := range c.Config.Providers {
-		keys = append(keys, key)
+const (
+	// Local logins get ErrTooManyAttempts for loginLockout after
+	// loginMaxFailures wrong passwords for a username or
+	// loginAddressMaxFailures wrong passwords from a client address.
+	loginMaxFailures        = 5
+	loginAddressMaxFailures = 20
+	loginLockout            = 15 * time.Minute
+)
+
+// LocalLogin checks the password of the local account and looks up its user.
+// client is the address the login comes from, guessing passwords is
+// throttled per username and per client.
+func (c *Core) LocalLogin(username string, password string, client string) (*TokenInfo, error) {
+	local, ok := c.Config.Providers[provider.LocalID].(*provider.LocalProvider)
+	if !ok {
+		return nil, fmt.Errorf("local accounts are not configured")
+	}
+	if err := c.LoginThrottle.Allowed(username); err != nil {
+		return nil, err
+	}
+	if err := c.LoginAddressThrottle.Allowed(client); err != nil {
+		return nil, err
 	}
-	return keys
+	profile, err := local.Login(username, password)
+	if errors.Is(err, user.ErrInvalidCredentials) {
+		c.LoginThrottle.Fail(username)
+		c.LoginAddressThrottle.Fail(client)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.LoginThrottle.Reset(username)
+	return c.ProfileTokenInfo(provider.LocalID, profile)
 }
 
-func (c *Core) AuthURL(providerID string, state string) (string, error) {
-	provider := c.Config.Providers[providerID]
-	if provider == nil {
+// Providers returns the provider instances in configured order.
+func (c *Core) Providers() []config.ProviderInfo {
+	return c.Config.ProviderInfos
+}
+
+// CodeVerifier returns a fresh PKCE verifier for a login with the provider,
+// or the empty string if PKCE is disabled for the provider.
+func (c *Core) CodeVerifier(providerID string) (string, error) {
+	if !c.Config.PKCE[providerID] {
+		return "", nil
+	}
+	return provider.GenerateVerifier()
+}
+
+// AuthURL returns the provider's login URL. nonce is the nonce of the login's
+// id_token, which is only checked by OpenID Connect providers.
+func (c *Core) AuthURL(providerID string, state string, codeVerifier string, nonce string) (string, error) {
+	var opts []oauth2.AuthCodeOption
+	if codeVerifier != "" {
+		opts = provider.S256ChallengeOptions(codeVerifier)
+	}
+	if nonce != "" {
+		opts = append(opts, provider.NonceOption(nonce))
+	}
+	p := c.Config.Providers[providerID]
+	if p == nil {
 		return "", fmt.Errorf("provider %s not found", providerID)
 	}
-	url := provider.AuthCodeURL(state)
+	url := p.AuthCodeURL(state, opts...)
+	if url == "" {
+		return "", fmt.Errorf("provider %s has no login url", providerID)
+	}
 	return url, nil
 }
@@ -2,12 +2,19 @@ package core
 
 import (
 	"context"
+	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
+	"fmt"
+	"sync"
 	"testing"
+	"time"
 
-	"github.com/SermoDigital/jose/crypto"
+	jose "github.com/go-jose/go-jose/v3"
+	"github.com/go-jose/go-jose/v3/jwt"
 	"github.com/krinklesaurus/jwt-proxy/config"
+	"github.com/krinklesaurus/jwt-proxy/provider"
 	"github.com/krinklesaurus/jwt-proxy/user"
 	uuid "github.com/satori/go.uuid"
 	"github.com/stretchr/testify/assert"
@@ -18,18 +25,27 @@ type mockProvider struct {
 	userId string
 }
 
-func (m mockProvider) AuthCodeURL(state string) string {
+func (m mockProvider) AuthCodeURL(state string, opts ...oauth2.AuthCodeOption) string {
 	return ""
 }
 
-func (m mockProvider) User() (string, error) {
-	return m.userId, nil
+func (m mockProvider) User(ctx context.Context, token *oauth2.Token) (*provider.Profile, error) {
+	return &provider.Profile{
+		ID:    m.userId,
+		Email: "mock@example.com",
+		Name:  "Mock User",
+		Raw:   map[string]interface{}{},
+	}, nil
 }
 
-func (m mockProvider) Exchange(ctx context.Context, code string) (*oauth2.Token, error) {
+func (m mockProvider) Exchange(ctx context.Context, code string, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
 	return &oauth2.Token{}, nil
 }
 
+func (m mockProvider) Refresh(ctx context.Context, token *oauth2.Token) (*oauth2.Token, error) {
+	return &oauth2.Token{AccessToken: "refreshed"}, nil
+}
+
 func (m mockProvider) String() string {
 	return m.Name()
 }
@@ -42,13 +58,37 @@ func (m mockProvider) ClientID() string {
 	return "mock_clientid"
 }
 
+// codeProvider issues tokens for the user whose id is the code, like a
+// provider that is called back for many users at once.
+type codeProvider struct {
+	mockProvider
+}
+
+func (m codeProvider) Exchange(ctx context.Context, code string, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
+	return &oauth2.Token{AccessToken: code}, nil
+}
+
+func (m codeProvider) User(ctx context.Context, token *oauth2.Token) (*provider.Profile, error) {
+	return &provider.Profile{ID: token.AccessToken, Email: token.AccessToken + "@example.com"}, nil
+}
+
 type mockUserservice struct {
 }
 
+// rsaTokenizer creates a tokenizer that signs with the RSA key.
+func rsaTokenizer(t *testing.T, privKey *rsa.PrivateKey) Tokenizer {
+	tokenizer, err := NewRSATokenizer(jose.RS256, privKey)
+	if !assert.Nil(t, err, "err should be nothing") {
+		t.FailNow()
+	}
+	return tokenizer
+}
+
 func TestPublicKey(t *testing.T) {
 	conf, _ := config.Initialize("../test/config-test.yml")
-	core := New(conf, nil, nil)
+	core := New(conf, rsaTokenizer(t, conf.PrivateRSAKey), nil)
 	publicKeys, _ := core.PublicKeys()
+	assert.NotEmpty(t, publicKeys)
 
 	for _, value := range publicKeys {
 		block, _ := pem.Decode([]byte(value))
@@ -64,8 +104,8 @@ func TestJwtToken(t *testing.T) {
 	userID := uuid.NewV4().String()
 	conf.Providers["mock_provider"] = mockProvider{userId: userID}
 
-	core := New(conf, NewRSATokenizer(crypto.SigningMethodRS256, conf.PrivateRSAKey), user.PlainUserService{})
-	token, err := core.GenTokenInfo("mock_provider", "code")
+	core := New(conf, rsaTokenizer(t, conf.PrivateRSAKey), user.PlainUserService{})
+	token, err := core.GenTokenInfo(context.Background(), "mock_provider", "code", "")
 	assert.Nil(t, err, "err should be nothing")
 
 	claims, _ := core.Claims(token)
@@ -76,3 +116,299 @@ func TestJwtToken(t *testing.T) {
 
 	assert.NotEmpty(t, data)
 }
+
+func TestGenTokenInfoParallel(t *testing.T) {
+	conf, _ := config.Initialize("../test/config-test.yml")
+	conf.Providers["mock_provider"] = codeProvider{}
+	core := New(conf, rsaTokenizer(t, conf.PrivateRSAKey), user.PlainUserService{})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(code string) {
+			defer wg.Done()
+			token, err := core.GenTokenInfo(context.Background(), "mock_provider", code, "")
+			if !assert.Nil(t, err, "err should be nothing") {
+				return
+			}
+			assert.Equal(t, "mock_provider:"+code, token.User)
+			assert.Equal(t, code+"@example.com", token.Profile.Email)
+		}(uuid.NewV4().String())
+	}
+	wg.Wait()
+}
+
+func TestProfileTokenInfo(t *testing.T) {
+	conf, _ := config.Initialize("../test/config-test.yml")
+	conf.Providers["mock_provider"] = mockProvider{}
+	core := New(conf, rsaTokenizer(t, conf.PrivateRSAKey), user.PlainUserService{})
+
+	token, err := core.ProfileTokenInfo("mock_provider", &provider.Profile{ID: "user-1234", Email: "someone@example.com"})
+	assert.Nil(t, err, "err should be nothing")
+	assert.Equal(t, "mock_provider:user-1234", token.User)
+
+	claims, err := core.Claims(token)
+	assert.Nil(t, err, "err should be nothing")
+	assert.Equal(t, "mock_provider", claims.Get("provider"))
+	assert.Nil(t, claims.Get("access_token"), "there is no provider token")
+
+	_, err = core.ProfileTokenInfo("unknown", &provider.Profile{ID: "user-1234"})
+	assert.NotNil(t, err, "unknown providers should be rejected")
+}
+
+func TestLocalLogin(t *testing.T) {
+	conf, _ := config.Initialize("../test/config-test.yml")
+	core := New(conf, rsaTokenizer(t, conf.PrivateRSAKey), user.PlainUserService{})
+	assert.False(t, core.LocalEnabled())
+
+	conf.Providers["local"] = provider.NewLocal(conf.RootURI, user.Credentials{
+		"tester": "$2a$10$JoBayCdMhH2.qobbaYsLuuPWYQK7xKxvF1moWt/W7Wruw6fIdkpQ6",
+	})
+	assert.True(t, core.LocalEnabled())
+
+	token, err := core.LocalLogin("tester", "tester", "192.0.2.1")
+	assert.Nil(t, err, "err should be nothing")
+	assert.Equal(t, "local:tester", token.User)
+	assert.False(t, token.Refreshable(), "local logins have no provider token")
+
+	claims, err := core.Claims(token)
+	assert.Nil(t, err, "err should be nothing")
+	assert.Equal(t, "local", claims.Get("provider"))
+
+	_, err = core.LocalLogin("tester", "wrong", "192.0.2.1")
+	assert.Equal(t, user.ErrInvalidCredentials, err)
+}
+
+func TestLocalLoginThrottle(t *testing.T) {
+	conf, _ := config.Initialize("../test/config-test.yml")
+	conf.Providers["local"] = provider.NewLocal(conf.RootURI, user.Credentials{
+		"tester": "$2a$10$JoBayCdMhH2.qobbaYsLuuPWYQK7xKxvF1moWt/W7Wruw6fIdkpQ6",
+	})
+	core := New(conf, rsaTokenizer(t, conf.PrivateRSAKey), user.PlainUserService{})
+
+	for i := 0; i < loginMaxFailures; i++ {
+		_, err := core.LocalLogin("tester", "wrong", "192.0.2.1")
+		assert.Equal(t, user.ErrInvalidCredentials, err)
+	}
+	_, err := core.LocalLogin("tester", "tester", "192.0.2.2")
+	assert.Equal(t, ErrTooManyAttempts, err, "the username should be locked out from every address")
+
+	for i := loginMaxFailures; i < loginAddressMaxFailures; i++ {
+		_, err := core.LocalLogin(fmt.Sprintf("guess-%d", i), "wrong", "192.0.2.1")
+		assert.Equal(t, user.ErrInvalidCredentials, err)
+	}
+	_, err = core.LocalLogin("other", "wrong", "192.0.2.1")
+	assert.Equal(t, ErrTooManyAttempts, err, "the address should be locked out for every username")
+}
+
+func TestJWKS(t *testing.T) {
+	conf, _ := config.Initialize("../test/config-test.yml")
+	core := New(conf, rsaTokenizer(t, conf.PrivateRSAKey), user.PlainUserService{})
+
+	jwks, err := core.JWKS()
+	assert.Nil(t, err, "err should be nothing")
+	assert.Len(t, jwks.Keys, 1)
+
+	key := jwks.Keys[0]
+	assert.NotEmpty(t, key.KeyID)
+	assert.Equal(t, "RS256", key.Algorithm)
+	assert.Equal(t, "sig", key.Use)
+	assert.True(t, key.IsPublic())
+
+	data, err := core.JwtToken(Claims{"user": "someone"})
+	assert.Nil(t, err, "err should be nothing")
+
+	parsed, err := jwt.ParseSigned(string(data))
+	assert.Nil(t, err, "err should be nothing")
+	assert.Equal(t, key.KeyID, parsed.Headers[0].KeyID)
+
+	claims, err := core.VerifyToken(data)
+	assert.Nil(t, err, "err should be nothing")
+	assert.Equal(t, "someone", claims.Get("user"))
+}
+
+func TestRefresh(t *testing.T) {
+	conf, _ := config.Initialize("../test/config-test.yml")
+	conf.RefreshExpirySeconds = 3600
+	conf.Providers["mock_provider"] = mockProvider{userId: uuid.NewV4().String()}
+
+	core := New(conf, rsaTokenizer(t, conf.PrivateRSAKey), user.PlainUserService{})
+	token, err := core.GenTokenInfo(context.Background(), "mock_provider", "code", "")
+	assert.Nil(t, err, "err should be nothing")
+
+	refreshToken, err := core.IssueRefreshToken(token)
+	assert.Nil(t, err, "err should be nothing")
+
+	refreshed, secondRefreshToken, err := core.Refresh(context.Background(), refreshToken)
+	assert.Nil(t, err, "err should be nothing")
+	assert.Equal(t, token.User, refreshed.User)
+	assert.Equal(t, "refreshed", refreshed.AccessToken)
+	assert.NotEqual(t, refreshToken, secondRefreshToken)
+
+	_, _, err = core.Refresh(context.Background(), refreshToken)
+	assert.Equal(t, ErrRefreshTokenReused, err)
+
+	_, _, err = core.Refresh(context.Background(), secondRefreshToken)
+	assert.Equal(t, ErrRefreshTokenInvalid, err, "reuse should revoke the whole family")
+
+	_, _, err = core.Refresh(context.Background(), "unknown")
+	assert.Equal(t, ErrRefreshTokenInvalid, err)
+}
+
+// flakyProvider fails to refresh the first time, like a provider that is down
+// for a moment.
+type flakyProvider struct {
+	mockProvider
+	failures *int
+}
+
+func (m flakyProvider) Refresh(ctx context.Context, token *oauth2.Token) (*oauth2.Token, error) {
+	if *m.failures > 0 {
+		*m.failures--
+		return nil, errors.New("provider unavailable")
+	}
+	return m.mockProvider.Refresh(ctx, token)
+}
+
+func TestRefreshRetryAfterProviderFailure(t *testing.T) {
+	conf, _ := config.Initialize("../test/config-test.yml")
+	conf.RefreshExpirySeconds = 3600
+	failures := 1
+	conf.Providers["mock_provider"] = flakyProvider{mockProvider{userId: uuid.NewV4().String()}, &failures}
+
+	core := New(conf, rsaTokenizer(t, conf.PrivateRSAKey), user.PlainUserService{})
+	token, err := core.GenTokenInfo(context.Background(), "mock_provider", "code", "")
+	assert.Nil(t, err, "err should be nothing")
+	refreshToken, err := core.IssueRefreshToken(token)
+	assert.Nil(t, err, "err should be nothing")
+
+	_, _, err = core.Refresh(context.Background(), refreshToken)
+	assert.EqualError(t, err, "provider unavailable")
+
+	refreshed, secondRefreshToken, err := core.Refresh(context.Background(), refreshToken)
+	assert.Nil(t, err, "retry should not be treated as reuse")
+	assert.Equal(t, "refreshed", refreshed.AccessToken)
+
+	_, _, err = core.Refresh(context.Background(), secondRefreshToken)
+	assert.Nil(t, err, "err should be nothing")
+}
+
+func TestRevocation(t *testing.T) {
+	conf, _ := config.Initialize("../test/config-test.yml")
+	conf.Providers["mock_provider"] = mockProvider{userId: uuid.NewV4().String()}
+	core := New(conf, rsaTokenizer(t, conf.PrivateRSAKey), user.PlainUserService{})
+
+	issue := func() ([]byte, Claims) {
+		token, err := core.GenTokenInfo(context.Background(), "mock_provider", "code", "")
+		assert.Nil(t, err, "err should be nothing")
+		claims, err := core.Claims(token)
+		assert.Nil(t, err, "err should be nothing")
+		data, err := core.JwtToken(claims)
+		assert.Nil(t, err, "err should be nothing")
+		return data, claims
+	}
+
+	first, firstClaims := issue()
+	second, secondClaims := issue()
+	assert.NotEmpty(t, firstClaims.ID())
+	assert.NotEqual(t, firstClaims.ID(), secondClaims.ID(), "every token should have a unique jti")
+
+	assert.Nil(t, core.RevokeToken(first))
+	_, err := core.VerifyToken(first)
+	assert.Equal(t, ErrTokenRevoked, err)
+	_, err = core.VerifyToken(second)
+	assert.Nil(t, err, "other tokens should still be valid")
+
+	assert.Nil(t, core.RevokeUser(secondClaims.Get("user").(string)))
+	_, err = core.VerifyToken(second)
+	assert.Equal(t, ErrTokenRevoked, err)
+
+	third, _ := issue()
+	assert.Nil(t, core.RevokeProvider("mock_provider"))
+	_, err = core.VerifyToken(third)
+	assert.Equal(t, ErrTokenRevoked, err)
+}
+
+func TestDenylistExpiry(t *testing.T) {
+	denylist := NewMemoryDenylist()
+	claims := Claims{"jti": "some-id", "user": "someone", "provider": "github"}
+	claims.SetIssuedAt(time.Now().Add(-time.Minute))
+
+	denylist.RevokeID("some-id", time.Now().Add(-time.Second))
+	revoked, _ := denylist.Revoked(claims)
+	assert.False(t, revoked, "expired entries should not revoke tokens")
+
+	denylist.RevokeUser("someone", time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	revoked, _ = denylist.Revoked(claims)
+	assert.False(t, revoked, "tokens issued after the revocation should be valid")
+
+	denylist.RevokeProvider("github", time.Now(), time.Now().Add(time.Hour))
+	revoked, _ = denylist.Revoked(claims)
+	assert.True(t, revoked)
+}
+
+func TestDenylistBoundary(t *testing.T) {
+	revokedAt := time.Unix(1600000000, 500000000)
+	claims := Claims{"user": "someone"}
+
+	denylist := NewMemoryDenylist()
+	denylist.RevokeUser("someone", revokedAt, time.Now().Add(time.Hour))
+
+	claims.SetIssuedAt(revokedAt.Truncate(time.Second))
+	revoked, _ := denylist.Revoked(claims)
+	assert.True(t, revoked, "tokens issued in the second of the revocation should be revoked")
+
+	claims.SetIssuedAt(revokedAt.Add(400 * time.Millisecond))
+	revoked, _ = denylist.Revoked(claims)
+	assert.True(t, revoked, "the whole second of the revocation should be revoked")
+
+	claims.SetIssuedAt(revokedAt.Truncate(time.Second).Add(time.Second))
+	revoked, _ = denylist.Revoked(claims)
+	assert.False(t, revoked, "tokens issued in the next second should be valid")
+}
+
+func TestClaimMapping(t *testing.T) {
+	conf, _ := config.Initialize("../test/config-test.yml")
+	conf.Providers["mock_provider"] = mockProvider{userId: "mock-id"}
+	conf.Claims.Providers = append(conf.Claims.Providers, config.ClaimsConfig{
+		Provider: "mock_provider",
+		Mapping: []config.ClaimMapping{
+			{Claim: "sub", Field: "id"},
+			{Claim: "display_name", Field: "name"},
+			{Claim: "avatar", Field: "avatar"},
+		},
+	})
+
+	core := New(conf, rsaTokenizer(t, conf.PrivateRSAKey), user.PlainUserService{})
+	token, err := core.GenTokenInfo(context.Background(), "mock_provider", "code", "")
+	assert.Nil(t, err, "err should be nothing")
+
+	claims, err := core.Claims(token)
+	assert.Nil(t, err, "err should be nothing")
+	assert.Equal(t, "your-audience", claims.Get("aud"))
+	assert.Equal(t, "mock-id", claims.Subject())
+	assert.Equal(t, "mock@example.com", claims.Get("email"))
+	assert.Equal(t, "Mock User", claims.Get("display_name"))
+	assert.False(t, claims.Has("avatar"), "empty profile fields should not be mapped")
+	assert.False(t, claims.Has("access_token"), "provider tokens should be dropped")
+	assert.False(t, claims.Has("refresh_token"), "provider tokens should be dropped")
+}
+
+func TestAuthURLPKCE(t *testing.T) {
+	conf, _ := config.Initialize("../test/config-test.yml")
+	core := New(conf, rsaTokenizer(t, conf.PrivateRSAKey), user.PlainUserService{})
+
+	verifier, err := core.CodeVerifier("github")
+	assert.Nil(t, err, "err should be nothing")
+	assert.NotEmpty(t, verifier)
+	url, err := core.AuthURL("github", "state", verifier, "id-token-nonce")
+	assert.Nil(t, err, "err should be nothing")
+	assert.Contains(t, url, "code_challenge_method=S256")
+	assert.Contains(t, url, "nonce=id-token-nonce")
+
+	verifier, err = core.CodeVerifier("gitea")
+	assert.Nil(t, err, "err should be nothing")
+	assert.Empty(t, verifier, "pkce is disabled for gitea")
+	url, _ = core.AuthURL("gitea", "state", verifier, "")
+	assert.NotContains(t, url, "code_challenge")
+}
@@ -0,0 +1,111 @@
+package core
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrTokenRevoked is returned when verifying a token that has been revoked.
+var ErrTokenRevoked = errors.New("token has been revoked")
+
+// Denylist keeps track of revoked tokens until they would have expired anyway.
+// Tokens are revoked either individually by their jti or in bulk for a user or
+// provider, which revokes every token issued up to that point in time. As iat
+// has a granularity of seconds, a bulk revocation covers the whole second it
+// happened in, including tokens issued later within that second.
+type Denylist interface {
+	RevokeID(jti string, expiresAt time.Time) error
+	RevokeUser(user string, issuedBefore time.Time, expiresAt time.Time) error
+	RevokeProvider(provider string, issuedBefore time.Time, expiresAt time.Time) error
+	Revoked(claims Claims) (bool, error)
+}
+
+// NewMemoryDenylist creates a Denylist that keeps all entries in memory.
+func NewMemoryDenylist() *MemoryDenylist {
+	return &MemoryDenylist{
+		ids:       map[string]time.Time{},
+		users:     map[string]bulkRevocation{},
+		providers: map[string]bulkRevocation{},
+	}
+}
+
+type bulkRevocation struct {
+	issuedBefore time.Time
+	expiresAt    time.Time
+}
+
+type MemoryDenylist struct {
+	mu        sync.RWMutex
+	ids       map[string]time.Time
+	users     map[string]bulkRevocation
+	providers map[string]bulkRevocation
+}
+
+func (d *MemoryDenylist) RevokeID(jti string, expiresAt time.Time) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.prune(time.Now())
+	d.ids[jti] = expiresAt
+	return nil
+}
+
+func (d *MemoryDenylist) RevokeUser(user string, issuedBefore time.Time, expiresAt time.Time) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.prune(time.Now())
+	d.users[user] = bulkRevocation{issuedBefore: issuedBefore, expiresAt: expiresAt}
+	return nil
+}
+
+func (d *MemoryDenylist) RevokeProvider(provider string, issuedBefore time.Time, expiresAt time.Time) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.prune(time.Now())
+	d.providers[provider] = bulkRevocation{issuedBefore: issuedBefore, expiresAt: expiresAt}
+	return nil
+}
+
+func (d *MemoryDenylist) Revoked(claims Claims) (bool, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	now := time.Now()
+	if expiresAt, ok := d.ids[claims.ID()]; ok && now.Before(expiresAt) {
+		return true, nil
+	}
+
+	issuedAt := claims.IssuedAt()
+	user, _ := claims.Get("user").(string)
+	if revocation, ok := d.users[user]; ok && revocation.revokes(issuedAt, now) {
+		return true, nil
+	}
+	provider, _ := claims.Get("provider").(string)
+	if revocation, ok := d.providers[provider]; ok && revocation.revokes(issuedAt, now) {
+		return true, nil
+	}
+	return false, nil
+}
+
+func (r bulkRevocation) revokes(issuedAt time.Time, now time.Time) bool {
+	return now.Before(r.expiresAt) && issuedAt.Unix() <= r.issuedBefore.Unix()
+}
+
+// prune removes all entries whose tokens have expired by now.
+func (d *MemoryDenylist) prune(now time.Time) {
+	for jti, expiresAt := range d.ids {
+		if now.After(expiresAt) {
+			delete(d.ids, jti)
+		}
+	}
+	for user, revocation := range d.users {
+		if now.After(revocation.expiresAt) {
+			delete(d.users, user)
+		}
+	}
+	for provider, revocation := range d.providers {
+		if now.After(revocation.expiresAt) {
+			delete(d.providers, provider)
+		}
+	}
+}
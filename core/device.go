@@ -0,0 +1,345 @@
+package core
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/krinklesaurus/jwt-proxy/log"
+	"github.com/krinklesaurus/jwt-proxy/util"
+)
+
+// The errors of polling a device code. Their messages are the error codes of
+// RFC 8628 section 3.5.
+var (
+	ErrAuthorizationPending = errors.New("authorization_pending")
+	ErrSlowDown             = errors.New("slow_down")
+	ErrAccessDenied         = errors.New("access_denied")
+	ErrExpiredToken         = errors.New("expired_token")
+	// ErrInvalidUserCode is returned for user codes that are unknown, expired
+	// or already used.
+	ErrInvalidUserCode = errors.New("invalid or expired user code")
+)
+
+const (
+	// slowDownIncrement is added to the interval of a device that polls too
+	// often, see RFC 8628 section 3.5.
+	slowDownIncrement = 5 * time.Second
+	// deviceRetention is the time expired device codes are kept, so that
+	// devices still polling learn that they expired.
+	deviceRetention = 10 * time.Minute
+	// Clients that typed in userCodeMaxFailures wrong user codes are locked
+	// out for userCodeLockout, see RFC 8628 section 5.1.
+	userCodeMaxFailures = 5
+	userCodeLockout     = 15 * time.Minute
+)
+
+// User codes consist of userCodeLength characters of userCodeAlphabet, which
+// has no vowels and no easily confused characters, see RFC 8628 section 6.1.
+const (
+	userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+	userCodeLength   = 8
+)
+
+// DeviceAuthorization is the server side state of a device authorization
+// request, see RFC 8628, while the user logs in on another device.
+type DeviceAuthorization struct {
+	// ID is the hash of the device code handed out to the device.
+	ID string
+	// UserCode is the normalized user code, see FormatUserCode.
+	UserCode  string
+	ClientID  string
+	Scope     string
+	Interval  time.Duration
+	LastPoll  time.Time
+	ExpiresAt time.Time
+	// Token is the login of the user once they approved the request. Denied
+	// is set if they denied it. Redeemed is set once the device picked up the
+	// login.
+	Token    *TokenInfo
+	Denied   bool
+	Redeemed bool
+}
+
+// pending returns true if the user can still approve or deny the request.
+func (d *DeviceAuthorization) pending() bool {
+	return d.Token == nil && !d.Denied && time.Now().Before(d.ExpiresAt)
+}
+
+// DeviceStore stores device authorization requests until the device picked up
+// their result.
+type DeviceStore interface {
+	// SaveDevice stores a new request.
+	SaveDevice(device *DeviceAuthorization) error
+	// Device returns the request of the hashed device code.
+	Device(id string) (*DeviceAuthorization, error)
+	// DeviceByUserCode returns the request of the normalized user code.
+	DeviceByUserCode(userCode string) (*DeviceAuthorization, error)
+	// UpdateDevice applies update to the request of the hashed device code
+	// atomically, so that concurrent polls and approvals don't overwrite each
+	// other, and returns the updated request. Nothing is stored if update
+	// returns an error.
+	UpdateDevice(id string, update func(device *DeviceAuthorization) error) (*DeviceAuthorization, error)
+	RemoveDevice(id string) error
+}
+
+// NewMemoryDeviceStore creates a DeviceStore that keeps all requests in
+// memory.
+func NewMemoryDeviceStore() *MemoryDeviceStore {
+	return &MemoryDeviceStore{
+		devices:   map[string]*DeviceAuthorization{},
+		userCodes: map[string]string{},
+	}
+}
+
+type MemoryDeviceStore struct {
+	mu        sync.Mutex
+	devices   map[string]*DeviceAuthorization
+	userCodes map[string]string
+}
+
+func (s *MemoryDeviceStore) SaveDevice(device *DeviceAuthorization) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for id, existing := range s.devices {
+		if now.After(existing.ExpiresAt.Add(deviceRetention)) {
+			delete(s.devices, id)
+			delete(s.userCodes, existing.UserCode)
+		}
+	}
+	if _, ok := s.userCodes[device.UserCode]; ok {
+		return fmt.Errorf("user code %s is already in use", device.UserCode)
+	}
+	saved := *device
+	s.devices[device.ID] = &saved
+	s.userCodes[device.UserCode] = device.ID
+	return nil
+}
+
+func (s *MemoryDeviceStore) Device(id string) (*DeviceAuthorization, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	device, ok := s.devices[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown device code", ErrInvalidGrant)
+	}
+	found := *device
+	return &found, nil
+}
+
+func (s *MemoryDeviceStore) DeviceByUserCode(userCode string) (*DeviceAuthorization, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	device, ok := s.devices[s.userCodes[userCode]]
+	if !ok {
+		return nil, ErrInvalidUserCode
+	}
+	found := *device
+	return &found, nil
+}
+
+func (s *MemoryDeviceStore) UpdateDevice(id string, update func(device *DeviceAuthorization) error) (*DeviceAuthorization, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	device, ok := s.devices[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown device code", ErrInvalidGrant)
+	}
+	updated := *device
+	if err := update(&updated); err != nil {
+		return nil, err
+	}
+	s.devices[id] = &updated
+	result := updated
+	return &result, nil
+}
+
+func (s *MemoryDeviceStore) RemoveDevice(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if device, ok := s.devices[id]; ok {
+		delete(s.userCodes, device.UserCode)
+		delete(s.devices, id)
+	}
+	return nil
+}
+
+// AuthorizeDevice starts the device authorization grant for the already
+// authenticated client, if any, and returns the request along with the device
+// code, see RFC 8628 section 3.2.
+func (c *Core) AuthorizeDevice(clientID string, scope string) (*DeviceAuthorization, string, error) {
+	if c.Config.DeviceExpirySeconds <= 0 {
+		return nil, "", errors.New("device authorization grant is disabled")
+	}
+
+	deviceCode, err := util.SecureRandomString(32)
+	if err != nil {
+		return nil, "", err
+	}
+	userCode, err := generateUserCode()
+	if err != nil {
+		return nil, "", err
+	}
+	device := &DeviceAuthorization{
+		ID:        hashToken(deviceCode),
+		UserCode:  userCode,
+		ClientID:  clientID,
+		Scope:     scope,
+		Interval:  time.Duration(c.Config.DeviceIntervalSeconds) * time.Second,
+		ExpiresAt: time.Now().Add(time.Duration(c.Config.DeviceExpirySeconds) * time.Second),
+	}
+	if err := c.DeviceStore.SaveDevice(device); err != nil {
+		return nil, "", err
+	}
+	return device, deviceCode, nil
+}
+
+// DeviceByUserCode returns the pending request of the user code the user typed
+// in on the verification page. Clients, identified by their address, that
+// typed in too many wrong user codes get ErrTooManyAttempts for a while.
+func (c *Core) DeviceByUserCode(userCode string, client string) (*DeviceAuthorization, error) {
+	if err := c.UserCodeThrottle.Allowed(client); err != nil {
+		return nil, err
+	}
+	device, err := c.pendingDevice(userCode)
+	if errors.Is(err, ErrInvalidUserCode) {
+		c.UserCodeThrottle.Fail(client)
+	}
+	return device, err
+}
+
+// pendingDevice returns the pending request of the user code.
+func (c *Core) pendingDevice(userCode string) (*DeviceAuthorization, error) {
+	device, err := c.DeviceStore.DeviceByUserCode(normalizeUserCode(userCode))
+	if err != nil {
+		return nil, err
+	}
+	if !device.pending() {
+		return nil, ErrInvalidUserCode
+	}
+	return device, nil
+}
+
+// ApproveDevice completes the request of the user code with the user's login,
+// which the device picks up with its next poll.
+func (c *Core) ApproveDevice(userCode string, token *TokenInfo) error {
+	return c.completeDevice(userCode, func(device *DeviceAuthorization) {
+		clientToken := *token
+		clientToken.Client = device.ClientID
+		device.Token = &clientToken
+	})
+}
+
+// DenyDevice completes the request of the user code without a login.
+func (c *Core) DenyDevice(userCode string) error {
+	return c.completeDevice(userCode, func(device *DeviceAuthorization) {
+		device.Denied = true
+	})
+}
+
+// completeDevice applies complete to the request of the user code if it is
+// still pending.
+func (c *Core) completeDevice(userCode string, complete func(device *DeviceAuthorization)) error {
+	device, err := c.pendingDevice(userCode)
+	if err != nil {
+		return err
+	}
+	_, err = c.DeviceStore.UpdateDevice(device.ID, func(device *DeviceAuthorization) error {
+		if !device.pending() {
+			return ErrInvalidUserCode
+		}
+		complete(device)
+		return nil
+	})
+	if errors.Is(err, ErrInvalidGrant) {
+		return ErrInvalidUserCode
+	}
+	return err
+}
+
+// PollDevice returns the approved request of the device code, see RFC 8628
+// section 3.4. Until then it returns ErrAuthorizationPending, or ErrSlowDown
+// if the device polls faster than its interval, which is increased then.
+func (c *Core) PollDevice(clientID string, deviceCode string) (*DeviceAuthorization, error) {
+	var pending error
+	device, err := c.DeviceStore.UpdateDevice(hashToken(deviceCode), func(device *DeviceAuthorization) error {
+		if device.ClientID != clientID {
+			log.Warnf("client %s tried to poll device code of client %s", clientID, device.ClientID)
+			return fmt.Errorf("%w: device code was issued to another client", ErrInvalidGrant)
+		}
+
+		now := time.Now()
+		switch {
+		case now.After(device.ExpiresAt):
+			return ErrExpiredToken
+		case device.Denied:
+			return ErrAccessDenied
+		case device.Redeemed:
+			return fmt.Errorf("%w: device code was already redeemed", ErrInvalidGrant)
+		case device.Token != nil:
+			device.Redeemed = true
+			return nil
+		}
+
+		pending = ErrAuthorizationPending
+		if now.Sub(device.LastPoll) < device.Interval {
+			device.Interval += slowDownIncrement
+			pending = ErrSlowDown
+		}
+		device.LastPoll = now
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if pending != nil {
+		return nil, pending
+	}
+	if err := c.DeviceStore.RemoveDevice(device.ID); err != nil {
+		return nil, err
+	}
+	return device, nil
+}
+
+// generateUserCode returns a random user code of userCodeAlphabet.
+func generateUserCode() (string, error) {
+	code := make([]byte, userCodeLength)
+	max := big.NewInt(int64(len(userCodeAlphabet)))
+	for i := range code {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		code[i] = userCodeAlphabet[n.Int64()]
+	}
+	return string(code), nil
+}
+
+// normalizeUserCode removes dashes and spaces from the user code the user typed
+// in and ignores its case.
+func normalizeUserCode(userCode string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, strings.ToUpper(userCode))
+}
+
+// FormatUserCode returns the user code as shown to the user, e.g. WDJB-MJHT.
+func FormatUserCode(userCode string) string {
+	if len(userCode) != userCodeLength {
+		return userCode
+	}
+	return userCode[:userCodeLength/2] + "-" + userCode[userCodeLength/2:]
+}
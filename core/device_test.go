@@ -0,0 +1,126 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/krinklesaurus/jwt-proxy/config"
+	"github.com/krinklesaurus/jwt-proxy/user"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeviceAuthorization(t *testing.T) {
+	conf, _ := config.Initialize("../test/config-test.yml")
+	conf.Providers["mock_provider"] = mockProvider{userId: "mock-id"}
+	conf.DeviceIntervalSeconds = 5
+	core := New(conf, rsaTokenizer(t, conf.PrivateRSAKey), user.PlainUserService{})
+
+	_, _, err := core.AuthorizeDevice("", "")
+	assert.NotNil(t, err, "the device grant is disabled by default")
+
+	conf.DeviceExpirySeconds = 600
+	device, deviceCode, err := core.AuthorizeDevice("cli", "openid")
+	assert.Nil(t, err, "err should be nothing")
+	assert.Regexp(t, regexp.MustCompile(`^[BCDFGHJKLMNPQRSTVWXZ]{4}-[BCDFGHJKLMNPQRSTVWXZ]{4}$`), FormatUserCode(device.UserCode))
+	assert.Equal(t, 5*time.Second, device.Interval)
+
+	_, err = core.PollDevice("cli", deviceCode)
+	assert.True(t, errors.Is(err, ErrAuthorizationPending))
+	_, err = core.PollDevice("cli", deviceCode)
+	assert.True(t, errors.Is(err, ErrSlowDown), "polling faster than the interval should slow down the device")
+	stored, _ := core.DeviceStore.Device(device.ID)
+	assert.Equal(t, 10*time.Second, stored.Interval)
+	_, err = core.PollDevice("other-cli", deviceCode)
+	assert.True(t, errors.Is(err, ErrInvalidGrant), "device codes are bound to their client")
+
+	_, err = core.DeviceByUserCode("unknown", "127.0.0.1")
+	assert.True(t, errors.Is(err, ErrInvalidUserCode))
+	userCode := FormatUserCode(device.UserCode)
+	pending, err := core.DeviceByUserCode(" "+strings.ToLower(userCode)+" ", "127.0.0.1")
+	assert.Nil(t, err, "user codes should be normalized")
+	assert.Equal(t, device.ID, pending.ID)
+
+	token, _ := core.GenTokenInfo(context.Background(), "mock_provider", "code", "")
+	assert.Nil(t, core.ApproveDevice(userCode, token))
+	assert.True(t, errors.Is(core.ApproveDevice(userCode, token), ErrInvalidUserCode), "user codes can only be used once")
+
+	approved, err := core.PollDevice("cli", deviceCode)
+	assert.Nil(t, err, "err should be nothing")
+	assert.Equal(t, token.User, approved.Token.User)
+	assert.Equal(t, "openid", approved.Scope)
+	_, err = core.PollDevice("cli", deviceCode)
+	assert.True(t, errors.Is(err, ErrInvalidGrant), "the login is handed out once")
+
+	device, deviceCode, _ = core.AuthorizeDevice("", "")
+	assert.Nil(t, core.DenyDevice(device.UserCode))
+	_, err = core.PollDevice("", deviceCode)
+	assert.True(t, errors.Is(err, ErrAccessDenied))
+
+	device, deviceCode, _ = core.AuthorizeDevice("", "")
+	core.DeviceStore.UpdateDevice(device.ID, func(device *DeviceAuthorization) error {
+		device.ExpiresAt = time.Now().Add(-time.Second)
+		return nil
+	})
+	_, err = core.PollDevice("", deviceCode)
+	assert.True(t, errors.Is(err, ErrExpiredToken))
+	_, err = core.DeviceByUserCode(device.UserCode, "127.0.0.1")
+	assert.True(t, errors.Is(err, ErrInvalidUserCode), "expired user codes should be rejected")
+}
+
+func TestDeviceConcurrentPollAndApprove(t *testing.T) {
+	conf, _ := config.Initialize("../test/config-test.yml")
+	conf.Providers["mock_provider"] = mockProvider{userId: "mock-id"}
+	conf.DeviceExpirySeconds = 600
+	core := New(conf, rsaTokenizer(t, conf.PrivateRSAKey), user.PlainUserService{})
+
+	device, deviceCode, err := core.AuthorizeDevice("", "")
+	assert.Nil(t, err, "err should be nothing")
+	token, _ := core.GenTokenInfo(context.Background(), "mock_provider", "code", "")
+
+	var wg sync.WaitGroup
+	results := make(chan *DeviceAuthorization, 50)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if approved, err := core.PollDevice("", deviceCode); err == nil {
+				results <- approved
+			}
+		}()
+	}
+	assert.Nil(t, core.ApproveDevice(device.UserCode, token))
+	wg.Wait()
+	if approved, err := core.PollDevice("", deviceCode); err == nil {
+		results <- approved
+	}
+	close(results)
+
+	count := 0
+	for approved := range results {
+		count++
+		assert.Equal(t, token.User, approved.Token.User)
+	}
+	assert.Equal(t, 1, count, "the approval must not be lost to a concurrent poll and handed out once")
+}
+
+func TestDeviceUserCodeLockout(t *testing.T) {
+	conf, _ := config.Initialize("../test/config-test.yml")
+	conf.DeviceExpirySeconds = 600
+	core := New(conf, rsaTokenizer(t, conf.PrivateRSAKey), user.PlainUserService{})
+
+	device, _, err := core.AuthorizeDevice("", "")
+	assert.Nil(t, err, "err should be nothing")
+	for i := 0; i < userCodeMaxFailures; i++ {
+		_, err = core.DeviceByUserCode("BCDF-GHJK", "192.0.2.1")
+		assert.True(t, errors.Is(err, ErrInvalidUserCode))
+	}
+	_, err = core.DeviceByUserCode(device.UserCode, "192.0.2.1")
+	assert.True(t, errors.Is(err, ErrTooManyAttempts), "clients guessing user codes should be locked out")
+	_, err = core.DeviceByUserCode(device.UserCode, "192.0.2.2")
+	assert.Nil(t, err, "other clients should not be locked out")
+}
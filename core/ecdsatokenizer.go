@@ -0,0 +1,14 @@
+package core
+
+import (
+	"crypto/ecdsa"
+
+	jose "github.com/go-jose/go-jose/v3"
+)
+
+// NewECDSATokenizer creates a tokenizer that signs every token with the given
+// ECDSA private key. The curve must match the signing method, i.e. P-256 for
+// ES256, P-384 for ES384 and P-521 for ES512.
+func NewECDSATokenizer(signingMethod jose.SignatureAlgorithm, privKey *ecdsa.PrivateKey) (Tokenizer, error) {
+	return newSingleKeyTokenizer(signingMethod, privKey)
+}
@@ -0,0 +1,13 @@
+package core
+
+import (
+	"crypto/ed25519"
+
+	jose "github.com/go-jose/go-jose/v3"
+)
+
+// NewEd25519Tokenizer creates a tokenizer that signs every token with the
+// given Ed25519 private key using the EdDSA signing method.
+func NewEd25519Tokenizer(privKey ed25519.PrivateKey) (Tokenizer, error) {
+	return newSingleKeyTokenizer(jose.EdDSA, privKey)
+}
@@ -0,0 +1,174 @@
+package core
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"fmt"
+	"strings"
+
+	jose "github.com/go-jose/go-jose/v3"
+	"github.com/krinklesaurus/jwt-proxy/config"
+)
+
+// KeyAlgorithms are the supported key management algorithms for encrypted
+// tokens. The content is always encrypted with A256GCM.
+var KeyAlgorithms = map[string]jose.KeyAlgorithm{
+	"RSA-OAEP":       jose.RSA_OAEP,
+	"RSA-OAEP-256":   jose.RSA_OAEP_256,
+	"ECDH-ES":        jose.ECDH_ES,
+	"ECDH-ES+A256KW": jose.ECDH_ES_A256KW,
+}
+
+// Recipient is a party a token is encrypted to. If PrivateKey is set,
+// jwt-proxy itself can decrypt tokens, e.g. to verify them.
+type Recipient struct {
+	Algorithm  jose.KeyAlgorithm
+	PublicKey  crypto.PublicKey
+	PrivateKey crypto.Signer
+}
+
+// NewEncryptingTokenizer wraps the tokenizer so that every token it signs is
+// additionally encrypted to the recipients as nested JWT, see RFC 7519
+// section 5.2. With a single recipient the token is compact serialized, with
+// several recipients the JWE JSON serialization is used.
+func NewEncryptingTokenizer(tokenizer Tokenizer, recipients []Recipient) (*EncryptingTokenizer, error) {
+	if len(recipients) == 0 {
+		return nil, fmt.Errorf("encrypted tokens need at least one recipient")
+	}
+
+	joseRecipients := []jose.Recipient{}
+	for _, recipient := range recipients {
+		kid, err := KeyID(recipient.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		joseRecipients = append(joseRecipients, jose.Recipient{
+			Algorithm: recipient.Algorithm,
+			Key:       recipient.PublicKey,
+			KeyID:     kid,
+		})
+	}
+
+	opts := (&jose.EncrypterOptions{}).WithType("JWT").WithContentType("JWT")
+	var encrypter jose.Encrypter
+	var err error
+	if len(joseRecipients) == 1 {
+		encrypter, err = jose.NewEncrypter(jose.A256GCM, joseRecipients[0], opts)
+	} else {
+		encrypter, err = jose.NewMultiEncrypter(jose.A256GCM, joseRecipients, opts)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &EncryptingTokenizer{tokenizer: tokenizer, encrypter: encrypter, recipients: recipients}, nil
+}
+
+type EncryptingTokenizer struct {
+	tokenizer  Tokenizer
+	encrypter  jose.Encrypter
+	recipients []Recipient
+}
+
+func (t *EncryptingTokenizer) Serialize(claims map[string]interface{}) ([]byte, error) {
+	signed, err := t.tokenizer.Serialize(claims)
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := t.encrypter.Encrypt(signed)
+	if err != nil {
+		return nil, err
+	}
+	if len(t.recipients) > 1 {
+		return []byte(encrypted.FullSerialize()), nil
+	}
+	serialized, err := encrypted.CompactSerialize()
+	if err != nil {
+		return nil, err
+	}
+	return []byte(serialized), nil
+}
+
+// Unwrap returns the tokenizer that signs the tokens before they are
+// encrypted.
+func (t *EncryptingTokenizer) Unwrap() Tokenizer {
+	return t.tokenizer
+}
+
+// Verify decrypts the token with the first recipient private key that matches
+// and verifies the signed token within.
+func (t *EncryptingTokenizer) Verify(token []byte) (Claims, error) {
+	encrypted, err := jose.ParseEncrypted(string(token))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	if encrypted.Header.ExtraHeaders[jose.HeaderContentType] != "JWT" {
+		return nil, fmt.Errorf("%w: encrypted token does not contain a JWT", ErrInvalidToken)
+	}
+
+	for _, recipient := range t.recipients {
+		if recipient.PrivateKey == nil {
+			continue
+		}
+		_, header, signed, err := encrypted.DecryptMulti(recipient.PrivateKey)
+		if err != nil {
+			continue
+		}
+		if header.Algorithm != string(recipient.Algorithm) {
+			continue
+		}
+		return t.tokenizer.Verify(signed)
+	}
+	return nil, fmt.Errorf("%w: could not decrypt token with any configured key", ErrInvalidToken)
+}
+
+// PublicKeys returns the public signing keys of the wrapped tokenizer.
+func (t *EncryptingTokenizer) PublicKeys() ([]jose.JSONWebKey, error) {
+	return t.tokenizer.PublicKeys()
+}
+
+// Rotate rotates the signing key of the wrapped tokenizer.
+func (t *EncryptingTokenizer) Rotate() error {
+	rotator, ok := t.tokenizer.(Rotator)
+	if !ok {
+		return fmt.Errorf("tokenizer does not support key rotation")
+	}
+	return rotator.Rotate()
+}
+
+// RecipientsFromConfig creates the recipients of encrypted tokens from the
+// config. Without explicit algorithm RSA keys use RSA-OAEP and EC keys use
+// ECDH-ES, or ECDH-ES+A256KW if there are several recipients.
+func RecipientsFromConfig(config *config.Config) ([]Recipient, error) {
+	recipients := []Recipient{}
+	for _, encryptionKey := range config.EncryptionKeys {
+		recipient := Recipient{PublicKey: encryptionKey.PublicKey}
+		if encryptionKey.PrivateKey != nil {
+			recipient.PrivateKey = encryptionKey.PrivateKey
+			recipient.PublicKey = encryptionKey.PrivateKey.Public()
+		}
+
+		algorithm := strings.ToUpper(encryptionKey.Algorithm)
+		if algorithm == "" {
+			switch recipient.PublicKey.(type) {
+			case *rsa.PublicKey:
+				algorithm = "RSA-OAEP"
+			case *ecdsa.PublicKey:
+				algorithm = "ECDH-ES"
+				if len(config.EncryptionKeys) > 1 {
+					algorithm = "ECDH-ES+A256KW"
+				}
+			default:
+				return nil, fmt.Errorf("unsupported encryption key type %T", recipient.PublicKey)
+			}
+		}
+		keyAlgorithm, ok := KeyAlgorithms[algorithm]
+		if !ok {
+			return nil, fmt.Errorf("unsupported key encryption algorithm %s", encryptionKey.Algorithm)
+		}
+		recipient.Algorithm = keyAlgorithm
+		recipients = append(recipients, recipient)
+	}
+	return recipients, nil
+}
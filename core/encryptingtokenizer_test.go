@@ -0,0 +1,94 @@
+package core
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"strings"
+	"testing"
+
+	jose "github.com/go-jose/go-jose/v3"
+	"github.com/go-jose/go-jose/v3/jwt"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncryptingTokenizer(t *testing.T) {
+	signingKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	tests := []struct {
+		name       string
+		recipients []Recipient
+	}{
+		{"RSA-OAEP", []Recipient{{Algorithm: jose.RSA_OAEP, PublicKey: rsaKey.Public(), PrivateKey: rsaKey}}},
+		{"ECDH-ES", []Recipient{{Algorithm: jose.ECDH_ES, PublicKey: ecKey.Public(), PrivateKey: ecKey}}},
+		{"multiple", []Recipient{
+			{Algorithm: jose.RSA_OAEP_256, PublicKey: rsaKey.Public()},
+			{Algorithm: jose.ECDH_ES_A256KW, PublicKey: ecKey.Public(), PrivateKey: ecKey},
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			signer, _ := NewECDSATokenizer(jose.ES256, signingKey)
+			tokenizer, err := NewEncryptingTokenizer(signer, test.recipients)
+			assert.Nil(t, err, "err should be nothing")
+
+			data, err := tokenizer.Serialize(Claims{"access_token": "secret-provider-token"})
+			assert.Nil(t, err, "err should be nothing")
+			assert.NotContains(t, string(data), "secret-provider-token")
+			if len(test.recipients) == 1 {
+				assert.Len(t, strings.Split(string(data), "."), 5, "single recipient token should be compact JWE")
+			}
+
+			claims, err := tokenizer.Verify(data)
+			assert.Nil(t, err, "err should be nothing")
+			assert.Equal(t, "secret-provider-token", claims.Get("access_token"))
+
+			_, err = signer.Verify(data)
+			assert.NotNil(t, err, "encrypted token must not verify as plain JWS")
+		})
+	}
+}
+
+func TestEncryptedTokenReadableByRecipient(t *testing.T) {
+	signingKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	recipientKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	signer := rsaTokenizer(t, signingKey)
+	tokenizer, _ := NewEncryptingTokenizer(signer, []Recipient{{Algorithm: jose.RSA_OAEP, PublicKey: recipientKey.Public()}})
+
+	data, err := tokenizer.Serialize(Claims{"user": "someone"})
+	assert.Nil(t, err, "err should be nothing")
+
+	_, err = tokenizer.Verify(data)
+	assert.NotNil(t, err, "jwt-proxy cannot decrypt without a private key")
+
+	nested, err := jwt.ParseSignedAndEncrypted(string(data))
+	assert.Nil(t, err, "err should be nothing")
+	signed, err := nested.Decrypt(recipientKey)
+	assert.Nil(t, err, "err should be nothing")
+
+	claims := Claims{}
+	assert.Nil(t, signed.Claims(signingKey.Public(), &claims))
+	assert.Equal(t, "someone", claims.Get("user"))
+}
+
+func TestSignedTokenIsNotEncrypted(t *testing.T) {
+	signingKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	recipientKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	signer := rsaTokenizer(t, signingKey)
+	tokenizer, _ := NewEncryptingTokenizer(signer, []Recipient{{Algorithm: jose.RSA_OAEP, PublicKey: recipientKey.Public()}})
+	assert.Equal(t, signer, SigningTokenizer(tokenizer))
+
+	core := &Core{Tokenizer: tokenizer}
+	data, err := core.SignedToken(Claims{"aud": "spa"})
+	assert.Nil(t, err, "err should be nothing")
+	assert.Len(t, strings.Split(string(data), "."), 3, "ID tokens should be plain JWS")
+	claims, err := signer.Verify(data)
+	assert.Nil(t, err, "err should be nothing")
+	assert.Equal(t, "spa", claims.Get("aud"))
+}
@@ -0,0 +1,12 @@
+package core
+
+import (
+	jose "github.com/go-jose/go-jose/v3"
+)
+
+// NewHMACTokenizer creates a tokenizer that signs every token with the given
+// shared secret. As verifiers need the secret itself, no public keys are
+// published for HMAC signed tokens.
+func NewHMACTokenizer(signingMethod jose.SignatureAlgorithm, secret []byte) (Tokenizer, error) {
+	return newSingleKeyTokenizer(signingMethod, secret)
+}
@@ -0,0 +1,50 @@
+package core
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+)
+
+// ErrInvalidResource is returned if a protected resource fails to
+// authenticate.
+var ErrInvalidResource = errors.New("invalid protected resource credentials")
+
+// introspectionExcluded are the claims of a token that are never returned on
+// introspection, as they are the provider's secrets.
+var introspectionExcluded = map[string]bool{
+	"access_token": true, "token_type": true, "refresh_token": true,
+}
+
+// AuthenticateResource checks the credentials of a protected resource.
+func (c *Core) AuthenticateResource(id string, secret string) error {
+	for _, resource := range c.Config.ProtectedResources {
+		if resource.ID == id && subtle.ConstantTimeCompare([]byte(secret), []byte(resource.Secret)) == 1 {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrInvalidResource, id)
+}
+
+// Introspect returns the RFC 7662 introspection response for the token, whose
+// sub is the unique user the token was issued to. Tokens that are invalid,
+// expired or revoked are reported as inactive only.
+func (c *Core) Introspect(token []byte) Claims {
+	claims, err := c.VerifyToken(token)
+	if err != nil {
+		return Claims{"active": false}
+	}
+
+	response := Claims{}
+	for name, value := range claims {
+		if !introspectionExcluded[name] {
+			response.Set(name, value)
+		}
+	}
+	if user, _ := claims.Get("user").(string); user != "" {
+		response.SetSubject(user)
+	}
+	response.Set("active", true)
+	response.Set("token_type", "Bearer")
+	return response
+}
@@ -0,0 +1,41 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/krinklesaurus/jwt-proxy/config"
+	"github.com/krinklesaurus/jwt-proxy/user"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIntrospect(t *testing.T) {
+	conf, _ := config.Initialize("../test/config-test.yml")
+	conf.Providers["mock_provider"] = mockProvider{userId: "mock-id"}
+	core := New(conf, rsaTokenizer(t, conf.PrivateRSAKey), user.PlainUserService{})
+
+	assert.Nil(t, core.AuthenticateResource("some-api", "some-api-secret"))
+	assert.True(t, errors.Is(core.AuthenticateResource("some-api", "wrong"), ErrInvalidResource))
+	assert.True(t, errors.Is(core.AuthenticateResource("unknown", "some-api-secret"), ErrInvalidResource))
+
+	token, err := core.GenTokenInfo(context.Background(), "mock_provider", "code", "")
+	assert.Nil(t, err, "err should be nothing")
+	claims, _ := core.Claims(token)
+	claims.Set("client_id", "internal-app")
+	claims.Set("scope", "openid email")
+	data, _ := core.JwtToken(claims)
+
+	response := core.Introspect(data)
+	assert.Equal(t, true, response.Get("active"))
+	assert.Equal(t, token.User, response.Subject())
+	assert.Equal(t, claims.Expiration(), response.Expiration())
+	assert.Equal(t, "openid email", response.Get("scope"))
+	assert.Equal(t, "internal-app", response.Get("client_id"))
+	assert.Equal(t, "mock@example.com", response.Get("email"))
+	assert.False(t, response.Has("access_token"), "provider tokens should never be returned")
+
+	assert.Nil(t, core.RevokeToken(data))
+	assert.Equal(t, Claims{"active": false}, core.Introspect(data))
+	assert.Equal(t, Claims{"active": false}, core.Introspect([]byte("garbage")))
+}
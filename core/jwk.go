@@ -0,0 +1,53 @@
+package core
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+
+	jose "github.com/go-jose/go-jose/v3"
+)
+
+// KeyID returns the RFC 7638 JWK thumbprint of the given public key which is
+// used as "kid" in both the JWKS and the header of the issued tokens.
+func KeyID(publicKey crypto.PublicKey) (string, error) {
+	jwk := jose.JSONWebKey{Key: publicKey}
+	thumbprint, err := jwk.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(thumbprint), nil
+}
+
+// secretKeyID derives the key id of an HMAC secret. Unlike a thumbprint it is
+// a MAC of a fixed label, so the key id does not reveal a plain hash of the
+// secret.
+func secretKeyID(secret []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("jwt-proxy key id"))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
+}
+
+func publicJWK(publicKey crypto.PublicKey, kid string, alg jose.SignatureAlgorithm) jose.JSONWebKey {
+	return jose.JSONWebKey{
+		Key:       publicKey,
+		KeyID:     kid,
+		Algorithm: string(alg),
+		Use:       "sig",
+	}
+}
+
+// newSigner creates a signer whose tokens carry the kid header. go-jose only
+// sets it for keys with a public key, so it is set explicitly for secrets.
+func newSigner(alg jose.SignatureAlgorithm, kid string, privKey interface{}) (jose.Signer, error) {
+	key := jose.SigningKey{
+		Algorithm: alg,
+		Key:       jose.JSONWebKey{Key: privKey, KeyID: kid, Algorithm: string(alg)},
+	}
+	options := (&jose.SignerOptions{}).WithType("JWT")
+	if _, ok := privKey.([]byte); ok {
+		options = options.WithHeader(jose.HeaderKey("kid"), kid)
+	}
+	return jose.NewSigner(key, options)
+}
@@ -0,0 +1,379 @@
+package core
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	jose "github.com/go-jose/go-jose/v3"
+	"github.com/krinklesaurus/jwt-proxy/config"
+	"github.com/krinklesaurus/jwt-proxy/log"
+)
+
+// KeyStatus is the lifecycle state of a key within a Keyring.
+type KeyStatus string
+
+const (
+	// KeyActive is the single key new tokens are signed with.
+	KeyActive KeyStatus = "active"
+	// KeyNext is published for verification ahead of becoming active, so that
+	// verifiers already know it when the first token is signed with it.
+	KeyNext KeyStatus = "next"
+	// KeyRetired no longer signs tokens but is still published until all
+	// tokens signed with it have expired.
+	KeyRetired KeyStatus = "retired"
+)
+
+// Key is a private signing key along with its key id and algorithm. Private is
+// either a crypto.Signer for asymmetric algorithms or the []byte shared secret
+// for HMAC.
+type Key struct {
+	ID        string
+	Algorithm jose.SignatureAlgorithm
+	Private   interface{}
+	Status    KeyStatus
+	// ExpiresAt is the point in time a retired key is dropped from the
+	// keyring. The zero value keeps the key forever.
+	ExpiresAt time.Time
+}
+
+// Public returns the public key of the key or nil for HMAC secrets, which
+// must never be published.
+func (k *Key) Public() crypto.PublicKey {
+	if signer, ok := k.Private.(crypto.Signer); ok {
+		return signer.Public()
+	}
+	return nil
+}
+
+// verificationKey returns the key used to verify signatures, which is the
+// public key or the shared secret for HMAC.
+func (k *Key) verificationKey() interface{} {
+	if public := k.Public(); public != nil {
+		return public
+	}
+	return k.Private
+}
+
+func (k *Key) expired(now time.Time) bool {
+	return !k.ExpiresAt.IsZero() && now.After(k.ExpiresAt)
+}
+
+// NewKey creates a Key from the given private key or HMAC secret after
+// checking that it can be used with the algorithm. If id is empty, the RFC 7638
+// thumbprint of the public key, or a MAC for HMAC secrets, is used as key id.
+func NewKey(id string, alg jose.SignatureAlgorithm, private interface{}, status KeyStatus) (*Key, error) {
+	if err := checkKey(alg, private); err != nil {
+		return nil, err
+	}
+	if id == "" {
+		var kid string
+		var err error
+		if secret, ok := private.([]byte); ok {
+			kid = secretKeyID(secret)
+		} else {
+			kid, err = KeyID(private.(crypto.Signer).Public())
+		}
+		if err != nil {
+			return nil, err
+		}
+		id = kid
+	}
+	return &Key{ID: id, Algorithm: alg, Private: private, Status: status}, nil
+}
+
+// checkKey returns an error if the key cannot be used for the algorithm.
+func checkKey(alg jose.SignatureAlgorithm, private interface{}) error {
+	switch alg {
+	case jose.RS256, jose.RS384, jose.RS512:
+		if key, ok := private.(*rsa.PrivateKey); ok && key != nil {
+			return nil
+		}
+	case jose.ES256, jose.ES384, jose.ES512:
+		if key, ok := private.(*ecdsa.PrivateKey); ok && key != nil {
+			if key.Curve != curves[alg] {
+				return fmt.Errorf("signing method %s requires curve %s, got %s", alg, curves[alg].Params().Name, key.Curve.Params().Name)
+			}
+			return nil
+		}
+	case jose.HS256, jose.HS384, jose.HS512:
+		if secret, ok := private.([]byte); ok {
+			if len(secret) < minSecretLength[alg] {
+				return fmt.Errorf("signing method %s requires a secret of at least %d bytes", alg, minSecretLength[alg])
+			}
+			return nil
+		}
+	case jose.EdDSA:
+		if _, ok := private.(ed25519.PrivateKey); ok {
+			return nil
+		}
+	default:
+		return fmt.Errorf("unknown signing method %s", alg)
+	}
+	return fmt.Errorf("signing method %s cannot be used with key of type %T", alg, private)
+}
+
+var curves = map[jose.SignatureAlgorithm]elliptic.Curve{
+	jose.ES256: elliptic.P256(),
+	jose.ES384: elliptic.P384(),
+	jose.ES512: elliptic.P521(),
+}
+
+// minSecretLength is the hash size of the HMAC algorithm as required by
+// RFC 7518 section 3.2.
+var minSecretLength = map[jose.SignatureAlgorithm]int{
+	jose.HS256: 32,
+	jose.HS384: 48,
+	jose.HS512: 64,
+}
+
+// KeyGenerator creates a fresh key that is added to the keyring as next key
+// on every rotation.
+type KeyGenerator func() (*Key, error)
+
+// GenerateKey returns a KeyGenerator for keys of the given algorithm.
+func GenerateKey(alg jose.SignatureAlgorithm) (KeyGenerator, error) {
+	var generate func() (interface{}, error)
+	switch alg {
+	case jose.RS256, jose.RS384, jose.RS512:
+		generate = func() (interface{}, error) {
+			return rsa.GenerateKey(rand.Reader, 2048)
+		}
+	case jose.ES256, jose.ES384, jose.ES512:
+		generate = func() (interface{}, error) {
+			return ecdsa.GenerateKey(curves[alg], rand.Reader)
+		}
+	case jose.HS256, jose.HS384, jose.HS512:
+		generate = func() (interface{}, error) {
+			secret := make([]byte, minSecretLength[alg])
+			_, err := rand.Read(secret)
+			return secret, err
+		}
+	case jose.EdDSA:
+		generate = func() (interface{}, error) {
+			_, private, err := ed25519.GenerateKey(rand.Reader)
+			return private, err
+		}
+	default:
+		return nil, fmt.Errorf("generating keys for signing method %s is not supported", alg)
+	}
+	return func() (*Key, error) {
+		private, err := generate()
+		if err != nil {
+			return nil, err
+		}
+		return NewKey("", alg, private, KeyNext)
+	}, nil
+}
+
+// ErrNoNextKey is returned if a rotation is requested but there is no key
+// to rotate to.
+var ErrNoNextKey = errors.New("no next key to rotate to")
+
+// Keyring holds exactly one active signing key, optionally one pre-published
+// next key and any number of retired keys that are still needed for
+// verification.
+type Keyring struct {
+	mu        sync.RWMutex
+	keys      []*Key
+	retention time.Duration
+	generate  KeyGenerator
+}
+
+// NewKeyring creates a keyring from the given keys. retention is the duration
+// a key is kept after being retired, which should be at least the maximum
+// lifetime of a token. If generate is not nil, a next key is created if none
+// was given, and on each rotation.
+func NewKeyring(keys []*Key, retention time.Duration, generate KeyGenerator) (*Keyring, error) {
+	active, next := 0, 0
+	ids := map[string]bool{}
+	for _, key := range keys {
+		if ids[key.ID] {
+			return nil, fmt.Errorf("duplicate key id %s", key.ID)
+		}
+		ids[key.ID] = true
+		switch key.Status {
+		case KeyActive:
+			active++
+		case KeyNext:
+			next++
+		case KeyRetired:
+		default:
+			return nil, fmt.Errorf("key %s has unknown status %s", key.ID, key.Status)
+		}
+	}
+	if active != 1 {
+		return nil, fmt.Errorf("keyring needs exactly one active key, found %d", active)
+	}
+	if next > 1 {
+		return nil, fmt.Errorf("keyring allows at most one next key, found %d", next)
+	}
+
+	keyring := &Keyring{keys: keys, retention: retention, generate: generate}
+	if next == 0 && generate != nil {
+		key, err := generate()
+		if err != nil {
+			return nil, err
+		}
+		keyring.keys = append(keyring.keys, key)
+	}
+	return keyring, nil
+}
+
+// Active returns the key new tokens are signed with.
+func (k *Keyring) Active() *Key {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	for _, key := range k.keys {
+		if key.Status == KeyActive {
+			return key
+		}
+	}
+	return nil
+}
+
+// Key returns the unexpired key with the given id or nil if there is none.
+func (k *Keyring) Key(id string) *Key {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	now := time.Now()
+	for _, key := range k.keys {
+		if key.ID == id && !key.expired(now) {
+			return key
+		}
+	}
+	return nil
+}
+
+// Keys returns all unexpired keys, the active one first.
+func (k *Keyring) Keys() []*Key {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	now := time.Now()
+	keys := []*Key{}
+	for _, key := range k.keys {
+		if key.Status == KeyActive {
+			keys = append([]*Key{key}, keys...)
+		} else if !key.expired(now) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// PublicKeys returns the public keys of all unexpired keys as JWKs. HMAC
+// secrets are never included.
+func (k *Keyring) PublicKeys() []jose.JSONWebKey {
+	jwks := []jose.JSONWebKey{}
+	for _, key := range k.Keys() {
+		if public := key.Public(); public != nil {
+			jwks = append(jwks, publicJWK(public, key.ID, key.Algorithm))
+		}
+	}
+	return jwks
+}
+
+// Rotate retires the active key, promotes the next key to be the active one
+// and, if the keyring has a generator, pre-publishes a new next key.
+func (k *Keyring) Rotate() error {
+	var generated *Key
+	if k.generate != nil {
+		key, err := k.generate()
+		if err != nil {
+			return err
+		}
+		generated = key
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	var active, next *Key
+	for _, key := range k.keys {
+		switch key.Status {
+		case KeyActive:
+			active = key
+		case KeyNext:
+			next = key
+		}
+	}
+	if next == nil {
+		return ErrNoNextKey
+	}
+
+	now := time.Now()
+	active.Status = KeyRetired
+	active.ExpiresAt = now.Add(k.retention)
+	next.Status = KeyActive
+
+	keys := []*Key{}
+	for _, key := range k.keys {
+		if !key.expired(now) {
+			keys = append(keys, key)
+		}
+	}
+	if generated != nil {
+		keys = append(keys, generated)
+	}
+	k.keys = keys
+
+	log.Infof("rotated signing key from %s to %s", active.ID, next.ID)
+	return nil
+}
+
+// RotateEvery rotates the keyring in the given interval until stop is closed.
+func (k *Keyring) RotateEvery(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := k.Rotate(); err != nil {
+				log.Errorf("error rotating signing key, %v", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// NewKeyringFromConfig creates the keyring from the configured signing keys.
+// Scheduled rotation requires a key generator, so it is only set up if a
+// rotation interval is configured.
+func NewKeyringFromConfig(config *config.Config) (*Keyring, error) {
+	alg, ok := SigningMethods[config.SigningMethod]
+	if !ok {
+		return nil, fmt.Errorf("unknown signing method %s", config.SigningMethod)
+	}
+
+	active, err := NewKey("", alg, config.PrivateKey, KeyActive)
+	if err != nil {
+		return nil, err
+	}
+	keys := []*Key{active}
+	for _, signingKey := range config.SigningKeys {
+		key, err := NewKey(signingKey.ID, alg, signingKey.PrivateKey, KeyStatus(signingKey.Status))
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	var generate KeyGenerator
+	if config.RotationIntervalSeconds > 0 {
+		generate, err = GenerateKey(alg)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	retention := time.Duration(config.ExpirySeconds) * time.Second
+	return NewKeyring(keys, retention, generate)
+}
@@ -0,0 +1,72 @@
+package core
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+	"time"
+
+	jose "github.com/go-jose/go-jose/v3"
+	"github.com/krinklesaurus/jwt-proxy/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyringFromConfig(t *testing.T) {
+	conf, _ := config.Initialize("../test/config-test.yml")
+	keyring, err := NewKeyringFromConfig(conf)
+	assert.Nil(t, err, "err should be nothing")
+
+	keys := keyring.Keys()
+	assert.Len(t, keys, 2)
+	assert.Equal(t, KeyActive, keys[0].Status)
+	assert.Equal(t, KeyNext, keys[1].Status)
+	assert.Len(t, keyring.PublicKeys(), 2)
+}
+
+func TestKeyringRotation(t *testing.T) {
+	generate, err := GenerateKey(jose.RS256)
+	assert.Nil(t, err, "err should be nothing")
+	active, err := generate()
+	assert.Nil(t, err, "err should be nothing")
+	active.Status = KeyActive
+
+	keyring, err := NewKeyring([]*Key{active}, time.Hour, generate)
+	assert.Nil(t, err, "err should be nothing")
+	assert.Len(t, keyring.PublicKeys(), 2, "next key should be pre-published")
+
+	tokenizer := NewKeyringTokenizer(keyring)
+	oldToken, err := tokenizer.Serialize(Claims{"user": "before"})
+	assert.Nil(t, err, "err should be nothing")
+
+	next := keyring.Keys()[1]
+	assert.Nil(t, tokenizer.Rotate())
+	assert.Equal(t, next.ID, keyring.Active().ID)
+	assert.Equal(t, KeyRetired, active.Status)
+	assert.Len(t, keyring.PublicKeys(), 3, "retired and new next key should be published")
+
+	claims, err := tokenizer.Verify(oldToken)
+	assert.Nil(t, err, "token signed with retired key should still be valid")
+	assert.Equal(t, "before", claims.Get("user"))
+
+	newToken, err := tokenizer.Serialize(Claims{"user": "after"})
+	assert.Nil(t, err, "err should be nothing")
+	claims, err = tokenizer.Verify(newToken)
+	assert.Nil(t, err, "err should be nothing")
+	assert.Equal(t, "after", claims.Get("user"))
+
+	active.ExpiresAt = time.Now().Add(-time.Second)
+	assert.Len(t, keyring.PublicKeys(), 2, "expired key should not be published")
+	_, err = tokenizer.Verify(oldToken)
+	assert.NotNil(t, err, "token signed with expired key should be invalid")
+}
+
+func TestKeyringRotationWithoutNextKey(t *testing.T) {
+	private, _ := rsa.GenerateKey(rand.Reader, 2048)
+	key, _ := NewKey("", jose.RS256, private, KeyActive)
+	keyring, err := NewKeyring([]*Key{key}, time.Hour, nil)
+	assert.Nil(t, err, "err should be nothing")
+	assert.Equal(t, ErrNoNextKey, keyring.Rotate())
+
+	_, err = NewKeyring([]*Key{}, time.Hour, nil)
+	assert.NotNil(t, err, "keyring without active key should fail")
+}
@@ -0,0 +1,75 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+
+	jose "github.com/go-jose/go-jose/v3"
+	"github.com/go-jose/go-jose/v3/jwt"
+)
+
+// NewKeyringTokenizer creates a tokenizer that signs tokens with the active
+// key of the keyring and verifies them with any of its unexpired keys.
+func NewKeyringTokenizer(keyring *Keyring) *KeyringTokenizer {
+	return &KeyringTokenizer{keyring: keyring}
+}
+
+// NewTokenizer creates a tokenizer for the signing method that signs every
+// token with the given private key, which is an *rsa.PrivateKey,
+// *ecdsa.PrivateKey, ed25519.PrivateKey or []byte secret for HMAC.
+func NewTokenizer(signingMethod jose.SignatureAlgorithm, privKey interface{}) (Tokenizer, error) {
+	return newSingleKeyTokenizer(signingMethod, privKey)
+}
+
+func newSingleKeyTokenizer(signingMethod jose.SignatureAlgorithm, privKey interface{}) (*KeyringTokenizer, error) {
+	key, err := NewKey("", signingMethod, privKey, KeyActive)
+	if err != nil {
+		return nil, err
+	}
+	keyring, err := NewKeyring([]*Key{key}, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+	return NewKeyringTokenizer(keyring), nil
+}
+
+type KeyringTokenizer struct {
+	keyring *Keyring
+}
+
+func (t *KeyringTokenizer) Serialize(claims map[string]interface{}) ([]byte, error) {
+	key := t.keyring.Active()
+	signer, err := newSigner(key.Algorithm, key.ID, key.Private)
+	if err != nil {
+		return nil, err
+	}
+	jwt, err := jwt.Signed(signer).Claims(claims).CompactSerialize()
+	if err != nil {
+		return nil, err
+	}
+	return []byte(jwt), nil
+}
+
+// Verify verifies the token with the key referenced by its kid header. Every
+// token is issued with a kid, so tokens without one are rejected.
+func (t *KeyringTokenizer) Verify(token []byte) (Claims, error) {
+	return verifySigned(token, func(header jose.Header) (*Key, error) {
+		if header.KeyID == "" {
+			return nil, errors.New("missing key id")
+		}
+		key := t.keyring.Key(header.KeyID)
+		if key == nil {
+			return nil, fmt.Errorf("unknown key id %s", header.KeyID)
+		}
+		return key, nil
+	})
+}
+
+func (t *KeyringTokenizer) PublicKeys() ([]jose.JSONWebKey, error) {
+	return t.keyring.PublicKeys(), nil
+}
+
+// Rotate rotates the signing key of the underlying keyring.
+func (t *KeyringTokenizer) Rotate() error {
+	return t.keyring.Rotate()
+}
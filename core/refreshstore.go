@@ -0,0 +1,139 @@
+package core
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+var (
+	// ErrRefreshTokenInvalid is returned for unknown or expired refresh tokens.
+	ErrRefreshTokenInvalid = errors.New("refresh token is invalid or expired")
+	// ErrRefreshTokenReused is returned if a refresh token is used a second
+	// time. The whole family of refresh tokens is revoked in that case, as
+	// either the legitimate client or an attacker holds a stolen copy.
+	ErrRefreshTokenReused = errors.New("refresh token was already used")
+)
+
+// RefreshSession is the server side state of a refresh token. Every refresh
+// token can be used once and is replaced by a new one of the same family.
+type RefreshSession struct {
+	// ID is the hash of the refresh token handed out to the client.
+	ID         string
+	Family     string
+	ProviderID string
+	User       string
+	Client     string
+	Token      oauth2.Token
+	Used       bool
+	ExpiresAt  time.Time
+}
+
+// RefreshStore stores refresh sessions.
+type RefreshStore interface {
+	Save(session *RefreshSession) error
+	// Use marks the session as used and returns it. If it was used before,
+	// the session's family is revoked and ErrRefreshTokenReused is returned.
+	Use(id string) (*RefreshSession, error)
+	// Release undoes Use of the session, whose token may have been renewed
+	// meanwhile, so that a refresh that failed upstream can be retried.
+	Release(session *RefreshSession) error
+	RevokeFamily(family string) error
+	RevokeUser(user string) error
+	RevokeProvider(providerID string) error
+}
+
+// NewMemoryRefreshStore creates a RefreshStore that keeps all sessions in
+// memory.
+func NewMemoryRefreshStore() *MemoryRefreshStore {
+	return &MemoryRefreshStore{sessions: map[string]*RefreshSession{}}
+}
+
+type MemoryRefreshStore struct {
+	mu       sync.Mutex
+	sessions map[string]*RefreshSession
+}
+
+func (s *MemoryRefreshStore) Save(session *RefreshSession) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for id, existing := range s.sessions {
+		if now.After(existing.ExpiresAt) {
+			delete(s.sessions, id)
+		}
+	}
+	s.sessions[session.ID] = session
+	return nil
+}
+
+func (s *MemoryRefreshStore) Use(id string) (*RefreshSession, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, ok := s.sessions[id]
+	if !ok || time.Now().After(session.ExpiresAt) {
+		return nil, ErrRefreshTokenInvalid
+	}
+	if session.Used {
+		s.revokeFamily(session.Family)
+		return nil, ErrRefreshTokenReused
+	}
+	session.Used = true
+	used := *session
+	return &used, nil
+}
+
+func (s *MemoryRefreshStore) Release(session *RefreshSession) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// the family might have been revoked meanwhile
+	if _, ok := s.sessions[session.ID]; !ok {
+		return ErrRefreshTokenInvalid
+	}
+	released := *session
+	released.Used = false
+	s.sessions[session.ID] = &released
+	return nil
+}
+
+func (s *MemoryRefreshStore) RevokeFamily(family string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.revokeFamily(family)
+	return nil
+}
+
+func (s *MemoryRefreshStore) RevokeUser(user string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, session := range s.sessions {
+		if session.User == user {
+			delete(s.sessions, id)
+		}
+	}
+	return nil
+}
+
+func (s *MemoryRefreshStore) RevokeProvider(providerID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, session := range s.sessions {
+		if session.ProviderID == providerID {
+			delete(s.sessions, id)
+		}
+	}
+	return nil
+}
+
+func (s *MemoryRefreshStore) revokeFamily(family string) {
+	for id, session := range s.sessions {
+		if session.Family == family {
+			delete(s.sessions, id)
+		}
+	}
+}
@@ -3,20 +3,11 @@ package core
 import (
 	"crypto/rsa"
 
-	"github.com/SermoDigital/jose/crypto"
-	"github.com/SermoDigital/jose/jws"
+	jose "github.com/go-jose/go-jose/v3"
 )
 
-func NewRSATokenizer(signingMethod crypto.SigningMethod, privKey *rsa.PrivateKey) Tokenizer {
-	return &RSATokenizer{signingMethod: signingMethod, privKey: privKey}
-}
-
-type RSATokenizer struct {
-	signingMethod crypto.SigningMethod
-	privKey       *rsa.PrivateKey
-}
-
-func (t *RSATokenizer) Serialize(claims map[string]interface{}) ([]byte, error) {
-	jwt := jws.NewJWT(claims, t.signingMethod)
-	return jwt.Serialize(t.privKey)
+// NewRSATokenizer creates a tokenizer that signs every token with the given
+// private key. Use NewKeyringTokenizer for rotating keys.
+func NewRSATokenizer(signingMethod jose.SignatureAlgorithm, privKey *rsa.PrivateKey) (Tokenizer, error) {
+	return newSingleKeyTokenizer(signingMethod, privKey)
 }
@@ -0,0 +1,77 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/krinklesaurus/jwt-proxy/config"
+	"github.com/krinklesaurus/jwt-proxy/user"
+	"github.com/krinklesaurus/jwt-proxy/util"
+)
+
+// ServiceProvider is the provider claim of the tokens of service accounts.
+const ServiceProvider = "service"
+
+// ErrInvalidTarget is returned if a service account requests a token for an
+// audience it is not allowed to, see RFC 8707 section 2.
+var ErrInvalidTarget = errors.New("invalid_target")
+
+// AuthenticateServiceAccount checks the service account's secret against its
+// bcrypt hash. Unknown accounts take as long to reject as wrong secrets.
+func (c *Core) AuthenticateServiceAccount(id string, secret string) (*config.ServiceAccount, error) {
+	account := c.Config.ServiceAccount(id)
+	secrets := user.Credentials{}
+	if account != nil {
+		secrets[account.ID] = account.SecretHash
+	}
+	if err := secrets.Verify(id, secret); err != nil {
+		return nil, fmt.Errorf("%w: wrong secret or unknown service account %s", ErrInvalidClient, id)
+	}
+	return account, nil
+}
+
+// ServiceAccountClaims returns the claims of a token for the authenticated
+// service account, whose sub and user are the account's id. The token is
+// issued for the requested audiences, which the account must be allowed to
+// request, or for all of its audiences if none are requested.
+func (c *Core) ServiceAccountClaims(account *config.ServiceAccount, audiences []string) (Claims, error) {
+	for _, audience := range audiences {
+		if !account.AudienceAllowed(audience) {
+			return nil, fmt.Errorf("%w: service account %s may not request audience %s", ErrInvalidTarget, account.ID, audience)
+		}
+	}
+	if len(audiences) == 0 {
+		audiences = account.Audiences
+	}
+	if len(audiences) == 0 {
+		audiences = []string{c.Config.Claims.ForProvider(ServiceProvider).Audience}
+	}
+
+	claims := Claims{}
+	for name, value := range account.Claims {
+		claims.Set(name, value)
+	}
+	claims.SetIssuer(c.Config.RootURI)
+	claims.SetSubject(account.ID)
+	claims.SetAudience(audiences...)
+
+	jti, err := util.SecureRandomString(16)
+	if err != nil {
+		return nil, err
+	}
+	claims.SetID(jti)
+
+	now := time.Now()
+	lifetime := time.Duration(account.ExpirySeconds) * time.Second
+	if lifetime > c.maxTokenLifetime() {
+		lifetime = c.maxTokenLifetime()
+	}
+	claims.SetExpiration(now.Add(lifetime))
+	claims.SetIssuedAt(now)
+
+	claims.Set("provider", ServiceProvider)
+	claims.Set("user", account.ID)
+	claims.Set("client_id", account.ID)
+	return claims, nil
+}
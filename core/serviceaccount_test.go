@@ -0,0 +1,48 @@
+package core
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/krinklesaurus/jwt-proxy/config"
+	"github.com/krinklesaurus/jwt-proxy/user"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServiceAccount(t *testing.T) {
+	conf, _ := config.Initialize("../test/config-test.yml")
+	core := New(conf, rsaTokenizer(t, conf.PrivateRSAKey), user.PlainUserService{})
+
+	_, err := core.AuthenticateServiceAccount("ci", "wrong")
+	assert.True(t, errors.Is(err, ErrInvalidClient))
+	_, err = core.AuthenticateServiceAccount("unknown", "ci-secret")
+	assert.True(t, errors.Is(err, ErrInvalidClient))
+	account, err := core.AuthenticateServiceAccount("ci", "ci-secret")
+	assert.Nil(t, err, "err should be nothing")
+
+	_, err = core.ServiceAccountClaims(account, []string{"your-audience"})
+	assert.True(t, errors.Is(err, ErrInvalidTarget))
+
+	claims, err := core.ServiceAccountClaims(account, nil)
+	assert.Nil(t, err, "err should be nothing")
+	assert.Equal(t, []string{"some-api", "other-api"}, claims.Get("aud"))
+
+	claims, err = core.ServiceAccountClaims(account, []string{"some-api"})
+	assert.Nil(t, err, "err should be nothing")
+	data, err := core.JwtToken(claims)
+	assert.Nil(t, err, "err should be nothing")
+
+	verified, err := core.VerifyToken(data)
+	assert.Nil(t, err, "err should be nothing")
+	assert.Equal(t, "ci", verified.Subject())
+	assert.Equal(t, "some-api", verified.Get("aud"))
+	assert.Equal(t, ServiceProvider, verified.Get("provider"))
+	assert.Equal(t, "ci", verified.Get("client_id"))
+	assert.Equal(t, "deployer", verified.Get("role"))
+	assert.WithinDuration(t, time.Now().Add(5*time.Minute), verified.Expiration(), 5*time.Second)
+
+	assert.Nil(t, core.RevokeProvider(ServiceProvider))
+	_, err = core.VerifyToken(data)
+	assert.True(t, errors.Is(err, ErrTokenRevoked))
+}
@@ -0,0 +1,76 @@
+package core
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrTooManyAttempts is returned while a throttled key is locked out.
+var ErrTooManyAttempts = errors.New("too many failed attempts, try again later")
+
+// NewThrottle creates a Throttle that locks a key out once it failed
+// maxFailures times within window, until window has passed since its first
+// failure.
+func NewThrottle(maxFailures int, window time.Duration) *Throttle {
+	return &Throttle{maxFailures: maxFailures, window: window, failures: map[string]*failures{}}
+}
+
+// Throttle counts failed attempts, e.g. of guessing a password or a user
+// code, per key like a username or a client address.
+type Throttle struct {
+	maxFailures int
+	window      time.Duration
+
+	mu       sync.Mutex
+	failures map[string]*failures
+}
+
+type failures struct {
+	count int
+	since time.Time
+}
+
+// Allowed returns ErrTooManyAttempts if any of the keys is locked out.
+func (t *Throttle) Allowed(keys ...string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	for _, key := range keys {
+		if f, ok := t.failures[key]; ok && f.count >= t.maxFailures && now.Before(f.since.Add(t.window)) {
+			return ErrTooManyAttempts
+		}
+	}
+	return nil
+}
+
+// Fail counts a failed attempt for each of the keys.
+func (t *Throttle) Fail(keys ...string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	for key, f := range t.failures {
+		if now.After(f.since.Add(t.window)) {
+			delete(t.failures, key)
+		}
+	}
+	for _, key := range keys {
+		f, ok := t.failures[key]
+		if !ok {
+			f = &failures{since: now}
+			t.failures[key] = f
+		}
+		f.count++
+	}
+}
+
+// Reset forgets the failed attempts of the keys after a successful attempt.
+func (t *Throttle) Reset(keys ...string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, key := range keys {
+		delete(t.failures, key)
+	}
+}
@@ -0,0 +1,67 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+
+	"github.com/krinklesaurus/jwt-proxy/provider"
+	"golang.org/x/oauth2"
+)
+
+// ExchangeToken looks up the user of an access token the caller got from the
+// provider itself, see RFC 8693. The provider must confirm that the token was
+// issued to the configured client, as the user info of any token of the
+// provider would do otherwise, which lets every other app of the provider
+// log in as its users. The returned token info is the same as after logging
+// in with the provider, so its claims are too. Tokens the provider rejects
+// are ErrInvalidGrant.
+func (c *Core) ExchangeToken(ctx context.Context, providerID string, accessToken string) (*TokenInfo, error) {
+	p := c.Config.Providers[providerID]
+	if p == nil || !c.Config.TokenExchange[providerID] {
+		return nil, fmt.Errorf("%w: token exchange is not enabled for provider %s", ErrInvalidRequest, providerID)
+	}
+	verifier, ok := p.(provider.TokenVerifier)
+	if !ok {
+		return nil, fmt.Errorf("%w: provider %s cannot verify access tokens", ErrInvalidRequest, providerID)
+	}
+	if accessToken == "" {
+		return nil, fmt.Errorf("%w: missing subject token", ErrInvalidRequest)
+	}
+
+	providerToken := oauth2.Token{AccessToken: accessToken, TokenType: "Bearer"}
+	err := verifier.VerifyToken(ctx, &providerToken)
+	if errors.Is(err, provider.ErrVerificationUnsupported) {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidRequest, err)
+	}
+	if err != nil {
+		if providerUnavailable(err) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w: %s rejected the subject token: %v", ErrInvalidGrant, providerID, err)
+	}
+	profile, err := p.User(ctx, &providerToken)
+	if err != nil {
+		if providerUnavailable(err) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w: %s rejected the subject token: %v", ErrInvalidGrant, providerID, err)
+	}
+	user, err := c.userService.UniqueUser(providerID, profile.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &TokenInfo{Token: providerToken, User: user, Provider: p, Profile: profile}, nil
+}
+
+// providerUnavailable returns true if the provider could not be asked or
+// failed itself, as opposed to rejecting the token.
+func providerUnavailable(err error) bool {
+	var statusErr *provider.StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= 500
+	}
+	var urlErr *url.Error
+	return errors.As(err, &urlErr)
+}
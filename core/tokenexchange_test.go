@@ -0,0 +1,71 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/krinklesaurus/jwt-proxy/config"
+	"github.com/krinklesaurus/jwt-proxy/provider"
+	"github.com/krinklesaurus/jwt-proxy/user"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2"
+)
+
+// statusProvider answers user lookups with the status of its access token,
+// like a provider whose user info endpoint rejects or fails.
+type statusProvider struct {
+	codeProvider
+}
+
+func (m statusProvider) User(ctx context.Context, token *oauth2.Token) (*provider.Profile, error) {
+	switch token.AccessToken {
+	case "expired":
+		return nil, &provider.StatusError{URL: "https://example.com/user", StatusCode: http.StatusUnauthorized}
+	case "outage":
+		return nil, &provider.StatusError{URL: "https://example.com/user", StatusCode: http.StatusBadGateway}
+	}
+	return m.codeProvider.User(ctx, token)
+}
+
+// VerifyToken accepts all tokens but those of another audience.
+func (m statusProvider) VerifyToken(ctx context.Context, token *oauth2.Token) error {
+	if token.AccessToken == "other-audience" {
+		return provider.ErrForeignToken
+	}
+	return nil
+}
+
+func TestExchangeToken(t *testing.T) {
+	conf, _ := config.Initialize("../test/config-test.yml")
+	conf.Providers["mock_provider"] = statusProvider{}
+	core := New(conf, rsaTokenizer(t, conf.PrivateRSAKey), user.PlainUserService{})
+
+	_, err := core.ExchangeToken(context.Background(), "mock_provider", "user-1234")
+	assert.True(t, errors.Is(err, ErrInvalidRequest), "token exchange must be enabled per provider")
+
+	conf.TokenExchange["mock_provider"] = true
+	_, err = core.ExchangeToken(context.Background(), "mock_provider", "")
+	assert.True(t, errors.Is(err, ErrInvalidRequest))
+	_, err = core.ExchangeToken(context.Background(), "mock_provider", "expired")
+	assert.True(t, errors.Is(err, ErrInvalidGrant))
+	_, err = core.ExchangeToken(context.Background(), "mock_provider", "other-audience")
+	assert.True(t, errors.Is(err, ErrInvalidGrant), "tokens issued to other clients must be rejected")
+	_, err = core.ExchangeToken(context.Background(), "mock_provider", "outage")
+	assert.NotNil(t, err)
+	assert.False(t, errors.Is(err, ErrInvalidGrant), "failures of the provider are no invalid grant")
+
+	token, err := core.ExchangeToken(context.Background(), "mock_provider", "user-1234")
+	assert.Nil(t, err, "err should be nothing")
+	assert.Equal(t, "user-1234", token.AccessToken)
+	claims, err := core.Claims(token)
+	assert.Nil(t, err, "err should be nothing")
+	assert.Equal(t, "mock_provider", claims.Get("provider"))
+	assert.Equal(t, "mock_provider:user-1234", claims.Get("user"))
+
+	conf.Providers["unverifiable"] = codeProvider{}
+	conf.TokenExchange["unverifiable"] = true
+	_, err = core.ExchangeToken(context.Background(), "unverifiable", "user-1234")
+	assert.True(t, errors.Is(err, ErrInvalidRequest), "providers that cannot verify tokens must be rejected")
+}
@@ -1,6 +1,75 @@
 package core
 
-// Tokenizer creates a byte array from an input map.
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	jose "github.com/go-jose/go-jose/v3"
+	"github.com/go-jose/go-jose/v3/jwt"
+)
+
+// Tokenizer creates a signed JWT from an input map, verifies JWTs it
+// created before and exposes the public keys needed for verification.
 type Tokenizer interface {
 	Serialize(claims map[string]interface{}) ([]byte, error)
+	Verify(token []byte) (Claims, error)
+	PublicKeys() ([]jose.JSONWebKey, error)
+}
+
+// ErrInvalidToken is returned if a token could not be verified.
+var ErrInvalidToken = errors.New("invalid token")
+
+// Wrapper is implemented by tokenizers that wrap a signing tokenizer, e.g. to
+// encrypt its tokens.
+type Wrapper interface {
+	Unwrap() Tokenizer
+}
+
+// SigningTokenizer returns the innermost tokenizer of wrapped tokenizers,
+// whose tokens are only signed.
+func SigningTokenizer(tokenizer Tokenizer) Tokenizer {
+	for {
+		wrapper, ok := tokenizer.(Wrapper)
+		if !ok {
+			return tokenizer
+		}
+		tokenizer = wrapper.Unwrap()
+	}
+}
+
+// Rotator is implemented by tokenizers whose signing key can be rotated.
+type Rotator interface {
+	Rotate() error
+}
+
+// verifySigned parses the compact serialized JWS token, looks up the key it
+// was signed with, checks that the algorithm matches the key and validates its
+// signature and time based claims.
+func verifySigned(token []byte, lookup func(header jose.Header) (*Key, error)) (Claims, error) {
+	jwtToken, err := jwt.ParseSigned(string(token))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	if len(jwtToken.Headers) != 1 {
+		return nil, fmt.Errorf("%w: expected exactly one signature", ErrInvalidToken)
+	}
+	header := jwtToken.Headers[0]
+	key, err := lookup(header)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	if header.Algorithm != string(key.Algorithm) {
+		return nil, fmt.Errorf("%w: unexpected signing method %s", ErrInvalidToken, header.Algorithm)
+	}
+
+	registered := jwt.Claims{}
+	claims := Claims{}
+	if err := jwtToken.Claims(key.verificationKey(), &registered, &claims); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	if err := registered.Validate(jwt.Expected{Time: time.Now()}); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	return claims, nil
 }
@@ -0,0 +1,105 @@
+package core
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+
+	jose "github.com/go-jose/go-jose/v3"
+	"github.com/go-jose/go-jose/v3/jwt"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenizers(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	p256Key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	p384Key, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	p521Key, _ := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	secret := []byte("0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef")
+
+	tests := []struct {
+		alg        jose.SignatureAlgorithm
+		key        interface{}
+		publicKeys int
+	}{
+		{jose.RS256, rsaKey, 1},
+		{jose.RS512, rsaKey, 1},
+		{jose.ES256, p256Key, 1},
+		{jose.ES384, p384Key, 1},
+		{jose.ES512, p521Key, 1},
+		{jose.HS256, secret, 0},
+		{jose.HS384, secret, 0},
+		{jose.HS512, secret, 0},
+		{jose.EdDSA, edKey, 1},
+	}
+
+	for _, test := range tests {
+		t.Run(string(test.alg), func(t *testing.T) {
+			tokenizer, err := NewTokenizer(test.alg, test.key)
+			assert.Nil(t, err, "err should be nothing")
+
+			data, err := tokenizer.Serialize(Claims{"user": "someone"})
+			assert.Nil(t, err, "err should be nothing")
+
+			claims, err := tokenizer.Verify(data)
+			assert.Nil(t, err, "err should be nothing")
+			assert.Equal(t, "someone", claims.Get("user"))
+
+			publicKeys, err := tokenizer.PublicKeys()
+			assert.Nil(t, err, "err should be nothing")
+			assert.Len(t, publicKeys, test.publicKeys)
+			for _, publicKey := range publicKeys {
+				assert.True(t, publicKey.IsPublic())
+				assert.Equal(t, string(test.alg), publicKey.Algorithm)
+			}
+
+			_, err = tokenizer.Verify(append(data, 'x'))
+			assert.NotNil(t, err, "tampered token should be invalid")
+		})
+	}
+}
+
+func TestTokenizerKeyMismatch(t *testing.T) {
+	p384Key, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	_, err := NewECDSATokenizer(jose.ES256, p384Key)
+	assert.NotNil(t, err, "ES256 must not accept P-384 keys")
+
+	_, err = NewHMACTokenizer(jose.HS256, []byte("too short"))
+	assert.NotNil(t, err, "HS256 must not accept short secrets")
+
+	_, err = NewTokenizer(jose.RS256, p384Key)
+	assert.NotNil(t, err, "RS256 must not accept EC keys")
+
+	_, err = NewRSATokenizer(jose.RS256, nil)
+	assert.NotNil(t, err, "RS256 must not accept a missing key")
+}
+
+func TestTokenizerRejectsMissingKeyID(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	tokenizer, _ := NewHMACTokenizer(jose.HS256, secret)
+
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.HS256, Key: secret}, (&jose.SignerOptions{}).WithType("JWT"))
+	assert.Nil(t, err, "err should be nothing")
+	data, err := jwt.Signed(signer).Claims(map[string]interface{}{"user": "someone"}).CompactSerialize()
+	assert.Nil(t, err, "err should be nothing")
+
+	_, err = tokenizer.Verify([]byte(data))
+	assert.NotNil(t, err, "tokens without kid should be invalid")
+}
+
+func TestTokenizerRejectsForeignAlgorithm(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	hmacTokenizer, _ := NewHMACTokenizer(jose.HS256, secret)
+	p256Key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ecdsaTokenizer, _ := NewECDSATokenizer(jose.ES256, p256Key)
+
+	data, err := hmacTokenizer.Serialize(Claims{"user": "someone"})
+	assert.Nil(t, err, "err should be nothing")
+
+	_, err = ecdsaTokenizer.Verify(data)
+	assert.NotNil(t, err, "token signed by other key should be invalid")
+}
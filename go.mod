@@ -3,16 +3,18 @@ module github.com/krinklesaurus/jwt-proxy
 go 1.12
 
 require (
-	github.com/SermoDigital/jose v0.9.2-0.20180104203859-803625baeddc
 	github.com/alecthomas/template v0.0.0-20190718012654-fb15b899a751
+	github.com/crewjam/saml v0.4.14
+	github.com/go-jose/go-jose/v3 v3.0.4
 	github.com/gorilla/mux v1.8.0
 	github.com/gorilla/sessions v1.2.1
 	github.com/satori/go.uuid v1.2.0
 	github.com/sirupsen/logrus v1.8.1
+	github.com/spf13/cast v1.4.1
 	github.com/spf13/viper v1.10.1
-	github.com/stretchr/testify v1.7.0
+	github.com/stretchr/testify v1.8.1 // crewjam/saml v0.4.14 requires at least v1.8.1
 	github.com/urfave/negroni/v2 v2.0.2
-	golang.org/x/crypto v0.0.0-20220112180741-5e0467b6c7ce
-	golang.org/x/net v0.0.0-20220114011407-0dd24b26b47d
+	golang.org/x/crypto v0.19.0
+	golang.org/x/net v0.10.0
 	golang.org/x/oauth2 v0.0.0-20211104180415-d3ed0bb246c8
 )
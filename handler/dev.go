@@ -0,0 +1,57 @@
+package handler
+
+import (
+	"fmt"
+	htmltemplate "html/template"
+	"net/http"
+
+	"github.com/krinklesaurus/jwt-proxy/log"
+	"github.com/krinklesaurus/jwt-proxy/provider"
+)
+
+// DevLoginHandler renders the form of the dev provider, on which any
+// username, email and groups can be typed in.
+func (handler *Handler) DevLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if handler.devProvider() == nil {
+		http.Error(w, "That's not the provider you're looking for", http.StatusNotFound)
+		return
+	}
+
+	page := fmt.Sprintf("%s/%s", handler.config.WWWRootDir, "dev.html")
+	devTemplate, err := htmltemplate.ParseFiles(page)
+	if err != nil {
+		log.Errorf("error parsing %s, error is %v", page, err.Error())
+		http.Error(w, "Sorry, some unknown error occurred", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	devTemplate.Execute(w, struct {
+		State string
+	}{r.URL.Query().Get("state")})
+}
+
+// DevAuthorizeHandler takes the form of the dev provider and redirects to the
+// callback like a real provider would, whose state check protects the login.
+func (handler *Handler) DevAuthorizeHandler(w http.ResponseWriter, r *http.Request) {
+	devProvider := handler.devProvider()
+	if devProvider == nil {
+		http.Error(w, "That's not the provider you're looking for", http.StatusNotFound)
+		return
+	}
+
+	callbackURL, err := devProvider.Authorize(r.PostFormValue("state"), r.PostFormValue("username"), r.PostFormValue("email"), r.PostFormValue("groups"))
+	if err != nil {
+		log.Errorf("error authorizing dev login %s", err.Error())
+		http.Error(w, "Sorry, some unknown error occurred", http.StatusBadRequest)
+		return
+	}
+	log.Warnf("dev login of %s", r.PostFormValue("username"))
+	http.Redirect(w, r, callbackURL, http.StatusSeeOther)
+}
+
+// devProvider returns the dev provider, or nil if the dev login is disabled.
+func (handler *Handler) devProvider() *provider.DevProvider {
+	devProvider, _ := handler.config.Providers[provider.DevID].(*provider.DevProvider)
+	return devProvider
+}
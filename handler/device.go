@@ -0,0 +1,291 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"net"
+	"net/http"
+	neturl "net/url"
+	"strings"
+	"time"
+
+	"github.com/krinklesaurus/jwt-proxy/config"
+	"github.com/krinklesaurus/jwt-proxy/core"
+	"github.com/krinklesaurus/jwt-proxy/log"
+	"github.com/krinklesaurus/jwt-proxy/provider"
+)
+
+// deviceCodeGrantType is the grant type devices poll the token endpoint with,
+// see RFC 8628 section 3.4.
+const deviceCodeGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+// deviceAuthorizationResponse is the JSON body of the device authorization
+// endpoint, see RFC 8628 section 3.2.
+type deviceAuthorizationResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int64  `json:"expires_in"`
+	Interval                int64  `json:"interval"`
+}
+
+// DeviceCodeHandler is the device authorization endpoint, which hands out a
+// device code to poll the token endpoint with and a user code to type in at
+// the verification page. A client_id is optional, registered clients must
+// authenticate like at the token endpoint.
+func (handler *Handler) DeviceCodeHandler(w http.ResponseWriter, r *http.Request) {
+	clientID, secret, basic := clientCredentials(r)
+	if clientID != "" {
+		if _, err := handler.core.AuthenticateClient(clientID, secret); err != nil {
+			log.Errorf("error authenticating client %s", err.Error())
+			if basic {
+				w.Header().Set("WWW-Authenticate", `Basic realm="jwt-proxy"`)
+			}
+			writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "")
+			return
+		}
+	}
+
+	device, deviceCode, err := handler.core.AuthorizeDevice(clientID, r.PostFormValue("scope"))
+	if err != nil {
+		log.Errorf("error authorizing device %s", err.Error())
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+
+	userCode := core.FormatUserCode(device.UserCode)
+	verificationURI := handler.config.RootURI + "/jwt-proxy/device"
+	writeJSON(w, http.StatusOK, deviceAuthorizationResponse{
+		DeviceCode:              deviceCode,
+		UserCode:                userCode,
+		VerificationURI:         verificationURI,
+		VerificationURIComplete: verificationURI + "?" + neturl.Values{"user_code": {userCode}}.Encode(),
+		ExpiresIn:               int64(time.Until(device.ExpiresAt).Seconds()),
+		Interval:                int64(device.Interval.Seconds()),
+	})
+}
+
+// DeviceHandler renders the verification page, on which the user types in the
+// user code of their device and picks the provider to log in with.
+func (handler *Handler) DeviceHandler(w http.ResponseWriter, r *http.Request) {
+	handler.devicePage(w, r, http.StatusOK, r.URL.Query().Get("user_code"), "", "")
+}
+
+// DeviceVerifyHandler takes the form of the verification page. If the user
+// code is pending, it is kept in the session while the user logs in with the
+// chosen provider, after which completeLogin approves the device. The user
+// may deny the request instead.
+func (handler *Handler) DeviceVerifyHandler(w http.ResponseWriter, r *http.Request) {
+	csrf, err := handler.nonceStore.GetAndRemoveCSRF(w, r)
+	if err != nil {
+		log.Errorf("Could not retrieve nonce from store %s", err.Error())
+		http.Error(w, "Sorry, some unknown error occurred", http.StatusInternalServerError)
+		return
+	}
+	if csrf == "" || subtle.ConstantTimeCompare([]byte(csrf), []byte(r.PostFormValue("csrf"))) != 1 {
+		log.Errorf("csrf token of device verification doesn't match")
+		http.Error(w, "Sorry, some unknown error occurred", http.StatusForbidden)
+		return
+	}
+
+	userCode := r.PostFormValue("user_code")
+	_, err = handler.core.DeviceByUserCode(userCode, handler.clientAddress(r))
+	if err == nil && r.PostFormValue("deny") != "" {
+		err = handler.core.DenyDevice(userCode)
+	}
+	if errors.Is(err, core.ErrTooManyAttempts) {
+		log.Warnf("locking out %s after too many wrong user codes", handler.clientAddress(r))
+		handler.devicePage(w, r, http.StatusTooManyRequests, userCode, "Too many wrong codes, please try again later.", "")
+		return
+	}
+	if errors.Is(err, core.ErrInvalidUserCode) {
+		log.Warnf("rejecting unknown user code %s", userCode)
+		handler.devicePage(w, r, http.StatusBadRequest, userCode, "The code is wrong or expired, please check the code shown on your device.", "")
+		return
+	}
+	if err != nil {
+		log.Errorf("error verifying user code %s", err.Error())
+		http.Error(w, "Sorry, some unknown error occurred", http.StatusInternalServerError)
+		return
+	}
+	if r.PostFormValue("deny") != "" {
+		handler.devicePage(w, r, http.StatusOK, "", "", "The device was denied access. You can close this window.")
+		return
+	}
+
+	// for=device keeps the user code in the session at the login, which
+	// forgets it otherwise, so an unrelated later login can't approve it.
+	login := "/jwt-proxy/login"
+	providerID := r.PostFormValue("provider")
+	switch {
+	case providerID == provider.LocalID && handler.core.LocalEnabled():
+	case handler.config.Providers[providerID] != nil && providerID != provider.LocalID:
+		login = login + "/" + neturl.PathEscape(providerID)
+	default:
+		http.Error(w, "That's not the provider you're looking for", http.StatusBadRequest)
+		return
+	}
+
+	if err := handler.nonceStore.SetDevice(w, r, userCode); err != nil {
+		log.Errorf("error saving user code %s", err.Error())
+		http.Error(w, "Sorry, some unknown error occurred", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, login+"?for=device", http.StatusSeeOther)
+}
+
+// forgetDevice removes the user code from the session unless the login was
+// started by the verification page.
+func (handler *Handler) forgetDevice(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("for") == "device" {
+		return
+	}
+	if _, err := handler.nonceStore.GetAndRemoveDevice(w, r); err != nil {
+		log.Warnf("error removing user code from session: %v", err)
+	}
+}
+
+// clientAddress returns the IP address of the client. Requests of trusted
+// proxies are attributed to the rightmost address of their X-Forwarded-For
+// header that is not a trusted proxy itself, as proxies append the address
+// they received the request from.
+func (handler *Handler) clientAddress(r *http.Request) string {
+	address, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		address = r.RemoteAddr
+	}
+	if !handler.config.TrustedProxy(address) {
+		return address
+	}
+	forwarded := strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(forwarded[i])
+		if hop == "" {
+			continue
+		}
+		address = hop
+		if !handler.config.TrustedProxy(hop) {
+			break
+		}
+	}
+	return address
+}
+
+// approveDevice completes the device authorization of the user code after the
+// user logged in.
+func (handler *Handler) approveDevice(w http.ResponseWriter, r *http.Request, userCode string, token *core.TokenInfo) {
+	err := handler.core.ApproveDevice(userCode, token)
+	if errors.Is(err, core.ErrInvalidUserCode) {
+		log.Warnf("user code %s expired during login", userCode)
+		handler.errorPage(w, http.StatusBadRequest, "Code expired", "Your login took too long, please start over on your device.")
+		return
+	}
+	if err != nil {
+		log.Errorf("error approving device %s", err.Error())
+		http.Error(w, "Sorry, some unknown error occurred", http.StatusInternalServerError)
+		return
+	}
+	handler.devicePage(w, r, http.StatusOK, "", "", "Your device is logged in. You can close this window.")
+}
+
+// devicePage renders device.html of the www root with a fresh CSRF nonce. If
+// message is set, it is shown instead of the form.
+func (handler *Handler) devicePage(w http.ResponseWriter, r *http.Request, status int, userCode string, errorMessage string, message string) {
+	page := fmt.Sprintf("%s/%s", handler.config.WWWRootDir, "device.html")
+	deviceTemplate, err := htmltemplate.ParseFiles(page)
+	if err != nil {
+		log.Errorf("error parsing %s, error is %v", page, err.Error())
+		http.Error(w, "Sorry, some unknown error occurred", http.StatusInternalServerError)
+		return
+	}
+
+	csrf, err := handler.nonceStore.CreateNonce(w, r)
+	if err != nil {
+		log.Errorf("error creating csrf %s", err.Error())
+		http.Error(w, "Sorry, some unknown error occurred", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	deviceTemplate.Execute(w, struct {
+		UserCode     string
+		Error        string
+		Message      string
+		LocalEnabled bool
+		Providers    []config.ProviderInfo
+		CSRF         string
+	}{
+		userCode,
+		errorMessage,
+		message,
+		handler.core.LocalEnabled(),
+		handler.core.Providers(),
+		csrf,
+	})
+}
+
+// deviceCodeGrant answers the polls of a device with the JWT of the user once
+// they approved it, see RFC 8628 section 3.5.
+func (handler *Handler) deviceCodeGrant(w http.ResponseWriter, r *http.Request) {
+	clientID, secret, basic := clientCredentials(r)
+	if clientID != "" {
+		if _, err := handler.core.AuthenticateClient(clientID, secret); err != nil {
+			log.Errorf("error authenticating client %s", err.Error())
+			if basic {
+				w.Header().Set("WWW-Authenticate", `Basic realm="jwt-proxy"`)
+			}
+			writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "")
+			return
+		}
+	}
+
+	device, err := handler.core.PollDevice(clientID, r.PostFormValue("device_code"))
+	if err != nil {
+		for _, known := range []error{core.ErrAuthorizationPending, core.ErrSlowDown, core.ErrAccessDenied, core.ErrExpiredToken, core.ErrInvalidGrant} {
+			if errors.Is(err, known) {
+				writeOAuthError(w, http.StatusBadRequest, known.Error(), "")
+				return
+			}
+		}
+		log.Errorf("error polling device code %s", err.Error())
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+
+	claims, err := handler.core.Claims(device.Token)
+	if err != nil {
+		log.Errorf("error %s", err.Error())
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+	if device.Scope != "" {
+		claims.Set("scope", device.Scope)
+	}
+	accessToken, err := handler.core.JwtToken(claims)
+	if err != nil {
+		log.Errorf("error %s", err.Error())
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+
+	response := tokenResponse{
+		AccessToken: string(accessToken),
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(time.Until(claims.Expiration()).Seconds()),
+		Scope:       device.Scope,
+	}
+	if handler.config.RefreshExpirySeconds > 0 && device.Token.Refreshable() {
+		response.RefreshToken, err = handler.core.IssueRefreshToken(device.Token)
+		if err != nil {
+			log.Errorf("error issuing refresh token %s", err.Error())
+			writeOAuthError(w, http.StatusInternalServerError, "server_error", "")
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
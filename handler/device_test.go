@@ -0,0 +1,130 @@
+package handler
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/krinklesaurus/jwt-proxy/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func newDeviceServer(t *testing.T) *testServer {
+	return newTestServer(t, func(conf *config.Config) {
+		conf.DeviceExpirySeconds = 600
+	})
+}
+
+// authorizeDevice requests a device code and returns the device code and the
+// user code.
+func authorizeDevice(t *testing.T, server *testServer) (string, string) {
+	response := server.post("/jwt-proxy/device/code", url.Values{"scope": {"openid"}})
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	device := decode(t, response)
+	assert.Equal(t, server.URL+"/jwt-proxy/device", device["verification_uri"])
+	return device["device_code"].(string), device["user_code"].(string)
+}
+
+// verifyUserCode types in the user code on the verification page.
+func verifyUserCode(t *testing.T, server *testServer, userCode string, form url.Values) *http.Response {
+	form.Set("csrf", csrf(t, server.get("/jwt-proxy/device?user_code="+url.QueryEscape(userCode))))
+	form.Set("user_code", userCode)
+	return server.post("/jwt-proxy/device", form)
+}
+
+func pollDevice(t *testing.T, server *testServer, deviceCode string) (int, map[string]interface{}) {
+	response := server.post("/jwt-proxy/token", url.Values{"grant_type": {deviceCodeGrantType}, "device_code": {deviceCode}})
+	return response.StatusCode, decode(t, response)
+}
+
+func TestDeviceAuthorizationGrant(t *testing.T) {
+	server := newDeviceServer(t)
+	defer server.Close()
+
+	deviceCode, userCode := authorizeDevice(t, server)
+	status, poll := pollDevice(t, server, deviceCode)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, "authorization_pending", poll["error"])
+
+	response := verifyUserCode(t, server, "BCDF-GHJK", url.Values{"provider": {"dev"}})
+	assert.Equal(t, http.StatusBadRequest, response.StatusCode, "unknown user codes should be rejected")
+
+	response = verifyUserCode(t, server, userCode, url.Values{"provider": {"unknown"}})
+	assert.Equal(t, http.StatusBadRequest, response.StatusCode)
+
+	response = verifyUserCode(t, server, userCode, url.Values{"provider": {"dev"}})
+	assert.Equal(t, http.StatusSeeOther, response.StatusCode)
+	assert.Equal(t, "/jwt-proxy/login/dev?for=device", response.Header.Get("Location"))
+	response = server.devLogin(response.Header.Get("Location"), "octocat")
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Contains(t, body(t, response), "Your device is logged in")
+
+	status, poll = pollDevice(t, server, deviceCode)
+	assert.Equal(t, http.StatusOK, status)
+	claims, err := server.core.VerifyToken([]byte(poll["access_token"].(string)))
+	assert.Nil(t, err, "err should be nothing")
+	assert.Equal(t, "dev:octocat", claims.Get("user"))
+	assert.Equal(t, "openid", claims.Get("scope"))
+
+	status, poll = pollDevice(t, server, deviceCode)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, "invalid_grant", poll["error"], "the login is handed out once")
+}
+
+func TestDeviceAuthorizationDenied(t *testing.T) {
+	server := newDeviceServer(t)
+	defer server.Close()
+
+	deviceCode, userCode := authorizeDevice(t, server)
+	response := verifyUserCode(t, server, userCode, url.Values{"deny": {"true"}})
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Contains(t, body(t, response), "denied")
+
+	status, poll := pollDevice(t, server, deviceCode)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, "access_denied", poll["error"])
+
+	response = server.post("/jwt-proxy/device", url.Values{"user_code": {userCode}, "csrf": {"forged"}})
+	assert.Equal(t, http.StatusForbidden, response.StatusCode)
+}
+
+func TestDeviceUserCodeIsBoundToItsLogin(t *testing.T) {
+	server := newDeviceServer(t)
+	defer server.Close()
+
+	deviceCode, userCode := authorizeDevice(t, server)
+	response := verifyUserCode(t, server, userCode, url.Values{"provider": {"dev"}})
+	assert.Equal(t, http.StatusSeeOther, response.StatusCode)
+
+	// the user abandons the device login and logs in for themselves later
+	response = server.devLogin("/jwt-proxy/login/dev", "octocat")
+	assert.Equal(t, http.StatusFound, response.StatusCode)
+	assert.NotEmpty(t, location(t, response).Query().Get("token"))
+
+	status, poll := pollDevice(t, server, deviceCode)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, "authorization_pending", poll["error"], "an unrelated login must not approve the device")
+}
+
+func TestDeviceUserCodeLockout(t *testing.T) {
+	server := newDeviceServer(t)
+	defer server.Close()
+
+	_, userCode := authorizeDevice(t, server)
+	for i := 0; i < 5; i++ {
+		response := verifyUserCode(t, server, "BCDF-GHJK", url.Values{"provider": {"dev"}})
+		assert.Equal(t, http.StatusBadRequest, response.StatusCode)
+	}
+	response := verifyUserCode(t, server, userCode, url.Values{"provider": {"dev"}})
+	assert.Equal(t, http.StatusTooManyRequests, response.StatusCode, "clients guessing user codes should be locked out")
+}
+
+func TestDeviceEndpointsDisabled(t *testing.T) {
+	server := newTestServer(t, nil)
+	defer server.Close()
+
+	response := server.post("/jwt-proxy/device/code", url.Values{})
+	assert.Equal(t, http.StatusNotFound, response.StatusCode)
+	response = server.post("/jwt-proxy/token", url.Values{"grant_type": {deviceCodeGrantType}, "device_code": {"code"}})
+	assert.Equal(t, "unsupported_grant_type", decode(t, response)["error"])
+}
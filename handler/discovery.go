@@ -0,0 +1,165 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/krinklesaurus/jwt-proxy/log"
+)
+
+// Names of the routes that are published in the discovery documents.
+const (
+	RouteAuthorization = "authorization"
+	RouteToken         = "token"
+	RouteUserInfo      = "userinfo"
+	RouteRefresh       = "refresh"
+	RouteRevocation    = "revocation"
+	RouteIntrospection = "introspection"
+	RouteJWKS          = "jwks"
+	// RouteDeviceAuthorization is the endpoint of RFC 8628 section 3.1.
+	RouteDeviceAuthorization = "device_authorization"
+)
+
+// metadata is the union of OpenID Connect Discovery 1.0 provider metadata and
+// RFC 8414 authorization server metadata.
+type metadata struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint,omitempty"`
+	TokenEndpoint                     string   `json:"token_endpoint,omitempty"`
+	UserInfoEndpoint                  string   `json:"userinfo_endpoint,omitempty"`
+	RevocationEndpoint                string   `json:"revocation_endpoint,omitempty"`
+	IntrospectionEndpoint             string   `json:"introspection_endpoint,omitempty"`
+	DeviceAuthorizationEndpoint       string   `json:"device_authorization_endpoint,omitempty"`
+	JWKSURI                           string   `json:"jwks_uri"`
+	ScopesSupported                   []string `json:"scopes_supported,omitempty"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported,omitempty"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported,omitempty"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported,omitempty"`
+	ClaimsSupported                   []string `json:"claims_supported,omitempty"`
+}
+
+// DiscoveryHandler returns the handler for both /.well-known/openid-configuration
+// and /.well-known/oauth-authorization-server. The endpoints are looked up by
+// name in the router, so only registered endpoints are published.
+func (handler *Handler) DiscoveryHandler(router *mux.Router) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		metadata, err := handler.metadata(router)
+		if err != nil {
+			log.Errorf("error creating discovery document %s", err.Error())
+			http.Error(w, "Sorry, some unknown error occurred", http.StatusInternalServerError)
+			return
+		}
+
+		json, err := json.Marshal(metadata)
+		if err != nil {
+			log.Errorf("error marshalling discovery document %s", err.Error())
+			http.Error(w, "Sorry, some unknown error occurred", http.StatusInternalServerError)
+			return
+		}
+		writeCacheable(w, r, "application/json", json)
+	}
+}
+
+func (handler *Handler) metadata(router *mux.Router) (*metadata, error) {
+	endpoint := func(name string) string {
+		route := router.Get(name)
+		if route == nil {
+			return ""
+		}
+		url, err := route.URL()
+		if err != nil {
+			return ""
+		}
+		return handler.config.RootURI + url.Path
+	}
+
+	grantTypes := []string{}
+	var scopes, authMethods, challengeMethods []string
+	authorizationEndpoint := endpoint(RouteAuthorization)
+	if authorizationEndpoint != "" {
+		grantTypes = append(grantTypes, "authorization_code")
+		scopes = []string{"openid"}
+		authMethods = []string{"client_secret_basic", "client_secret_post", "none"}
+		challengeMethods = []string{"S256"}
+	}
+	if endpoint(RouteRefresh) != "" {
+		grantTypes = append(grantTypes, "refresh_token")
+	}
+	deviceAuthorizationEndpoint := endpoint(RouteDeviceAuthorization)
+	if deviceAuthorizationEndpoint != "" {
+		grantTypes = append(grantTypes, deviceCodeGrantType)
+	}
+	if handler.config.TokenExchangeEnabled() {
+		grantTypes = append(grantTypes, tokenExchangeGrantType)
+	}
+	if len(handler.config.ServiceAccounts) > 0 {
+		grantTypes = append(grantTypes, "client_credentials")
+		if authMethods == nil {
+			authMethods = []string{"client_secret_basic", "client_secret_post"}
+		}
+	}
+
+	algs, err := handler.signingAlgorithms()
+	if err != nil {
+		return nil, err
+	}
+
+	claims := []string{"iss", "sub", "aud", "exp", "iat", "jti", "auth_time", "nonce", "provider", "user"}
+	seen := map[string]bool{}
+	for _, claim := range claims {
+		seen[claim] = true
+	}
+	mappings := handler.config.Claims.Mapping
+	for _, provider := range handler.config.Claims.Providers {
+		mappings = append(mappings, provider.Mapping...)
+	}
+	for _, mapping := range mappings {
+		if !seen[mapping.Claim] {
+			seen[mapping.Claim] = true
+			claims = append(claims, mapping.Claim)
+		}
+	}
+
+	return &metadata{
+		Issuer:                            handler.config.RootURI,
+		AuthorizationEndpoint:             authorizationEndpoint,
+		TokenEndpoint:                     endpoint(RouteToken),
+		UserInfoEndpoint:                  endpoint(RouteUserInfo),
+		RevocationEndpoint:                endpoint(RouteRevocation),
+		IntrospectionEndpoint:             endpoint(RouteIntrospection),
+		DeviceAuthorizationEndpoint:       deviceAuthorizationEndpoint,
+		JWKSURI:                           endpoint(RouteJWKS),
+		ScopesSupported:                   scopes,
+		ResponseTypesSupported:            []string{"code"},
+		GrantTypesSupported:               grantTypes,
+		SubjectTypesSupported:             []string{"public"},
+		IDTokenSigningAlgValuesSupported:  algs,
+		TokenEndpointAuthMethodsSupported: authMethods,
+		CodeChallengeMethodsSupported:     challengeMethods,
+		ClaimsSupported:                   claims,
+	}, nil
+}
+
+// signingAlgorithms returns the configured signing method along with the
+// algorithms of all published keys.
+func (handler *Handler) signingAlgorithms() ([]string, error) {
+	jwks, err := handler.core.JWKS()
+	if err != nil {
+		return nil, err
+	}
+	algs := []string{handler.config.SigningMethod}
+	for _, key := range jwks.Keys {
+		known := false
+		for _, alg := range algs {
+			known = known || alg == key.Algorithm
+		}
+		if !known {
+			algs = append(algs, key.Algorithm)
+		}
+	}
+	return algs, nil
+}
@@ -1,17 +1,24 @@
 package handler
 
 import (
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
+	htmltemplate "html/template"
 	"net/http"
-
-	"github.com/SermoDigital/jose/jws"
+	neturl "net/url"
+	"strings"
+	"time"
 
 	"github.com/alecthomas/template"
 	"github.com/gorilla/mux"
 	"github.com/krinklesaurus/jwt-proxy/config"
 	"github.com/krinklesaurus/jwt-proxy/core"
 	"github.com/krinklesaurus/jwt-proxy/log"
+	"github.com/krinklesaurus/jwt-proxy/provider"
+	"github.com/krinklesaurus/jwt-proxy/user"
 )
 
 type Handler struct {
@@ -47,10 +54,92 @@ func (handler *Handler) jwtHandler(w http.ResponseWriter, r *http.Request, token
 	jwtAsString := string(tokenByte)
 
 	url := handler.core.RedirectURI()
-	urlWithToken := fmt.Sprintf(url+"?token=%s", jwtAsString)
+	urlWithToken := fmt.Sprintf(url+"?token=%s", neturl.QueryEscape(jwtAsString))
+
+	if handler.config.RefreshExpirySeconds > 0 && token.Refreshable() {
+		refreshToken, err := handler.core.IssueRefreshToken(token)
+		if err != nil {
+			log.Errorf("error issuing refresh token %s", err.Error())
+			http.Error(w, "Sorry, some unknown error occurred", http.StatusInternalServerError)
+			return
+		}
+		urlWithToken = urlWithToken + "&refresh_token=" + neturl.QueryEscape(refreshToken)
+	}
+
 	http.Redirect(w, r, urlWithToken, 302)
 }
 
+// tokenResponse is the JSON body of successful token endpoint responses, see
+// RFC 6749 section 5.1.
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	IDToken      string `json:"id_token,omitempty"`
+	Scope        string `json:"scope,omitempty"`
+}
+
+// writeJSON writes the value as JSON with the given status code. Responses
+// are never cached as they might contain tokens.
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	body, err := json.Marshal(value)
+	if err != nil {
+		log.Errorf("error marshalling response %s", err.Error())
+		http.Error(w, "Sorry, some unknown error occurred", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// writeOAuthError writes an RFC 6749 section 5.2 error response.
+func writeOAuthError(w http.ResponseWriter, status int, code string, description string) {
+	writeJSON(w, status, struct {
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description,omitempty"`
+	}{code, description})
+}
+
+// RefreshHandler exchanges a refresh token for a new JWT and a new refresh
+// token. Every refresh token can only be used once.
+func (handler *Handler) RefreshHandler(w http.ResponseWriter, r *http.Request) {
+	refreshToken := r.PostFormValue("refresh_token")
+	if refreshToken == "" {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "missing refresh_token")
+		return
+	}
+
+	token, newRefreshToken, err := handler.core.Refresh(r.Context(), refreshToken)
+	if err != nil {
+		log.Errorf("error refreshing token %s", err.Error())
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "refresh token is invalid, expired or revoked")
+		return
+	}
+
+	claims, err := handler.core.Claims(token)
+	if err != nil {
+		log.Errorf("error %s", err.Error())
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+	tokenByte, err := handler.core.JwtToken(claims)
+	if err != nil {
+		log.Errorf("error %s", err.Error())
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, tokenResponse{
+		AccessToken:  string(tokenByte),
+		TokenType:    "Bearer",
+		ExpiresIn:    int64(time.Until(claims.Expiration()).Seconds()),
+		RefreshToken: newRefreshToken,
+	})
+}
+
 func (handler *Handler) HomeHandler(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/jwt-proxy/login", 302)
 }
@@ -73,13 +162,19 @@ func (handler *Handler) CallbackHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	queryParams := r.URL.Query()
-	code := queryParams.Get("code")
-	state := queryParams.Get("state")
+	// providers like Apple post the callback parameters instead of sending
+	// them in the query
+	if err := r.ParseForm(); err != nil {
+		log.Errorf("error parsing callback params %s", err.Error())
+		http.Error(w, "Sorry, some unknown error occurred", http.StatusBadRequest)
+		return
+	}
+	code := r.Form.Get("code")
+	state := r.Form.Get("state")
 
 	log.Debugf("received code %s and state %s", code, state)
 
-	nonce, err := handler.nonceStore.GetAndRemove(r)
+	nonce, err := handler.nonceStore.GetAndRemove(w, r)
 	if err != nil {
 		log.Errorf("Could not retrieve nonce from store %s", err.Error())
 		http.Error(w, "Sorry, some unknown error occurred", http.StatusInternalServerError)
@@ -92,13 +187,55 @@ func (handler *Handler) CallbackHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	token, err := handler.core.GenTokenInfo(providerName, code)
+	verifier, idTokenNonce, err := handler.nonceStore.GetAndRemoveVerifier(w, r)
+	if err != nil {
+		log.Errorf("Could not retrieve code verifier from store %s", err.Error())
+		http.Error(w, "Sorry, some unknown error occurred", http.StatusInternalServerError)
+		return
+	}
+
+	ctx := provider.WithIDTokenNonce(provider.WithCallbackParams(r.Context(), r.Form), idTokenNonce)
+	token, err := handler.core.GenTokenInfo(ctx, providerName, code, verifier)
+	if errors.Is(err, provider.ErrNotAllowed) {
+		log.Warnf("rejecting login %s", err.Error())
+		handler.errorPage(w, http.StatusForbidden, "Access denied",
+			"The account you logged in with is not allowed to use this service, "+strings.TrimPrefix(err.Error(), provider.ErrNotAllowed.Error()+": ")+".")
+		return
+	}
 	if err != nil {
 		log.Errorf("error retrieving token %s", err.Error())
 		http.Error(w, "Sorry, some unknown error occurred", http.StatusInternalServerError)
 		return
 	}
 
+	handler.completeLogin(w, r, token)
+}
+
+// completeLogin answers the pending authorization request of the session, if
+// any, approves the device the user logs in for, or redirects to the redirect
+// URI with the JWT of the logged in user.
+func (handler *Handler) completeLogin(w http.ResponseWriter, r *http.Request, token *core.TokenInfo) {
+	requestID, err := handler.nonceStore.GetAndRemoveAuthorization(w, r)
+	if err != nil {
+		log.Errorf("Could not retrieve authorization request from store %s", err.Error())
+		http.Error(w, "Sorry, some unknown error occurred", http.StatusInternalServerError)
+		return
+	}
+	if requestID != "" {
+		handler.authorizationHandler(w, r, requestID, token)
+		return
+	}
+	userCode, err := handler.nonceStore.GetAndRemoveDevice(w, r)
+	if err != nil {
+		log.Errorf("Could not retrieve user code from store %s", err.Error())
+		http.Error(w, "Sorry, some unknown error occurred", http.StatusInternalServerError)
+		return
+	}
+	if userCode != "" {
+		handler.approveDevice(w, r, userCode, token)
+		return
+	}
+
 	handler.jwtHandler(w, r, token)
 }
 
@@ -112,6 +249,7 @@ func (handler *Handler) LoginHandler(w http.ResponseWriter, r *http.Request) {
 
 	supportedProviders := handler.core.Providers()
 
+	handler.forgetDevice(w, r)
 	csrf, err := handler.nonceStore.CreateNonce(w, r)
 	if err != nil {
 		log.Errorf("error creating csrf %s", err.Error())
@@ -120,11 +258,13 @@ func (handler *Handler) LoginHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	templateData := struct {
+		LocalEnabled bool
 		LocalAuthURL string
-		Providers    []string
+		Providers    []config.ProviderInfo
 		CSRF         string
 	}{
-		"/auth",
+		handler.core.LocalEnabled(),
+		"/jwt-proxy/auth",
 		supportedProviders,
 		csrf,
 	}
@@ -132,27 +272,128 @@ func (handler *Handler) LoginHandler(w http.ResponseWriter, r *http.Request) {
 	loginTemplate.Execute(w, templateData)
 }
 
+// LocalLoginHandler logs in a local account with the username and password of
+// the login page's form, which is protected by the CSRF nonce of the session.
+func (handler *Handler) LocalLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if !handler.core.LocalEnabled() {
+		http.Error(w, "That's not the provider you're looking for", http.StatusNotFound)
+		return
+	}
+
+	csrf, err := handler.nonceStore.GetAndRemoveCSRF(w, r)
+	if err != nil {
+		log.Errorf("Could not retrieve nonce from store %s", err.Error())
+		http.Error(w, "Sorry, some unknown error occurred", http.StatusInternalServerError)
+		return
+	}
+	if csrf == "" || subtle.ConstantTimeCompare([]byte(csrf), []byte(r.PostFormValue("csrf"))) != 1 {
+		log.Errorf("csrf token of local login doesn't match")
+		http.Error(w, "Sorry, some unknown error occurred", http.StatusForbidden)
+		return
+	}
+
+	username := r.PostFormValue("username")
+	token, err := handler.core.LocalLogin(username, r.PostFormValue("password"), handler.clientAddress(r))
+	if errors.Is(err, user.ErrInvalidCredentials) {
+		log.Warnf("rejecting local login of %s", username)
+		handler.errorPage(w, http.StatusUnauthorized, "Login failed", "The username or password is wrong.")
+		return
+	}
+	if errors.Is(err, core.ErrTooManyAttempts) {
+		log.Warnf("locking out local login of %s from %s after too many wrong passwords", username, handler.clientAddress(r))
+		handler.errorPage(w, http.StatusTooManyRequests, "Login failed", "Too many failed logins, please try again later.")
+		return
+	}
+	if err != nil {
+		log.Errorf("error logging in local account %s", err.Error())
+		http.Error(w, "Sorry, some unknown error occurred", http.StatusInternalServerError)
+		return
+	}
+
+	handler.completeLogin(w, r, token)
+}
+
+// errorPage renders error.html of the www root with the title and message,
+// which is escaped as it may contain e.g. the user's email. If the page cannot
+// be rendered, the message is returned as plain text.
+func (handler *Handler) errorPage(w http.ResponseWriter, status int, title string, message string) {
+	page := fmt.Sprintf("%s/%s", handler.config.WWWRootDir, "error.html")
+	errorTemplate, err := htmltemplate.ParseFiles(page)
+	if err != nil {
+		log.Errorf("error parsing %s, error is %v", page, err.Error())
+		http.Error(w, message, status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	errorTemplate.Execute(w, struct {
+		Title   string
+		Message string
+	}{title, message})
+}
+
 func (handler *Handler) ProviderLoginHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	provider := vars["provider"]
+	providerID := vars["provider"]
+
+	verifier, err := handler.core.CodeVerifier(providerID)
+	if err != nil {
+		log.Errorf("error creating code verifier %s", err.Error())
+		http.Error(w, "Sorry, some unknown error occurred", http.StatusInternalServerError)
+		return
+	}
+	idTokenNonce, err := provider.GenerateNonce()
+	if err != nil {
+		log.Errorf("error creating id_token nonce %s", err.Error())
+		http.Error(w, "Sorry, some unknown error occurred", http.StatusInternalServerError)
+		return
+	}
 
-	state, err := handler.nonceStore.CreateNonce(w, r)
+	handler.forgetDevice(w, r)
+	createNonce := handler.nonceStore.CreateNonceWithVerifier
+	if postsBack(handler.config.Providers[providerID]) {
+		createNonce = handler.nonceStore.CreateCrossSiteNonce
+	}
+	state, err := createNonce(w, r, verifier, idTokenNonce)
 	if err != nil {
 		log.Errorf("error creating nonce %s", err.Error())
 		http.Error(w, "Sorry, some unknown error occurred", http.StatusInternalServerError)
 		return
 	}
 
-	authCodeURL, err := handler.core.AuthURL(provider, state)
+	authCodeURL, err := handler.core.AuthURL(providerID, state, verifier, idTokenNonce)
 	if err != nil {
 		log.Errorf("error getting auth url, %v", err)
 		http.Error(w, "That's not the provider you're looking for", http.StatusBadRequest)
+		return
 	}
 	log.Debugf("redirecting to %s", authCodeURL)
 	http.Redirect(w, r, authCodeURL, 302)
 }
 
+// postsBack returns true if the provider posts the login back to jwt-proxy
+// from its own site, like Sign in with Apple and SAML identity providers do.
+func postsBack(p provider.Provider) bool {
+	switch p.(type) {
+	case *provider.AppleProvider, *provider.SAMLProvider:
+		return true
+	}
+	return false
+}
+
+// jwksMaxAge is the number of seconds verifiers may cache the public keys.
+const jwksMaxAge = 3600
+
+// PublicKeyHandler returns the PEM encoded public keys. If the client asks for
+// a JSON Web Key Set, either with ?format=jwks or the Accept header, the keys
+// are returned the same way as from the JWKSHandler.
 func (handler *Handler) PublicKeyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("format") == "jwks" || strings.Contains(r.Header.Get("Accept"), "application/jwk-set+json") {
+		handler.JWKSHandler(w, r)
+		return
+	}
+
 	publicKeys, err := handler.core.PublicKeys()
 	if err != nil {
 		log.Errorf("error reading public key %s", err.Error())
@@ -166,18 +407,154 @@ func (handler *Handler) PublicKeyHandler(w http.ResponseWriter, r *http.Request)
 		Keys: publicKeys,
 	})
 
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(json)
+	writeCacheable(w, r, "application/json", json)
+}
+
+// JWKSHandler returns the public keys as RFC 7517 JSON Web Key Set.
+func (handler *Handler) JWKSHandler(w http.ResponseWriter, r *http.Request) {
+	jwks, err := handler.core.JWKS()
+	if err != nil {
+		log.Errorf("error reading public keys %s", err.Error())
+		http.Error(w, "Sorry, some unknown error occurred", http.StatusInternalServerError)
+		return
+	}
+
+	json, err := json.Marshal(jwks)
+	if err != nil {
+		log.Errorf("error marshalling jwks %s", err.Error())
+		http.Error(w, "Sorry, some unknown error occurred", http.StatusInternalServerError)
+		return
+	}
+
+	writeCacheable(w, r, "application/jwk-set+json", json)
+}
+
+// writeCacheable writes the body along with Cache-Control and ETag headers and
+// answers conditional requests with 304 Not Modified.
+func writeCacheable(w http.ResponseWriter, r *http.Request, contentType string, body []byte) {
+	etag := fmt.Sprintf("\"%x\"", sha256.Sum256(body))
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", jwksMaxAge))
+	w.Header().Set("ETag", etag)
+
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		for _, candidate := range strings.Split(match, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == etag || candidate == "*" {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Write(body)
+}
+
+// tokenFromRequest extracts the JWT either from the Authorization header or
+// from the access_token form parameter.
+func tokenFromRequest(r *http.Request) ([]byte, error) {
+	if token, err := bearerToken(r); err == nil {
+		return token, nil
+	}
+	if token := r.FormValue("access_token"); token != "" {
+		return []byte(token), nil
+	}
+	return nil, fmt.Errorf("no token present in request")
+}
+
+// bearerToken extracts the bearer token from the Authorization header only.
+func bearerToken(r *http.Request) ([]byte, error) {
+	if auth := r.Header.Get("Authorization"); len(auth) > 7 && strings.EqualFold(auth[:7], "bearer ") {
+		return []byte(auth[7:]), nil
+	}
+	return nil, fmt.Errorf("no bearer token present in request")
+}
+
+// RotateKeysHandler rotates the signing key. It requires the configured admin
+// secret as bearer token and returns the new JSON Web Key Set.
+func (handler *Handler) RotateKeysHandler(w http.ResponseWriter, r *http.Request) {
+	if !handler.authorizeAdmin(w, r) {
+		return
+	}
+
+	if err := handler.core.RotateKeys(); err != nil {
+		log.Errorf("error rotating keys %s", err.Error())
+		status := http.StatusInternalServerError
+		if errors.Is(err, core.ErrNoNextKey) {
+			status = http.StatusConflict
+		}
+		http.Error(w, "Sorry, some unknown error occurred", status)
+		return
+	}
+
+	handler.JWKSHandler(w, r)
+}
+
+// RevokeHandler revokes the token given in the form parameter token, see
+// RFC 7009. As required by the RFC, invalid tokens are answered with 200, too.
+func (handler *Handler) RevokeHandler(w http.ResponseWriter, r *http.Request) {
+	token := r.PostFormValue("token")
+	if token == "" {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "missing token")
+		return
+	}
+	if err := handler.core.RevokeToken([]byte(token)); err != nil {
+		log.Debugf("not revoking token: %v", err)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// AdminRevokeHandler revokes tokens by one of the form parameters jti, user or
+// provider. It requires the configured admin secret as bearer token.
+func (handler *Handler) AdminRevokeHandler(w http.ResponseWriter, r *http.Request) {
+	if !handler.authorizeAdmin(w, r) {
+		return
+	}
+
+	var err error
+	if jti := r.PostFormValue("jti"); jti != "" {
+		log.Infof("revoking token %s", jti)
+		err = handler.core.RevokeID(jti)
+	} else if user := r.PostFormValue("user"); user != "" {
+		log.Infof("revoking all tokens of user %s", user)
+		err = handler.core.RevokeUser(user)
+	} else if provider := r.PostFormValue("provider"); provider != "" {
+		log.Infof("revoking all tokens of provider %s", provider)
+		err = handler.core.RevokeProvider(provider)
+	} else {
+		http.Error(w, "one of jti, user or provider is required", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Errorf("error revoking tokens %s", err.Error())
+		http.Error(w, "Sorry, some unknown error occurred", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// authorizeAdmin checks that the request carries the admin secret as bearer
+// token in the Authorization header and answers with 401 otherwise. Unlike
+// JWTs, the secret is never accepted as form parameter, which would end up in
+// logs and browser histories.
+func (handler *Handler) authorizeAdmin(w http.ResponseWriter, r *http.Request) bool {
+	secret, err := bearerToken(r)
+	if err != nil || handler.config.AdminSecret == "" ||
+		subtle.ConstantTimeCompare(secret, []byte(handler.config.AdminSecret)) != 1 {
+		http.Error(w, "not authorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
 }
 
 func (handler *Handler) VerifyToken(w http.ResponseWriter, r *http.Request) {
-	jwt, err := jws.ParseJWTFromRequest(r)
+	token, err := tokenFromRequest(r)
 	if err != nil {
 		log.Errorf("no jwt found: %v", err)
 		http.Error(w, "no jwt found", http.StatusUnauthorized)
 		return
 	}
-	err = jwt.Validate(handler.config.PublicRSAKey, core.SigningMethods[handler.config.SigningMethod])
+	_, err = handler.core.VerifyToken(token)
 	if err != nil {
 		log.Errorf("no valid jwt: %v", err)
 		http.Error(w, "no valid jwt", http.StatusUnauthorized)
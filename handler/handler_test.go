@@ -0,0 +1,323 @@
+package handler
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	jose "github.com/go-jose/go-jose/v3"
+	"github.com/krinklesaurus/jwt-proxy/config"
+	"github.com/krinklesaurus/jwt-proxy/core"
+	"github.com/krinklesaurus/jwt-proxy/provider"
+	"github.com/krinklesaurus/jwt-proxy/user"
+	"github.com/stretchr/testify/assert"
+)
+
+// alicePassword is the password of the local account alice of the test
+// server.
+const alicePassword = "secret"
+
+// testServer runs the routes of jwt-proxy for the test config. The dev
+// provider and the local account alice are enabled, whose logins stand in for
+// the logins with any provider.
+type testServer struct {
+	*httptest.Server
+	t      *testing.T
+	config *config.Config
+	core   *core.Core
+	// client keeps the session cookie and does not follow redirects, so that
+	// tests can check where jwt-proxy redirects to.
+	client *http.Client
+}
+
+// newTestServer starts the test server, configure may change the config
+// before the routes are set up.
+func newTestServer(t *testing.T, configure func(conf *config.Config)) *testServer {
+	conf, err := config.Initialize("../test/config-test.yml")
+	if !assert.Nil(t, err, "err should be nothing") {
+		t.FailNow()
+	}
+	server := httptest.NewServer(http.NotFoundHandler())
+	conf.RootURI = server.URL
+	conf.WWWRootDir = "../www"
+	conf.DevLogin = true
+	conf.Providers[provider.DevID] = provider.NewDev(server.URL)
+	conf.Providers[provider.LocalID] = provider.NewLocal(server.URL, user.Credentials{
+		"alice": "$2a$10$kaTqKwAE5QgXJYo2pcdrfu6IH9zZAOy2sDJ8iaKYg9P3sw/RC.sZG",
+	})
+	if configure != nil {
+		configure(conf)
+	}
+
+	tokenizer, err := core.NewRSATokenizer(jose.RS256, conf.PrivateRSAKey)
+	if !assert.Nil(t, err, "err should be nothing") {
+		t.FailNow()
+	}
+	authCore := core.New(conf, tokenizer, user.PlainUserService{})
+	store, _ := NewHTTPSessionStore()
+	handler, _ := New(conf, authCore, store)
+	server.Config.Handler = handler.Router()
+
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{
+		Jar: jar,
+		CheckRedirect: func(r *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return &testServer{Server: server, t: t, config: conf, core: authCore, client: client}
+}
+
+// get requests the path, which may be an absolute URL of the server, e.g. a
+// redirect location.
+func (s *testServer) get(path string) *http.Response {
+	response, err := s.client.Get(s.url(path))
+	if !assert.Nil(s.t, err, "err should be nothing") {
+		s.t.FailNow()
+	}
+	return response
+}
+
+// post posts the form to the path.
+func (s *testServer) post(path string, form url.Values) *http.Response {
+	response, err := s.client.PostForm(s.url(path), form)
+	if !assert.Nil(s.t, err, "err should be nothing") {
+		s.t.FailNow()
+	}
+	return response
+}
+
+// do sends the request with the server's client.
+func (s *testServer) do(request *http.Request) *http.Response {
+	response, err := s.client.Do(request)
+	if !assert.Nil(s.t, err, "err should be nothing") {
+		s.t.FailNow()
+	}
+	return response
+}
+
+func (s *testServer) url(path string) string {
+	if strings.HasPrefix(path, "http") {
+		return path
+	}
+	return s.URL + path
+}
+
+// devLogin starts the login at path, follows the redirects to the form of the
+// dev provider, logs in as username and returns the response of the callback.
+func (s *testServer) devLogin(path string, username string) *http.Response {
+	response := s.get(path)
+	login := location(s.t, response)
+	for response.StatusCode == http.StatusFound && login.Path != "/jwt-proxy/dev" {
+		response = s.get(response.Header.Get("Location"))
+		login = location(s.t, response)
+	}
+	assert.Equal(s.t, "/jwt-proxy/dev", login.Path)
+
+	response = s.post("/jwt-proxy/dev", url.Values{"state": {login.Query().Get("state")}, "username": {username}})
+	assert.Equal(s.t, http.StatusSeeOther, response.StatusCode)
+	return s.get(response.Header.Get("Location"))
+}
+
+// csrf returns the CSRF nonce of the page's form.
+func csrf(t *testing.T, response *http.Response) string {
+	match := regexp.MustCompile(`name="csrf" value="([^"]+)"`).FindStringSubmatch(body(t, response))
+	if !assert.Len(t, match, 2, "page should have a csrf nonce") {
+		t.FailNow()
+	}
+	return match[1]
+}
+
+// location returns the parsed redirect location of the response.
+func location(t *testing.T, response *http.Response) *url.URL {
+	parsed, err := url.Parse(response.Header.Get("Location"))
+	assert.Nil(t, err, "err should be nothing")
+	return parsed
+}
+
+func body(t *testing.T, response *http.Response) string {
+	defer response.Body.Close()
+	contents, err := ioutil.ReadAll(response.Body)
+	assert.Nil(t, err, "err should be nothing")
+	return string(contents)
+}
+
+// decode decodes the JSON body of the response.
+func decode(t *testing.T, response *http.Response) map[string]interface{} {
+	defer response.Body.Close()
+	value := map[string]interface{}{}
+	assert.Nil(t, json.NewDecoder(response.Body).Decode(&value))
+	return value
+}
+
+func TestProviderLogin(t *testing.T) {
+	server := newTestServer(t, nil)
+	defer server.Close()
+
+	response := server.get("/jwt-proxy/login/dev")
+	for _, cookie := range response.Cookies() {
+		assert.Equal(t, sessionName, cookie.Name, "logins that are not posted back need no cross-site cookie")
+		assert.NotEqual(t, http.SameSiteNoneMode, cookie.SameSite)
+	}
+
+	response = server.devLogin("/jwt-proxy/login/dev", "octocat")
+	assert.Equal(t, http.StatusFound, response.StatusCode)
+	redirect := location(t, response)
+	assert.Equal(t, "http://localhost:8080/callback", redirect.Scheme+"://"+redirect.Host+redirect.Path)
+	claims, err := server.core.VerifyToken([]byte(redirect.Query().Get("token")))
+	assert.Nil(t, err, "the redirect should carry a valid jwt")
+	assert.Equal(t, "dev:octocat", claims.Get("user"))
+
+	response = server.get("/jwt-proxy/login/unknown")
+	assert.Equal(t, http.StatusBadRequest, response.StatusCode)
+
+	// the login page is opened in another tab while logging in
+	login := location(t, server.get("/jwt-proxy/login/dev"))
+	assert.Equal(t, http.StatusOK, server.get("/jwt-proxy/login").StatusCode)
+	response = server.post("/jwt-proxy/dev", url.Values{"state": {login.Query().Get("state")}, "username": {"octocat"}})
+	response = server.get(response.Header.Get("Location"))
+	assert.Equal(t, http.StatusFound, response.StatusCode, "forms must not replace the state of a pending login")
+	assert.NotEmpty(t, location(t, response).Query().Get("token"))
+}
+
+func TestCallbackRejectsWrongState(t *testing.T) {
+	server := newTestServer(t, nil)
+	defer server.Close()
+
+	login := location(t, server.get("/jwt-proxy/login/dev"))
+	response := server.post("/jwt-proxy/dev", url.Values{"state": {"forged-state"}, "username": {"mallory"}})
+	assert.Equal(t, http.StatusSeeOther, response.StatusCode)
+	response = server.get(response.Header.Get("Location"))
+	assert.Equal(t, http.StatusInternalServerError, response.StatusCode, "callbacks must carry the state of the session")
+
+	response = server.get("/jwt-proxy/callback/dev?state=" + url.QueryEscape(login.Query().Get("state")))
+	assert.Equal(t, http.StatusInternalServerError, response.StatusCode, "the state is used up by the failed callback")
+
+	login = location(t, server.get("/jwt-proxy/login/dev"))
+	response = server.get("/jwt-proxy/callback/dev?state=" + url.QueryEscape(login.Query().Get("state")))
+	assert.Equal(t, http.StatusInternalServerError, response.StatusCode, "callbacks without code must be rejected")
+}
+
+func TestLocalLogin(t *testing.T) {
+	server := newTestServer(t, nil)
+	defer server.Close()
+
+	response := server.get("/jwt-proxy/login")
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	nonce := csrf(t, response)
+
+	response = server.post("/jwt-proxy/auth", url.Values{"csrf": {nonce}, "username": {"alice"}, "password": {"wrong"}})
+	assert.Equal(t, http.StatusUnauthorized, response.StatusCode)
+
+	response = server.post("/jwt-proxy/auth", url.Values{"csrf": {nonce}, "username": {"alice"}, "password": {alicePassword}})
+	assert.Equal(t, http.StatusForbidden, response.StatusCode, "the csrf nonce is used up by the failed login")
+
+	response = server.post("/jwt-proxy/auth", url.Values{"csrf": {"forged"}, "username": {"alice"}, "password": {alicePassword}})
+	assert.Equal(t, http.StatusForbidden, response.StatusCode)
+
+	nonce = csrf(t, server.get("/jwt-proxy/login"))
+	response = server.post("/jwt-proxy/auth", url.Values{"csrf": {nonce}, "username": {"alice"}, "password": {alicePassword}})
+	assert.Equal(t, http.StatusFound, response.StatusCode)
+	claims, err := server.core.VerifyToken([]byte(location(t, response).Query().Get("token")))
+	assert.Nil(t, err, "the redirect should carry a valid jwt")
+	assert.Equal(t, "local:alice", claims.Get("user"))
+
+	for i := 0; i < 5; i++ {
+		nonce = csrf(t, server.get("/jwt-proxy/login"))
+		response = server.post("/jwt-proxy/auth", url.Values{"csrf": {nonce}, "username": {"alice"}, "password": {"wrong"}})
+		assert.Equal(t, http.StatusUnauthorized, response.StatusCode)
+	}
+	nonce = csrf(t, server.get("/jwt-proxy/login"))
+	response = server.post("/jwt-proxy/auth", url.Values{"csrf": {nonce}, "username": {"alice"}, "password": {alicePassword}})
+	assert.Equal(t, http.StatusTooManyRequests, response.StatusCode, "guessing passwords should be throttled")
+}
+
+func TestDevLogin(t *testing.T) {
+	server := newTestServer(t, nil)
+	defer server.Close()
+
+	response := server.get("/jwt-proxy/dev?state=some-state")
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Contains(t, body(t, response), `value="some-state"`)
+
+	response = server.post("/jwt-proxy/dev", url.Values{"state": {"some-state"}})
+	assert.Equal(t, http.StatusBadRequest, response.StatusCode, "dev logins need a username")
+
+	disabled := newTestServer(t, func(conf *config.Config) {
+		conf.DevLogin = false
+		delete(conf.Providers, provider.DevID)
+	})
+	defer disabled.Close()
+	response = disabled.get("/jwt-proxy/dev")
+	assert.Equal(t, http.StatusNotFound, response.StatusCode)
+}
+
+func TestRevoke(t *testing.T) {
+	server := newTestServer(t, nil)
+	defer server.Close()
+
+	token := location(t, server.devLogin("/jwt-proxy/login/dev", "octocat")).Query().Get("token")
+	request, _ := http.NewRequest(http.MethodGet, server.URL+"/jwt-proxy/token", nil)
+	request.Header.Set("Authorization", "Bearer "+token)
+	assert.Equal(t, http.StatusOK, server.do(request).StatusCode)
+
+	response := server.post("/jwt-proxy/revoke", url.Values{})
+	assert.Equal(t, http.StatusBadRequest, response.StatusCode)
+	assert.Equal(t, "invalid_request", decode(t, response)["error"])
+
+	response = server.post("/jwt-proxy/revoke", url.Values{"token": {"garbage"}})
+	assert.Equal(t, http.StatusOK, response.StatusCode, "invalid tokens are answered with 200, too")
+
+	response = server.post("/jwt-proxy/revoke", url.Values{"token": {token}})
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	request, _ = http.NewRequest(http.MethodGet, server.URL+"/jwt-proxy/token", nil)
+	request.Header.Set("Authorization", "Bearer "+token)
+	assert.Equal(t, http.StatusUnauthorized, server.do(request).StatusCode, "revoked tokens must not verify")
+}
+
+func TestAdminEndpoints(t *testing.T) {
+	server := newTestServer(t, func(conf *config.Config) {
+		conf.AdminSecret = "admin-secret"
+	})
+	defer server.Close()
+
+	response := server.post("/jwt-proxy/admin/revoke", url.Values{"user": {"dev:octocat"}, "access_token": {"admin-secret"}})
+	assert.Equal(t, http.StatusUnauthorized, response.StatusCode, "the admin secret must only be accepted in the Authorization header")
+
+	request, _ := http.NewRequest(http.MethodPost, server.URL+"/jwt-proxy/admin/revoke", strings.NewReader("user=dev%3Aoctocat"))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Authorization", "Bearer admin-secret")
+	assert.Equal(t, http.StatusOK, server.do(request).StatusCode)
+
+	request, _ = http.NewRequest(http.MethodPost, server.URL+"/jwt-proxy/admin/keys/rotate", nil)
+	request.Header.Set("Authorization", "Bearer admin-secret")
+	response = server.do(request)
+	assert.Equal(t, http.StatusConflict, response.StatusCode, "the test keyring has no key to rotate to")
+	assert.NotContains(t, body(t, response), core.ErrNoNextKey.Error(), "errors must not be disclosed")
+}
+
+func TestClientAddress(t *testing.T) {
+	conf, err := config.Initialize("../test/config-test.yml")
+	if !assert.Nil(t, err, "err should be nothing") {
+		t.FailNow()
+	}
+	handler := &Handler{config: conf}
+
+	request := httptest.NewRequest(http.MethodPost, "/jwt-proxy/auth", nil)
+	request.RemoteAddr = "203.0.113.7:51234"
+	request.Header.Set("X-Forwarded-For", "198.51.100.1")
+	assert.Equal(t, "203.0.113.7", handler.clientAddress(request), "only trusted proxies may forward addresses")
+
+	request.RemoteAddr = "10.0.0.2:51234"
+	request.Header.Set("X-Forwarded-For", "198.51.100.1, 203.0.113.7, 192.168.1.1")
+	assert.Equal(t, "203.0.113.7", handler.clientAddress(request), "addresses added by the client must be ignored")
+
+	request.Header.Del("X-Forwarded-For")
+	assert.Equal(t, "10.0.0.2", handler.clientAddress(request))
+}
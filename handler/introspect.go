@@ -0,0 +1,27 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/krinklesaurus/jwt-proxy/log"
+)
+
+// IntrospectHandler answers RFC 7662 token introspection requests of the
+// configured protected resources, which authenticate like OAuth clients.
+func (handler *Handler) IntrospectHandler(w http.ResponseWriter, r *http.Request) {
+	id, secret, _ := clientCredentials(r)
+	if err := handler.core.AuthenticateResource(id, secret); err != nil {
+		log.Errorf("error authenticating protected resource %s", err.Error())
+		w.Header().Set("WWW-Authenticate", `Basic realm="jwt-proxy"`)
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "")
+		return
+	}
+
+	token := r.PostFormValue("token")
+	if token == "" {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "missing token")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, handler.core.Introspect([]byte(token)))
+}
@@ -0,0 +1,39 @@
+package handler
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIntrospect(t *testing.T) {
+	server := newTestServer(t, nil)
+	defer server.Close()
+
+	token := location(t, server.devLogin("/jwt-proxy/login/dev", "octocat")).Query().Get("token")
+
+	response := server.post("/jwt-proxy/introspect", url.Values{"token": {token}, "client_id": {"some-api"}, "client_secret": {"wrong-secret"}})
+	assert.Equal(t, http.StatusUnauthorized, response.StatusCode)
+	assert.Equal(t, `Basic realm="jwt-proxy"`, response.Header.Get("WWW-Authenticate"))
+	assert.Equal(t, "invalid_client", decode(t, response)["error"])
+
+	credentials := url.Values{"client_id": {"some-api"}, "client_secret": {"some-api-secret"}}
+	response = server.post("/jwt-proxy/introspect", credentials)
+	assert.Equal(t, http.StatusBadRequest, response.StatusCode)
+	assert.Equal(t, "invalid_request", decode(t, response)["error"])
+
+	credentials.Set("token", "garbage")
+	response = server.post("/jwt-proxy/introspect", credentials)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, map[string]interface{}{"active": false}, decode(t, response))
+
+	credentials.Set("token", token)
+	response = server.post("/jwt-proxy/introspect", credentials)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	introspection := decode(t, response)
+	assert.Equal(t, true, introspection["active"])
+	assert.Equal(t, "dev:octocat", introspection["sub"])
+	assert.NotContains(t, introspection, "access_token", "provider tokens must not be disclosed")
+}
@@ -0,0 +1,273 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	neturl "net/url"
+	"time"
+
+	"github.com/krinklesaurus/jwt-proxy/core"
+	"github.com/krinklesaurus/jwt-proxy/log"
+)
+
+// AuthorizeHandler starts the OpenID Connect authorization code flow of a
+// registered client. The request is kept in the user's session while they log
+// in with one of the providers, optionally preselected with ?provider=.
+func (handler *Handler) AuthorizeHandler(w http.ResponseWriter, r *http.Request) {
+	request := &core.AuthorizationRequest{
+		ClientID:            r.FormValue("client_id"),
+		RedirectURI:         r.FormValue("redirect_uri"),
+		ResponseType:        r.FormValue("response_type"),
+		Scope:               r.FormValue("scope"),
+		State:               r.FormValue("state"),
+		Nonce:               r.FormValue("nonce"),
+		CodeChallenge:       r.FormValue("code_challenge"),
+		CodeChallengeMethod: r.FormValue("code_challenge_method"),
+	}
+
+	id, err := handler.core.Authorize(request)
+	if errors.Is(err, core.ErrInvalidRedirectURI) {
+		log.Errorf("rejecting authorization request %s", err.Error())
+		http.Error(w, "unknown client or redirect uri", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Errorf("rejecting authorization request %s", err.Error())
+		redirectAuthorizationError(w, r, request, err)
+		return
+	}
+
+	if err := handler.nonceStore.SetAuthorization(w, r, id); err != nil {
+		log.Errorf("error saving authorization request %s", err.Error())
+		http.Error(w, "Sorry, some unknown error occurred", http.StatusInternalServerError)
+		return
+	}
+
+	login := "/jwt-proxy/login"
+	if provider := r.FormValue("provider"); provider != "" {
+		login = login + "/" + neturl.PathEscape(provider)
+	}
+	http.Redirect(w, r, login, http.StatusFound)
+}
+
+// redirectAuthorizationError sends the user back to the client with the error,
+// see RFC 6749 section 4.1.2.1.
+func redirectAuthorizationError(w http.ResponseWriter, r *http.Request, request *core.AuthorizationRequest, err error) {
+	code := core.ErrInvalidRequest.Error()
+	for _, known := range []error{core.ErrInvalidRequest, core.ErrUnsupportedResponseType} {
+		if errors.Is(err, known) {
+			code = known.Error()
+		}
+	}
+	params := neturl.Values{}
+	params.Set("error", code)
+	if request.State != "" {
+		params.Set("state", request.State)
+	}
+	redirectWithParams(w, r, request.RedirectURI, params)
+}
+
+// redirectWithParams redirects to the client's redirect URI with the params
+// added to the query it may already have, see RFC 6749 section 3.1.2.
+func redirectWithParams(w http.ResponseWriter, r *http.Request, redirectURI string, params neturl.Values) {
+	location, err := neturl.Parse(redirectURI)
+	if err != nil {
+		log.Errorf("error parsing redirect uri %s", err.Error())
+		http.Error(w, "Sorry, some unknown error occurred", http.StatusInternalServerError)
+		return
+	}
+	query := location.Query()
+	for name, values := range params {
+		query[name] = values
+	}
+	location.RawQuery = query.Encode()
+	http.Redirect(w, r, location.String(), http.StatusFound)
+}
+
+// authorizationHandler completes the client's pending authorization request
+// after the user logged in by redirecting back to the client with the code.
+func (handler *Handler) authorizationHandler(w http.ResponseWriter, r *http.Request, requestID string, token *core.TokenInfo) {
+	request, code, err := handler.core.IssueAuthorizationCode(requestID, token)
+	if err != nil {
+		log.Errorf("error issuing authorization code %s", err.Error())
+		http.Error(w, "Your login took too long, please start over", http.StatusBadRequest)
+		return
+	}
+
+	params := neturl.Values{}
+	params.Set("code", code)
+	if request.State != "" {
+		params.Set("state", request.State)
+	}
+	redirectWithParams(w, r, request.RedirectURI, params)
+}
+
+// TokenHandler is the OAuth token endpoint for POST requests with a
+// grant_type. All other requests verify the given JWT as before.
+func (handler *Handler) TokenHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.PostFormValue("grant_type") == "" {
+		handler.VerifyToken(w, r)
+		return
+	}
+
+	switch grantType := r.PostFormValue("grant_type"); {
+	case grantType == "authorization_code" && len(handler.config.Clients) > 0:
+		handler.authorizationCodeGrant(w, r)
+	case grantType == "refresh_token" && handler.config.RefreshExpirySeconds > 0:
+		handler.RefreshHandler(w, r)
+	case grantType == deviceCodeGrantType && handler.config.DeviceExpirySeconds > 0:
+		handler.deviceCodeGrant(w, r)
+	case grantType == "client_credentials" && len(handler.config.ServiceAccounts) > 0:
+		handler.clientCredentialsGrant(w, r)
+	case grantType == tokenExchangeGrantType && handler.config.TokenExchangeEnabled():
+		handler.tokenExchangeGrant(w, r)
+	default:
+		writeOAuthError(w, http.StatusBadRequest, "unsupported_grant_type", "")
+	}
+}
+
+// authorizationCodeGrant redeems an authorization code for an access token
+// and, for the openid scope, an ID token, see RFC 6749 section 4.1.3.
+func (handler *Handler) authorizationCodeGrant(w http.ResponseWriter, r *http.Request) {
+	clientID, secret, basic := clientCredentials(r)
+	client, err := handler.core.AuthenticateClient(clientID, secret)
+	if err != nil {
+		log.Errorf("error authenticating client %s", err.Error())
+		if basic {
+			w.Header().Set("WWW-Authenticate", `Basic realm="jwt-proxy"`)
+		}
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "")
+		return
+	}
+
+	code, err := handler.core.ExchangeCode(client, r.PostFormValue("code"), r.PostFormValue("redirect_uri"), r.PostFormValue("code_verifier"))
+	if err != nil {
+		log.Errorf("error redeeming authorization code %s", err.Error())
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "")
+		return
+	}
+
+	claims, err := handler.core.Claims(&code.Token)
+	if err != nil {
+		log.Errorf("error %s", err.Error())
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+	if code.Request.Scope != "" {
+		claims.Set("scope", code.Request.Scope)
+	}
+	accessToken, err := handler.core.JwtToken(claims)
+	if err != nil {
+		log.Errorf("error %s", err.Error())
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+
+	response := tokenResponse{
+		AccessToken: string(accessToken),
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(time.Until(claims.Expiration()).Seconds()),
+		Scope:       code.Request.Scope,
+	}
+
+	if code.Request.OpenID() {
+		idClaims, err := handler.core.IDToken(code)
+		if err != nil {
+			log.Errorf("error %s", err.Error())
+			writeOAuthError(w, http.StatusInternalServerError, "server_error", "")
+			return
+		}
+		idToken, err := handler.core.SignedToken(idClaims)
+		if err != nil {
+			log.Errorf("error %s", err.Error())
+			writeOAuthError(w, http.StatusInternalServerError, "server_error", "")
+			return
+		}
+		response.IDToken = string(idToken)
+	}
+
+	if handler.config.RefreshExpirySeconds > 0 && code.Token.Refreshable() {
+		response.RefreshToken, err = handler.core.IssueRefreshToken(&code.Token)
+		if err != nil {
+			log.Errorf("error issuing refresh token %s", err.Error())
+			writeOAuthError(w, http.StatusInternalServerError, "server_error", "")
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// clientCredentialsGrant issues a token to a service account, see RFC 6749
+// section 4.4. The audience parameter, which may be repeated, narrows the
+// token down to some of the account's audiences.
+func (handler *Handler) clientCredentialsGrant(w http.ResponseWriter, r *http.Request) {
+	id, secret, basic := clientCredentials(r)
+	account, err := handler.core.AuthenticateServiceAccount(id, secret)
+	if err != nil {
+		log.Errorf("error authenticating service account %s", err.Error())
+		if basic {
+			w.Header().Set("WWW-Authenticate", `Basic realm="jwt-proxy"`)
+		}
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "")
+		return
+	}
+
+	claims, err := handler.core.ServiceAccountClaims(account, r.PostForm["audience"])
+	if errors.Is(err, core.ErrInvalidTarget) {
+		log.Warnf("rejecting token request %s", err.Error())
+		writeOAuthError(w, http.StatusBadRequest, "invalid_target", "")
+		return
+	}
+	if err != nil {
+		log.Errorf("error %s", err.Error())
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+	accessToken, err := handler.core.JwtToken(claims)
+	if err != nil {
+		log.Errorf("error %s", err.Error())
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, tokenResponse{
+		AccessToken: string(accessToken),
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(time.Until(claims.Expiration()).Seconds()),
+	})
+}
+
+// clientCredentials returns the id and secret a client authenticates with,
+// either via HTTP basic authentication or the client_id and client_secret form
+// parameters. basic is true for the former.
+func clientCredentials(r *http.Request) (id string, secret string, basic bool) {
+	id, secret, basic = r.BasicAuth()
+	if basic {
+		// credentials are form encoded before being put into the header, see
+		// RFC 6749 section 2.3.1
+		id, _ = neturl.QueryUnescape(id)
+		secret, _ = neturl.QueryUnescape(secret)
+		return id, secret, true
+	}
+	return r.PostFormValue("client_id"), r.PostFormValue("client_secret"), false
+}
+
+// UserInfoHandler returns the claims about the user of the bearer access
+// token, see https://openid.net/specs/openid-connect-core-1_0.html#UserInfo
+func (handler *Handler) UserInfoHandler(w http.ResponseWriter, r *http.Request) {
+	token, err := tokenFromRequest(r)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="jwt-proxy"`)
+		http.Error(w, "no jwt found", http.StatusUnauthorized)
+		return
+	}
+	userInfo, err := handler.core.UserInfo(token)
+	if err != nil {
+		log.Errorf("no valid jwt: %v", err)
+		w.Header().Set("WWW-Authenticate", `Bearer realm="jwt-proxy", error="invalid_token"`)
+		http.Error(w, "no valid jwt", http.StatusUnauthorized)
+		return
+	}
+	writeJSON(w, http.StatusOK, userInfo)
+}
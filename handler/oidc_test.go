@@ -0,0 +1,214 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/krinklesaurus/jwt-proxy/config"
+	"github.com/stretchr/testify/assert"
+)
+
+// codeVerifier is the PKCE code verifier of the test's authorization requests.
+const codeVerifier = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+
+func codeChallenge() string {
+	hash := sha256.Sum256([]byte(codeVerifier))
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
+// authorize starts an authorization request of the public client spa, logs
+// in with the dev provider and returns the redirect back to the client.
+func authorize(t *testing.T, server *testServer) *url.URL {
+	response := server.devLogin("/jwt-proxy/authorize?"+url.Values{
+		"client_id":             {"spa"},
+		"redirect_uri":          {"http://localhost:3001/callback"},
+		"response_type":         {"code"},
+		"scope":                 {"openid"},
+		"state":                 {"client-state"},
+		"nonce":                 {"client-nonce"},
+		"code_challenge":        {codeChallenge()},
+		"code_challenge_method": {"S256"},
+		"provider":              {"dev"},
+	}.Encode(), "octocat")
+	assert.Equal(t, http.StatusFound, response.StatusCode)
+	return location(t, response)
+}
+
+func TestAuthorize(t *testing.T) {
+	server := newTestServer(t, func(conf *config.Config) {
+		conf.Clients = append(conf.Clients, config.Client{ID: "tenant-app", Secret: "tenant-secret", RedirectURIs: []string{"http://localhost:3002/callback?tenant=acme"}})
+	})
+	defer server.Close()
+
+	response := server.get("/jwt-proxy/authorize?client_id=unknown&redirect_uri=http%3A%2F%2Flocalhost%3A3001%2Fcallback&response_type=code")
+	assert.Equal(t, http.StatusBadRequest, response.StatusCode, "unknown clients must not be redirected to")
+
+	response = server.get("/jwt-proxy/authorize?client_id=spa&redirect_uri=http%3A%2F%2Fevil.example.com%2Fcallback&response_type=code")
+	assert.Equal(t, http.StatusBadRequest, response.StatusCode, "unregistered redirect uris must not be redirected to")
+
+	response = server.get("/jwt-proxy/authorize?" + url.Values{
+		"client_id":             {"spa"},
+		"redirect_uri":          {"http://localhost:3001/callback"},
+		"response_type":         {"code"},
+		"state":                 {"client-state"},
+		"code_challenge":        {codeVerifier},
+		"code_challenge_method": {"plain"},
+	}.Encode())
+	assert.Equal(t, http.StatusFound, response.StatusCode)
+	redirect := location(t, response)
+	assert.Equal(t, "localhost:3001", redirect.Host)
+	assert.Equal(t, "invalid_request", redirect.Query().Get("error"), "plain code challenges must be rejected")
+	assert.Equal(t, "client-state", redirect.Query().Get("state"))
+
+	response = server.get("/jwt-proxy/authorize?" + url.Values{
+		"client_id":     {"tenant-app"},
+		"redirect_uri":  {"http://localhost:3002/callback?tenant=acme"},
+		"response_type": {"token"},
+	}.Encode())
+	redirect = location(t, response)
+	assert.Equal(t, "/callback", redirect.Path)
+	assert.Equal(t, "unsupported_response_type", redirect.Query().Get("error"))
+	assert.Equal(t, "acme", redirect.Query().Get("tenant"), "the query of the redirect uri must be kept")
+
+	response = server.get("/jwt-proxy/authorize?" + url.Values{
+		"client_id":     {"tenant-app"},
+		"redirect_uri":  {"http://localhost:3002/callback?tenant=acme"},
+		"response_type": {"code"},
+	}.Encode())
+	assert.Equal(t, http.StatusFound, response.StatusCode)
+	assert.Equal(t, "/jwt-proxy/login", location(t, response).Path)
+
+	redirect = authorize(t, server)
+	assert.Equal(t, "http://localhost:3001/callback", redirect.Scheme+"://"+redirect.Host+redirect.Path)
+	assert.NotEmpty(t, redirect.Query().Get("code"))
+	assert.Equal(t, "client-state", redirect.Query().Get("state"))
+}
+
+func TestAuthorizationCodeGrant(t *testing.T) {
+	server := newTestServer(t, nil)
+	defer server.Close()
+
+	code := authorize(t, server).Query().Get("code")
+	grant := url.Values{
+		"grant_type":    {"authorization_code"},
+		"client_id":     {"spa"},
+		"code":          {code},
+		"redirect_uri":  {"http://localhost:3001/callback"},
+		"code_verifier": {"wrong-verifier"},
+	}
+	response := server.post("/jwt-proxy/token", grant)
+	assert.Equal(t, http.StatusBadRequest, response.StatusCode)
+	assert.Equal(t, "invalid_grant", decode(t, response)["error"])
+
+	code = authorize(t, server).Query().Get("code")
+	grant.Set("code", code)
+	grant.Set("client_id", "unknown")
+	response = server.post("/jwt-proxy/token", grant)
+	assert.Equal(t, http.StatusUnauthorized, response.StatusCode)
+	assert.Equal(t, "invalid_client", decode(t, response)["error"])
+
+	code = authorize(t, server).Query().Get("code")
+	grant.Set("code", code)
+	grant.Set("client_id", "spa")
+	grant.Set("code_verifier", codeVerifier)
+	response = server.post("/jwt-proxy/token", grant)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, "no-store", response.Header.Get("Cache-Control"))
+	tokens := decode(t, response)
+	assert.Equal(t, "Bearer", tokens["token_type"])
+	idToken, err := server.core.VerifyToken([]byte(tokens["id_token"].(string)))
+	assert.Nil(t, err, "err should be nothing")
+	assert.Equal(t, "client-nonce", idToken.Get("nonce"))
+
+	request, _ := http.NewRequest(http.MethodGet, server.URL+"/jwt-proxy/userinfo", nil)
+	request.Header.Set("Authorization", "Bearer "+tokens["access_token"].(string))
+	response = server.do(request)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, "dev:octocat", decode(t, response)["sub"])
+
+	response = server.post("/jwt-proxy/token", grant)
+	assert.Equal(t, http.StatusBadRequest, response.StatusCode, "codes can only be redeemed once")
+}
+
+func TestRefreshTokenGrant(t *testing.T) {
+	server := newTestServer(t, func(conf *config.Config) {
+		conf.RefreshExpirySeconds = 3600
+	})
+	defer server.Close()
+
+	refreshToken := location(t, server.devLogin("/jwt-proxy/login/dev", "octocat")).Query().Get("refresh_token")
+	assert.NotEmpty(t, refreshToken)
+
+	response := server.post("/jwt-proxy/token", url.Values{"grant_type": {"refresh_token"}})
+	assert.Equal(t, http.StatusBadRequest, response.StatusCode)
+	assert.Equal(t, "invalid_request", decode(t, response)["error"])
+
+	response = server.post("/jwt-proxy/token", url.Values{"grant_type": {"refresh_token"}, "refresh_token": {refreshToken}})
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	tokens := decode(t, response)
+	assert.NotEmpty(t, tokens["access_token"])
+	assert.NotEqual(t, refreshToken, tokens["refresh_token"], "refresh tokens are rotated")
+
+	response = server.post("/jwt-proxy/token/refresh", url.Values{"refresh_token": {refreshToken}})
+	assert.Equal(t, http.StatusBadRequest, response.StatusCode, "refresh tokens can only be used once")
+	assert.Equal(t, "invalid_grant", decode(t, response)["error"])
+}
+
+func TestClientCredentialsGrant(t *testing.T) {
+	server := newTestServer(t, nil)
+	defer server.Close()
+
+	request, _ := http.NewRequest(http.MethodPost, server.URL+"/jwt-proxy/token", strings.NewReader("grant_type=client_credentials"))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.SetBasicAuth("ci", "wrong-secret")
+	response := server.do(request)
+	assert.Equal(t, http.StatusUnauthorized, response.StatusCode)
+	assert.NotEmpty(t, response.Header.Get("WWW-Authenticate"))
+	assert.Equal(t, "invalid_client", decode(t, response)["error"])
+
+	grant := url.Values{"grant_type": {"client_credentials"}, "client_id": {"ci"}, "client_secret": {"ci-secret"}, "audience": {"your-audience"}}
+	response = server.post("/jwt-proxy/token", grant)
+	assert.Equal(t, http.StatusBadRequest, response.StatusCode)
+	assert.Equal(t, "invalid_target", decode(t, response)["error"])
+
+	grant.Set("audience", "some-api")
+	response = server.post("/jwt-proxy/token", grant)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	claims, err := server.core.VerifyToken([]byte(decode(t, response)["access_token"].(string)))
+	assert.Nil(t, err, "err should be nothing")
+	assert.Equal(t, "ci", claims.Subject())
+}
+
+func TestTokenEndpointErrors(t *testing.T) {
+	server := newTestServer(t, nil)
+	defer server.Close()
+
+	response := server.post("/jwt-proxy/token", url.Values{"grant_type": {"password"}})
+	assert.Equal(t, http.StatusBadRequest, response.StatusCode)
+	assert.Equal(t, "unsupported_grant_type", decode(t, response)["error"])
+
+	response = server.post("/jwt-proxy/token", url.Values{"grant_type": {"refresh_token"}})
+	assert.Equal(t, "unsupported_grant_type", decode(t, response)["error"], "refresh tokens are disabled by default")
+
+	response = server.get("/jwt-proxy/token")
+	assert.Equal(t, http.StatusUnauthorized, response.StatusCode, "requests without grant verify their jwt")
+}
+
+func TestUserInfo(t *testing.T) {
+	server := newTestServer(t, nil)
+	defer server.Close()
+
+	response := server.get("/jwt-proxy/userinfo")
+	assert.Equal(t, http.StatusUnauthorized, response.StatusCode)
+	assert.Equal(t, `Bearer realm="jwt-proxy"`, response.Header.Get("WWW-Authenticate"))
+
+	request, _ := http.NewRequest(http.MethodGet, server.URL+"/jwt-proxy/userinfo", nil)
+	request.Header.Set("Authorization", "Bearer garbage")
+	response = server.do(request)
+	assert.Equal(t, http.StatusUnauthorized, response.StatusCode)
+	assert.Contains(t, response.Header.Get("WWW-Authenticate"), `error="invalid_token"`)
+}
@@ -0,0 +1,50 @@
+package handler
+
+import (
+	"github.com/gorilla/mux"
+)
+
+// Router returns the routes of jwt-proxy. Endpoints of features that are not
+// configured are left out, so that the discovery document omits them, too.
+func (handler *Handler) Router() *mux.Router {
+	r := mux.NewRouter()
+	r.HandleFunc("/", handler.HomeHandler).Methods("GET", "HEAD")
+	r.HandleFunc("/robots.txt", handler.RobotsHandler).Methods("GET", "HEAD")
+	r.HandleFunc("/ping", handler.PingHandler).Methods("GET", "HEAD")
+	r.HandleFunc("/jwt-proxy/login", handler.LoginHandler).Methods("GET", "HEAD")
+	r.HandleFunc("/jwt-proxy/auth", handler.LocalLoginHandler).Methods("POST")
+	r.HandleFunc("/jwt-proxy/login/{provider}", handler.ProviderLoginHandler).Methods("GET", "HEAD")
+	r.HandleFunc("/jwt-proxy/callback/{provider}", handler.CallbackHandler).Methods("GET", "HEAD", "POST")
+	r.HandleFunc("/jwt-proxy/saml/{provider}/metadata", handler.SAMLMetadataHandler).Methods("GET", "HEAD")
+	r.HandleFunc("/jwt-proxy/saml/{provider}/acs", handler.SAMLACSHandler).Methods("POST")
+	r.HandleFunc("/jwt-proxy/pubkey", handler.PublicKeyHandler).Methods("GET", "HEAD")
+	r.HandleFunc("/.well-known/jwks.json", handler.JWKSHandler).Methods("GET", "HEAD").Name(RouteJWKS)
+	if handler.config.DevLogin {
+		r.HandleFunc("/jwt-proxy/dev", handler.DevLoginHandler).Methods("GET", "HEAD")
+		r.HandleFunc("/jwt-proxy/dev", handler.DevAuthorizeHandler).Methods("POST")
+	}
+	if handler.config.RefreshExpirySeconds > 0 {
+		r.HandleFunc("/jwt-proxy/token/refresh", handler.RefreshHandler).Methods("POST").Name(RouteRefresh)
+	}
+	if handler.config.DeviceExpirySeconds > 0 {
+		r.HandleFunc("/jwt-proxy/device/code", handler.DeviceCodeHandler).Methods("POST").Name(RouteDeviceAuthorization)
+		r.HandleFunc("/jwt-proxy/device", handler.DeviceHandler).Methods("GET", "HEAD")
+		r.HandleFunc("/jwt-proxy/device", handler.DeviceVerifyHandler).Methods("POST")
+	}
+	if handler.config.AdminSecret != "" {
+		r.HandleFunc("/jwt-proxy/admin/keys/rotate", handler.RotateKeysHandler).Methods("POST")
+		r.HandleFunc("/jwt-proxy/admin/revoke", handler.AdminRevokeHandler).Methods("POST")
+	}
+	if len(handler.config.Clients) > 0 {
+		r.HandleFunc("/jwt-proxy/authorize", handler.AuthorizeHandler).Methods("GET", "POST").Name(RouteAuthorization)
+		r.HandleFunc("/jwt-proxy/userinfo", handler.UserInfoHandler).Methods("GET", "POST").Name(RouteUserInfo)
+	}
+	if len(handler.config.ProtectedResources) > 0 {
+		r.HandleFunc("/jwt-proxy/introspect", handler.IntrospectHandler).Methods("POST").Name(RouteIntrospection)
+	}
+	r.HandleFunc("/jwt-proxy/token", handler.TokenHandler).Methods("GET", "HEAD", "PUT", "POST").Name(RouteToken)
+	r.HandleFunc("/jwt-proxy/revoke", handler.RevokeHandler).Methods("POST").Name(RouteRevocation)
+	r.HandleFunc("/.well-known/openid-configuration", handler.DiscoveryHandler(r)).Methods("GET", "HEAD")
+	r.HandleFunc("/.well-known/oauth-authorization-server", handler.DiscoveryHandler(r)).Methods("GET", "HEAD")
+	return r
+}
@@ -0,0 +1,81 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/krinklesaurus/jwt-proxy/log"
+	"github.com/krinklesaurus/jwt-proxy/provider"
+)
+
+// SAMLMetadataHandler serves jwt-proxy's service provider metadata, which is
+// registered with the SAML identity provider.
+func (handler *Handler) SAMLMetadataHandler(w http.ResponseWriter, r *http.Request) {
+	samlProvider := handler.samlProvider(r)
+	if samlProvider == nil {
+		http.Error(w, "That's not the provider you're looking for", http.StatusNotFound)
+		return
+	}
+
+	metadata, err := samlProvider.Metadata()
+	if err != nil {
+		log.Errorf("error creating saml metadata %s", err.Error())
+		http.Error(w, "Sorry, some unknown error occurred", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/samlmetadata+xml")
+	w.Write(metadata)
+}
+
+// SAMLACSHandler is the assertion consumer service the SAML identity provider
+// posts its response to. Like the callback of OAuth2 providers, it looks up
+// the user of the validated assertion and completes the login.
+func (handler *Handler) SAMLACSHandler(w http.ResponseWriter, r *http.Request) {
+	samlProvider := handler.samlProvider(r)
+	if samlProvider == nil {
+		http.Error(w, "That's not the provider you're looking for", http.StatusNotFound)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		log.Errorf("error parsing saml response %s", err.Error())
+		http.Error(w, "Sorry, some unknown error occurred", http.StatusBadRequest)
+		return
+	}
+	state := r.PostForm.Get("RelayState")
+
+	nonce, err := handler.nonceStore.GetAndRemove(w, r)
+	if err != nil {
+		log.Errorf("Could not retrieve nonce from store %s", err.Error())
+		http.Error(w, "Sorry, some unknown error occurred", http.StatusInternalServerError)
+		return
+	}
+	if nonce != state {
+		log.Errorf("states don't match: session:%s vs. param:%s", nonce, state)
+		http.Error(w, "Sorry, some unknown error occurred", http.StatusInternalServerError)
+		return
+	}
+
+	profile, err := samlProvider.ParseResponse(r, state)
+	if err != nil {
+		log.Errorf("error validating saml response of %s %s", samlProvider.Name(), err.Error())
+		http.Error(w, "Sorry, some unknown error occurred", http.StatusBadRequest)
+		return
+	}
+
+	token, err := handler.core.ProfileTokenInfo(samlProvider.Name(), profile)
+	if err != nil {
+		log.Errorf("error retrieving token %s", err.Error())
+		http.Error(w, "Sorry, some unknown error occurred", http.StatusInternalServerError)
+		return
+	}
+
+	handler.completeLogin(w, r, token)
+}
+
+// samlProvider returns the SAML provider of the request's provider param, or
+// nil if it is no SAML provider.
+func (handler *Handler) samlProvider(r *http.Request) *provider.SAMLProvider {
+	samlProvider, _ := handler.config.Providers[mux.Vars(r)["provider"]].(*provider.SAMLProvider)
+	return samlProvider
+}
@@ -0,0 +1,105 @@
+package handler
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/krinklesaurus/jwt-proxy/config"
+	"github.com/krinklesaurus/jwt-proxy/provider"
+	"github.com/krinklesaurus/jwt-proxy/provider/samltest"
+	"github.com/stretchr/testify/assert"
+)
+
+// newSAMLServer starts the test server with the SAML provider okta, whose
+// identity provider has registered jwt-proxy's metadata.
+func newSAMLServer(t *testing.T) (*testServer, *samltest.IDP) {
+	idp := samltest.NewIDP(t)
+	server := newTestServer(t, func(conf *config.Config) {
+		samlProvider, err := provider.NewSAML(conf.RootURI, "okta", provider.SAMLOptions{IDPMetadata: idp.Metadata(t)})
+		assert.Nil(t, err, "err should be nothing")
+		conf.Providers["okta"] = samlProvider
+	})
+
+	response := server.get("/jwt-proxy/saml/okta/metadata")
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, "application/samlmetadata+xml", response.Header.Get("Content-Type"))
+	idp.Register(t, []byte(body(t, response)))
+	return server, idp
+}
+
+func TestSAMLLogin(t *testing.T) {
+	server, idp := newSAMLServer(t)
+	defer server.Close()
+
+	response := server.get("/jwt-proxy/login/okta")
+	assert.Equal(t, http.StatusFound, response.StatusCode)
+	assert.Equal(t, "idp.example.com", location(t, response).Host)
+	for _, cookie := range response.Cookies() {
+		if cookie.Name == crossSiteSessionName && cookie.MaxAge > 0 {
+			assert.Equal(t, http.SameSiteNoneMode, cookie.SameSite, "the identity provider posts the login back")
+			assert.True(t, cookie.Secure)
+			assert.Equal(t, crossSiteMaxAge, cookie.MaxAge)
+		} else {
+			assert.NotEqual(t, http.SameSiteNoneMode, cookie.SameSite, "only the login may be sent along with cross-site posts")
+		}
+	}
+	acs, form := idp.Login(t, response.Header.Get("Location"))
+	assert.Equal(t, server.URL+"/jwt-proxy/saml/okta/acs", acs)
+
+	response = server.post(acs, form)
+	assert.Equal(t, http.StatusFound, response.StatusCode)
+	claims, err := server.core.VerifyToken([]byte(location(t, response).Query().Get("token")))
+	assert.Nil(t, err, "the redirect should carry a valid jwt")
+	assert.Equal(t, "okta:user-1234", claims.Get("user"))
+
+	response = server.post(acs, form)
+	assert.NotEqual(t, http.StatusFound, response.StatusCode, "responses cannot be replayed")
+}
+
+func TestSAMLACSErrors(t *testing.T) {
+	server, idp := newSAMLServer(t)
+	defer server.Close()
+
+	response := server.get("/jwt-proxy/saml/dev/metadata")
+	assert.Equal(t, http.StatusNotFound, response.StatusCode, "only saml providers have metadata")
+	response = server.post("/jwt-proxy/saml/unknown/acs", url.Values{})
+	assert.Equal(t, http.StatusNotFound, response.StatusCode)
+
+	response = server.get("/jwt-proxy/login/okta")
+	acs, form := idp.Login(t, response.Header.Get("Location"))
+	response = server.post(acs, url.Values{"SAMLResponse": form["SAMLResponse"], "RelayState": {"forged-state"}})
+	assert.Equal(t, http.StatusInternalServerError, response.StatusCode, "responses must carry the state of the session")
+
+	response = server.get("/jwt-proxy/login/okta")
+	_, form = idp.Login(t, response.Header.Get("Location"))
+	form.Set("SAMLResponse", "garbage")
+	response = server.post(acs, form)
+	assert.Equal(t, http.StatusBadRequest, response.StatusCode, "invalid responses must be rejected")
+}
+
+func TestSAMLAuthorize(t *testing.T) {
+	server, idp := newSAMLServer(t)
+	defer server.Close()
+
+	response := server.get("/jwt-proxy/authorize?" + url.Values{
+		"client_id":             {"spa"},
+		"redirect_uri":          {"http://localhost:3001/callback"},
+		"response_type":         {"code"},
+		"state":                 {"client-state"},
+		"code_challenge":        {codeChallenge()},
+		"code_challenge_method": {"S256"},
+		"provider":              {"okta"},
+	}.Encode())
+	for response.StatusCode == http.StatusFound && location(t, response).Host != "idp.example.com" {
+		response = server.get(response.Header.Get("Location"))
+	}
+	acs, form := idp.Login(t, response.Header.Get("Location"))
+
+	response = server.post(acs, form)
+	assert.Equal(t, http.StatusFound, response.StatusCode)
+	redirect := location(t, response)
+	assert.Equal(t, "localhost:3001", redirect.Host, "the authorization request should be answered after the cross-site post")
+	assert.NotEmpty(t, redirect.Query().Get("code"))
+	assert.Equal(t, "client-state", redirect.Query().Get("state"))
+}
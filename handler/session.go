@@ -1,6 +1,7 @@
 package handler
 
 import (
+	"crypto/rand"
 	"errors"
 	"net/http"
 
@@ -11,47 +12,277 @@ import (
 
 const sessionName string = "nonce-session"
 const sessionNonce string = "nonce"
+const sessionAuthorization string = "authorization"
+const sessionVerifier string = "verifier"
+const sessionIDTokenNonce string = "idTokenNonce"
+const sessionDevice string = "device"
+const sessionCSRF string = "csrf"
 
-// NonceStore simply stores a nonce for CSRF attack prevention
+// crossSiteSessionName is the cookie of logins whose provider posts back to
+// jwt-proxy, which expires after crossSiteMaxAge seconds.
+const crossSiteSessionName string = "nonce-post"
+const crossSiteMaxAge int = 600
+
+// NonceStore simply stores a nonce for CSRF attack prevention along with the
+// PKCE verifier and the id_token nonce of the login with a provider. It also
+// keeps the CSRF nonce of jwt-proxy's forms, the id of the client's
+// authorization request and the user code of the device the user logs in for.
 type NonceStore interface {
+	// CreateNonce creates the CSRF nonce of a form, a pending login with a
+	// provider is kept.
 	CreateNonce(w http.ResponseWriter, r *http.Request) (string, error)
-	GetAndRemove(r *http.Request) (string, error)
+	// GetAndRemoveCSRF returns the CSRF nonce of the form, which is used up.
+	GetAndRemoveCSRF(w http.ResponseWriter, r *http.Request) (string, error)
+	// CreateNonceWithVerifier stores the PKCE verifier and the id_token nonce
+	// next to the nonce, empty values remove previous ones.
+	CreateNonceWithVerifier(w http.ResponseWriter, r *http.Request, verifier string, idTokenNonce string) (string, error)
+	// CreateCrossSiteNonce is CreateNonceWithVerifier for logins whose
+	// provider posts back to jwt-proxy from its own site. They are kept in a
+	// short-lived cookie that is sent along with cross-site posts, so the
+	// session cookie need not be.
+	CreateCrossSiteNonce(w http.ResponseWriter, r *http.Request, verifier string, idTokenNonce string) (string, error)
+	// GetAndRemove returns the nonce of the login, which is used up.
+	GetAndRemove(w http.ResponseWriter, r *http.Request) (string, error)
+	// GetAndRemoveVerifier returns the PKCE verifier and the id_token nonce
+	// of the login, which are empty if the login has none.
+	GetAndRemoveVerifier(w http.ResponseWriter, r *http.Request) (verifier string, idTokenNonce string, err error)
+	SetAuthorization(w http.ResponseWriter, r *http.Request, id string) error
+	// GetAndRemoveAuthorization returns the empty string if there is no
+	// pending authorization request.
+	GetAndRemoveAuthorization(w http.ResponseWriter, r *http.Request) (string, error)
+	SetDevice(w http.ResponseWriter, r *http.Request, userCode string) error
+	// GetAndRemoveDevice returns the empty string if the user does not log in
+	// for a device.
+	GetAndRemoveDevice(w http.ResponseWriter, r *http.Request) (string, error)
 }
 
 func NewHTTPSessionStore() (*HTTPSessionStore, error) {
-	sessionStore := sessions.NewCookieStore([]byte(util.RandomString(32)))
-	return &HTTPSessionStore{sessionStore: sessionStore}, nil
+	// the key authenticates the cookies, which carry the PKCE verifiers and
+	// pending authorization requests, so it must not be guessable
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	sessionStore := sessions.NewCookieStore(key)
+	// Sign in with Apple and SAML identity providers post back to
+	// jwt-proxy, browsers only send cookies along with such posts if they
+	// are secure
+	crossSiteStore := sessions.NewCookieStore(key)
+	crossSiteStore.MaxAge(crossSiteMaxAge)
+	crossSiteStore.Options.HttpOnly = true
+	crossSiteStore.Options.Secure = true
+	crossSiteStore.Options.SameSite = http.SameSiteNoneMode
+	return &HTTPSessionStore{sessionStore: sessionStore, crossSiteStore: crossSiteStore}, nil
 }
 
 type HTTPSessionStore struct {
-	sessionStore *sessions.CookieStore
+	sessionStore   *sessions.CookieStore
+	crossSiteStore *sessions.CookieStore
 }
 
 func (store *HTTPSessionStore) CreateNonce(w http.ResponseWriter, r *http.Request) (string, error) {
-	nonce := util.RandomString(32)
+	session, err := store.sessionStore.Get(r, sessionName)
+	if err != nil {
+		log.Warnf("error getting session: %v", err)
+	}
+	csrf, err := util.SecureRandomString(32)
+	if err != nil {
+		return "", err
+	}
+	session.Values[sessionCSRF] = csrf
+	if err := session.Save(r, w); err != nil {
+		log.Errorf("error saving session: %v", err)
+	}
+	return csrf, nil
+}
+
+func (store *HTTPSessionStore) GetAndRemoveCSRF(w http.ResponseWriter, r *http.Request) (string, error) {
+	session, err := store.sessionStore.Get(r, sessionName)
+	if err != nil {
+		return "", err
+	}
+	csrf, _ := session.Values[sessionCSRF].(string)
+	if csrf == "" {
+		return "", nil
+	}
+	delete(session.Values, sessionCSRF)
+	return csrf, session.Save(r, w)
+}
+
+func (store *HTTPSessionStore) CreateNonceWithVerifier(w http.ResponseWriter, r *http.Request, verifier string, idTokenNonce string) (string, error) {
 	log.Debugf("get sessions store with name %s", sessionName)
 	session, err := store.sessionStore.Get(r, sessionName)
 	if err != nil {
 		log.Warnf("error getting session: %v", err)
 	}
+
+	// the login replaces a pending cross-site login, whose authorization
+	// request or device are continued
+	if crossSite, err := store.crossSiteStore.Get(r, crossSiteSessionName); err == nil && !crossSite.IsNew {
+		moveValues(crossSite, session, sessionAuthorization, sessionDevice)
+		crossSite.Options.MaxAge = -1
+		if err := crossSite.Save(r, w); err != nil {
+			log.Errorf("error removing cross-site session: %v", err)
+		}
+	}
+
+	return store.createNonce(w, r, session, verifier, idTokenNonce)
+}
+
+func (store *HTTPSessionStore) CreateCrossSiteNonce(w http.ResponseWriter, r *http.Request, verifier string, idTokenNonce string) (string, error) {
+	session, err := store.sessionStore.Get(r, sessionName)
+	if err != nil {
+		log.Warnf("error getting session: %v", err)
+	}
+	crossSite, err := store.crossSiteStore.Get(r, crossSiteSessionName)
+	if err != nil {
+		log.Warnf("error getting cross-site session: %v", err)
+	}
+
+	moveValues(session, crossSite, sessionAuthorization, sessionDevice)
+	delete(session.Values, sessionNonce)
+	delete(session.Values, sessionVerifier)
+	delete(session.Values, sessionIDTokenNonce)
+	if err := session.Save(r, w); err != nil {
+		log.Errorf("error saving session: %v", err)
+	}
+
+	return store.createNonce(w, r, crossSite, verifier, idTokenNonce)
+}
+
+// createNonce stores a new nonce, the verifier and the id_token nonce in the
+// session.
+func (store *HTTPSessionStore) createNonce(w http.ResponseWriter, r *http.Request, session *sessions.Session, verifier string, idTokenNonce string) (string, error) {
+	nonce, err := util.SecureRandomString(32)
+	if err != nil {
+		return "", err
+	}
 	log.Debugf("set session key %s to %s", sessionNonce, nonce)
 	session.Values[sessionNonce] = nonce
-	err = session.Save(r, w)
-	if err != nil {
+	if verifier != "" {
+		session.Values[sessionVerifier] = verifier
+	} else {
+		delete(session.Values, sessionVerifier)
+	}
+	if idTokenNonce != "" {
+		session.Values[sessionIDTokenNonce] = idTokenNonce
+	} else {
+		delete(session.Values, sessionIDTokenNonce)
+	}
+	if err := session.Save(r, w); err != nil {
 		log.Errorf("error saving session: %v", err)
 	}
 	return nonce, nil
 }
 
-func (store *HTTPSessionStore) GetAndRemove(r *http.Request) (string, error) {
-	session, err := store.sessionStore.Get(r, sessionName)
+func (store *HTTPSessionStore) GetAndRemove(w http.ResponseWriter, r *http.Request) (string, error) {
+	loginSessions, err := store.loginSessions(r)
 	if err != nil {
 		return "", err
 	}
-	value, ok := session.Values[sessionNonce].(string)
-	session.Values[sessionNonce] = nil
-	if !ok {
+	value := takeValue(loginSessions, sessionNonce)
+	if value == "" {
 		return "", errors.New("value from session is not a string")
 	}
-	return value, nil
+	return value, saveSessions(w, r, loginSessions)
+}
+
+func (store *HTTPSessionStore) GetAndRemoveVerifier(w http.ResponseWriter, r *http.Request) (string, string, error) {
+	loginSessions, err := store.loginSessions(r)
+	if err != nil {
+		return "", "", err
+	}
+	verifier := takeValue(loginSessions, sessionVerifier)
+	idTokenNonce := takeValue(loginSessions, sessionIDTokenNonce)
+	return verifier, idTokenNonce, saveSessions(w, r, loginSessions)
+}
+
+func (store *HTTPSessionStore) SetAuthorization(w http.ResponseWriter, r *http.Request, id string) error {
+	session, err := store.sessionStore.Get(r, sessionName)
+	if err != nil {
+		log.Warnf("error getting session: %v", err)
+	}
+	session.Values[sessionAuthorization] = id
+	return session.Save(r, w)
+}
+
+func (store *HTTPSessionStore) GetAndRemoveAuthorization(w http.ResponseWriter, r *http.Request) (string, error) {
+	loginSessions, err := store.loginSessions(r)
+	if err != nil {
+		return "", err
+	}
+	id := takeValue(loginSessions, sessionAuthorization)
+	if id == "" {
+		return "", nil
+	}
+	return id, saveSessions(w, r, loginSessions)
+}
+
+func (store *HTTPSessionStore) SetDevice(w http.ResponseWriter, r *http.Request, userCode string) error {
+	session, err := store.sessionStore.Get(r, sessionName)
+	if err != nil {
+		log.Warnf("error getting session: %v", err)
+	}
+	session.Values[sessionDevice] = userCode
+	return session.Save(r, w)
+}
+
+func (store *HTTPSessionStore) GetAndRemoveDevice(w http.ResponseWriter, r *http.Request) (string, error) {
+	loginSessions, err := store.loginSessions(r)
+	if err != nil {
+		return "", err
+	}
+	userCode := takeValue(loginSessions, sessionDevice)
+	if userCode == "" {
+		return "", nil
+	}
+	return userCode, saveSessions(w, r, loginSessions)
+}
+
+// loginSessions returns the sessions a pending login may be kept in, i.e. the
+// cross-site session, if the request carries one, and the session.
+func (store *HTTPSessionStore) loginSessions(r *http.Request) ([]*sessions.Session, error) {
+	session, err := store.sessionStore.Get(r, sessionName)
+	if err != nil {
+		return nil, err
+	}
+	if crossSite, err := store.crossSiteStore.Get(r, crossSiteSessionName); err == nil && !crossSite.IsNew {
+		return []*sessions.Session{crossSite, session}, nil
+	}
+	return []*sessions.Session{session}, nil
+}
+
+// takeValue removes the value from all sessions and returns the first one
+// found, or the empty string.
+func takeValue(loginSessions []*sessions.Session, key string) string {
+	value := ""
+	for _, session := range loginSessions {
+		if s, _ := session.Values[key].(string); s != "" && value == "" {
+			value = s
+		}
+		delete(session.Values, key)
+	}
+	return value
+}
+
+// moveValues moves the values from one session to the other, unless the
+// other one has them already.
+func moveValues(from *sessions.Session, to *sessions.Session, keys ...string) {
+	for _, key := range keys {
+		if value, ok := from.Values[key]; ok {
+			if _, exists := to.Values[key]; !exists {
+				to.Values[key] = value
+			}
+			delete(from.Values, key)
+		}
+	}
+}
+
+func saveSessions(w http.ResponseWriter, r *http.Request, loginSessions []*sessions.Session) error {
+	for _, session := range loginSessions {
+		if err := session.Save(r, w); err != nil {
+			return err
+		}
+	}
+	return nil
 }
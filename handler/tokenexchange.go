@@ -0,0 +1,87 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/krinklesaurus/jwt-proxy/core"
+	"github.com/krinklesaurus/jwt-proxy/log"
+)
+
+// The grant type and token type of RFC 8693 token exchange.
+const (
+	tokenExchangeGrantType = "urn:ietf:params:oauth:grant-type:token-exchange"
+	accessTokenType        = "urn:ietf:params:oauth:token-type:access_token"
+)
+
+// tokenExchangeResponse is the JSON body of a token exchange, see RFC 8693
+// section 2.2.1.
+type tokenExchangeResponse struct {
+	tokenResponse
+	IssuedTokenType string `json:"issued_token_type"`
+}
+
+// tokenExchangeGrant exchanges an access token of the provider given by the
+// provider parameter for the JWT the user would get by logging in with that
+// provider, see RFC 8693 section 2.1. A client_id is optional, registered
+// clients must authenticate like at the token endpoint.
+func (handler *Handler) tokenExchangeGrant(w http.ResponseWriter, r *http.Request) {
+	clientID, secret, basic := clientCredentials(r)
+	if clientID != "" {
+		if _, err := handler.core.AuthenticateClient(clientID, secret); err != nil {
+			log.Errorf("error authenticating client %s", err.Error())
+			if basic {
+				w.Header().Set("WWW-Authenticate", `Basic realm="jwt-proxy"`)
+			}
+			writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "")
+			return
+		}
+	}
+
+	if tokenType := r.PostFormValue("subject_token_type"); tokenType != accessTokenType {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "subject_token_type must be "+accessTokenType)
+		return
+	}
+	token, err := handler.core.ExchangeToken(r.Context(), r.PostFormValue("provider"), r.PostFormValue("subject_token"))
+	if errors.Is(err, core.ErrInvalidRequest) {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", strings.TrimPrefix(err.Error(), core.ErrInvalidRequest.Error()+": "))
+		return
+	}
+	if errors.Is(err, core.ErrInvalidGrant) {
+		log.Warnf("rejecting token exchange %s", err.Error())
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "")
+		return
+	}
+	if err != nil {
+		log.Errorf("error exchanging token %s", err.Error())
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+
+	claims, err := handler.core.Claims(token)
+	if err != nil {
+		log.Errorf("error %s", err.Error())
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+	if clientID != "" {
+		claims.Set("client_id", clientID)
+	}
+	accessToken, err := handler.core.JwtToken(claims)
+	if err != nil {
+		log.Errorf("error %s", err.Error())
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, tokenExchangeResponse{
+		tokenResponse: tokenResponse{
+			AccessToken: string(accessToken),
+			TokenType:   "Bearer",
+			ExpiresIn:   int64(time.Until(claims.Expiration()).Seconds()),
+		},
+		IssuedTokenType: accessTokenType,
+	})
+}
@@ -0,0 +1,77 @@
+package handler
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/krinklesaurus/jwt-proxy/config"
+	"github.com/krinklesaurus/jwt-proxy/provider"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+)
+
+// exchangeProvider accepts the access token foreign-token as the token of
+// another app only, any other token is the token of the user with that id.
+type exchangeProvider struct {
+	*provider.DevProvider
+}
+
+func (p *exchangeProvider) VerifyToken(ctx context.Context, token *oauth2.Token) error {
+	if token.AccessToken == "foreign-token" {
+		return provider.ErrForeignToken
+	}
+	return nil
+}
+
+func (p *exchangeProvider) User(ctx context.Context, token *oauth2.Token) (*provider.Profile, error) {
+	return &provider.Profile{ID: token.AccessToken, Login: token.AccessToken}, nil
+}
+
+func TestTokenExchangeGrant(t *testing.T) {
+	server := newTestServer(t, func(conf *config.Config) {
+		conf.Providers["exchange"] = &exchangeProvider{provider.NewDev(conf.RootURI)}
+		conf.TokenExchange["exchange"] = true
+	})
+	defer server.Close()
+
+	grant := url.Values{
+		"grant_type":         {tokenExchangeGrantType},
+		"provider":           {"exchange"},
+		"subject_token":      {"octocat"},
+		"subject_token_type": {"urn:ietf:params:oauth:token-type:id_token"},
+	}
+	response := server.post("/jwt-proxy/token", grant)
+	assert.Equal(t, http.StatusBadRequest, response.StatusCode)
+	assert.Equal(t, "invalid_request", decode(t, response)["error"])
+
+	grant.Set("subject_token_type", accessTokenType)
+	grant.Set("provider", "dev")
+	response = server.post("/jwt-proxy/token", grant)
+	assert.Equal(t, http.StatusBadRequest, response.StatusCode)
+	assert.Equal(t, "invalid_request", decode(t, response)["error"], "providers without token exchange must be rejected")
+
+	grant.Set("provider", "exchange")
+	grant.Set("subject_token", "foreign-token")
+	response = server.post("/jwt-proxy/token", grant)
+	assert.Equal(t, http.StatusBadRequest, response.StatusCode)
+	assert.Equal(t, "invalid_grant", decode(t, response)["error"], "tokens of other apps must be rejected")
+
+	grant.Set("subject_token", "octocat")
+	grant.Set("client_id", "internal-app")
+	grant.Set("client_secret", "wrong-secret")
+	response = server.post("/jwt-proxy/token", grant)
+	assert.Equal(t, http.StatusUnauthorized, response.StatusCode)
+	assert.Equal(t, "invalid_client", decode(t, response)["error"])
+
+	grant.Set("client_secret", "internal-app-secret")
+	response = server.post("/jwt-proxy/token", grant)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	tokens := decode(t, response)
+	assert.Equal(t, accessTokenType, tokens["issued_token_type"])
+	claims, err := server.core.VerifyToken([]byte(tokens["access_token"].(string)))
+	assert.Nil(t, err, "err should be nothing")
+	assert.Equal(t, "exchange:octocat", claims.Get("user"))
+	assert.Equal(t, "internal-app", claims.Get("client_id"))
+}
@@ -3,8 +3,8 @@ package main
 import (
 	"flag"
 	"net/http"
+	"time"
 
-	"github.com/gorilla/mux"
 	"github.com/krinklesaurus/jwt-proxy/config"
 	"github.com/krinklesaurus/jwt-proxy/core"
 	"github.com/krinklesaurus/jwt-proxy/handler"
@@ -28,10 +28,36 @@ func main() {
 	}
 
 	log.Infof("Config initialized: %s", config.String())
+	if config.DevLogin {
+		log.Warnf("****************************************************************")
+		log.Warnf("* DEV LOGIN IS ENABLED: ANYONE CAN LOG IN AS ANY USER WITH ANY *")
+		log.Warnf("* EMAIL AND GROUPS. NEVER SET dev.enabled IN PRODUCTION.       *")
+		log.Warnf("****************************************************************")
+	}
 
 	userService := &user.PlainUserService{}
 
-	tokenizer := core.NewRSATokenizer(core.SigningMethods[config.SigningMethod], config.PrivateRSAKey)
+	keyring, err := core.NewKeyringFromConfig(config)
+	if err != nil {
+		log.Errorf("error initializing keyring %v", err)
+		return
+	}
+	if config.RotationIntervalSeconds > 0 {
+		go keyring.RotateEvery(time.Duration(config.RotationIntervalSeconds)*time.Second, nil)
+	}
+	var tokenizer core.Tokenizer = core.NewKeyringTokenizer(keyring)
+	if len(config.EncryptionKeys) > 0 {
+		recipients, err := core.RecipientsFromConfig(config)
+		if err != nil {
+			log.Errorf("error initializing token encryption %v", err)
+			return
+		}
+		tokenizer, err = core.NewEncryptingTokenizer(tokenizer, recipients)
+		if err != nil {
+			log.Errorf("error initializing token encryption %v", err)
+			return
+		}
+	}
 
 	core := core.New(config, tokenizer, userService)
 	store, err := handler.NewHTTPSessionStore()
@@ -39,21 +65,13 @@ func main() {
 		log.Errorf("error initializing session store %v", err)
 		return
 	}
-	handler, err := handler.New(config, core, store)
+	h, err := handler.New(config, core, store)
 	if err != nil {
 		log.Errorf("error initializing handler store %v", err)
 		return
 	}
 
-	r := mux.NewRouter()
-	r.HandleFunc("/", handler.HomeHandler).Methods("GET", "HEAD")
-	r.HandleFunc("/robots.txt", handler.RobotsHandler).Methods("GET", "HEAD")
-	r.HandleFunc("/ping", handler.PingHandler).Methods("GET", "HEAD")
-	r.HandleFunc("/jwt-proxy/login", handler.LoginHandler).Methods("GET", "HEAD")
-	r.HandleFunc("/jwt-proxy/login/{provider}", handler.ProviderLoginHandler).Methods("GET", "HEAD")
-	r.HandleFunc("/jwt-proxy/callback/{provider}", handler.CallbackHandler).Methods("GET", "HEAD")
-	r.HandleFunc("/jwt-proxy/pubkey", handler.PublicKeyHandler).Methods("GET", "HEAD")
-	r.HandleFunc("/jwt-proxy/token", handler.VerifyToken).Methods("GET", "HEAD", "PUT", "POST")
+	r := h.Router()
 
 	n := negroni.New()
 	n.Use(negroni.NewLogger())
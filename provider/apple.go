@@ -0,0 +1,204 @@
+package provider
+
+import (
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	jose "github.com/go-jose/go-jose/v3"
+	"github.com/go-jose/go-jose/v3/jwt"
+	"github.com/krinklesaurus/jwt-proxy/log"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+)
+
+// appleIssuer is the issuer of Sign in with Apple's id_tokens and the
+// audience of the client secret.
+const appleIssuer = "https://appleid.apple.com"
+
+// appleSecretLifetime is the lifetime of the client secret, which is created
+// again once less than appleSecretRenewal is left. Apple accepts up to six
+// months.
+const (
+	appleSecretLifetime = 24 * time.Hour
+	appleSecretRenewal  = time.Hour
+)
+
+// AppleOptions are the settings of Sign in with Apple next to the client id,
+// which is the Services ID.
+type AppleOptions struct {
+	TeamID string
+	KeyID  string
+	// PrivateKey is the PEM encoded .p8 key the client secret is signed with.
+	PrivateKey []byte
+	// Issuer replaces https://appleid.apple.com, whose endpoints are at
+	// /auth/authorize, /auth/token and /auth/keys.
+	Issuer string
+	// HTTPClient calls Apple, the default client if nil.
+	HTTPClient *http.Client
+}
+
+// NewApple creates a Sign in with Apple provider. Apple posts the callback
+// with response_mode=form_post and requires a client secret that is a JWT
+// signed with the team's key.
+func NewApple(rootURI string, name string, clientID string, scopes []string, options AppleOptions) (*AppleProvider, error) {
+	log.Debugf("create apple provider %s with clientID %s and scopes %s", name, clientID, scopes)
+	if options.TeamID == "" || options.KeyID == "" {
+		return nil, fmt.Errorf("%s teamId and keyId must not be empty", name)
+	}
+	key, err := parseApplePrivateKey(options.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("%s privateKey: %w", name, err)
+	}
+
+	issuer := strings.TrimSuffix(options.Issuer, "/")
+	if issuer == "" {
+		issuer = appleIssuer
+	}
+	apple := &AppleProvider{
+		OIDCProvider: newOIDCProvider(rootURI, name, issuer, clientID, "", scopes, &discovery{
+			Issuer:                issuer,
+			AuthorizationEndpoint: issuer + "/auth/authorize",
+			TokenEndpoint:         issuer + "/auth/token",
+			JWKSURI:               issuer + "/auth/keys",
+		}, orDefault(options.HTTPClient)),
+		teamID: options.TeamID,
+		keyID:  options.KeyID,
+		key:    key,
+	}
+	apple.conf.Endpoint.AuthStyle = oauth2.AuthStyleInParams
+	apple.OIDCProvider.clientSecret = apple.clientSecret
+	return apple, nil
+}
+
+// AppleProvider validates Apple's id_token like any OpenID Connect provider,
+// Apple has no user info endpoint though.
+type AppleProvider struct {
+	*OIDCProvider
+
+	teamID string
+	keyID  string
+	key    *ecdsa.PrivateKey
+
+	mu           sync.Mutex
+	secret       string
+	secretExpiry time.Time
+}
+
+// AuthCodeURL asks Apple to post the code, which is required if any scope is
+// requested.
+func (a *AppleProvider) AuthCodeURL(state string, opts ...oauth2.AuthCodeOption) string {
+	return a.OIDCProvider.AuthCodeURL(state, append(opts, oauth2.SetAuthURLParam("response_mode", "form_post"))...)
+}
+
+// User returns the profile of the id_token. Apple sends the user's name only
+// on the first login as user parameter of the callback.
+func (a *AppleProvider) User(ctx context.Context, token *oauth2.Token) (*Profile, error) {
+	idToken, _ := token.Extra("id_token").(string)
+	if idToken == "" {
+		return nil, fmt.Errorf("%w: token response of %s has no id_token", ErrInvalidIDToken, a.issuer)
+	}
+	profile, err := a.validate(idToken, "")
+	if err != nil {
+		return nil, err
+	}
+	if profile.ID == "" {
+		return nil, fmt.Errorf("%w: missing sub", ErrInvalidIDToken)
+	}
+
+	if user := callbackParams(ctx).Get("user"); user != "" {
+		firstLogin := struct {
+			Name struct {
+				FirstName string `json:"firstName"`
+				LastName  string `json:"lastName"`
+			} `json:"name"`
+		}{}
+		if err := json.Unmarshal([]byte(user), &firstLogin); err != nil {
+			log.Warnf("ignoring user of apple callback: %v", err)
+		} else {
+			profile.Name = strings.TrimSpace(firstLogin.Name.FirstName + " " + firstLogin.Name.LastName)
+		}
+	}
+	return profile, nil
+}
+
+// clientSecret returns the cached client secret or signs a new one, if it
+// expires soon.
+func (a *AppleProvider) clientSecret() (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	if a.secret != "" && a.secretExpiry.Sub(now) > appleSecretRenewal {
+		return a.secret, nil
+	}
+
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: a.key},
+		(&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", a.keyID))
+	if err != nil {
+		return "", err
+	}
+	expiry := now.Add(appleSecretLifetime)
+	secret, err := jwt.Signed(signer).Claims(jwt.Claims{
+		Issuer:   a.teamID,
+		Subject:  a.clientID,
+		Audience: jwt.Audience{a.issuer},
+		IssuedAt: jwt.NewNumericDate(now),
+		Expiry:   jwt.NewNumericDate(expiry),
+	}).CompactSerialize()
+	if err != nil {
+		return "", err
+	}
+	a.secret, a.secretExpiry = secret, expiry
+	return secret, nil
+}
+
+func (a *AppleProvider) String() string {
+	toString := struct {
+		ClientID   string   `json:"client_id"`
+		TeamID     string   `json:"team_id"`
+		KeyID      string   `json:"key_id"`
+		AuthURL    string   `json:"auth_url"`
+		TokenURL   string   `json:"token_url"`
+		RediectURL string   `json:"redirect_url"`
+		Scopes     []string `json:"scopes"`
+	}{
+		a.conf.ClientID,
+		a.teamID,
+		a.keyID,
+		a.conf.Endpoint.AuthURL,
+		a.conf.Endpoint.TokenURL,
+		a.conf.RedirectURL,
+		a.conf.Scopes,
+	}
+	b, err := json.Marshal(toString)
+	if err != nil {
+		fmt.Println(err)
+		return err.Error()
+	}
+	return string(b)
+}
+
+// parseApplePrivateKey parses the PKCS #8 P-256 key of a .p8 file.
+func parseApplePrivateKey(data []byte) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM encoded key found")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	ecKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("expected an EC key, got %T", key)
+	}
+	return ecKey, nil
+}
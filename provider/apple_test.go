@@ -0,0 +1,111 @@
+package provider
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	jose "github.com/go-jose/go-jose/v3"
+	"github.com/go-jose/go-jose/v3/jwt"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+// newFakeApple returns an issuer serving Apple's endpoints, whose token
+// endpoint only accepts client secrets signed with teamKey.
+func newFakeApple(t *testing.T, teamKey *ecdsa.PrivateKey, secrets *[]string) *fakeIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err, "err should be nothing")
+	issuer := &fakeIssuer{key: key, signingKey: key}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/auth/keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+			{Key: &issuer.key.PublicKey, KeyID: "issuer-key", Algorithm: "RS256", Use: "sig"},
+		}})
+	})
+	mux.HandleFunc("/auth/token", func(w http.ResponseWriter, r *http.Request) {
+		secret := r.PostFormValue("client_secret")
+		parsed, err := jwt.ParseSigned(secret)
+		if err != nil || len(parsed.Headers) != 1 || parsed.Headers[0].KeyID != "key-id" {
+			http.Error(w, `{"error": "invalid_client"}`, http.StatusBadRequest)
+			return
+		}
+		claims := jwt.Claims{}
+		if err := parsed.Claims(&teamKey.PublicKey, &claims); err != nil ||
+			claims.Validate(jwt.Expected{Issuer: "team-id", Subject: "client-id", Audience: jwt.Audience{issuer.URL}}) != nil {
+			http.Error(w, `{"error": "invalid_client"}`, http.StatusBadRequest)
+			return
+		}
+		*secrets = append(*secrets, secret)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "apple-access-token",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     issuer.sign(t, issuer.signingKey, issuer.claims),
+		})
+	})
+	issuer.Server = httptest.NewServer(mux)
+	return issuer
+}
+
+func TestAppleProvider(t *testing.T) {
+	teamKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err, "err should be nothing")
+	der, err := x509.MarshalPKCS8PrivateKey(teamKey)
+	assert.Nil(t, err, "err should be nothing")
+	p8 := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+
+	secrets := []string{}
+	issuer := newFakeApple(t, teamKey, &secrets)
+	defer issuer.Close()
+
+	provider, err := NewApple("http://localhost:8080", "apple", "client-id", []string{"name", "email"}, AppleOptions{
+		TeamID:     "team-id",
+		KeyID:      "key-id",
+		PrivateKey: p8,
+		Issuer:     issuer.URL,
+	})
+	assert.Nil(t, err, "err should be nothing")
+
+	authCodeURL := provider.AuthCodeURL("state", NonceOption("login-nonce"))
+	assert.Contains(t, authCodeURL, issuer.URL+"/auth/authorize?")
+	assert.Contains(t, authCodeURL, "response_mode=form_post")
+
+	issuer.claims = issuer.validClaims(t, authCodeURL)
+	token, err := provider.Exchange(WithIDTokenNonce(context.Background(), "login-nonce"), "code")
+	assert.Nil(t, err, "err should be nothing")
+
+	ctx := WithCallbackParams(context.Background(), url.Values{
+		"user": {`{"name": {"firstName": "Some", "lastName": "One"}, "email": "someone@example.com"}`},
+	})
+	profile, err := provider.User(ctx, token)
+	assert.Nil(t, err, "err should be nothing")
+	assert.Equal(t, "user-1234", profile.ID)
+	assert.Equal(t, "someone@example.com", profile.Email)
+	assert.Equal(t, "Some One", profile.Name)
+
+	// Apple sends the name on the first login only
+	profile, err = provider.User(context.Background(), token)
+	assert.Nil(t, err, "err should be nothing")
+	assert.Equal(t, "", profile.Name)
+
+	issuer.claims = issuer.validClaims(t, provider.AuthCodeURL("state", NonceOption("second-nonce")))
+	_, err = provider.Exchange(WithIDTokenNonce(context.Background(), "second-nonce"), "code")
+	assert.Nil(t, err, "err should be nothing")
+	assert.Len(t, secrets, 2)
+	assert.Equal(t, secrets[0], secrets[1], "client secret should be reused until it expires")
+
+	_, err = NewApple("http://localhost:8080", "apple", "client-id", nil, AppleOptions{TeamID: "team-id", KeyID: "key-id", PrivateKey: []byte("no key")})
+	assert.NotNil(t, err, "invalid private keys should be rejected")
+}
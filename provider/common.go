@@ -1,17 +1,290 @@
 package provider
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
 	"golang.org/x/net/context"
 	"golang.org/x/oauth2"
 )
 
 // Provider is the interface every OAuth provider has to fulfill for being
-// used within jwt-proxy
+// used within jwt-proxy. Providers keep no state about a login, all calls are
+// scoped to the request by their context and token, so that a provider can
+// serve concurrent logins.
 type Provider interface {
-	AuthCodeURL(state string) string
-	User() (string, error)
-	Exchange(ctx context.Context, code string) (*oauth2.Token, error)
+	// AuthCodeURL and Exchange take the options of the login, e.g. its PKCE
+	// code challenge and verifier.
+	AuthCodeURL(state string, opts ...oauth2.AuthCodeOption) string
+	Exchange(ctx context.Context, code string, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error)
+	Refresh(ctx context.Context, token *oauth2.Token) (*oauth2.Token, error)
+	// User looks up the user the token was issued for.
+	User(ctx context.Context, token *oauth2.Token) (*Profile, error)
 	String() string
 	Name() string
 	ClientID() string
 }
+
+// ErrNotAllowed is returned by User if the user is not allowed to log in with
+// the provider, e.g. because they are no member of the required organization.
+var ErrNotAllowed = errors.New("user is not allowed to log in")
+
+// TokenVerifier is implemented by providers that can check that an access
+// token was issued to their own client, so that tokens other apps got from
+// the provider cannot be exchanged for a JWT.
+type TokenVerifier interface {
+	// VerifyToken returns ErrForeignToken if the token is not active or was
+	// issued to another client and ErrVerificationUnsupported if the provider
+	// turns out to offer no way to check the token.
+	VerifyToken(ctx context.Context, token *oauth2.Token) error
+}
+
+// The errors of VerifyToken.
+var (
+	ErrForeignToken            = errors.New("access token was not issued to the client")
+	ErrVerificationUnsupported = errors.New("provider cannot verify access tokens")
+)
+
+type callbackParamsKey struct{}
+
+// WithCallbackParams returns a context carrying the parameters the provider
+// called back with, e.g. the user's name Sign in with Apple posts on the first
+// login only.
+func WithCallbackParams(ctx context.Context, params url.Values) context.Context {
+	return context.WithValue(ctx, callbackParamsKey{}, params)
+}
+
+// callbackParams returns the parameters of the callback, which are empty if
+// the context has none.
+func callbackParams(ctx context.Context) url.Values {
+	params, _ := ctx.Value(callbackParamsKey{}).(url.Values)
+	if params == nil {
+		return url.Values{}
+	}
+	return params
+}
+
+// The normalized profile fields providers fill from their user info as far as
+// the provider supports them.
+const (
+	ProfileID            = "id"
+	ProfileLogin         = "login"
+	ProfileEmail         = "email"
+	ProfileEmailVerified = "email_verified"
+	ProfileName          = "name"
+	ProfileAvatar        = "avatar"
+	ProfileGroups        = "groups"
+)
+
+// Profile is the user as returned by a provider. Raw holds all attributes of
+// the provider's user info.
+type Profile struct {
+	ID            string
+	Login         string
+	Email         string
+	EmailVerified bool
+	Name          string
+	Avatar        string
+	Groups        []string
+	Raw           map[string]interface{}
+}
+
+// Field returns the normalized profile field with the given name or, for any
+// other name, the raw attribute at that dotted path.
+func (p *Profile) Field(name string) interface{} {
+	switch name {
+	case ProfileID:
+		return p.ID
+	case ProfileLogin:
+		return p.Login
+	case ProfileEmail:
+		return p.Email
+	case ProfileEmailVerified:
+		return p.EmailVerified
+	case ProfileName:
+		return p.Name
+	case ProfileAvatar:
+		return p.Avatar
+	case ProfileGroups:
+		if len(p.Groups) == 0 {
+			return nil
+		}
+		return p.Groups
+	}
+	return lookup(p.Raw, name)
+}
+
+// decodeProfile decodes the provider's user info into a profile. The
+// normalized fields are looked up by the given, possibly dotted, paths of the
+// raw attributes and by their own name otherwise.
+func decodeProfile(contents []byte, fields map[string]string) (*Profile, error) {
+	dec := json.NewDecoder(bytes.NewReader(contents))
+	dec.UseNumber()
+	raw := map[string]interface{}{}
+	if err := dec.Decode(&raw); err != nil {
+		return nil, err
+	}
+
+	value := func(field string) interface{} {
+		if path, ok := fields[field]; ok {
+			return lookup(raw, path)
+		}
+		return raw[field]
+	}
+	str := func(field string) string {
+		if v := value(field); v != nil {
+			return fmt.Sprint(v)
+		}
+		return ""
+	}
+
+	profile := &Profile{
+		ID:     str(ProfileID),
+		Login:  str(ProfileLogin),
+		Email:  str(ProfileEmail),
+		Name:   str(ProfileName),
+		Avatar: str(ProfileAvatar),
+		Raw:    raw,
+	}
+	switch verified := value(ProfileEmailVerified).(type) {
+	case bool:
+		profile.EmailVerified = verified
+	case string:
+		profile.EmailVerified = verified == "true"
+	}
+	switch groups := value(ProfileGroups).(type) {
+	case []interface{}:
+		for _, group := range groups {
+			profile.Groups = append(profile.Groups, fmt.Sprint(group))
+		}
+	case string:
+		profile.Groups = []string{groups}
+	}
+	return profile, nil
+}
+
+// getUserInfo fetches the user info at url with the client, sending the
+// access token as bearer token.
+func getUserInfo(ctx context.Context, client *http.Client, url string, token *oauth2.Token) ([]byte, error) {
+	request, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	request = request.WithContext(ctx)
+	request.Header.Set("Accept", "application/json")
+	token.SetAuthHeader(request)
+
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if err := checkStatus(response); err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(response.Body)
+}
+
+// lookup returns the value at the path, e.g. "data.emails.0.value" or the
+// JSONPath "$.data.emails[0].value", where numbers index into arrays. Keys
+// with dots can be quoted, e.g. "$['first.name']", attributes whose name
+// contains dots, like SAML's urn:oid:... attributes, are also found by their
+// full name. Paths that ValidatePath rejects find nothing.
+func lookup(raw map[string]interface{}, path string) interface{} {
+	if value, ok := raw[path]; ok {
+		return value
+	}
+	keys, err := parsePath(path)
+	if err != nil {
+		return nil
+	}
+	var value interface{} = raw
+	for _, key := range keys {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			value = v[key]
+		case []interface{}:
+			index, err := strconv.Atoi(key)
+			if err != nil || index < 0 || index >= len(v) {
+				return nil
+			}
+			value = v[index]
+		default:
+			return nil
+		}
+	}
+	return value
+}
+
+// ValidatePath returns an error if the path of a profile attribute is no
+// path lookup supports, e.g. a JSONPath expression with wildcards, filters or
+// recursive descent.
+func ValidatePath(path string) error {
+	_, err := parsePath(path)
+	return err
+}
+
+// parsePath splits the path into its keys. Keys are separated by dots or
+// given in brackets, either as array index or as quoted key.
+func parsePath(path string) ([]string, error) {
+	unsupported := fmt.Errorf("unsupported path %s, paths consist of keys separated by dots, [index] and ['key']", path)
+	rest := path
+	if strings.HasPrefix(rest, "$.") || strings.HasPrefix(rest, "$[") {
+		rest = strings.TrimPrefix(rest[1:], ".")
+	}
+
+	keys := []string{}
+	dotted := false
+	for {
+		if !dotted && strings.HasPrefix(rest, "[") {
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, unsupported
+			}
+			key := rest[1:end]
+			if len(key) >= 2 && (key[0] == '\'' || key[0] == '"') {
+				quote := key[0]
+				// the quoted key may contain a ]
+				closing := strings.IndexByte(rest[2:], quote)
+				if closing < 0 || !strings.HasPrefix(rest[2+closing+1:], "]") {
+					return nil, unsupported
+				}
+				key = rest[2 : 2+closing]
+				end = 2 + closing + 1
+			} else if key == "" || strings.Trim(key, "0123456789") != "" {
+				return nil, unsupported
+			}
+			keys = append(keys, key)
+			rest = rest[end+1:]
+		} else {
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			key := rest[:end]
+			if key == "" || key == "*" {
+				return nil, unsupported
+			}
+			keys = append(keys, key)
+			rest = rest[end:]
+		}
+
+		if rest == "" {
+			return keys, nil
+		}
+		if rest[0] != '.' && rest[0] != '[' {
+			return nil, unsupported
+		}
+		dotted = rest[0] == '.'
+		if dotted {
+			rest = rest[1:]
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package provider
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodeProfile(t *testing.T) {
+	contents := []byte(`{"id": 1234567890, "name": "Some One", "picture": {"data": {"url": "https://example.com/a.png"}}}`)
+
+	profile, err := decodeProfile(contents, map[string]string{
+		ProfileAvatar: "picture.data.url",
+		ProfileEmail:  "missing.path",
+	})
+	assert.Nil(t, err, "err should be nothing")
+	assert.Equal(t, "1234567890", profile.ID)
+	assert.Equal(t, "Some One", profile.Name)
+	assert.Equal(t, "https://example.com/a.png", profile.Avatar)
+	assert.Empty(t, profile.Email)
+	assert.Contains(t, profile.Raw, "picture", "raw attributes should be kept")
+	assert.Equal(t, "https://example.com/a.png", profile.Field("picture.data.url"))
+}
+
+func TestLookup(t *testing.T) {
+	raw := map[string]interface{}{
+		"emails":          []interface{}{map[string]interface{}{"value": "someone@example.com"}},
+		"first.name":      "Some",
+		"urn:oid:0.9.2.1": "someone",
+		"data":            map[string]interface{}{"groups": []interface{}{"admins", "developers"}},
+	}
+
+	tests := map[string]interface{}{
+		"emails.0.value":          "someone@example.com",
+		"$.emails[0].value":       "someone@example.com",
+		"emails[0].value":         "someone@example.com",
+		"$['emails'][0]['value']": "someone@example.com",
+		"$['first.name']":         "Some",
+		`$["first.name"]`:         "Some",
+		"urn:oid:0.9.2.1":         "someone",
+		"$.data.groups[1]":        "developers",
+		"$.emails[1].value":       nil,
+		"$.missing.path":          nil,
+	}
+	for path, expected := range tests {
+		assert.Nil(t, ValidatePath(path), path)
+		assert.Equal(t, expected, lookup(raw, path), path)
+	}
+
+	for _, path := range []string{"$.emails[*].value", "$..value", "emails[?(@.primary)].value", "emails[0", "emails[-1]", "emails.", "emails[0]value", "$['first.name"} {
+		assert.NotNil(t, ValidatePath(path), path)
+		assert.Nil(t, lookup(raw, path), path)
+	}
+}
@@ -0,0 +1,181 @@
+package provider
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/krinklesaurus/jwt-proxy/util"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+)
+
+// DevID is the id of the development provider, whose tokens have the
+// provider claim dev.
+const DevID = "dev"
+
+// devTokenLifetime is the lifetime of the development provider's access
+// tokens, which are only valid within this process.
+const devTokenLifetime = time.Hour
+
+// ErrInvalidDevGrant is returned if a code or access token of the development
+// provider is unknown or expired.
+var ErrInvalidDevGrant = errors.New("unknown or expired code or token of dev login")
+
+// NewDev creates the development provider, which lets anyone log in as any
+// user on jwt-proxy's own login form. It must never be enabled in production.
+func NewDev(rootURI string) *DevProvider {
+	return &DevProvider{
+		loginURL:    rootURI + "/jwt-proxy/dev",
+		callbackURL: rootURI + "/jwt-proxy/callback/" + DevID,
+		codes:       map[string]devGrant{},
+		tokens:      map[string]devGrant{},
+	}
+}
+
+// DevProvider behaves like an OAuth2 provider, so that development logins go
+// through the callback, claims and redirect like real ones. The form at
+// loginURL hands the typed in profile to Authorize, which redirects to the
+// callback with a code for it.
+type DevProvider struct {
+	loginURL    string
+	callbackURL string
+
+	mu     sync.Mutex
+	codes  map[string]devGrant
+	tokens map[string]devGrant
+}
+
+type devGrant struct {
+	profile   *Profile
+	expiresAt time.Time
+}
+
+// AuthCodeURL returns the form of the development login.
+func (d *DevProvider) AuthCodeURL(state string, opts ...oauth2.AuthCodeOption) string {
+	return d.loginURL + "?" + url.Values{"state": {state}}.Encode()
+}
+
+// Authorize returns the callback URL with a code for the user with the given
+// username, email and groups, which are separated by commas or spaces.
+func (d *DevProvider) Authorize(state string, username string, email string, groups string) (string, error) {
+	if username == "" {
+		return "", errors.New("username of dev login must not be empty")
+	}
+	profile := &Profile{
+		ID:            username,
+		Login:         username,
+		Name:          username,
+		Email:         email,
+		EmailVerified: email != "",
+		Groups: strings.FieldsFunc(groups, func(r rune) bool {
+			return r == ',' || r == ' '
+		}),
+	}
+	profile.Raw = map[string]interface{}{
+		ProfileID:            profile.ID,
+		ProfileLogin:         profile.Login,
+		ProfileName:          profile.Name,
+		ProfileEmail:         profile.Email,
+		ProfileEmailVerified: profile.EmailVerified,
+		ProfileGroups:        profile.Groups,
+	}
+
+	code, err := d.grant(d.codes, profile, nonceLifetime)
+	if err != nil {
+		return "", err
+	}
+	return d.callbackURL + "?" + url.Values{"code": {code}, "state": {state}}.Encode(), nil
+}
+
+// grant stores the profile under a fresh random key.
+func (d *DevProvider) grant(grants map[string]devGrant, profile *Profile, lifetime time.Duration) (string, error) {
+	key, err := util.SecureRandomString(32)
+	if err != nil {
+		return "", err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	for existing, grant := range grants {
+		if now.After(grant.expiresAt) {
+			delete(grants, existing)
+		}
+	}
+	grants[key] = devGrant{profile: profile, expiresAt: now.Add(lifetime)}
+	return key, nil
+}
+
+// profile returns the profile of an unexpired key.
+func (d *DevProvider) profile(grants map[string]devGrant, key string, remove bool) (*Profile, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	grant, ok := grants[key]
+	if remove {
+		delete(grants, key)
+	}
+	if !ok || time.Now().After(grant.expiresAt) {
+		return nil, ErrInvalidDevGrant
+	}
+	return grant.profile, nil
+}
+
+// Exchange redeems the code once for an access token of the same user.
+func (d *DevProvider) Exchange(ctx context.Context, code string, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
+	profile, err := d.profile(d.codes, code, true)
+	if err != nil {
+		return nil, err
+	}
+	accessToken, err := d.grant(d.tokens, profile, devTokenLifetime)
+	if err != nil {
+		return nil, err
+	}
+	return &oauth2.Token{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		Expiry:      time.Now().Add(devTokenLifetime),
+	}, nil
+}
+
+// Refresh returns the token as long as it is valid, the development provider
+// issues no refresh tokens.
+func (d *DevProvider) Refresh(ctx context.Context, token *oauth2.Token) (*oauth2.Token, error) {
+	if _, err := d.profile(d.tokens, token.AccessToken, false); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// User returns the profile that was typed in for the access token.
+func (d *DevProvider) User(ctx context.Context, token *oauth2.Token) (*Profile, error) {
+	return d.profile(d.tokens, token.AccessToken, false)
+}
+
+func (d *DevProvider) Name() string {
+	return DevID
+}
+
+func (d *DevProvider) ClientID() string {
+	return ""
+}
+
+func (d *DevProvider) String() string {
+	toString := struct {
+		LoginURL    string `json:"login_url"`
+		RedirectURL string `json:"redirect_url"`
+	}{
+		d.loginURL,
+		d.callbackURL,
+	}
+	b, err := json.Marshal(toString)
+	if err != nil {
+		fmt.Println(err)
+		return err.Error()
+	}
+	return string(b)
+}
@@ -0,0 +1,43 @@
+package provider
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestDevProvider(t *testing.T) {
+	provider := NewDev("http://localhost:8080")
+	assert.Equal(t, "http://localhost:8080/jwt-proxy/dev?state=state", provider.AuthCodeURL("state"))
+
+	callback, err := provider.Authorize("state", "tester", "tester@example.com", "admins, developers")
+	assert.Nil(t, err, "err should be nothing")
+	assert.True(t, strings.HasPrefix(callback, "http://localhost:8080/jwt-proxy/callback/dev?"))
+	params, err := url.Parse(callback)
+	assert.Nil(t, err, "err should be nothing")
+	assert.Equal(t, "state", params.Query().Get("state"))
+
+	code := params.Query().Get("code")
+	token, err := provider.Exchange(context.Background(), code)
+	assert.Nil(t, err, "err should be nothing")
+	profile, err := provider.User(context.Background(), token)
+	assert.Nil(t, err, "err should be nothing")
+	assert.Equal(t, "tester", profile.ID)
+	assert.Equal(t, "tester@example.com", profile.Email)
+	assert.True(t, profile.EmailVerified)
+	assert.Equal(t, []string{"admins", "developers"}, profile.Groups)
+	assert.Equal(t, []string{"admins", "developers"}, profile.Field("groups"))
+
+	_, err = provider.Exchange(context.Background(), code)
+	assert.True(t, errors.Is(err, ErrInvalidDevGrant), "codes can be redeemed once")
+	token.AccessToken = "unknown"
+	_, err = provider.User(context.Background(), token)
+	assert.True(t, errors.Is(err, ErrInvalidDevGrant), "unknown tokens should be rejected")
+
+	_, err = provider.Authorize("state", "", "", "")
+	assert.NotNil(t, err, "the username must not be empty")
+}
@@ -1,10 +1,8 @@
 package provider
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"net/http"
 
 	"github.com/krinklesaurus/jwt-proxy/log"
@@ -13,65 +11,74 @@ import (
 	"golang.org/x/oauth2/facebook"
 )
 
-func NewFacebook(rootURI string, clientID string, clientSecret string, scopes []string) Provider {
+// facebookUserInfo is the user info of the Graph API with the fields of the
+// profile.
+const facebookUserInfo = "https://graph.facebook.com/me?fields=id,name,email,picture"
+
+// FacebookOptions are the optional settings of a Facebook provider.
+type FacebookOptions struct {
+	// HTTPClient calls Facebook, the default client if nil.
+	HTTPClient *http.Client
+}
+
+func NewFacebook(rootURI string, name string, clientID string, clientSecret string, scopes []string, options FacebookOptions) Provider {
 	return &FacebookProvider{
 		conf: oauth2.Config{
-			RedirectURL:  rootURI + "/jwt-proxy/callback/facebook",
+			RedirectURL:  rootURI + "/jwt-proxy/callback/" + name,
 			ClientID:     clientID,
 			ClientSecret: clientSecret,
 			Scopes:       scopes,
 			Endpoint:     facebook.Endpoint,
 		},
-		clientID: clientID,
+		name:        name,
+		userInfoURL: facebookUserInfo,
+		client:      orDefault(options.HTTPClient),
+		clientID:    clientID,
 	}
 }
 
 type FacebookProvider struct {
-	conf     oauth2.Config
-	token    *oauth2.Token
-	clientID string
+	name        string
+	conf        oauth2.Config
+	userInfoURL string
+	client      *http.Client
+	clientID    string
 }
 
-func (f *FacebookProvider) AuthCodeURL(state string) string {
-	return f.conf.AuthCodeURL(state)
+func (f *FacebookProvider) AuthCodeURL(state string, opts ...oauth2.AuthCodeOption) string {
+	return f.conf.AuthCodeURL(state, opts...)
 }
 
 func (f *FacebookProvider) ClientID() string {
 	return f.clientID
 }
 
-func (f *FacebookProvider) User() (string, error) {
-	url := fmt.Sprintf("https://graph.facebook.com/me?access_token=%s", f.token.AccessToken)
-
-	response, err := http.Get(url)
-	if err != nil {
-		return "", err
-	}
-	defer response.Body.Close()
-	contents, err := ioutil.ReadAll(response.Body)
+// User reads the user info with the access token as bearer token.
+func (f *FacebookProvider) User(ctx context.Context, token *oauth2.Token) (*Profile, error) {
+	contents, err := getUserInfo(ctx, f.client, f.userInfoURL, token)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	log.Debugf("contents from facebook: %s", contents)
 
-	dec := json.NewDecoder(bytes.NewReader(contents))
-	var asMap map[string]string
-	dec.Decode(&asMap)
-	return asMap["id"], nil
+	return decodeProfile(contents, map[string]string{
+		ProfileAvatar: "picture.data.url",
+	})
 }
 
-func (f *FacebookProvider) Exchange(ctx context.Context, code string) (*oauth2.Token, error) {
-	token, err := f.conf.Exchange(ctx, code)
-	if err != nil {
-		return nil, err
-	}
-	f.token = token
-	return f.token, err
+func (f *FacebookProvider) Exchange(ctx context.Context, code string, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
+	return f.conf.Exchange(withClient(ctx, f.client), code, opts...)
+}
+
+// Refresh returns a fresh token for the given token, using its refresh token
+// if it is expired.
+func (f *FacebookProvider) Refresh(ctx context.Context, token *oauth2.Token) (*oauth2.Token, error) {
+	return f.conf.TokenSource(withClient(ctx, f.client), token).Token()
 }
 
 func (f *FacebookProvider) Name() string {
-	return "facebook"
+	return f.name
 }
 
 func (f *FacebookProvider) String() string {
@@ -2,8 +2,8 @@ package provider
 
 import "fmt"
 
-func ExampleFacebookAuthCodeURL() {
-	f := NewFacebook("http://localhost:8080", "client-id", "client-secret", []string{"scope-1", "scope-2"})
+func ExampleFacebookProvider_AuthCodeURL() {
+	f := NewFacebook("http://localhost:8080", "facebook", "client-id", "client-secret", []string{"scope-1", "scope-2"}, FacebookOptions{})
 	authCodeURL := f.AuthCodeURL("state")
 	fmt.Println(authCodeURL)
 
@@ -3,9 +3,11 @@ package provider
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
 	"net/http"
+	"net/url"
+	"strings"
 
 	"github.com/krinklesaurus/jwt-proxy/log"
 	"golang.org/x/net/context"
@@ -13,77 +15,269 @@ import (
 	"golang.org/x/oauth2/github"
 )
 
-func NewGithub(rootURI string, clientID string, clientSecret string, scopes []string) Provider {
+// githubAPI is the API of github.com, GitHub Enterprise Server serves its API
+// at [baseUrl]/api/v3.
+const githubAPI = "https://api.github.com"
+
+// githubPageSize is the number of organizations or teams read per request.
+const githubPageSize = 100
+
+// GithubOptions are the optional settings of a GitHub provider.
+type GithubOptions struct {
+	// BaseURL is the URL of a GitHub Enterprise Server, github.com if empty.
+	BaseURL string
+	// AllowedOrganizations and AllowedTeams restrict the login to members of
+	// any of the organizations or teams, which are given as org/team-slug.
+	AllowedOrganizations []string
+	AllowedTeams         []string
+	// Organizations and Teams read the user's organizations and teams into
+	// the profile fields orgs and teams, which is implied by the respective
+	// restriction.
+	Organizations bool
+	Teams         bool
+	// PersonalAccessTokens lets VerifyToken accept tokens unknown to the app,
+	// like personal access tokens, whose users must then be members of the
+	// allowed organizations or teams.
+	PersonalAccessTokens bool
+	// HTTPClient calls GitHub, the default client if nil.
+	HTTPClient *http.Client
+}
+
+func NewGithub(rootURI string, name string, clientID string, clientSecret string, scopes []string, options GithubOptions) Provider {
 	log.Debugf("create github provider with clientID %s and scopes %s", clientID, scopes)
+	endpoint := github.Endpoint
+	api := githubAPI
+	if baseURL := strings.TrimSuffix(options.BaseURL, "/"); baseURL != "" {
+		endpoint = oauth2.Endpoint{
+			AuthURL:  baseURL + "/login/oauth/authorize",
+			TokenURL: baseURL + "/login/oauth/access_token",
+		}
+		api = baseURL + "/api/v3"
+	}
+
+	readOrganizations := options.Organizations || len(options.AllowedOrganizations) > 0
+	readTeams := options.Teams || len(options.AllowedTeams) > 0
+	if (readOrganizations || readTeams) && !contains(scopes, "read:org") {
+		scopes = append(append([]string{}, scopes...), "read:org")
+	}
+
 	return &GithubProvider{conf: oauth2.Config{
-		RedirectURL:  rootURI + "/jwt-proxy/callback/github",
+		RedirectURL:  rootURI + "/jwt-proxy/callback/" + name,
 		ClientID:     clientID,
 		ClientSecret: clientSecret,
 		Scopes:       scopes,
-		Endpoint:     github.Endpoint,
+		Endpoint:     endpoint,
 	},
-		clientID: clientID,
+		name:                 name,
+		api:                  api,
+		allowedOrganizations: options.AllowedOrganizations,
+		allowedTeams:         options.AllowedTeams,
+		readOrganizations:    readOrganizations,
+		readTeams:            readTeams,
+		personalAccessTokens: options.PersonalAccessTokens,
+		client:               orDefault(options.HTTPClient),
+		clientID:             clientID,
 	}
 }
 
-type userInfo struct {
-	Login string `json:"login"`
-}
-
 type GithubProvider struct {
-	conf     oauth2.Config
-	token    *oauth2.Token
-	clientID string
+	name                 string
+	conf                 oauth2.Config
+	api                  string
+	allowedOrganizations []string
+	allowedTeams         []string
+	readOrganizations    bool
+	readTeams            bool
+	personalAccessTokens bool
+	client               *http.Client
+	clientID             string
 }
 
-func (g *GithubProvider) AuthCodeURL(state string) string {
-	return g.conf.AuthCodeURL(state)
+func (g *GithubProvider) AuthCodeURL(state string, opts ...oauth2.AuthCodeOption) string {
+	return g.conf.AuthCodeURL(state, opts...)
 }
 
 func (g *GithubProvider) ClientID() string {
 	return g.clientID
 }
 
-func (g *GithubProvider) User() (string, error) {
-	url := fmt.Sprintf("https://api.github.com/user?access_token=%s", g.token.AccessToken)
+// User reads the user info with the access token along with the user's
+// organizations and teams, if configured, and checks that the user is a
+// member of one of the allowed organizations or teams.
+func (g *GithubProvider) User(ctx context.Context, token *oauth2.Token) (*Profile, error) {
+	contents, err := getUserInfo(ctx, g.client, g.api+"/user", token)
+	if err != nil {
+		return nil, err
+	}
 
-	response, err := http.Get(url)
+	log.Debugf("contents from github: %s", contents)
+
+	profile, err := decodeProfile(contents, map[string]string{
+		ProfileAvatar: "avatar_url",
+	})
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+
+	// logins can be renamed and registered by someone else afterwards, so
+	// users are identified by their numeric id
+	if profile.ID == "" {
+		return nil, fmt.Errorf("github user %s has no id", profile.Login)
+	}
+
+	var orgs, teams []string
+	if g.readOrganizations {
+		if orgs, err = g.organizations(ctx, token); err != nil {
+			return nil, err
+		}
+		profile.Raw["orgs"] = orgs
+	}
+	if g.readTeams {
+		if teams, err = g.teams(ctx, token); err != nil {
+			return nil, err
+		}
+		profile.Raw["teams"] = teams
+		profile.Groups = teams
 	}
-	defer response.Body.Close()
-	contents, err := ioutil.ReadAll(response.Body)
+
+	if len(g.allowedOrganizations) == 0 && len(g.allowedTeams) == 0 {
+		return profile, nil
+	}
+	if containsAny(g.allowedOrganizations, orgs) || containsAny(g.allowedTeams, teams) {
+		return profile, nil
+	}
+	return nil, fmt.Errorf("%w: %s is no member of the allowed organizations or teams", ErrNotAllowed, profile.Login)
+}
+
+// VerifyToken checks with GitHub's API for OAuth apps that the access token
+// was issued to the provider's app. Tokens of other apps and personal access
+// tokens are unknown to the app and rejected, unless personal access tokens
+// are enabled. User restricts them to the allowed organizations and teams.
+func (g *GithubProvider) VerifyToken(ctx context.Context, token *oauth2.Token) error {
+	body, err := json.Marshal(map[string]string{"access_token": token.AccessToken})
 	if err != nil {
-		return "", err
+		return err
 	}
+	request, err := http.NewRequest(http.MethodPost, g.api+"/applications/"+url.PathEscape(g.clientID)+"/token", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.SetBasicAuth(g.conf.ClientID, g.conf.ClientSecret)
 
-	dec := json.NewDecoder(bytes.NewReader(contents))
-	var userInfo userInfo
-	err = dec.Decode(&userInfo)
+	authorization := struct {
+		App struct {
+			ClientID string `json:"client_id"`
+		} `json:"app"`
+	}{}
+	err = doJSON(ctx, g.client, request, &authorization)
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) && (statusErr.StatusCode == http.StatusNotFound || statusErr.StatusCode == http.StatusUnprocessableEntity) {
+		if g.personalAccessTokens {
+			log.Debugf("accepting token unknown to app %s as personal access token", g.clientID)
+			return nil
+		}
+		return fmt.Errorf("%w: github does not know the token of app %s", ErrForeignToken, g.clientID)
+	}
 	if err != nil {
-		return "", err
+		return err
 	}
-	log.Debugf("contents from github: %s", userInfo)
+	if authorization.App.ClientID != g.clientID {
+		return fmt.Errorf("%w: github token is for app %s", ErrForeignToken, authorization.App.ClientID)
+	}
+	return nil
+}
 
-	return userInfo.Login, nil
+// organizations returns the logins of the user's organizations.
+func (g *GithubProvider) organizations(ctx context.Context, token *oauth2.Token) ([]string, error) {
+	orgs := []string{}
+	err := g.list(ctx, "/user/orgs", token, func(contents []byte) (int, error) {
+		page := []struct {
+			Login string `json:"login"`
+		}{}
+		if err := json.Unmarshal(contents, &page); err != nil {
+			return 0, err
+		}
+		for _, org := range page {
+			orgs = append(orgs, org.Login)
+		}
+		return len(page), nil
+	})
+	return orgs, err
 }
 
-func (g *GithubProvider) Exchange(ctx context.Context, code string) (*oauth2.Token, error) {
-	token, err := g.conf.Exchange(ctx, code)
+// teams returns the user's teams as org/team-slug.
+func (g *GithubProvider) teams(ctx context.Context, token *oauth2.Token) ([]string, error) {
+	teams := []string{}
+	err := g.list(ctx, "/user/teams", token, func(contents []byte) (int, error) {
+		page := []struct {
+			Slug         string `json:"slug"`
+			Organization struct {
+				Login string `json:"login"`
+			} `json:"organization"`
+		}{}
+		if err := json.Unmarshal(contents, &page); err != nil {
+			return 0, err
+		}
+		for _, team := range page {
+			teams = append(teams, team.Organization.Login+"/"+team.Slug)
+		}
+		return len(page), nil
+	})
+	return teams, err
+}
+
+// list reads all pages of the list at path, decode returns the number of
+// entries of a page.
+func (g *GithubProvider) list(ctx context.Context, path string, token *oauth2.Token, decode func(contents []byte) (int, error)) error {
+	for page := 1; ; page++ {
+		contents, err := getUserInfo(ctx, g.client, fmt.Sprintf("%s%s?per_page=%d&page=%d", g.api, path, githubPageSize, page), token)
+		if err != nil {
+			return err
+		}
+		entries, err := decode(contents)
+		if err != nil {
+			return err
+		}
+		if entries < githubPageSize {
+			return nil
+		}
+	}
+}
+
+// containsAny returns true if any of the values is allowed. GitHub logins and
+// slugs are case insensitive.
+func containsAny(allowed []string, values []string) bool {
+	for _, a := range allowed {
+		for _, value := range values {
+			if strings.EqualFold(a, value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (g *GithubProvider) Exchange(ctx context.Context, code string, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
+	token, err := g.conf.Exchange(withClient(ctx, g.client), code, opts...)
 	if err != nil {
 		return nil, err
 	}
 
-	if errorMsg := token.Extra("error"); errorMsg != "" {
+	if errorMsg, _ := token.Extra("error").(string); errorMsg != "" {
 		return nil, fmt.Errorf("%s", token.Extra("error_description"))
 	}
+	return token, nil
+}
 
-	g.token = token
-	return g.token, err
+// Refresh returns a fresh token for the given token, using its refresh token
+// if it is expired.
+func (g *GithubProvider) Refresh(ctx context.Context, token *oauth2.Token) (*oauth2.Token, error) {
+	return g.conf.TokenSource(withClient(ctx, g.client), token).Token()
 }
 
 func (g *GithubProvider) Name() string {
-	return "github"
+	return g.name
 }
 
 func (g *GithubProvider) String() string {
@@ -1,12 +1,161 @@
 package provider
 
-import "fmt"
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
 
-func ExampleGithubAuthCodeURL() {
-	f := NewGithub("http://localhost:8080", "client-id", "client-secret", []string{"scope-1", "scope-2"})
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+)
+
+func ExampleGithubProvider_AuthCodeURL() {
+	f := NewGithub("http://localhost:8080", "github", "client-id", "client-secret", []string{"scope-1", "scope-2"}, GithubOptions{})
 	authCodeURL := f.AuthCodeURL("state")
 	fmt.Println(authCodeURL)
 
 	// Output:
 	// https://github.com/login/oauth/authorize?client_id=client-id&redirect_uri=http%3A%2F%2Flocalhost%3A8080%2Fjwt-proxy%2Fcallback%2Fgithub&response_type=code&scope=scope-1+scope-2&state=state
 }
+
+// newFakeGithub is a GitHub Enterprise Server whose user octocat is member of
+// the organization octo-org and its team admins, with more teams than fit on
+// one page. octocat-pat is octocat's personal access token.
+func newFakeGithub(t *testing.T) *httptest.Server {
+	authorized := func(w http.ResponseWriter, r *http.Request) bool {
+		if auth := r.Header.Get("Authorization"); auth != "Bearer octocat-token" && auth != "Bearer octocat-pat" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return false
+		}
+		return true
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login/oauth/access_token", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"access_token": "octocat-token", "token_type": "bearer"})
+	})
+	mux.HandleFunc("/api/v3/user", func(w http.ResponseWriter, r *http.Request) {
+		if authorized(w, r) {
+			w.Write([]byte(`{"login": "octocat", "id": 1, "name": "The Octocat", "avatar_url": "https://github.example.com/octocat.png"}`))
+		}
+	})
+	mux.HandleFunc("/api/v3/applications/client-id/token", func(w http.ResponseWriter, r *http.Request) {
+		body := map[string]string{}
+		json.NewDecoder(r.Body).Decode(&body)
+		if id, secret, _ := r.BasicAuth(); id != "client-id" || secret != "client-secret" || body["access_token"] != "octocat-token" {
+			http.Error(w, `{"message": "Not Found"}`, http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"token": "octocat-token", "app": {"client_id": "client-id"}}`))
+	})
+	mux.HandleFunc("/api/v3/user/orgs", func(w http.ResponseWriter, r *http.Request) {
+		if authorized(w, r) {
+			w.Write([]byte(`[{"login": "octo-org"}]`))
+		}
+	})
+	mux.HandleFunc("/api/v3/user/teams", func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(w, r) {
+			return
+		}
+		teams := []map[string]interface{}{}
+		if r.URL.Query().Get("page") == "1" {
+			for i := 0; i < githubPageSize; i++ {
+				teams = append(teams, map[string]interface{}{"slug": fmt.Sprintf("team-%d", i), "organization": map[string]string{"login": "other-org"}})
+			}
+		} else {
+			teams = append(teams, map[string]interface{}{"slug": "admins", "organization": map[string]string{"login": "octo-org"}})
+		}
+		json.NewEncoder(w).Encode(teams)
+	})
+	return httptest.NewServer(mux)
+}
+
+func TestGithubProvider(t *testing.T) {
+	server := newFakeGithub(t)
+	defer server.Close()
+
+	login := func(options GithubOptions) (*Profile, error) {
+		options.BaseURL = server.URL
+		provider := NewGithub("http://localhost:8080", "github-enterprise", "client-id", "client-secret", []string{"user"}, options)
+		token, err := provider.Exchange(context.Background(), "code")
+		if err != nil {
+			return nil, err
+		}
+		return provider.User(context.Background(), token)
+	}
+
+	profile, err := login(GithubOptions{})
+	assert.Nil(t, err, "err should be nothing")
+	assert.Equal(t, "1", profile.ID, "users are identified by their numeric id")
+	assert.Equal(t, "octocat", profile.Login)
+	assert.Equal(t, "The Octocat", profile.Name)
+	assert.Nil(t, profile.Field("orgs"), "organizations are only read if configured")
+
+	profile, err = login(GithubOptions{Organizations: true, Teams: true})
+	assert.Nil(t, err, "err should be nothing")
+	assert.Equal(t, []string{"octo-org"}, profile.Field("orgs"))
+	assert.Len(t, profile.Field("teams"), githubPageSize+1, "all pages of teams should be read")
+	assert.Contains(t, profile.Groups, "octo-org/admins")
+
+	_, err = login(GithubOptions{AllowedOrganizations: []string{"Octo-Org"}})
+	assert.Nil(t, err, "members of an allowed organization should be admitted")
+	_, err = login(GithubOptions{AllowedTeams: []string{"octo-org/admins"}})
+	assert.Nil(t, err, "members of an allowed team should be admitted")
+
+	_, err = login(GithubOptions{AllowedOrganizations: []string{"evil-org"}})
+	assert.True(t, errors.Is(err, ErrNotAllowed))
+	_, err = login(GithubOptions{AllowedTeams: []string{"octo-org/owners"}})
+	assert.True(t, errors.Is(err, ErrNotAllowed))
+}
+
+func TestGithubProviderEnterpriseScopes(t *testing.T) {
+	provider := NewGithub("http://localhost:8080", "github-enterprise", "client-id", "client-secret", []string{"user"}, GithubOptions{
+		BaseURL:              "https://github.example.com/",
+		AllowedOrganizations: []string{"octo-org"},
+	})
+	authCodeURL := provider.AuthCodeURL("state")
+	assert.True(t, strings.HasPrefix(authCodeURL, "https://github.example.com/login/oauth/authorize?"))
+	assert.Contains(t, authCodeURL, "scope=user+read%3Aorg", "organizations can only be read with read:org")
+}
+
+func TestGithubProviderVerifyToken(t *testing.T) {
+	server := newFakeGithub(t)
+	defer server.Close()
+
+	provider := NewGithub("http://localhost:8080", "github-enterprise", "client-id", "client-secret", []string{"user"}, GithubOptions{BaseURL: server.URL}).(*GithubProvider)
+	assert.Nil(t, provider.VerifyToken(context.Background(), &oauth2.Token{AccessToken: "octocat-token"}))
+	err := provider.VerifyToken(context.Background(), &oauth2.Token{AccessToken: "personal-access-token"})
+	assert.True(t, errors.Is(err, ErrForeignToken), "tokens unknown to the app must be rejected")
+}
+
+func TestGithubProviderPersonalAccessTokens(t *testing.T) {
+	server := newFakeGithub(t)
+	defer server.Close()
+
+	pat := &oauth2.Token{AccessToken: "octocat-pat"}
+	provider := NewGithub("http://localhost:8080", "github-enterprise", "client-id", "client-secret", []string{"user"}, GithubOptions{BaseURL: server.URL}).(*GithubProvider)
+	assert.True(t, errors.Is(provider.VerifyToken(context.Background(), pat), ErrForeignToken), "personal access tokens are rejected by default")
+
+	provider = NewGithub("http://localhost:8080", "github-enterprise", "client-id", "client-secret", []string{"user"}, GithubOptions{
+		BaseURL:              server.URL,
+		AllowedOrganizations: []string{"octo-org"},
+		PersonalAccessTokens: true,
+	}).(*GithubProvider)
+	assert.Nil(t, provider.VerifyToken(context.Background(), pat))
+	profile, err := provider.User(context.Background(), pat)
+	assert.Nil(t, err, "err should be nothing")
+	assert.Equal(t, "octocat", profile.Login)
+
+	provider.allowedOrganizations = []string{"other-org"}
+	_, err = provider.User(context.Background(), pat)
+	assert.True(t, errors.Is(err, ErrNotAllowed), "personal access tokens of other users must be rejected")
+
+	_, err = New("github", "http://localhost:8080", "github", Options{"clientId": "client-id", "clientSecret": "client-secret", "scopes": "user", "personalAccessTokens": true})
+	assert.NotNil(t, err, "personal access tokens need allowed organizations or teams")
+}
@@ -1,11 +1,11 @@
 package provider
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"net/http"
+	"net/url"
+	"strings"
 
 	"github.com/krinklesaurus/jwt-proxy/log"
 	"golang.org/x/net/context"
@@ -13,64 +13,148 @@ import (
 	"golang.org/x/oauth2/google"
 )
 
-func NewGoogle(rootURI string, clientID string, clientSecret string, scopes []string) Provider {
+const (
+	googleUserInfo  = "https://www.googleapis.com/oauth2/v2/userinfo"
+	googleTokenInfo = "https://oauth2.googleapis.com/tokeninfo"
+)
+
+// GoogleOptions are the optional settings of a Google provider.
+type GoogleOptions struct {
+	// AllowedDomains restricts the login to Google Workspace accounts of the
+	// hosted domains.
+	AllowedDomains []string
+	// HTTPClient calls Google, the default client if nil.
+	HTTPClient *http.Client
+}
+
+func NewGoogle(rootURI string, name string, clientID string, clientSecret string, scopes []string, options GoogleOptions) Provider {
+	if len(options.AllowedDomains) > 0 && !contains(scopes, "email") {
+		scopes = append(append([]string{}, scopes...), "email")
+	}
 	return &GoogleProvider{conf: oauth2.Config{
-		RedirectURL:  rootURI + "/jwt-proxy/callback/google",
+		RedirectURL:  rootURI + "/jwt-proxy/callback/" + name,
 		ClientID:     clientID,
 		ClientSecret: clientSecret,
 		Scopes:       scopes,
 		Endpoint:     google.Endpoint,
 	},
-		clientID: clientID,
+		name:           name,
+		userInfoURL:    googleUserInfo,
+		tokenInfoURL:   googleTokenInfo,
+		allowedDomains: options.AllowedDomains,
+		client:         orDefault(options.HTTPClient),
+		clientID:       clientID,
 	}
 }
 
 type GoogleProvider struct {
-	conf     oauth2.Config
-	token    *oauth2.Token
-	clientID string
+	name           string
+	conf           oauth2.Config
+	userInfoURL    string
+	tokenInfoURL   string
+	allowedDomains []string
+	client         *http.Client
+	clientID       string
 }
 
-func (g *GoogleProvider) AuthCodeURL(state string) string {
-	return g.conf.AuthCodeURL(state)
+// AuthCodeURL returns Google's login URL. With allowed domains, the hd
+// parameter hints Google to offer accounts of these domains only, which is
+// no replacement for checking the domain of the profile.
+func (g *GoogleProvider) AuthCodeURL(state string, opts ...oauth2.AuthCodeOption) string {
+	switch len(g.allowedDomains) {
+	case 0:
+	case 1:
+		opts = append(opts, oauth2.SetAuthURLParam("hd", g.allowedDomains[0]))
+	default:
+		opts = append(opts, oauth2.SetAuthURLParam("hd", "*"))
+	}
+	return g.conf.AuthCodeURL(state, opts...)
 }
 
 func (g *GoogleProvider) ClientID() string {
 	return g.clientID
 }
 
-func (g *GoogleProvider) User() (string, error) {
-	url := fmt.Sprintf("https://www.googleapis.com/oauth2/v2/userinfo?access_token=%s", g.token.AccessToken)
-
-	response, err := http.Get(url)
+// User reads the user info with the access token as bearer token. Accounts
+// without a verified email are rejected, as are accounts outside the allowed
+// domains. The profile field domain is the account's hosted domain or, for
+// consumer accounts, the domain of the verified email.
+func (g *GoogleProvider) User(ctx context.Context, token *oauth2.Token) (*Profile, error) {
+	contents, err := getUserInfo(ctx, g.client, g.userInfoURL, token)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	defer response.Body.Close()
-	contents, err := ioutil.ReadAll(response.Body)
+
+	log.Debugf("contents from google: %s", contents)
+
+	profile, err := decodeProfile(contents, map[string]string{
+		ProfileAvatar:        "picture",
+		ProfileEmailVerified: "verified_email",
+	})
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	log.Debugf("contents from google: %s", contents)
+	if !profile.EmailVerified {
+		if profile.Email == "" {
+			return nil, fmt.Errorf("%w: account has no verified email", ErrNotAllowed)
+		}
+		return nil, fmt.Errorf("%w: email %s is not verified", ErrNotAllowed, profile.Email)
+	}
+
+	hostedDomain, _ := profile.Raw["hd"].(string)
+	if hostedDomain != "" {
+		profile.Raw["domain"] = hostedDomain
+	} else if profile.Email != "" {
+		profile.Raw["domain"] = profile.Email[strings.LastIndex(profile.Email, "@")+1:]
+	}
 
-	dec := json.NewDecoder(bytes.NewReader(contents))
-	var asMap map[string]string
-	dec.Decode(&asMap)
-	return asMap["id"], nil
+	if len(g.allowedDomains) == 0 {
+		return profile, nil
+	}
+	for _, allowed := range g.allowedDomains {
+		if hostedDomain != "" && strings.EqualFold(allowed, hostedDomain) {
+			return profile, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s is no account of the allowed domains", ErrNotAllowed, profile.Email)
 }
 
-func (g *GoogleProvider) Exchange(ctx context.Context, code string) (*oauth2.Token, error) {
-	token, err := g.conf.Exchange(ctx, code)
+// VerifyToken checks with Google's token info that the access token was
+// issued to the provider's client, i.e. that it is its aud or azp.
+func (g *GoogleProvider) VerifyToken(ctx context.Context, token *oauth2.Token) error {
+	form := url.Values{"access_token": {token.AccessToken}}
+	request, err := http.NewRequest(http.MethodPost, g.tokenInfoURL, strings.NewReader(form.Encode()))
 	if err != nil {
-		return nil, err
+		return err
 	}
-	g.token = token
-	return g.token, err
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	info := struct {
+		Audience        string `json:"aud"`
+		AuthorizedParty string `json:"azp"`
+	}{}
+	if err := doJSON(ctx, g.client, request, &info); err != nil {
+		return err
+	}
+	if info.Audience != g.clientID && info.AuthorizedParty != g.clientID {
+		return fmt.Errorf("%w: google token is for client %s", ErrForeignToken, info.Audience)
+	}
+	return nil
+}
+
+func (g *GoogleProvider) Exchange(ctx context.Context, code string, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
+	return g.conf.Exchange(withClient(ctx, g.client), code, opts...)
+}
+
+// Refresh returns a fresh token for the given token, using its refresh token
+// if it is expired.
+func (g *GoogleProvider) Refresh(ctx context.Context, token *oauth2.Token) (*oauth2.Token, error) {
+	return g.conf.TokenSource(withClient(ctx, g.client), token).Token()
 }
 
 func (g *GoogleProvider) Name() string {
-	return "google"
+	return g.name
 }
 
 func (g *GoogleProvider) String() string {
@@ -1,12 +1,100 @@
 package provider
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
 
-func ExampleGoogleAuthCodeURL() {
-	f := NewGoogle("http://localhost:8080", "client-id", "client-secret", []string{"scope-1", "scope-2"})
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+)
+
+func ExampleGoogleProvider_AuthCodeURL() {
+	f := NewGoogle("http://localhost:8080", "google", "client-id", "client-secret", []string{"scope-1", "scope-2"}, GoogleOptions{})
 	authCodeURL := f.AuthCodeURL("state")
 	fmt.Println(authCodeURL)
 
 	// Output:
 	// https://accounts.google.com/o/oauth2/auth?client_id=client-id&redirect_uri=http%3A%2F%2Flocalhost%3A8080%2Fjwt-proxy%2Fcallback%2Fgoogle&response_type=code&scope=scope-1+scope-2&state=state
 }
+
+func TestGoogleProvider(t *testing.T) {
+	profiles := map[string]string{
+		"workspace":  `{"id": "1", "email": "someone@example.com", "verified_email": true, "hd": "example.com"}`,
+		"consumer":   `{"id": "2", "email": "someone@gmail.com", "verified_email": true}`,
+		"unverified": `{"id": "3", "email": "someone@example.com", "verified_email": false, "hd": "example.com"}`,
+		"no-email":   `{"id": "4", "verified_email": false}`,
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		profile, ok := profiles[strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")]
+		if !ok || r.URL.Query().Get("access_token") != "" {
+			http.Error(w, `{"error": "invalid_token"}`, http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(profile))
+	}))
+	defer server.Close()
+
+	user := func(options GoogleOptions, accessToken string) (*Profile, error) {
+		provider := NewGoogle("http://localhost:8080", "google", "client-id", "client-secret", []string{"profile"}, options).(*GoogleProvider)
+		provider.userInfoURL = server.URL
+		return provider.User(context.Background(), &oauth2.Token{AccessToken: accessToken})
+	}
+
+	profile, err := user(GoogleOptions{}, "consumer")
+	assert.Nil(t, err, "err should be nothing")
+	assert.True(t, profile.EmailVerified)
+	assert.Equal(t, "gmail.com", profile.Field("domain"))
+
+	_, err = user(GoogleOptions{}, "unverified")
+	assert.True(t, errors.Is(err, ErrNotAllowed), "unverified emails should be rejected")
+	_, err = user(GoogleOptions{}, "no-email")
+	assert.True(t, errors.Is(err, ErrNotAllowed), "accounts without email should be rejected")
+
+	_, err = user(GoogleOptions{}, "expired")
+	statusErr := &StatusError{}
+	assert.True(t, errors.As(err, &statusErr), "error responses should not be decoded")
+	assert.Equal(t, http.StatusUnauthorized, statusErr.StatusCode)
+
+	allowed := GoogleOptions{AllowedDomains: []string{"example.com"}}
+	profile, err = user(allowed, "workspace")
+	assert.Nil(t, err, "err should be nothing")
+	assert.Equal(t, "example.com", profile.Field("domain"))
+
+	_, err = user(allowed, "consumer")
+	assert.True(t, errors.Is(err, ErrNotAllowed), "accounts outside the allowed domains should be rejected")
+	_, err = user(allowed, "unverified")
+	assert.True(t, errors.Is(err, ErrNotAllowed))
+
+	provider := NewGoogle("http://localhost:8080", "google", "client-id", "client-secret", []string{"profile"}, allowed)
+	assert.Contains(t, provider.AuthCodeURL("state"), "hd=example.com")
+	assert.Contains(t, provider.AuthCodeURL("state"), "scope=profile+email")
+}
+
+func TestGoogleProviderVerifyToken(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.PostFormValue("access_token") {
+		case "own":
+			w.Write([]byte(`{"aud": "client-id", "azp": "client-id", "sub": "1", "expires_in": "3599"}`))
+		case "other-audience":
+			w.Write([]byte(`{"aud": "other-client-id", "azp": "other-client-id", "sub": "1", "expires_in": "3599"}`))
+		default:
+			http.Error(w, `{"error": "invalid_token"}`, http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	provider := NewGoogle("http://localhost:8080", "google", "client-id", "client-secret", []string{"profile"}, GoogleOptions{}).(*GoogleProvider)
+	provider.tokenInfoURL = server.URL
+
+	assert.Nil(t, provider.VerifyToken(context.Background(), &oauth2.Token{AccessToken: "own"}))
+	err := provider.VerifyToken(context.Background(), &oauth2.Token{AccessToken: "other-audience"})
+	assert.True(t, errors.Is(err, ErrForeignToken), "tokens for another audience must be rejected")
+	err = provider.VerifyToken(context.Background(), &oauth2.Token{AccessToken: "expired"})
+	statusErr := &StatusError{}
+	assert.True(t, errors.As(err, &statusErr))
+}
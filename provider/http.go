@@ -0,0 +1,152 @@
+package provider
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+)
+
+// The timeouts of provider requests if none are configured.
+const (
+	defaultConnectTimeout = 5 * time.Second
+	defaultTimeout        = 15 * time.Second
+)
+
+// maxErrorBody is the number of bytes of an error response kept in a
+// StatusError.
+const maxErrorBody = 512
+
+// HTTPOptions configure the HTTP client a provider calls its endpoints with.
+type HTTPOptions struct {
+	// Timeout limits a whole request including reading the response and
+	// ConnectTimeout limits connecting including the TLS handshake. Zero
+	// means the default.
+	Timeout        time.Duration
+	ConnectTimeout time.Duration
+	// Proxy is the URL of the outbound proxy. If empty, the proxy is taken
+	// from HTTPS_PROXY, HTTP_PROXY and NO_PROXY.
+	Proxy string
+	// CABundle are PEM encoded certificates that are trusted in addition to
+	// the system's, e.g. of a corporate proxy or a self-hosted issuer.
+	CABundle []byte
+}
+
+// defaultHTTPClient is used by providers that were created without a client.
+var defaultHTTPClient, _ = NewHTTPClient(HTTPOptions{})
+
+// NewHTTPClient creates an HTTP client for calling a provider.
+func NewHTTPClient(options HTTPOptions) (*http.Client, error) {
+	if options.Timeout <= 0 {
+		options.Timeout = defaultTimeout
+	}
+	if options.ConnectTimeout <= 0 {
+		options.ConnectTimeout = defaultConnectTimeout
+	}
+
+	proxy := http.ProxyFromEnvironment
+	if options.Proxy != "" {
+		proxyURL, err := url.Parse(options.Proxy)
+		if err != nil || proxyURL.Host == "" {
+			return nil, fmt.Errorf("invalid proxy url %s", options.Proxy)
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if len(options.CABundle) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(options.CABundle) {
+			return nil, errors.New("ca bundle contains no PEM encoded certificate")
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	dialer := &net.Dialer{Timeout: options.ConnectTimeout, KeepAlive: 30 * time.Second}
+	return &http.Client{
+		Timeout: options.Timeout,
+		Transport: &http.Transport{
+			Proxy:                 proxy,
+			DialContext:           dialer.DialContext,
+			TLSClientConfig:       tlsConfig,
+			TLSHandshakeTimeout:   options.ConnectTimeout,
+			ResponseHeaderTimeout: options.Timeout,
+			MaxIdleConns:          100,
+			IdleConnTimeout:       90 * time.Second,
+			ExpectContinueTimeout: time.Second,
+		},
+	}, nil
+}
+
+// orDefault returns the client or, if it is nil, the default client.
+func orDefault(client *http.Client) *http.Client {
+	if client == nil {
+		return defaultHTTPClient
+	}
+	return client
+}
+
+// withClient returns a context that makes the oauth2 package send the token
+// requests with the client.
+func withClient(ctx context.Context, client *http.Client) context.Context {
+	return context.WithValue(ctx, oauth2.HTTPClient, client)
+}
+
+// doJSON sends the request with the client and decodes the JSON response into
+// value.
+func doJSON(ctx context.Context, client *http.Client, request *http.Request, value interface{}) error {
+	request = request.WithContext(ctx)
+	request.Header.Set("Accept", "application/json")
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if err := checkStatus(response); err != nil {
+		return err
+	}
+	return json.NewDecoder(response.Body).Decode(value)
+}
+
+// StatusError is returned if an endpoint of a provider answers with another
+// status than 2xx, so that errors are not mistaken for empty user info.
+type StatusError struct {
+	URL        string
+	StatusCode int
+	// Body is the beginning of the response, which usually tells the reason.
+	Body string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s returned %d %s: %s", e.URL, e.StatusCode, http.StatusText(e.StatusCode), e.Body)
+}
+
+// checkStatus returns a StatusError if the response is no success. The URL
+// is reported without its query, which might carry secrets.
+func checkStatus(response *http.Response) error {
+	if response.StatusCode >= 200 && response.StatusCode < 300 {
+		return nil
+	}
+	body, _ := ioutil.ReadAll(io.LimitReader(response.Body, maxErrorBody))
+	location := *response.Request.URL
+	location.RawQuery = ""
+	return &StatusError{
+		URL:        location.String(),
+		StatusCode: response.StatusCode,
+		Body:       strings.TrimSpace(string(body)),
+	}
+}
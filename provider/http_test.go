@@ -0,0 +1,94 @@
+package provider
+
+import (
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+)
+
+func TestHTTPClientTrustsCABundle(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id": "1234"}`))
+	}))
+	defer server.Close()
+	bundle := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+
+	_, err := defaultHTTPClient.Get(server.URL)
+	assert.NotNil(t, err, "unknown certificates should be rejected")
+
+	client, err := NewHTTPClient(HTTPOptions{CABundle: bundle})
+	assert.Nil(t, err, "err should be nothing")
+	response, err := client.Get(server.URL)
+	assert.Nil(t, err, "err should be nothing")
+	response.Body.Close()
+
+	_, err = NewHTTPClient(HTTPOptions{CABundle: []byte("no certificate")})
+	assert.NotNil(t, err, "invalid bundles should be rejected")
+}
+
+func TestHTTPClientUsesProxy(t *testing.T) {
+	requested := ""
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = r.URL.String()
+		w.Write([]byte(`{"id": "1234"}`))
+	}))
+	defer proxy.Close()
+
+	client, err := NewHTTPClient(HTTPOptions{Proxy: proxy.URL})
+	assert.Nil(t, err, "err should be nothing")
+	contents, err := getUserInfo(context.Background(), client, "http://userinfo.example.com/me", &oauth2.Token{AccessToken: "token"})
+	assert.Nil(t, err, "err should be nothing")
+	assert.Equal(t, `{"id": "1234"}`, string(contents))
+	assert.Equal(t, "http://userinfo.example.com/me", requested)
+
+	_, err = NewHTTPClient(HTTPOptions{Proxy: "no proxy"})
+	assert.NotNil(t, err, "invalid proxy urls should be rejected")
+}
+
+func TestHTTPClientTimesOut(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	client, err := NewHTTPClient(HTTPOptions{Timeout: 50 * time.Millisecond})
+	assert.Nil(t, err, "err should be nothing")
+	_, err = getUserInfo(context.Background(), client, server.URL, &oauth2.Token{AccessToken: "token"})
+	netErr, ok := errors.Unwrap(err).(interface{ Timeout() bool })
+	assert.True(t, ok && netErr.Timeout(), "slow providers should time out")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = getUserInfo(ctx, defaultHTTPClient, server.URL, &oauth2.Token{AccessToken: "token"})
+	assert.True(t, errors.Is(err, context.Canceled), "requests should be canceled with their context")
+}
+
+func TestGetUserInfoSendsBearerToken(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" || r.URL.RawQuery != "" {
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"id": "1234"}`))
+	}))
+	defer server.Close()
+
+	_, err := getUserInfo(context.Background(), defaultHTTPClient, server.URL, &oauth2.Token{AccessToken: "token"})
+	assert.Nil(t, err, "err should be nothing")
+
+	_, err = getUserInfo(context.Background(), defaultHTTPClient, server.URL+"?secret=1", &oauth2.Token{AccessToken: "other"})
+	statusErr := &StatusError{}
+	assert.True(t, errors.As(err, &statusErr))
+	assert.Equal(t, http.StatusUnauthorized, statusErr.StatusCode)
+	assert.Equal(t, "invalid token", statusErr.Body)
+	assert.Equal(t, server.URL, statusErr.URL, "the query should not be reported")
+}
@@ -0,0 +1,81 @@
+package provider
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/krinklesaurus/jwt-proxy/user"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+)
+
+// LocalID is the id of the provider of local accounts, whose tokens have the
+// provider claim local.
+const LocalID = "local"
+
+// errLocalNoToken is returned by the OAuth2 methods of the local provider,
+// whose logins are completed with Login.
+var errLocalNoToken = errors.New("local accounts have no OAuth2 tokens")
+
+// NewLocal creates the provider of the local accounts, which log in with
+// username and password on the login page.
+func NewLocal(rootURI string, credentials user.Credentials) *LocalProvider {
+	return &LocalProvider{loginURL: rootURI + "/jwt-proxy/login", credentials: credentials}
+}
+
+// LocalProvider is a Provider, so that local logins share the users and claims
+// of the other providers.
+type LocalProvider struct {
+	loginURL    string
+	credentials user.Credentials
+}
+
+// Login checks the password and returns the profile of the local account,
+// whose id is the username.
+func (l *LocalProvider) Login(username string, password string) (*Profile, error) {
+	if err := l.credentials.Verify(username, password); err != nil {
+		return nil, err
+	}
+	return &Profile{ID: username, Login: username, Raw: map[string]interface{}{}}, nil
+}
+
+// AuthCodeURL returns the login page, which has the form of the local
+// accounts.
+func (l *LocalProvider) AuthCodeURL(state string, opts ...oauth2.AuthCodeOption) string {
+	return l.loginURL
+}
+
+func (l *LocalProvider) Exchange(ctx context.Context, code string, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
+	return nil, errLocalNoToken
+}
+
+func (l *LocalProvider) Refresh(ctx context.Context, token *oauth2.Token) (*oauth2.Token, error) {
+	return nil, errLocalNoToken
+}
+
+func (l *LocalProvider) User(ctx context.Context, token *oauth2.Token) (*Profile, error) {
+	return nil, errLocalNoToken
+}
+
+func (l *LocalProvider) Name() string {
+	return LocalID
+}
+
+func (l *LocalProvider) ClientID() string {
+	return ""
+}
+
+func (l *LocalProvider) String() string {
+	toString := struct {
+		Users int `json:"users"`
+	}{
+		len(l.credentials),
+	}
+	b, err := json.Marshal(toString)
+	if err != nil {
+		fmt.Println(err)
+		return err.Error()
+	}
+	return string(b)
+}
@@ -0,0 +1,155 @@
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/krinklesaurus/jwt-proxy/log"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+)
+
+// AuthStyles are the supported ways to send the client credentials to the
+// token endpoint. The empty style detects the right one automatically.
+var AuthStyles = map[string]oauth2.AuthStyle{
+	"":       oauth2.AuthStyleAutoDetect,
+	"header": oauth2.AuthStyleInHeader,
+	"params": oauth2.AuthStyleInParams,
+}
+
+// OAuth2Options are the endpoints of a plain OAuth2 provider and the paths of
+// the user's id and profile fields within its user info.
+type OAuth2Options struct {
+	AuthURL     string
+	TokenURL    string
+	UserInfoURL string
+	AuthStyle   string
+	// UserIDPath is the path of the user's id, "id" if empty.
+	UserIDPath string
+	// ProfilePaths maps the normalized profile fields to their paths.
+	ProfilePaths map[string]string
+	// HTTPClient calls the endpoints, the default client if nil.
+	HTTPClient *http.Client
+}
+
+// NewOAuth2 creates a provider for any service that speaks plain OAuth2 and
+// returns the user as JSON from a user info endpoint.
+func NewOAuth2(rootURI string, name string, clientID string, clientSecret string, scopes []string, options OAuth2Options) (*OAuth2Provider, error) {
+	log.Debugf("create oauth2 provider %s with clientID %s and scopes %s", name, clientID, scopes)
+	if options.AuthURL == "" || options.TokenURL == "" || options.UserInfoURL == "" {
+		return nil, fmt.Errorf("oauth2 provider %s needs authUrl, tokenUrl and userInfoUrl", name)
+	}
+	authStyle, ok := AuthStyles[options.AuthStyle]
+	if !ok {
+		return nil, fmt.Errorf("unknown auth style %s of oauth2 provider %s", options.AuthStyle, name)
+	}
+
+	fields := map[string]string{}
+	for field, path := range options.ProfilePaths {
+		fields[field] = path
+	}
+	fields[ProfileID] = "id"
+	if options.UserIDPath != "" {
+		fields[ProfileID] = options.UserIDPath
+	}
+	for field, path := range fields {
+		if err := ValidatePath(path); err != nil {
+			return nil, fmt.Errorf("%s of oauth2 provider %s: %w", field, name, err)
+		}
+	}
+
+	return &OAuth2Provider{
+		name: name,
+		conf: oauth2.Config{
+			RedirectURL:  rootURI + "/jwt-proxy/callback/" + name,
+			ClientID:     clientID,
+			ClientSecret: clientSecret,
+			Scopes:       scopes,
+			Endpoint: oauth2.Endpoint{
+				AuthURL:   options.AuthURL,
+				TokenURL:  options.TokenURL,
+				AuthStyle: authStyle,
+			},
+		},
+		userInfoURL: options.UserInfoURL,
+		fields:      fields,
+		client:      orDefault(options.HTTPClient),
+		clientID:    clientID,
+	}, nil
+}
+
+type OAuth2Provider struct {
+	name        string
+	conf        oauth2.Config
+	userInfoURL string
+	fields      map[string]string
+	client      *http.Client
+	clientID    string
+}
+
+func (o *OAuth2Provider) AuthCodeURL(state string, opts ...oauth2.AuthCodeOption) string {
+	return o.conf.AuthCodeURL(state, opts...)
+}
+
+func (o *OAuth2Provider) ClientID() string {
+	return o.clientID
+}
+
+// User reads the user info with the access token as bearer token and takes
+// the user's id from the configured path.
+func (o *OAuth2Provider) User(ctx context.Context, token *oauth2.Token) (*Profile, error) {
+	contents, err := getUserInfo(ctx, o.client, o.userInfoURL, token)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", o.name, err)
+	}
+
+	log.Debugf("contents from %s: %s", o.name, contents)
+
+	profile, err := decodeProfile(contents, o.fields)
+	if err != nil {
+		return nil, err
+	}
+	if profile.ID == "" {
+		return nil, fmt.Errorf("user info of %s has no user id at %s", o.name, o.fields[ProfileID])
+	}
+	return profile, nil
+}
+
+func (o *OAuth2Provider) Exchange(ctx context.Context, code string, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
+	return o.conf.Exchange(withClient(ctx, o.client), code, opts...)
+}
+
+// Refresh returns a fresh token for the given token, using its refresh token
+// if it is expired.
+func (o *OAuth2Provider) Refresh(ctx context.Context, token *oauth2.Token) (*oauth2.Token, error) {
+	return o.conf.TokenSource(withClient(ctx, o.client), token).Token()
+}
+
+func (o *OAuth2Provider) Name() string {
+	return o.name
+}
+
+func (o *OAuth2Provider) String() string {
+	toString := struct {
+		ClientID    string   `json:"client_id"`
+		AuthURL     string   `json:"auth_url"`
+		TokenURL    string   `json:"token_url"`
+		UserInfoURL string   `json:"user_info_url"`
+		RediectURL  string   `json:"redirect_url"`
+		Scopes      []string `json:"scopes"`
+	}{
+		o.conf.ClientID,
+		o.conf.Endpoint.AuthURL,
+		o.conf.Endpoint.TokenURL,
+		o.userInfoURL,
+		o.conf.RedirectURL,
+		o.conf.Scopes,
+	}
+	b, err := json.Marshal(toString)
+	if err != nil {
+		fmt.Println(err)
+		return err.Error()
+	}
+	return string(b)
+}
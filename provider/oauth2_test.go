@@ -0,0 +1,112 @@
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestOAuth2Provider(t *testing.T) {
+	server := newFakeOAuth2Server(t)
+	defer server.Close()
+
+	provider := newFakeOAuth2Provider(t, server)
+	assert.Contains(t, provider.AuthCodeURL("state"), "redirect_uri=http%3A%2F%2Flocalhost%3A8080%2Fjwt-proxy%2Fcallback%2Fsome-service")
+
+	token, err := provider.Exchange(context.Background(), "42")
+	assert.Nil(t, err, "err should be nothing")
+
+	profile, err := provider.User(context.Background(), token)
+	assert.Nil(t, err, "err should be nothing")
+	assert.Equal(t, "42", profile.ID)
+	assert.Equal(t, "someone-42", profile.Login)
+	assert.Equal(t, "someone-42@example.com", profile.Email)
+
+	_, err = NewOAuth2("http://localhost:8080", "some-service", "client-id", "client-secret", nil, OAuth2Options{
+		AuthURL:     server.URL + "/authorize",
+		TokenURL:    server.URL + "/token",
+		UserInfoURL: server.URL + "/user",
+		AuthStyle:   "unknown",
+	})
+	assert.NotNil(t, err, "unknown auth styles should be rejected")
+
+	_, err = NewOAuth2("http://localhost:8080", "some-service", "client-id", "client-secret", nil, OAuth2Options{
+		AuthURL:     server.URL + "/authorize",
+		TokenURL:    server.URL + "/token",
+		UserInfoURL: server.URL + "/user",
+		UserIDPath:  "$.accounts[*].id",
+	})
+	assert.NotNil(t, err, "unsupported paths should be rejected")
+}
+
+// TestOAuth2ProviderParallelCallbacks logs in many users at once with the same
+// provider, each of which must end up with their own profile.
+func TestOAuth2ProviderParallelCallbacks(t *testing.T) {
+	server := newFakeOAuth2Server(t)
+	defer server.Close()
+
+	provider := newFakeOAuth2Provider(t, server)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(code string) {
+			defer wg.Done()
+			token, err := provider.Exchange(context.Background(), code)
+			if !assert.Nil(t, err, "err should be nothing") {
+				return
+			}
+			profile, err := provider.User(context.Background(), token)
+			if !assert.Nil(t, err, "err should be nothing") {
+				return
+			}
+			assert.Equal(t, code, profile.ID)
+			assert.Equal(t, "someone-"+code+"@example.com", profile.Email)
+		}(strconv.Itoa(i))
+	}
+	wg.Wait()
+}
+
+// newFakeOAuth2Server returns a server whose access token for a code belongs
+// to the user with the code as id.
+func newFakeOAuth2Server(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "client-id", r.PostFormValue("client_id"), "params auth style should send credentials in the body")
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"access_token": "token-" + r.PostFormValue("code"), "token_type": "Bearer"})
+	})
+	mux.HandleFunc("/user", func(w http.ResponseWriter, r *http.Request) {
+		uid := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer token-")
+		if _, err := strconv.Atoi(uid); err != nil {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprintf(w, `{"data": {"account": {"uid": %s, "handle": "someone-%s"}, "emails": [{"value": "someone-%s@example.com"}]}}`, uid, uid, uid)
+	})
+	return httptest.NewServer(mux)
+}
+
+func newFakeOAuth2Provider(t *testing.T, server *httptest.Server) *OAuth2Provider {
+	provider, err := NewOAuth2("http://localhost:8080", "some-service", "client-id", "client-secret", []string{"user"}, OAuth2Options{
+		AuthURL:     server.URL + "/authorize",
+		TokenURL:    server.URL + "/token",
+		UserInfoURL: server.URL + "/user",
+		AuthStyle:   "params",
+		UserIDPath:  "$.data.account.uid",
+		ProfilePaths: map[string]string{
+			ProfileLogin: "data.account.handle",
+			ProfileEmail: "data.emails.0.value",
+		},
+	})
+	assert.Nil(t, err, "err should be nothing")
+	return provider
+}
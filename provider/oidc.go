@@ -0,0 +1,466 @@
+package provider
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	jose "github.com/go-jose/go-jose/v3"
+	"github.com/go-jose/go-jose/v3/jwt"
+	"github.com/krinklesaurus/jwt-proxy/log"
+	"github.com/krinklesaurus/jwt-proxy/util"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+)
+
+// ErrInvalidIDToken is returned if the id_token of an OpenID Connect provider
+// fails validation.
+var ErrInvalidIDToken = errors.New("invalid id_token")
+
+// nonceLifetime is the time a user has to log in with the issuer.
+const nonceLifetime = 10 * time.Minute
+
+// GenerateNonce returns a fresh nonce for the id_token of a login, which is
+// kept in the user's session.
+func GenerateNonce() (string, error) {
+	return util.SecureRandomString(16)
+}
+
+// NonceOption returns the option sending the nonce on the authorization
+// request.
+func NonceOption(nonce string) oauth2.AuthCodeOption {
+	return oauth2.SetAuthURLParam("nonce", nonce)
+}
+
+type idTokenNonceKey struct{}
+
+// WithIDTokenNonce returns a context carrying the nonce of the user's login,
+// which the id_token returned by Exchange has to carry.
+func WithIDTokenNonce(ctx context.Context, nonce string) context.Context {
+	return context.WithValue(ctx, idTokenNonceKey{}, nonce)
+}
+
+// idTokenNonce returns the nonce of the login, which is empty if there is
+// none.
+func idTokenNonce(ctx context.Context) string {
+	nonce, _ := ctx.Value(idTokenNonceKey{}).(string)
+	return nonce
+}
+
+// idTokenAlgorithms are the accepted signature algorithms of id_tokens. HMAC
+// is not accepted, as it would make the client secret the verification key.
+var idTokenAlgorithms = map[string]bool{
+	"RS256": true, "RS384": true, "RS512": true,
+	"PS256": true, "PS384": true, "PS512": true,
+	"ES256": true, "ES384": true, "ES512": true,
+	"EdDSA": true,
+}
+
+// discovery is the part of the OpenID Connect discovery document the provider
+// needs.
+type discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserInfoEndpoint      string `json:"userinfo_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+	IntrospectionEndpoint string `json:"introspection_endpoint"`
+}
+
+// OIDCOptions are the optional settings of an OpenID Connect provider.
+type OIDCOptions struct {
+	// HTTPClient calls the issuer, the default client if nil.
+	HTTPClient *http.Client
+}
+
+// NewOIDC creates a provider for any OpenID Connect issuer, e.g. Keycloak, Dex,
+// Okta or Azure AD. The endpoints are read from the issuer's discovery
+// document on first use, so that jwt-proxy starts while the issuer is down.
+func NewOIDC(rootURI string, name string, issuer string, clientID string, clientSecret string, scopes []string, options OIDCOptions) (*OIDCProvider, error) {
+	log.Debugf("create oidc provider %s for issuer %s with clientID %s and scopes %s", name, issuer, clientID, scopes)
+	return newOIDCProvider(rootURI, name, issuer, clientID, clientSecret, scopes, nil, orDefault(options.HTTPClient)), nil
+}
+
+// newOIDCProvider creates the provider for the issuer's endpoints, which are
+// discovered if metadata is nil.
+func newOIDCProvider(rootURI string, name string, issuer string, clientID string, clientSecret string, scopes []string, metadata *discovery, client *http.Client) *OIDCProvider {
+	return &OIDCProvider{
+		name: name,
+		conf: oauth2.Config{
+			RedirectURL:  rootURI + "/jwt-proxy/callback/" + name,
+			ClientID:     clientID,
+			ClientSecret: clientSecret,
+			Scopes:       scopes,
+		},
+		issuer:   issuer,
+		metadata: metadata,
+		client:   client,
+		clientID: clientID,
+	}
+}
+
+type OIDCProvider struct {
+	name   string
+	conf   oauth2.Config
+	issuer string
+
+	// mu guards the lazily fetched metadata and keys, it is never held while
+	// calling the issuer.
+	mu       sync.Mutex
+	metadata *discovery
+	keys     *jose.JSONWebKeySet
+
+	// clientSecret creates the client secret for each token request if set,
+	// e.g. for Sign in with Apple.
+	clientSecret func() (string, error)
+
+	client   *http.Client
+	clientID string
+}
+
+// endpoints returns the issuer's endpoints. A failed discovery is tried again
+// on the next call.
+func (o *OIDCProvider) endpoints() (*discovery, error) {
+	o.mu.Lock()
+	metadata := o.metadata
+	o.mu.Unlock()
+	if metadata != nil {
+		return metadata, nil
+	}
+
+	metadata = &discovery{}
+	if err := getJSON(o.client, o.issuer+"/.well-known/openid-configuration", metadata); err != nil {
+		return nil, fmt.Errorf("error reading discovery document of %s: %w", o.issuer, err)
+	}
+	if metadata.Issuer != o.issuer {
+		return nil, fmt.Errorf("discovery document of %s is for issuer %s", o.issuer, metadata.Issuer)
+	}
+	if metadata.JWKSURI == "" {
+		return nil, fmt.Errorf("discovery document of %s has no jwks_uri", o.issuer)
+	}
+
+	o.mu.Lock()
+	o.metadata = metadata
+	o.mu.Unlock()
+	return metadata, nil
+}
+
+// endpointConfig returns the OAuth2 config with the issuer's endpoints.
+func (o *OIDCProvider) endpointConfig() (*oauth2.Config, error) {
+	metadata, err := o.endpoints()
+	if err != nil {
+		return nil, err
+	}
+	conf := o.conf
+	conf.Endpoint.AuthURL = metadata.AuthorizationEndpoint
+	conf.Endpoint.TokenURL = metadata.TokenEndpoint
+	return &conf, nil
+}
+
+// config returns the OAuth2 config for a token request.
+func (o *OIDCProvider) config() (*oauth2.Config, error) {
+	conf, err := o.endpointConfig()
+	if err != nil || o.clientSecret == nil {
+		return conf, err
+	}
+	conf.ClientSecret, err = o.clientSecret()
+	if err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+// AuthCodeURL returns the issuer's login URL, whose options must include the
+// NonceOption of the login. It is empty if the issuer cannot be discovered.
+func (o *OIDCProvider) AuthCodeURL(state string, opts ...oauth2.AuthCodeOption) string {
+	conf, err := o.endpointConfig()
+	if err != nil {
+		log.Errorf("error creating login url of %s: %v", o.name, err)
+		return ""
+	}
+	return conf.AuthCodeURL(state, opts...)
+}
+
+func (o *OIDCProvider) ClientID() string {
+	return o.clientID
+}
+
+// User returns the profile from the token's id_token or, if the issuer did
+// not return one, e.g. on refresh, from the user info endpoint. The user's id
+// is the sub claim.
+func (o *OIDCProvider) User(ctx context.Context, token *oauth2.Token) (*Profile, error) {
+	var profile *Profile
+	var err error
+	if idToken, _ := token.Extra("id_token").(string); idToken != "" {
+		profile, err = o.validate(idToken, "")
+	} else {
+		profile, err = o.userInfo(ctx, token)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if profile.ID == "" {
+		return nil, fmt.Errorf("%w: missing sub", ErrInvalidIDToken)
+	}
+	return profile, nil
+}
+
+// Exchange redeems the code and validates the returned id_token including the
+// nonce of the login, which the context has to carry, see WithIDTokenNonce.
+func (o *OIDCProvider) Exchange(ctx context.Context, code string, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
+	nonce := idTokenNonce(ctx)
+	if nonce == "" {
+		return nil, fmt.Errorf("%w: login with %s has no nonce", ErrInvalidIDToken, o.issuer)
+	}
+	conf, err := o.config()
+	if err != nil {
+		return nil, err
+	}
+	token, err := conf.Exchange(withClient(ctx, o.client), code, opts...)
+	if err != nil {
+		return nil, err
+	}
+	idToken, _ := token.Extra("id_token").(string)
+	if idToken == "" {
+		return nil, fmt.Errorf("%w: token response of %s has no id_token", ErrInvalidIDToken, o.issuer)
+	}
+	if _, err := o.validate(idToken, nonce); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// Refresh returns a fresh token for the given token.
+func (o *OIDCProvider) Refresh(ctx context.Context, token *oauth2.Token) (*oauth2.Token, error) {
+	conf, err := o.config()
+	if err != nil {
+		return nil, err
+	}
+	return conf.TokenSource(withClient(ctx, o.client), token).Token()
+}
+
+// VerifyToken asks the issuer's introspection endpoint, see RFC 7662, whether
+// the access token is active and was issued to the provider's client, i.e.
+// that it is its client_id or one of its audiences.
+func (o *OIDCProvider) VerifyToken(ctx context.Context, token *oauth2.Token) error {
+	metadata, err := o.endpoints()
+	if err != nil {
+		return err
+	}
+	if metadata.IntrospectionEndpoint == "" {
+		return fmt.Errorf("%w: issuer %s has no introspection endpoint", ErrVerificationUnsupported, o.issuer)
+	}
+	conf, err := o.config()
+	if err != nil {
+		return err
+	}
+
+	form := url.Values{"token": {token.AccessToken}, "token_type_hint": {"access_token"}}
+	request, err := http.NewRequest(http.MethodPost, metadata.IntrospectionEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.SetBasicAuth(url.QueryEscape(conf.ClientID), url.QueryEscape(conf.ClientSecret))
+
+	introspection := struct {
+		Active   bool         `json:"active"`
+		ClientID string       `json:"client_id"`
+		Audience jwt.Audience `json:"aud"`
+	}{}
+	if err := doJSON(ctx, o.client, request, &introspection); err != nil {
+		return fmt.Errorf("%s: %w", o.issuer, err)
+	}
+	if !introspection.Active {
+		return fmt.Errorf("%w: token is not active at %s", ErrForeignToken, o.issuer)
+	}
+	if introspection.ClientID != o.clientID && !introspection.Audience.Contains(o.clientID) {
+		return fmt.Errorf("%w: token of %s is for client %s", ErrForeignToken, o.issuer, introspection.ClientID)
+	}
+	return nil
+}
+
+// validate checks the signature, iss, aud, exp and, if nonce is set, the nonce
+// of the id_token and returns its claims as profile.
+func (o *OIDCProvider) validate(idToken string, nonce string) (*Profile, error) {
+	jws, err := jose.ParseSigned(idToken)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidIDToken, err)
+	}
+	if len(jws.Signatures) != 1 {
+		return nil, fmt.Errorf("%w: expected exactly one signature", ErrInvalidIDToken)
+	}
+	header := jws.Signatures[0].Header
+	if !idTokenAlgorithms[header.Algorithm] {
+		return nil, fmt.Errorf("%w: unsupported algorithm %s", ErrInvalidIDToken, header.Algorithm)
+	}
+
+	key, err := o.key(header)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := jws.Verify(key)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidIDToken, err)
+	}
+
+	claims := jwt.Claims{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidIDToken, err)
+	}
+	if claims.Expiry == nil {
+		return nil, fmt.Errorf("%w: missing exp", ErrInvalidIDToken)
+	}
+	err = claims.Validate(jwt.Expected{
+		Issuer:   o.issuer,
+		Audience: jwt.Audience{o.clientID},
+		Time:     time.Now(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidIDToken, err)
+	}
+
+	profile, err := decodeProfile(payload, oidcProfileFields)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidIDToken, err)
+	}
+
+	if nonce != "" {
+		tokenNonce, _ := profile.Raw["nonce"].(string)
+		if subtle.ConstantTimeCompare([]byte(tokenNonce), []byte(nonce)) != 1 {
+			return nil, fmt.Errorf("%w: nonce does not match the login", ErrInvalidIDToken)
+		}
+	}
+	return profile, nil
+}
+
+// oidcProfileFields maps the standard claims to the normalized profile fields.
+var oidcProfileFields = map[string]string{
+	ProfileID:     "sub",
+	ProfileLogin:  "preferred_username",
+	ProfileEmail:  "email",
+	ProfileName:   "name",
+	ProfileAvatar: "picture",
+	ProfileGroups: "groups",
+}
+
+// key returns the issuer's key the id_token was signed with. The JWKS is
+// fetched again if the key is unknown, as the issuer might have rotated its
+// keys.
+func (o *OIDCProvider) key(header jose.Header) (*jose.JSONWebKey, error) {
+	o.mu.Lock()
+	keys := o.keys
+	o.mu.Unlock()
+
+	for attempt := 0; attempt < 2; attempt++ {
+		if keys == nil || attempt > 0 {
+			var err error
+			if keys, err = o.fetchKeys(); err != nil {
+				return nil, err
+			}
+		}
+
+		candidates := keys.Keys
+		if header.KeyID != "" {
+			candidates = keys.Key(header.KeyID)
+		}
+		for _, candidate := range candidates {
+			if candidate.Use != "" && candidate.Use != "sig" {
+				continue
+			}
+			if candidate.Algorithm != "" && candidate.Algorithm != header.Algorithm {
+				continue
+			}
+			key := candidate
+			return &key, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: no key %s in jwks of %s", ErrInvalidIDToken, header.KeyID, o.issuer)
+}
+
+// fetchKeys reads the issuer's JWKS and keeps it for the next id_tokens.
+func (o *OIDCProvider) fetchKeys() (*jose.JSONWebKeySet, error) {
+	metadata, err := o.endpoints()
+	if err != nil {
+		return nil, err
+	}
+	keys := &jose.JSONWebKeySet{}
+	if err := getJSON(o.client, metadata.JWKSURI, keys); err != nil {
+		return nil, fmt.Errorf("error reading jwks of %s: %w", o.issuer, err)
+	}
+
+	o.mu.Lock()
+	o.keys = keys
+	o.mu.Unlock()
+	return keys, nil
+}
+
+// userInfo reads the profile from the issuer's user info endpoint.
+func (o *OIDCProvider) userInfo(ctx context.Context, token *oauth2.Token) (*Profile, error) {
+	metadata, err := o.endpoints()
+	if err != nil {
+		return nil, err
+	}
+	if metadata.UserInfoEndpoint == "" {
+		return nil, fmt.Errorf("issuer %s has no userinfo endpoint", o.issuer)
+	}
+	contents, err := getUserInfo(ctx, o.client, metadata.UserInfoEndpoint, token)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", o.issuer, err)
+	}
+	return decodeProfile(contents, oidcProfileFields)
+}
+
+func (o *OIDCProvider) Name() string {
+	return o.name
+}
+
+func (o *OIDCProvider) String() string {
+	o.mu.Lock()
+	metadata := o.metadata
+	o.mu.Unlock()
+	if metadata == nil {
+		metadata = &discovery{}
+	}
+
+	toString := struct {
+		ClientID   string   `json:"client_id"`
+		Issuer     string   `json:"issuer"`
+		AuthURL    string   `json:"auth_url"`
+		TokenURL   string   `json:"token_url"`
+		RediectURL string   `json:"redirect_url"`
+		Scopes     []string `json:"scopes"`
+	}{
+		o.conf.ClientID,
+		o.issuer,
+		metadata.AuthorizationEndpoint,
+		metadata.TokenEndpoint,
+		o.conf.RedirectURL,
+		o.conf.Scopes,
+	}
+	b, err := json.Marshal(toString)
+	if err != nil {
+		fmt.Println(err)
+		return err.Error()
+	}
+	return string(b)
+}
+
+// getJSON decodes the JSON document at url into value.
+func getJSON(client *http.Client, url string, value interface{}) error {
+	response, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if err := checkStatus(response); err != nil {
+		return err
+	}
+	return json.NewDecoder(response.Body).Decode(value)
+}
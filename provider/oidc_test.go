@@ -0,0 +1,206 @@
+package provider
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	jose "github.com/go-jose/go-jose/v3"
+	"github.com/go-jose/go-jose/v3/jwt"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+)
+
+// fakeIssuer is an in-process OpenID Connect issuer that returns an id_token
+// with the claims of the test.
+type fakeIssuer struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+	// signingKey signs the id_token, which is key unless the test wants an
+	// invalid signature.
+	signingKey *rsa.PrivateKey
+	claims     map[string]interface{}
+}
+
+func newFakeIssuer(t *testing.T) *fakeIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err, "err should be nothing")
+	issuer := &fakeIssuer{key: key, signingKey: key}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 issuer.URL,
+			"authorization_endpoint": issuer.URL + "/authorize",
+			"token_endpoint":         issuer.URL + "/token",
+			"userinfo_endpoint":      issuer.URL + "/userinfo",
+			"jwks_uri":               issuer.URL + "/jwks",
+			"introspection_endpoint": issuer.URL + "/introspect",
+		})
+	})
+	mux.HandleFunc("/introspect", func(w http.ResponseWriter, r *http.Request) {
+		if id, secret, _ := r.BasicAuth(); id != "client-id" || secret != "client-secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		switch r.PostFormValue("token") {
+		case "issuer-access-token":
+			w.Write([]byte(`{"active": true, "client_id": "client-id", "aud": ["account", "client-id"]}`))
+		case "other-client-token":
+			w.Write([]byte(`{"active": true, "client_id": "other-client", "aud": "account"}`))
+		default:
+			w.Write([]byte(`{"active": false}`))
+		}
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+			{Key: &issuer.key.PublicKey, KeyID: "issuer-key", Algorithm: "RS256", Use: "sig"},
+		}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "issuer-access-token",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     issuer.sign(t, issuer.signingKey, issuer.claims),
+		})
+	})
+	issuer.Server = httptest.NewServer(mux)
+	return issuer
+}
+
+func (f *fakeIssuer) sign(t *testing.T, key *rsa.PrivateKey, claims map[string]interface{}) string {
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: key},
+		(&jose.SignerOptions{}).WithHeader("kid", "issuer-key"))
+	assert.Nil(t, err, "err should be nothing")
+	token, err := jwt.Signed(signer).Claims(claims).CompactSerialize()
+	assert.Nil(t, err, "err should be nothing")
+	return token
+}
+
+// validClaims returns the claims of a valid id_token for the nonce of the
+// auth code URL.
+func (f *fakeIssuer) validClaims(t *testing.T, authCodeURL string) map[string]interface{} {
+	parsed, err := url.Parse(authCodeURL)
+	assert.Nil(t, err, "err should be nothing")
+	return map[string]interface{}{
+		"iss":                f.URL,
+		"sub":                "user-1234",
+		"aud":                "client-id",
+		"exp":                time.Now().Add(time.Hour).Unix(),
+		"iat":                time.Now().Unix(),
+		"nonce":              parsed.Query().Get("nonce"),
+		"email":              "someone@example.com",
+		"preferred_username": "someone",
+	}
+}
+
+func TestOIDCProvider(t *testing.T) {
+	issuer := newFakeIssuer(t)
+	defer issuer.Close()
+
+	provider, err := NewOIDC("http://localhost:8080", "keycloak", issuer.URL, "client-id", "client-secret", []string{"openid", "email"}, OIDCOptions{})
+	assert.Nil(t, err, "err should be nothing")
+
+	authCodeURL := provider.AuthCodeURL("state", NonceOption("login-nonce"))
+	assert.Contains(t, authCodeURL, issuer.URL+"/authorize?")
+	assert.Contains(t, authCodeURL, "redirect_uri=http%3A%2F%2Flocalhost%3A8080%2Fjwt-proxy%2Fcallback%2Fkeycloak")
+	assert.Contains(t, authCodeURL, "nonce=login-nonce")
+
+	issuer.claims = issuer.validClaims(t, authCodeURL)
+	token, err := provider.Exchange(WithIDTokenNonce(context.Background(), "login-nonce"), "code")
+	assert.Nil(t, err, "err should be nothing")
+	assert.Equal(t, "issuer-access-token", token.AccessToken)
+
+	profile, err := provider.User(context.Background(), token)
+	assert.Nil(t, err, "err should be nothing")
+	assert.Equal(t, "user-1234", profile.ID)
+	assert.Equal(t, "someone@example.com", profile.Email)
+	assert.Equal(t, "someone", profile.Login)
+
+	_, err = provider.Exchange(WithIDTokenNonce(context.Background(), "other-login-nonce"), "code")
+	assert.True(t, errors.Is(err, ErrInvalidIDToken), "nonce must be the one of the user's login")
+	_, err = provider.Exchange(context.Background(), "code")
+	assert.True(t, errors.Is(err, ErrInvalidIDToken), "logins without nonce must be rejected")
+}
+
+func TestOIDCProviderRejectsInvalidIDTokens(t *testing.T) {
+	issuer := newFakeIssuer(t)
+	defer issuer.Close()
+
+	provider, err := NewOIDC("http://localhost:8080", "keycloak", issuer.URL, "client-id", "client-secret", []string{"openid"}, OIDCOptions{})
+	assert.Nil(t, err, "err should be nothing")
+
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	tests := map[string]func(claims map[string]interface{}){
+		"wrong issuer":   func(claims map[string]interface{}) { claims["iss"] = "https://evil.example.com" },
+		"wrong audience": func(claims map[string]interface{}) { claims["aud"] = "other-client" },
+		"expired":        func(claims map[string]interface{}) { claims["exp"] = time.Now().Add(-time.Hour).Unix() },
+		"missing exp":    func(claims map[string]interface{}) { delete(claims, "exp") },
+		"unknown nonce":  func(claims map[string]interface{}) { claims["nonce"] = "forged" },
+		"wrong key":      nil,
+	}
+	for name, modify := range tests {
+		issuer.claims = issuer.validClaims(t, provider.AuthCodeURL("state", NonceOption("login-nonce")))
+		issuer.signingKey = issuer.key
+		if modify != nil {
+			modify(issuer.claims)
+		} else {
+			issuer.signingKey = otherKey
+		}
+		_, err := provider.Exchange(WithIDTokenNonce(context.Background(), "login-nonce"), "code")
+		assert.True(t, errors.Is(err, ErrInvalidIDToken), name)
+	}
+}
+
+func TestOIDCProviderDiscoveryIssuerMismatch(t *testing.T) {
+	issuer := newFakeIssuer(t)
+	defer issuer.Close()
+
+	provider, err := NewOIDC("http://localhost:8080", "keycloak", issuer.URL+"/", "client-id", "client-secret", []string{"openid"}, OIDCOptions{})
+	assert.Nil(t, err, "discovery should wait for the first login")
+	assert.Empty(t, provider.AuthCodeURL("state"), "issuer of the discovery document must match")
+}
+
+func TestOIDCProviderLazyDiscovery(t *testing.T) {
+	issuer := newFakeIssuer(t)
+	url := issuer.URL
+	issuer.Close()
+
+	provider, err := NewOIDC("http://localhost:8080", "keycloak", url, "client-id", "client-secret", []string{"openid"}, OIDCOptions{})
+	assert.Nil(t, err, "jwt-proxy should start while the issuer is down")
+	assert.Empty(t, provider.AuthCodeURL("state"))
+
+	issuer = newFakeIssuer(t)
+	defer issuer.Close()
+	provider, err = NewOIDC("http://localhost:8080", "keycloak", issuer.URL, "client-id", "client-secret", []string{"openid"}, OIDCOptions{})
+	assert.Nil(t, err, "err should be nothing")
+	assert.Contains(t, provider.AuthCodeURL("state"), issuer.URL+"/authorize?")
+}
+
+func TestOIDCProviderVerifyToken(t *testing.T) {
+	issuer := newFakeIssuer(t)
+	defer issuer.Close()
+
+	provider, err := NewOIDC("http://localhost:8080", "keycloak", issuer.URL, "client-id", "client-secret", []string{"openid"}, OIDCOptions{})
+	assert.Nil(t, err, "err should be nothing")
+
+	assert.Nil(t, provider.VerifyToken(context.Background(), &oauth2.Token{AccessToken: "issuer-access-token"}))
+	err = provider.VerifyToken(context.Background(), &oauth2.Token{AccessToken: "other-client-token"})
+	assert.True(t, errors.Is(err, ErrForeignToken), "tokens of other clients must be rejected")
+	err = provider.VerifyToken(context.Background(), &oauth2.Token{AccessToken: "revoked"})
+	assert.True(t, errors.Is(err, ErrForeignToken), "inactive tokens must be rejected")
+
+	withoutIntrospection := newOIDCProvider("http://localhost:8080", "apple", issuer.URL, "client-id", "client-secret", []string{"openid"},
+		&discovery{Issuer: issuer.URL, JWKSURI: issuer.URL + "/jwks"}, issuer.Client())
+	err = withoutIntrospection.VerifyToken(context.Background(), &oauth2.Token{AccessToken: "issuer-access-token"})
+	assert.True(t, errors.Is(err, ErrVerificationUnsupported))
+}
@@ -0,0 +1,31 @@
+package provider
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+
+	"github.com/krinklesaurus/jwt-proxy/util"
+	"golang.org/x/oauth2"
+)
+
+// GenerateVerifier returns a fresh PKCE code verifier of 43 characters, see
+// RFC 7636 section 4.1.
+func GenerateVerifier() (string, error) {
+	return util.SecureRandomString(32)
+}
+
+// S256ChallengeOptions returns the options sending the S256 code challenge of
+// the verifier on the authorization request.
+func S256ChallengeOptions(verifier string) []oauth2.AuthCodeOption {
+	hash := sha256.Sum256([]byte(verifier))
+	return []oauth2.AuthCodeOption{
+		oauth2.SetAuthURLParam("code_challenge", base64.RawURLEncoding.EncodeToString(hash[:])),
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"),
+	}
+}
+
+// VerifierOption returns the option sending the verifier on the token
+// request.
+func VerifierOption(verifier string) oauth2.AuthCodeOption {
+	return oauth2.SetAuthURLParam("code_verifier", verifier)
+}
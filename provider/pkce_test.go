@@ -0,0 +1,49 @@
+package provider
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestPKCE(t *testing.T) {
+	verifier, err := GenerateVerifier()
+	assert.Nil(t, err, "err should be nothing")
+	assert.Len(t, verifier, 43)
+
+	var challenge string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hash := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+		if base64.RawURLEncoding.EncodeToString(hash[:]) != challenge {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error": "invalid_grant"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"access_token": "some-access-token", "token_type": "Bearer"})
+	}))
+	defer server.Close()
+
+	provider := newFakeOAuth2Provider(t, server)
+	provider.conf.Endpoint.TokenURL = server.URL
+
+	authCodeURL, err := url.Parse(provider.AuthCodeURL("state", S256ChallengeOptions(verifier)...))
+	assert.Nil(t, err, "err should be nothing")
+	assert.Equal(t, "S256", authCodeURL.Query().Get("code_challenge_method"))
+	challenge = authCodeURL.Query().Get("code_challenge")
+	assert.NotEmpty(t, challenge)
+
+	_, err = provider.Exchange(context.Background(), "code", VerifierOption(verifier))
+	assert.Nil(t, err, "err should be nothing")
+
+	_, err = provider.Exchange(context.Background(), "code", VerifierOption("wrong-verifier"))
+	assert.NotNil(t, err, "the token endpoint should reject the wrong verifier")
+}
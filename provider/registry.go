@@ -0,0 +1,313 @@
+package provider
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cast"
+)
+
+// Options are the settings of one configured provider instance, e.g. its id,
+// type, clientId and the options specific to its type. Keys are matched case
+// insensitively.
+type Options map[string]interface{}
+
+// Has returns true if the option is set.
+func (o Options) Has(key string) bool {
+	return o.get(key) != nil
+}
+
+func (o Options) String(key string) string {
+	return cast.ToString(o.get(key))
+}
+
+// Strings returns a list option, a single string is split at whitespace.
+func (o Options) Strings(key string) []string {
+	values := cast.ToStringSlice(o.get(key))
+	if values == nil {
+		return []string{}
+	}
+	return values
+}
+
+func (o Options) Int(key string) int {
+	return cast.ToInt(o.get(key))
+}
+
+func (o Options) Bool(key string) bool {
+	return cast.ToBool(o.get(key))
+}
+
+func (o Options) StringMap(key string) map[string]string {
+	return cast.ToStringMapString(o.get(key))
+}
+
+// httpClient returns the client the provider calls its endpoints with, which
+// is configured by timeoutSeconds, connectTimeoutSeconds, proxyUrl and
+// caBundlePath.
+func (o Options) httpClient(id string) (*http.Client, error) {
+	options := HTTPOptions{
+		Timeout:        time.Duration(o.Int("timeoutSeconds")) * time.Second,
+		ConnectTimeout: time.Duration(o.Int("connectTimeoutSeconds")) * time.Second,
+		Proxy:          o.String("proxyUrl"),
+	}
+	if path := o.String("caBundlePath"); path != "" {
+		var err error
+		if options.CABundle, err = ioutil.ReadFile(path); err != nil {
+			return nil, err
+		}
+	}
+	client, err := NewHTTPClient(options)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", id, err)
+	}
+	return client, nil
+}
+
+func (o Options) get(key string) interface{} {
+	if value, ok := o[key]; ok {
+		return value
+	}
+	for name, value := range o {
+		if strings.EqualFold(name, key) {
+			return value
+		}
+	}
+	return nil
+}
+
+// require returns an error naming the first of the options that is empty.
+func (o Options) require(id string, keys ...string) error {
+	for _, key := range keys {
+		if o.String(key) == "" && len(o.Strings(key)) == 0 {
+			return fmt.Errorf("%s %s must not be empty", id, key)
+		}
+	}
+	return nil
+}
+
+// Factory creates the provider instance with the given id, whose callback is
+// rootURI/jwt-proxy/callback/id.
+type Factory func(rootURI string, id string, options Options) (Provider, error)
+
+type registration struct {
+	displayName string
+	factory     Factory
+}
+
+var registry = map[string]registration{}
+
+// Register makes a provider type available for configuration. displayName is
+// shown on the login page unless an instance configures its own name, if it
+// is empty the instance's id is shown.
+func Register(providerType string, displayName string, factory Factory) {
+	registry[providerType] = registration{displayName: displayName, factory: factory}
+}
+
+// Registered returns true if there is a factory for the provider type.
+func Registered(providerType string) bool {
+	_, ok := registry[providerType]
+	return ok
+}
+
+// Types returns the registered provider types.
+func Types() []string {
+	types := []string{}
+	for providerType := range registry {
+		types = append(types, providerType)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// DisplayName returns the name of the provider instance on the login page,
+// which is the name option, the display name of its type or its id.
+func DisplayName(providerType string, id string, options Options) string {
+	if name := options.String("name"); name != "" {
+		return name
+	}
+	if name := registry[providerType].displayName; name != "" {
+		return name
+	}
+	return id
+}
+
+// New creates the provider instance with the factory of its type.
+func New(providerType string, rootURI string, id string, options Options) (Provider, error) {
+	registration, ok := registry[providerType]
+	if !ok {
+		return nil, fmt.Errorf("unknown type %s of provider %s, known types are %s", providerType, id, strings.Join(Types(), ", "))
+	}
+	return registration.factory(rootURI, id, options)
+}
+
+func init() {
+	Register("google", "Google", func(rootURI string, id string, options Options) (Provider, error) {
+		if err := options.require(id, "clientId", "clientSecret", "scopes"); err != nil {
+			return nil, err
+		}
+		client, err := options.httpClient(id)
+		if err != nil {
+			return nil, err
+		}
+		return NewGoogle(rootURI, id, options.String("clientId"), options.String("clientSecret"), options.Strings("scopes"), GoogleOptions{
+			AllowedDomains: options.Strings("allowedDomains"),
+			HTTPClient:     client,
+		}), nil
+	})
+	Register("github", "GitHub", func(rootURI string, id string, options Options) (Provider, error) {
+		if err := options.require(id, "clientId", "clientSecret", "scopes"); err != nil {
+			return nil, err
+		}
+		personalAccessTokens := options.Bool("personalAccessTokens")
+		if personalAccessTokens && len(options.Strings("allowedOrganizations")) == 0 && len(options.Strings("allowedTeams")) == 0 {
+			return nil, fmt.Errorf("%s personalAccessTokens requires allowedOrganizations or allowedTeams", id)
+		}
+		client, err := options.httpClient(id)
+		if err != nil {
+			return nil, err
+		}
+		return NewGithub(rootURI, id, options.String("clientId"), options.String("clientSecret"), options.Strings("scopes"), GithubOptions{
+			BaseURL:              options.String("baseUrl"),
+			AllowedOrganizations: options.Strings("allowedOrganizations"),
+			AllowedTeams:         options.Strings("allowedTeams"),
+			Organizations:        options.Bool("organizations"),
+			Teams:                options.Bool("teams"),
+			PersonalAccessTokens: personalAccessTokens,
+			HTTPClient:           client,
+		}), nil
+	})
+	Register("facebook", "Facebook", func(rootURI string, id string, options Options) (Provider, error) {
+		if err := options.require(id, "clientId", "clientSecret", "scopes"); err != nil {
+			return nil, err
+		}
+		client, err := options.httpClient(id)
+		if err != nil {
+			return nil, err
+		}
+		return NewFacebook(rootURI, id, options.String("clientId"), options.String("clientSecret"), options.Strings("scopes"), FacebookOptions{
+			HTTPClient: client,
+		}), nil
+	})
+	Register("apple", "Apple", func(rootURI string, id string, options Options) (Provider, error) {
+		if err := options.require(id, "clientId", "teamId", "keyId"); err != nil {
+			return nil, err
+		}
+		client, err := options.httpClient(id)
+		if err != nil {
+			return nil, err
+		}
+		privateKey := []byte(options.String("privateKey"))
+		if path := options.String("privateKeyPath"); path != "" {
+			if privateKey, err = ioutil.ReadFile(path); err != nil {
+				return nil, err
+			}
+		}
+		provider, err := NewApple(rootURI, id, options.String("clientId"), options.Strings("scopes"), AppleOptions{
+			TeamID:     options.String("teamId"),
+			KeyID:      options.String("keyId"),
+			PrivateKey: privateKey,
+			Issuer:     options.String("issuer"),
+			HTTPClient: client,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return provider, nil
+	})
+	Register("saml", "", func(rootURI string, id string, options Options) (Provider, error) {
+		client, err := options.httpClient(id)
+		if err != nil {
+			return nil, err
+		}
+		metadata := []byte(options.String("idpMetadata"))
+		switch {
+		case options.String("idpMetadataUrl") != "":
+			metadata, err = getSAMLMetadata(client, options.String("idpMetadataUrl"))
+		case options.String("idpMetadataPath") != "":
+			metadata, err = ioutil.ReadFile(options.String("idpMetadataPath"))
+		case len(metadata) == 0:
+			err = fmt.Errorf("%s idpMetadataUrl must not be empty", id)
+		}
+		if err != nil {
+			return nil, err
+		}
+		samlOptions := SAMLOptions{
+			IDPMetadata:  metadata,
+			EntityID:     options.String("entityId"),
+			NameIDFormat: options.String("nameIdFormat"),
+			SignRequests: options.Bool("signRequests"),
+			Attributes:   options.StringMap("attributes"),
+		}
+		if path := options.String("certificatePath"); path != "" {
+			if samlOptions.Certificate, err = ioutil.ReadFile(path); err != nil {
+				return nil, err
+			}
+		}
+		if path := options.String("privateKeyPath"); path != "" {
+			if samlOptions.PrivateKey, err = ioutil.ReadFile(path); err != nil {
+				return nil, err
+			}
+		}
+		provider, err := NewSAML(rootURI, id, samlOptions)
+		if err != nil {
+			return nil, err
+		}
+		return provider, nil
+	})
+	Register("oidc", "", func(rootURI string, id string, options Options) (Provider, error) {
+		if err := options.require(id, "clientId", "clientSecret", "issuer"); err != nil {
+			return nil, err
+		}
+		client, err := options.httpClient(id)
+		if err != nil {
+			return nil, err
+		}
+		scopes := options.Strings("scopes")
+		if !contains(scopes, "openid") {
+			scopes = append([]string{"openid"}, scopes...)
+		}
+		provider, err := NewOIDC(rootURI, id, options.String("issuer"), options.String("clientId"), options.String("clientSecret"), scopes, OIDCOptions{
+			HTTPClient: client,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return provider, nil
+	})
+	Register("oauth2", "", func(rootURI string, id string, options Options) (Provider, error) {
+		if err := options.require(id, "clientId", "clientSecret"); err != nil {
+			return nil, err
+		}
+		client, err := options.httpClient(id)
+		if err != nil {
+			return nil, err
+		}
+		provider, err := NewOAuth2(rootURI, id, options.String("clientId"), options.String("clientSecret"), options.Strings("scopes"), OAuth2Options{
+			AuthURL:      options.String("authUrl"),
+			TokenURL:     options.String("tokenUrl"),
+			UserInfoURL:  options.String("userInfoUrl"),
+			AuthStyle:    options.String("authStyle"),
+			UserIDPath:   options.String("userIdPath"),
+			ProfilePaths: options.StringMap("profile"),
+			HTTPClient:   client,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return provider, nil
+	})
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,37 @@
+package provider
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistry(t *testing.T) {
+	Register("custom", "Custom", func(rootURI string, id string, options Options) (Provider, error) {
+		return NewGithub(rootURI, id, options.String("clientId"), options.String("clientSecret"), options.Strings("scopes"), GithubOptions{}), nil
+	})
+	defer delete(registry, "custom")
+
+	options := Options{"clientid": "client-id", "ClientSecret": "client-secret", "scopes": "a b"}
+	provider, err := New("custom", "http://localhost:8080", "my-custom", options)
+	assert.Nil(t, err, "err should be nothing")
+	assert.Equal(t, "my-custom", provider.Name())
+	assert.Equal(t, "client-id", provider.ClientID())
+	assert.Contains(t, provider.AuthCodeURL("state"), "callback%2Fmy-custom")
+	assert.Contains(t, provider.AuthCodeURL("state"), "scope=a+b")
+	assert.Equal(t, "Custom", DisplayName("custom", "my-custom", options))
+	assert.Equal(t, "Mine", DisplayName("custom", "my-custom", Options{"name": "Mine"}))
+	assert.Equal(t, "my-oauth2", DisplayName("oauth2", "my-oauth2", Options{}))
+
+	_, err = New("unknown", "http://localhost:8080", "some-id", options)
+	assert.NotNil(t, err, "unknown types should be rejected")
+	_, err = New("github", "http://localhost:8080", "github", Options{"clientId": "client-id"})
+	assert.NotNil(t, err, "missing options should be rejected")
+	_, err = New("github", "http://localhost:8080", "github", Options{"clientId": "client-id", "clientSecret": "client-secret", "scopes": "user", "caBundlePath": "does-not-exist.pem"})
+	assert.NotNil(t, err, "missing ca bundles should be rejected")
+
+	provider, err = New("github", "http://localhost:8080", "github", Options{"clientId": "client-id", "clientSecret": "client-secret", "scopes": "user", "timeoutSeconds": 3})
+	assert.Nil(t, err, "err should be nothing")
+	assert.Equal(t, 3*time.Second, provider.(*GithubProvider).client.Timeout)
+}
@@ -0,0 +1,373 @@
+package provider
+
+import (
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/crewjam/saml"
+	"github.com/krinklesaurus/jwt-proxy/log"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+)
+
+// ErrInvalidSAMLResponse is returned if the response of a SAML identity
+// provider fails validation.
+var ErrInvalidSAMLResponse = errors.New("invalid SAML response")
+
+// errSAMLNoToken is returned by the OAuth2 methods of SAML providers, whose
+// logins are completed at the assertion consumer service.
+var errSAMLNoToken = errors.New("SAML identity providers issue no OAuth2 tokens")
+
+// samlSignatureMethod signs authentication requests if signRequests is set.
+const samlSignatureMethod = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"
+
+// samlNameIDFormats are the short names of the NameID formats.
+var samlNameIDFormats = map[string]saml.NameIDFormat{
+	"persistent":   saml.PersistentNameIDFormat,
+	"transient":    saml.TransientNameIDFormat,
+	"emailAddress": saml.EmailAddressNameIDFormat,
+	"unspecified":  saml.UnspecifiedNameIDFormat,
+}
+
+// samlAttributes are the attributes, by name or friendly name, the profile
+// fields are read from unless configured otherwise.
+var samlAttributes = map[string][]string{
+	ProfileLogin:  {"uid", "urn:oid:0.9.2342.19200300.100.1.1"},
+	ProfileEmail:  {"mail", "email", "urn:oid:0.9.2342.19200300.100.1.3", "http://schemas.xmlsoap.org/ws/2005/05/identity/claims/emailaddress"},
+	ProfileName:   {"displayName", "cn", "urn:oid:2.16.840.1.113730.3.1.241", "http://schemas.xmlsoap.org/ws/2005/05/identity/claims/name"},
+	ProfileGroups: {"groups", "memberOf", "eduPersonAffiliation", "http://schemas.microsoft.com/ws/2008/06/identity/claims/groups"},
+}
+
+// SAMLOptions are the settings of a SAML 2.0 identity provider.
+type SAMLOptions struct {
+	// IDPMetadata is the identity provider's metadata XML.
+	IDPMetadata []byte
+	// EntityID is jwt-proxy's entity id, the URL of its metadata if empty.
+	EntityID string
+	// NameIDFormat is the requested NameID format as URN or short name,
+	// persistent if empty.
+	NameIDFormat string
+	// Certificate and PrivateKey are the PEM encoded key pair the identity
+	// provider encrypts assertions for, the key also signs authentication
+	// requests if SignRequests is set.
+	Certificate  []byte
+	PrivateKey   []byte
+	SignRequests bool
+	// Attributes maps profile fields to the attribute they are read from,
+	// e.g. email to urn:oid:0.9.2342.19200300.100.1.3. The id is the NameID
+	// unless it is mapped to an attribute.
+	Attributes map[string]string
+}
+
+// NewSAML creates a SAML 2.0 service provider for the identity provider. Its
+// metadata is served at /jwt-proxy/saml/[name]/metadata and the identity
+// provider posts its responses to /jwt-proxy/saml/[name]/acs.
+func NewSAML(rootURI string, name string, options SAMLOptions) (*SAMLProvider, error) {
+	log.Debugf("create saml provider %s", name)
+	idpMetadata, err := parseSAMLMetadata(options.IDPMetadata)
+	if err != nil {
+		return nil, fmt.Errorf("%s idp metadata: %w", name, err)
+	}
+
+	metadataURL, err := url.Parse(rootURI + "/jwt-proxy/saml/" + name + "/metadata")
+	if err != nil {
+		return nil, err
+	}
+	acsURL, err := url.Parse(rootURI + "/jwt-proxy/saml/" + name + "/acs")
+	if err != nil {
+		return nil, err
+	}
+
+	nameIDFormat := saml.PersistentNameIDFormat
+	if options.NameIDFormat != "" {
+		nameIDFormat = saml.NameIDFormat(options.NameIDFormat)
+		if short, ok := samlNameIDFormats[options.NameIDFormat]; ok {
+			nameIDFormat = short
+		}
+	}
+
+	sp := &saml.ServiceProvider{
+		EntityID:          options.EntityID,
+		MetadataURL:       *metadataURL,
+		AcsURL:            *acsURL,
+		IDPMetadata:       idpMetadata,
+		AuthnNameIDFormat: nameIDFormat,
+	}
+	if len(options.Certificate) > 0 || len(options.PrivateKey) > 0 {
+		keyPair, err := tls.X509KeyPair(options.Certificate, options.PrivateKey)
+		if err != nil {
+			return nil, fmt.Errorf("%s certificate: %w", name, err)
+		}
+		key, ok := keyPair.PrivateKey.(*rsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("%s privateKey: expected an RSA key, got %T", name, keyPair.PrivateKey)
+		}
+		certificate, err := x509.ParseCertificate(keyPair.Certificate[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s certificate: %w", name, err)
+		}
+		sp.Key = key
+		sp.Certificate = certificate
+	}
+	if options.SignRequests {
+		if sp.Key == nil {
+			return nil, fmt.Errorf("%s signRequests requires a certificate and privateKey", name)
+		}
+		sp.SignatureMethod = samlSignatureMethod
+	}
+	if sp.GetSSOBindingLocation(saml.HTTPRedirectBinding) == "" {
+		return nil, fmt.Errorf("%s idp metadata has no HTTP-Redirect single sign-on service", name)
+	}
+
+	return &SAMLProvider{
+		name:        name,
+		sp:          sp,
+		attributes:  options.Attributes,
+		requests:    map[string]samlRequest{},
+		maxRequests: maxSAMLRequests,
+	}, nil
+}
+
+// maxSAMLRequests is the number of pending authentication requests kept per
+// identity provider, the oldest ones are dropped once it is reached.
+const maxSAMLRequests = 10000
+
+// SAMLProvider logs users in with a SAML 2.0 identity provider. It is a
+// Provider, so that SAML logins share the users and claims of OAuth2 logins,
+// but it completes logins with ParseResponse instead of Exchange and User.
+type SAMLProvider struct {
+	name       string
+	sp         *saml.ServiceProvider
+	attributes map[string]string
+
+	mu       sync.Mutex
+	requests map[string]samlRequest
+	// pending are the states of the requests, oldest first
+	pending     []string
+	maxRequests int
+}
+
+// samlRequest is a pending authentication request.
+type samlRequest struct {
+	id        string
+	expiresAt time.Time
+}
+
+// AuthCodeURL returns the identity provider's login URL with an
+// authentication request, whose RelayState is state. opts are ignored.
+func (s *SAMLProvider) AuthCodeURL(state string, opts ...oauth2.AuthCodeOption) string {
+	request, err := s.sp.MakeAuthenticationRequest(s.sp.GetSSOBindingLocation(saml.HTTPRedirectBinding), saml.HTTPRedirectBinding, saml.HTTPPostBinding)
+	if err != nil {
+		log.Errorf("error creating authentication request %v", err)
+		return ""
+	}
+	redirect, err := request.Redirect(url.QueryEscape(state), s.sp)
+	if err != nil {
+		log.Errorf("error creating authentication request %v", err)
+		return ""
+	}
+
+	s.mu.Lock()
+	now := time.Now()
+	for len(s.pending) > 0 {
+		oldest, ok := s.requests[s.pending[0]]
+		if ok && now.Before(oldest.expiresAt) && len(s.pending) < s.maxRequests {
+			break
+		}
+		delete(s.requests, s.pending[0])
+		s.pending = s.pending[1:]
+	}
+	s.requests[state] = samlRequest{id: request.ID, expiresAt: now.Add(nonceLifetime)}
+	s.pending = append(s.pending, state)
+	s.mu.Unlock()
+
+	return redirect.String()
+}
+
+// ParseResponse validates the response the identity provider posted to the
+// assertion consumer service for the login with the given state, i.e. its
+// signature, issuer, destination, audience and validity. Each authentication
+// request is answered once, so responses cannot be replayed.
+func (s *SAMLProvider) ParseResponse(r *http.Request, state string) (*Profile, error) {
+	s.mu.Lock()
+	request, ok := s.requests[state]
+	delete(s.requests, state)
+	s.mu.Unlock()
+	if !ok || time.Now().After(request.expiresAt) {
+		return nil, fmt.Errorf("%w: unknown or reused RelayState", ErrInvalidSAMLResponse)
+	}
+
+	assertion, err := s.sp.ParseResponse(r, []string{request.id})
+	if err != nil {
+		// the error of invalid responses is deliberately vague, the
+		// reason is kept as private error
+		var invalid *saml.InvalidResponseError
+		if errors.As(err, &invalid) {
+			err = invalid.PrivateErr
+		}
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSAMLResponse, err)
+	}
+
+	profile := s.profile(assertion)
+	if profile.ID == "" {
+		return nil, fmt.Errorf("%w: missing NameID", ErrInvalidSAMLResponse)
+	}
+	return profile, nil
+}
+
+// profile returns the profile of the assertion. Raw holds all attributes by
+// name and friendly name, attributes with several values are lists.
+func (s *SAMLProvider) profile(assertion *saml.Assertion) *Profile {
+	raw := map[string]interface{}{}
+	values := map[string][]string{}
+	for _, statement := range assertion.AttributeStatements {
+		for _, attribute := range statement.Attributes {
+			attributeValues := []string{}
+			for _, value := range attribute.Values {
+				attributeValues = append(attributeValues, value.Value)
+			}
+			for _, key := range []string{attribute.Name, attribute.FriendlyName} {
+				if key == "" {
+					continue
+				}
+				values[key] = attributeValues
+				if len(attributeValues) == 1 {
+					raw[key] = attributeValues[0]
+				} else {
+					list := []interface{}{}
+					for _, value := range attributeValues {
+						list = append(list, value)
+					}
+					raw[key] = list
+				}
+			}
+		}
+	}
+
+	attribute := func(field string) []string {
+		if name, ok := s.attributes[field]; ok {
+			return values[name]
+		}
+		for _, name := range samlAttributes[field] {
+			if value, ok := values[name]; ok {
+				return value
+			}
+		}
+		return nil
+	}
+	first := func(field string) string {
+		if value := attribute(field); len(value) > 0 {
+			return value[0]
+		}
+		return ""
+	}
+
+	profile := &Profile{
+		Login:  first(ProfileLogin),
+		Email:  first(ProfileEmail),
+		Name:   first(ProfileName),
+		Avatar: first(ProfileAvatar),
+		Groups: attribute(ProfileGroups),
+		Raw:    raw,
+	}
+	if _, ok := s.attributes[ProfileID]; ok {
+		profile.ID = first(ProfileID)
+	} else if assertion.Subject != nil && assertion.Subject.NameID != nil {
+		profile.ID = assertion.Subject.NameID.Value
+	}
+	if verified := first(ProfileEmailVerified); verified != "" {
+		profile.EmailVerified = verified == "true"
+	}
+	return profile
+}
+
+// Metadata returns jwt-proxy's service provider metadata XML for the
+// identity provider.
+func (s *SAMLProvider) Metadata() ([]byte, error) {
+	return xml.MarshalIndent(s.sp.Metadata(), "", "  ")
+}
+
+func (s *SAMLProvider) Exchange(ctx context.Context, code string, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
+	return nil, errSAMLNoToken
+}
+
+// Refresh fails, as SAML logins cannot be refreshed without the user.
+func (s *SAMLProvider) Refresh(ctx context.Context, token *oauth2.Token) (*oauth2.Token, error) {
+	return nil, errSAMLNoToken
+}
+
+func (s *SAMLProvider) User(ctx context.Context, token *oauth2.Token) (*Profile, error) {
+	return nil, errSAMLNoToken
+}
+
+func (s *SAMLProvider) Name() string {
+	return s.name
+}
+
+// ClientID returns jwt-proxy's entity id.
+func (s *SAMLProvider) ClientID() string {
+	return s.sp.Metadata().EntityID
+}
+
+func (s *SAMLProvider) String() string {
+	toString := struct {
+		EntityID    string `json:"entity_id"`
+		IDPEntityID string `json:"idp_entity_id"`
+		SSOURL      string `json:"sso_url"`
+		ACSURL      string `json:"acs_url"`
+	}{
+		s.ClientID(),
+		s.sp.IDPMetadata.EntityID,
+		s.sp.GetSSOBindingLocation(saml.HTTPRedirectBinding),
+		s.sp.AcsURL.String(),
+	}
+	b, err := json.Marshal(toString)
+	if err != nil {
+		return err.Error()
+	}
+	return string(b)
+}
+
+// parseSAMLMetadata parses the metadata of an identity provider, which may be
+// a single entity or the first entity of a list with an identity provider.
+func parseSAMLMetadata(data []byte) (*saml.EntityDescriptor, error) {
+	entity := &saml.EntityDescriptor{}
+	err := xml.Unmarshal(data, entity)
+	if err == nil && len(entity.IDPSSODescriptors) > 0 {
+		return entity, nil
+	}
+
+	entities := &saml.EntitiesDescriptor{}
+	if err := xml.Unmarshal(data, entities); err != nil {
+		return nil, err
+	}
+	for i := range entities.EntityDescriptors {
+		if len(entities.EntityDescriptors[i].IDPSSODescriptors) > 0 {
+			return &entities.EntityDescriptors[i], nil
+		}
+	}
+	return nil, errors.New("no identity provider found")
+}
+
+// getSAMLMetadata fetches the metadata of an identity provider.
+func getSAMLMetadata(client *http.Client, url string) ([]byte, error) {
+	response, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if err := checkStatus(response); err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(response.Body)
+}
@@ -0,0 +1,133 @@
+package provider
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/crewjam/saml"
+	"github.com/krinklesaurus/jwt-proxy/provider/samltest"
+	"github.com/stretchr/testify/assert"
+)
+
+// login has the identity provider answer the authentication request of the
+// auth code URL and returns the request the browser posts to the assertion
+// consumer service.
+func login(t *testing.T, idp *samltest.IDP, authCodeURL string) *http.Request {
+	acs, form := idp.Login(t, authCodeURL)
+	return post(acs, form)
+}
+
+func post(target string, form url.Values) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, target, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.ParseForm()
+	return r
+}
+
+func TestSAMLProvider(t *testing.T) {
+	idp := samltest.NewIDP(t)
+	provider, err := NewSAML("http://localhost:8080", "okta", SAMLOptions{IDPMetadata: idp.Metadata(t)})
+	assert.Nil(t, err, "err should be nothing")
+
+	spMetadata, err := provider.Metadata()
+	assert.Nil(t, err, "err should be nothing")
+	sp := idp.Register(t, spMetadata)
+	assert.Equal(t, "http://localhost:8080/jwt-proxy/saml/okta/metadata", sp.EntityID)
+	assert.Equal(t, "http://localhost:8080/jwt-proxy/saml/okta/acs", sp.SPSSODescriptors[0].AssertionConsumerServices[0].Location)
+
+	idp.Session = &saml.Session{
+		NameID:         "user-1234",
+		UserEmail:      "someone@example.com",
+		UserCommonName: "Some One",
+		Groups:         []string{"admins", "developers"},
+	}
+	authCodeURL := provider.AuthCodeURL("state")
+	assert.True(t, strings.HasPrefix(authCodeURL, "https://idp.example.com/sso?SAMLRequest="))
+	assert.Contains(t, authCodeURL, "RelayState=state")
+
+	acs := login(t, idp, authCodeURL)
+	profile, err := provider.ParseResponse(acs, "state")
+	assert.Nil(t, err, "err should be nothing")
+	assert.Equal(t, "user-1234", profile.ID)
+	assert.Equal(t, "Some One", profile.Name)
+	assert.Equal(t, []string{"admins", "developers"}, profile.Groups)
+	assert.Equal(t, "someone@example.com", profile.Field("urn:oid:1.3.6.1.4.1.5923.1.1.1.6"), "attributes should be found by name")
+	assert.Equal(t, "someone@example.com", profile.Field("eduPersonPrincipalName"), "attributes should be found by friendly name")
+
+	_, err = provider.ParseResponse(acs, "state")
+	assert.True(t, errors.Is(err, ErrInvalidSAMLResponse), "responses cannot be replayed")
+
+	acs = login(t, idp, provider.AuthCodeURL("state"))
+	_, err = provider.ParseResponse(acs, "other-state")
+	assert.True(t, errors.Is(err, ErrInvalidSAMLResponse), "responses must answer the login's request")
+}
+
+func TestSAMLProviderDropsOldestRequests(t *testing.T) {
+	idp := samltest.NewIDP(t)
+	provider, err := NewSAML("http://localhost:8080", "okta", SAMLOptions{IDPMetadata: idp.Metadata(t)})
+	assert.Nil(t, err, "err should be nothing")
+	spMetadata, err := provider.Metadata()
+	assert.Nil(t, err, "err should be nothing")
+	idp.Register(t, spMetadata)
+	provider.maxRequests = 2
+
+	first := login(t, idp, provider.AuthCodeURL("first"))
+	second := login(t, idp, provider.AuthCodeURL("second"))
+	third := login(t, idp, provider.AuthCodeURL("third"))
+	assert.Len(t, provider.requests, 2, "pending requests should be capped")
+
+	_, err = provider.ParseResponse(first, "first")
+	assert.True(t, errors.Is(err, ErrInvalidSAMLResponse), "the oldest request should be dropped")
+	_, err = provider.ParseResponse(second, "second")
+	assert.Nil(t, err, "err should be nothing")
+	_, err = provider.ParseResponse(third, "third")
+	assert.Nil(t, err, "err should be nothing")
+}
+
+func TestSAMLProviderRejectsInvalidResponses(t *testing.T) {
+	idp := samltest.NewIDP(t)
+	provider, err := NewSAML("http://localhost:8080", "okta", SAMLOptions{
+		IDPMetadata: idp.Metadata(t),
+		Attributes:  map[string]string{ProfileID: "eduPersonPrincipalName"},
+	})
+	assert.Nil(t, err, "err should be nothing")
+	spMetadata, _ := provider.Metadata()
+	idp.Register(t, spMetadata)
+
+	acs := login(t, idp, provider.AuthCodeURL("state"))
+	profile, err := provider.ParseResponse(acs, "state")
+	assert.Nil(t, err, "err should be nothing")
+	assert.Equal(t, "someone@example.com", profile.ID, "id should be read from the configured attribute")
+
+	tests := map[string]func(response string) string{
+		"tampered": func(response string) string {
+			return strings.Replace(response, "someone@example.com", "admin@example.com", 1)
+		},
+		"wrong audience": func(response string) string {
+			return strings.Replace(response, "/jwt-proxy/saml/okta/metadata<", "/jwt-proxy/saml/other/metadata<", 1)
+		},
+		"unsigned": func(response string) string {
+			for strings.Contains(response, "<ds:Signature") {
+				start, end := strings.Index(response, "<ds:Signature"), strings.Index(response, "</ds:Signature>")
+				response = response[:start] + response[end+len("</ds:Signature>"):]
+			}
+			return response
+		},
+	}
+	for name, modify := range tests {
+		acs := login(t, idp, provider.AuthCodeURL("state"))
+		response, err := base64.StdEncoding.DecodeString(acs.PostForm.Get("SAMLResponse"))
+		assert.Nil(t, err, "err should be nothing")
+		modified := modify(string(response))
+		assert.NotEqual(t, string(response), modified, name)
+
+		form := url.Values{"SAMLResponse": {base64.StdEncoding.EncodeToString([]byte(modified))}, "RelayState": {"state"}}
+		_, err = provider.ParseResponse(post(acs.URL.String(), form), "state")
+		assert.True(t, errors.Is(err, ErrInvalidSAMLResponse), name)
+	}
+}
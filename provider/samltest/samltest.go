@@ -0,0 +1,90 @@
+// Package samltest provides an in-process SAML identity provider for tests of
+// SAML logins.
+package samltest
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/xml"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/crewjam/saml"
+	"github.com/stretchr/testify/assert"
+)
+
+// IDP is an identity provider at https://idp.example.com that logs in
+// everyone as the user of its session.
+type IDP struct {
+	Session *saml.Session
+	idp     *saml.IdentityProvider
+	sp      *saml.EntityDescriptor
+}
+
+// NewIDP creates an identity provider with a fresh signing key, whose session
+// is the user user-1234 with email someone@example.com.
+func NewIDP(t *testing.T) *IDP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err, "err should be nothing")
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "idp.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err, "err should be nothing")
+	certificate, err := x509.ParseCertificate(der)
+	assert.Nil(t, err, "err should be nothing")
+
+	metadataURL, _ := url.Parse("https://idp.example.com/metadata")
+	ssoURL, _ := url.Parse("https://idp.example.com/sso")
+	fake := &IDP{Session: &saml.Session{NameID: "user-1234", UserEmail: "someone@example.com"}}
+	fake.idp = &saml.IdentityProvider{
+		Key:                     key,
+		Certificate:             certificate,
+		MetadataURL:             *metadataURL,
+		SSOURL:                  *ssoURL,
+		ServiceProviderProvider: fake,
+	}
+	return fake
+}
+
+// GetServiceProvider returns the registered service provider.
+func (f *IDP) GetServiceProvider(r *http.Request, serviceProviderID string) (*saml.EntityDescriptor, error) {
+	return f.sp, nil
+}
+
+// Metadata returns the identity provider's metadata.
+func (f *IDP) Metadata(t *testing.T) []byte {
+	metadata, err := xml.Marshal(f.idp.Metadata())
+	assert.Nil(t, err, "err should be nothing")
+	return metadata
+}
+
+// Register registers the service provider of the metadata, whose requests
+// are answered from then on.
+func (f *IDP) Register(t *testing.T, spMetadata []byte) *saml.EntityDescriptor {
+	f.sp = &saml.EntityDescriptor{}
+	assert.Nil(t, xml.Unmarshal(spMetadata, f.sp))
+	return f.sp
+}
+
+// Login answers the authentication request of the redirect to the identity
+// provider and returns the URL of the assertion consumer service along with
+// the form the browser posts to it.
+func (f *IDP) Login(t *testing.T, redirect string) (string, url.Values) {
+	req, err := saml.NewIdpAuthnRequest(f.idp, httptest.NewRequest(http.MethodGet, redirect, nil))
+	assert.Nil(t, err, "err should be nothing")
+	assert.Nil(t, req.Validate(), "authentication request should be valid")
+	assert.Nil(t, saml.DefaultAssertionMaker{}.MakeAssertion(req, f.Session))
+	form, err := req.PostBinding()
+	assert.Nil(t, err, "err should be nothing")
+	return form.URL, url.Values{"SAMLResponse": {form.SAMLResponse}, "RelayState": {form.RelayState}}
+}
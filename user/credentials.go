@@ -0,0 +1,80 @@
+package user
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ErrInvalidCredentials is returned if the username is unknown or the password
+// is wrong, which are deliberately not told apart.
+var ErrInvalidCredentials = errors.New("invalid username or password")
+
+// unknownUserHash is compared with the password of unknown users, so that
+// they take as long to reject as wrong passwords.
+const unknownUserHash = "$2a$10$1OoZ/iVZLoQrDt7KZPZICORybNQJ14kveXc/4F8d46sckE.NP8CT6"
+
+// Credentials are the bcrypt password hashes of local accounts by username.
+type Credentials map[string]string
+
+// ReadHtpasswd reads the accounts of an htpasswd file, whose passwords must be
+// bcrypt hashes as created by htpasswd -B.
+func ReadHtpasswd(path string) (Credentials, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	credentials := Credentials{}
+	scanner := bufio.NewScanner(file)
+	for number := 1; scanner.Scan(); number++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		separator := strings.Index(line, ":")
+		if separator < 0 {
+			return nil, fmt.Errorf("%s line %d: expected username:hash", path, number)
+		}
+		if err := credentials.Add(line[:separator], line[separator+1:]); err != nil {
+			return nil, fmt.Errorf("%s line %d: %w", path, number, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return credentials, nil
+}
+
+// Add adds the account, whose hash must be a bcrypt hash.
+func (c Credentials) Add(username string, hash string) error {
+	if username == "" {
+		return errors.New("username must not be empty")
+	}
+	if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+		return fmt.Errorf("password of %s is no bcrypt hash: %w", username, err)
+	}
+	if _, ok := c[username]; ok {
+		return fmt.Errorf("user %s is defined twice", username)
+	}
+	c[username] = hash
+	return nil
+}
+
+// Verify returns ErrInvalidCredentials unless the user exists and the password
+// matches.
+func (c Credentials) Verify(username string, password string) error {
+	hash, ok := c[username]
+	if !ok {
+		hash = unknownUserHash
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)); err != nil || !ok {
+		return ErrInvalidCredentials
+	}
+	return nil
+}
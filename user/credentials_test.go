@@ -0,0 +1,44 @@
+package user
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestReadHtpasswd(t *testing.T) {
+	credentials, err := ReadHtpasswd("../test/htpasswd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(credentials) != 2 {
+		t.Errorf("expected 2 accounts, got %d", len(credentials))
+	}
+
+	if err := credentials.Verify("tester", "tester"); err != nil {
+		t.Error(err)
+	}
+	if err := credentials.Verify("admin", "secret"); err != nil {
+		t.Error(err)
+	}
+	if err := credentials.Verify("admin", "tester"); err != ErrInvalidCredentials {
+		t.Errorf("Could log in with wrong password, err is %v", err)
+	}
+	if err := credentials.Verify("unknown", "tester"); err != ErrInvalidCredentials {
+		t.Errorf("Could log in as unknown user, err is %v", err)
+	}
+}
+
+func TestReadHtpasswdRejectsOtherHashes(t *testing.T) {
+	file, err := ioutil.TempFile("", "htpasswd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("tester:$apr1$Jm9uJ8i2$xxtW9MDZM0pb2cXXfMazC/\n")
+	file.Close()
+
+	if _, err := ReadHtpasswd(file.Name()); err == nil {
+		t.Error("MD5 passwords should be rejected")
+	}
+}
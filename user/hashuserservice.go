@@ -4,12 +4,12 @@ import (
 	"crypto/sha256"
 	"fmt"
 
-	"golang.org/x/crypto/bcrypt"
-
 	"github.com/krinklesaurus/jwt-proxy/log"
 )
 
 type HashUserService struct {
+	// Credentials are the local accounts LoginUser checks.
+	Credentials Credentials
 }
 
 func (us HashUserService) UniqueUser(provider string, providerUserID string) (string, error) {
@@ -22,17 +22,7 @@ func (us HashUserService) UniqueUser(provider string, providerUserID string) (st
 	return hashedUserID, nil
 }
 
+// LoginUser checks the password of the local account.
 func (us HashUserService) LoginUser(username string, plainPassword string) error {
-	testPassword, err := bcrypt.GenerateFromPassword([]byte("tester"), bcrypt.DefaultCost)
-
-	if err != nil {
-		return err
-	}
-
-	err = bcrypt.CompareHashAndPassword(testPassword, []byte(plainPassword))
-	if err != nil {
-		return err
-	}
-
-	return nil
+	return us.Credentials.Verify(username, plainPassword)
 }
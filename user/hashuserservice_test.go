@@ -18,7 +18,9 @@ func TestCorrectHashedUserID(t *testing.T) {
 }
 
 func TestLoginTester(t *testing.T) {
-	us := &HashUserService{}
+	us := &HashUserService{Credentials: Credentials{
+		"tester": "$2a$10$JoBayCdMhH2.qobbaYsLuuPWYQK7xKxvF1moWt/W7Wruw6fIdkpQ6",
+	}}
 
 	err := us.LoginUser("tester", "tester")
 	if err != nil {
@@ -30,3 +32,12 @@ func TestLoginTester(t *testing.T) {
 		t.Error("Could log in with wrong password \"wrong\"")
 	}
 }
+
+func TestLoginUnknownUser(t *testing.T) {
+	us := &HashUserService{}
+
+	err := us.LoginUser("tester", "tester")
+	if err != ErrInvalidCredentials {
+		t.Errorf("Could log in without account, err is %v", err)
+	}
+}
@@ -1,6 +1,8 @@
 package util
 
 import (
+	cryptorand "crypto/rand"
+	"encoding/base64"
 	"math/rand"
 	"time"
 )
@@ -30,3 +32,13 @@ func RandomString(n int) string {
 
 	return string(b)
 }
+
+// SecureRandomString returns a base64url encoded string of n random bytes
+// from crypto/rand, which is suitable for credentials.
+func SecureRandomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := cryptorand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}